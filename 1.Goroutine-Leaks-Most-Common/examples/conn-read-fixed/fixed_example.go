@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/netsim"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// LineServer is a line-based echo server with one goroutine per
+// connection. Every read and write has a deadline, so a client that goes
+// quiet without closing, whether it crashed, lost its network or is holding
+// the connection on purpose, is disconnected after IdleTimeout instead of
+// pinning a goroutine forever.
+type LineServer struct {
+	// IdleTimeout is how long a client has to send each complete line, and
+	// to take each echo. Zero means defaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	accepted int64
+	active   int64 // handlers still running
+	lines    int64 // lines echoed
+	timedOut int64 // connections closed for going quiet
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	handlers  sync.WaitGroup
+}
+
+const defaultIdleTimeout = time.Second
+
+var idleTimeout = flag.Duration("idle-timeout", defaultIdleTimeout, "close a connection that hasn't sent a full line within this long")
+
+// Serve accepts connections from ln until it is closed, starting a handler
+// goroutine for each. It returns net.ErrClosed once Close has been called.
+func (s *LineServer) Serve(ln net.Listener) error {
+	if !s.track(ln, nil) {
+		ln.Close()
+		return net.ErrClosed
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.accepted, 1)
+		if !s.track(nil, conn) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		go s.handle(conn)
+	}
+}
+
+// track registers a listener or a connection for Close, and counts a
+// connection's handler. It reports false once the server is closed.
+func (s *LineServer) track(ln net.Listener, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if ln != nil {
+		s.listeners[ln] = struct{}{}
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+	}
+	return true
+}
+
+// handle echoes every line conn sends until the client closes it, fails to
+// send a line within the idle timeout, or the server is closed
+func (s *LineServer) handle(conn net.Conn) {
+	atomic.AddInt64(&s.active, 1)
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		atomic.AddInt64(&s.active, -1)
+		s.handlers.Done()
+	}()
+
+	timeout := s.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultIdleTimeout
+	}
+	r := bufio.NewReader(conn)
+	for {
+		// The deadline covers the whole line, so a client trickling one byte
+		// at a time can't stretch it either
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				atomic.AddInt64(&s.timedOut, 1)
+			}
+			return
+		}
+		atomic.AddInt64(&s.lines, 1)
+
+		// A client that stops reading would block the echo just the same
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops every listener, closes every open connection and waits for
+// their handlers to return
+func (s *LineServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	server := &LineServer{IdleTimeout: *idleTimeout}
+	tcpAddr, pipes := startLineServer(server)
+	time.Sleep(100 * time.Millisecond) // Let server start
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Print initial state
+	fmt.Printf("[START] Goroutines: %d  |  Open FDs: %d\n", runtime.NumGoroutine(), fdcount.Count())
+	fmt.Println("20 clients/second each echo one line.")
+	fmt.Printf("Half close their connection; the other half vanish and are dropped after %v.\n\n", server.IdleTimeout)
+
+	ticker := time.NewTicker(50 * time.Millisecond) // 20 clients/second
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	reportInterval := 2 * time.Second
+	lastReport := startTime
+
+	for n := 1; ; n++ {
+		<-ticker.C
+		var err error
+		if n%2 == 0 {
+			err = vanishingClient(pipes)
+		} else {
+			err = politeClient(tcpAddr)
+		}
+		if err != nil {
+			log.Printf("Client error: %v", err)
+		}
+
+		// Report every 2 seconds
+		if time.Since(lastReport) >= reportInterval {
+			goroutines := runtime.NumGoroutine()
+			elapsed := time.Since(startTime).Seconds()
+			fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Open FDs: %d  |  Accepted: %d  |  Handlers running: %d  |  Lines: %d  |  Timed out: %d\n",
+				elapsed, goroutines, fdcount.Count(), atomic.LoadInt64(&server.accepted),
+				atomic.LoadInt64(&server.active), atomic.LoadInt64(&server.lines),
+				atomic.LoadInt64(&server.timedOut))
+			fmt.Printf("           %s\n", gcpercent.Stats())
+
+			if goroutines < 50 {
+				fmt.Println("Goroutines stable: quiet clients are dropped at the idle timeout.")
+			}
+
+			lastReport = time.Now()
+		}
+	}
+}
+
+// startLineServer serves s on a TCP listener, for clients that dial in, and
+// on a netsim.Network, for clients that vanish
+func startLineServer(s *LineServer) (string, *netsim.Network) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	pipes := netsim.NewNetwork()
+	go s.Serve(pipes)
+	return ln.Addr().String(), pipes
+}
+
+// politeClient dials addr, echoes one line and closes the connection, so
+// its handler reads EOF and returns
+func politeClient(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return echoLine(conn)
+}
+
+// vanishingClient echoes one line over a pipe and then drops its end
+// without closing it, like a client whose host lost power: no FIN is ever
+// sent, so the server can't tell it from a client that is just quiet
+func vanishingClient(pipes *netsim.Network) error {
+	conn, err := pipes.Dial(context.Background(), "pipe", "server")
+	if err != nil {
+		return err
+	}
+	return echoLine(conn)
+}
+
+// echoLine sends one line on conn and waits for it to come back
+func echoLine(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := fmt.Fprintln(conn, "ping"); err != nil {
+		return err
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return fmt.Errorf("reading echo: %w", err)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestIdleTimeout runs a LineServer with a 100ms idle timeout on TCP and on
+// pipes. Clients that echo a line and go quiet must be disconnected after
+// the timeout, with their handlers gone and a TCP client seeing EOF; a
+// client that keeps sending lines faster than the timeout must stay
+// connected; and Close must end every handler.
+func TestIdleTimeout(t *testing.T) {
+	waitFor := func(cond func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); !cond() && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return cond()
+	}
+
+	const (
+		timeout = 100 * time.Millisecond
+		quiet   = 10 // of each kind
+	)
+	baseline := runtime.NumGoroutine()
+	s := &LineServer{IdleTimeout: timeout}
+	tcpAddr, pipes := startLineServer(s)
+	active := func() int64 { return atomic.LoadInt64(&s.active) }
+
+	// Quiet clients: pipes that vanish, and TCP connections held open
+	var held []net.Conn
+	for i := 0; i < quiet; i++ {
+		if err := vanishingClient(pipes); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", tcpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := echoLine(conn); err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, conn)
+	}
+	start := time.Now()
+	check(t, fmt.Sprintf("%d quiet connections have a handler each: %d running", 2*quiet, active()), active() == 2*quiet)
+	check(t, "all of them are closed after the idle timeout", waitFor(func() bool { return active() == 0 }))
+	took := time.Since(start)
+	check(t, fmt.Sprintf("in %v, no sooner than the %v timeout", took.Round(time.Millisecond), timeout),
+		took >= timeout-10*time.Millisecond && took < timeout+500*time.Millisecond)
+	check(t, fmt.Sprintf("each was counted as timed out: %d", atomic.LoadInt64(&s.timedOut)), atomic.LoadInt64(&s.timedOut) == 2*quiet)
+
+	eofs := 0
+	for _, conn := range held {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+			eofs++
+		}
+		conn.Close()
+	}
+	check(t, fmt.Sprintf("%d of %d held TCP clients read EOF from the server", eofs, quiet), eofs == quiet)
+
+	// A client sending every 50ms is never idle for 100ms
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoed := 0
+	for i := 0; i < 8; i++ {
+		if echoLine(conn) == nil {
+			echoed++
+		}
+		time.Sleep(timeout / 2)
+	}
+	conn.Close()
+	check(t, fmt.Sprintf("a client sending every %v stayed connected for %d lines", timeout/2, echoed), echoed == 8)
+
+	// Close ends handlers that haven't reached their timeout
+	for i := 0; i < 3; i++ {
+		vanishingClient(pipes)
+	}
+	waitFor(func() bool { return active() == 3 })
+	start = time.Now()
+	s.Close()
+	check(t, fmt.Sprintf("Close ended 3 handlers in %v, before their timeout", time.Since(start).Round(time.Microsecond)),
+		active() == 0 && time.Since(start) < timeout)
+	_, err = pipes.Dial(context.Background(), "pipe", "server")
+	check(t, fmt.Sprintf("a closed server accepts nothing (%v)", err), errors.Is(err, net.ErrClosed))
+
+	time.Sleep(50 * time.Millisecond)
+	leaked := runtime.NumGoroutine() - baseline
+	check(t, fmt.Sprintf("goroutines back to baseline (%+d)", leaked), leaked <= 0)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/netsim"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// LineServer is a line-based echo server with one goroutine per
+// connection, the shape of most hand-written TCP servers: chat, telemetry
+// ingest, a Redis-style protocol.
+// BUG: the handler reads without a deadline. A client that connects and
+// then goes quiet without closing, because it crashed, lost its network or
+// simply holds the connection open, leaves its handler blocked in conn.Read
+// forever, together with the connection and its read buffer.
+type LineServer struct {
+	accepted int64
+	active   int64 // handlers still running
+	lines    int64 // lines echoed
+}
+
+// Serve accepts connections from ln until it is closed, starting a handler
+// goroutine for each
+func (s *LineServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.accepted, 1)
+		go s.handle(conn)
+	}
+}
+
+// handle echoes every line conn sends until the client closes it
+func (s *LineServer) handle(conn net.Conn) {
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		// BUG: no read deadline. A client that never sends another byte
+		// and never closes keeps this Read, and this goroutine, forever.
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.lines, 1)
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6060")
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
+	}()
+
+	server := &LineServer{}
+	tcpAddr, pipes := startLineServer(server)
+	time.Sleep(100 * time.Millisecond) // Let server start
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Print initial state
+	fmt.Printf("[START] Goroutines: %d  |  Open FDs: %d\n", runtime.NumGoroutine(), fdcount.Count())
+	fmt.Println("20 clients/second each echo one line.")
+	fmt.Print("Half close their connection; the other half vanish without closing it.\n\n")
+
+	ticker := time.NewTicker(50 * time.Millisecond) // 20 clients/second
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	reportInterval := 2 * time.Second
+	lastReport := startTime
+
+	for n := 1; ; n++ {
+		<-ticker.C
+		var err error
+		if n%2 == 0 {
+			err = vanishingClient(pipes)
+		} else {
+			err = politeClient(tcpAddr)
+		}
+		if err != nil {
+			log.Printf("Client error: %v", err)
+		}
+
+		// Report every 2 seconds
+		if time.Since(lastReport) >= reportInterval {
+			goroutines := runtime.NumGoroutine()
+			elapsed := time.Since(startTime).Seconds()
+			fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Open FDs: %d  |  Accepted: %d  |  Handlers running: %d  |  Lines: %d\n",
+				elapsed, goroutines, fdcount.Count(), atomic.LoadInt64(&server.accepted),
+				atomic.LoadInt64(&server.active), atomic.LoadInt64(&server.lines))
+			fmt.Printf("           %s\n", gcpercent.Stats())
+
+			if goroutines > 50 {
+				fmt.Println("\n⚠️  WARNING: Connection handler leak detected!")
+				fmt.Println("Handlers blocked in conn.Read for clients that went quiet.")
+				fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine?debug=1 | grep -B2 -A8 LineServer")
+			}
+
+			lastReport = time.Now()
+		}
+	}
+}
+
+// startLineServer serves s on a TCP listener, for clients that dial in, and
+// on a netsim.Network, for clients that vanish
+func startLineServer(s *LineServer) (string, *netsim.Network) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	pipes := netsim.NewNetwork()
+	go s.Serve(pipes)
+	return ln.Addr().String(), pipes
+}
+
+// politeClient dials addr, echoes one line and closes the connection, so
+// its handler reads EOF and returns
+func politeClient(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return echoLine(conn)
+}
+
+// vanishingClient echoes one line over a pipe and then drops its end
+// without closing it, like a client whose host lost power: no FIN is ever
+// sent, so the server can't tell it from a client that is just quiet
+func vanishingClient(pipes *netsim.Network) error {
+	conn, err := pipes.Dial(context.Background(), "pipe", "server")
+	if err != nil {
+		return err
+	}
+	return echoLine(conn)
+}
+
+// echoLine sends one line on conn and waits for it to come back
+func echoLine(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := fmt.Fprintln(conn, "ping"); err != nil {
+		return err
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return fmt.Errorf("reading echo: %w", err)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -2,24 +2,48 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutinegroup"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workload"
 )
 
 // This example demonstrates the FIXED version using context for cancellation
 // and proper channel handling to prevent goroutine leaks.
 
+// Load profile: ramp up to 50 goroutines/second, hold, then ramp back down
+const (
+	peakRate = 50.0
+	warmup   = 2 * time.Second
+	steady   = 6 * time.Second
+	cooldown = 2 * time.Second
+)
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
 	// Start pprof server for profiling
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
 		fmt.Println("Collect goroutine profile with: curl http://localhost:6060/debug/pprof/goroutine > goroutine_fixed.pprof")
 		fmt.Println("Compare with leaked version: go tool pprof -base=goroutine_leak.pprof goroutine_fixed.pprof")
 		fmt.Println()
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
@@ -27,49 +51,74 @@ func main() {
 	// Give pprof server time to start
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
 
-	// Create a context with cancellation for cleanup
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Every goroutine below is registered with mgr, so one Shutdown cancels
+	// them all and reports any that don't exit
+	mgr := NewGoroutineManager(context.Background())
 
 	// Start the fixed version - goroutines will terminate properly
-	go processWorkersFixed(ctx)
-
-	// Monitor goroutine count every 2 seconds
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	mgr.Go("simulator", func(ctx context.Context) {
+		processWorkersFixed(ctx, mgr)
+	})
 
 	duration := 10 * time.Second
-	start := time.Now()
+	monitorDone := make(chan struct{})
+	mgr.Go("monitor", func(ctx context.Context) {
+		defer close(monitorDone)
+		monitor(ctx, mgr, duration)
+	})
+	<-monitorDone
 
-	for time.Since(start) < duration {
-		<-ticker.C
-		fmt.Printf("[AFTER %v] Goroutines: %d\n", time.Since(start).Round(time.Second), runtime.NumGoroutine())
+	// Cancel every managed goroutine and wait for them to exit
+	if err := mgr.Shutdown(time.Second); err != nil {
+		fmt.Printf("\n⚠️  %v\n", err)
+	} else {
+		fmt.Println("\nAll goroutines cleaned up successfully")
 	}
-
-	// Cancel context to trigger cleanup
-	cancel()
-	
-	// Give goroutines time to clean up
-	time.Sleep(100 * time.Millisecond)
-	
-	fmt.Println("\nAll goroutines cleaned up successfully")
 	fmt.Printf("Final goroutine count: %d\n", runtime.NumGoroutine())
+	fmt.Printf("By state: %s\n", goroutinegroup.Format(goroutinegroup.ByState()))
 	fmt.Println("Press Ctrl+C to stop")
-	
+
 	// Keep running so you can collect profiles
 	select {}
 }
 
-// processWorkersFixed demonstrates the proper pattern using context
-func processWorkersFixed(ctx context.Context) {
+// monitor prints the goroutine count every 2 seconds for duration
+func monitor(ctx context.Context, mgr *GoroutineManager, duration time.Duration) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for time.Since(start) < duration {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		fmt.Printf("[AFTER %v] Goroutines: %d  |  Target rate: %.0f/s\n",
+			time.Since(start).Round(time.Second),
+			runtime.NumGoroutine(),
+			workload.Rate(time.Since(start), peakRate, warmup, steady, cooldown))
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		fmt.Printf("           By state: %s\n", goroutinegroup.Format(goroutinegroup.ByState()))
+		fmt.Printf("           Managed: %s\n", formatManaged(mgr.Running()))
+	}
+}
+
+// processWorkersFixed demonstrates the proper pattern using context. The
+// receiver and every worker are started through mgr.
+func processWorkersFixed(ctx context.Context, mgr *GoroutineManager) {
 	// Use a buffered channel to prevent blocking
 	// Buffer size should match expected concurrency
 	resultCh := make(chan int, 10)
 
 	// Start a receiver goroutine
-	go func() {
+	mgr.Go("receiver", func(ctx context.Context) {
 		for {
 			select {
 			case result := <-resultCh:
@@ -79,22 +128,16 @@ func processWorkersFixed(ctx context.Context) {
 				return
 			}
 		}
-	}()
+	})
 
-	// Spawn worker goroutines with proper cancellation
-	ticker := time.NewTicker(20 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			// Spawn worker that respects context
-			go worker(ctx, resultCh)
-		case <-ctx.Done():
-			// Stop spawning new workers and return
-			return
-		}
-	}
+	// Spawn worker goroutines following the ramp profile (peak 50 per second).
+	// workload.Ramp stops spawning as soon as ctx is cancelled.
+	workload.Ramp(ctx, peakRate, warmup, steady, cooldown, func() {
+		// Spawn worker that respects context
+		mgr.Go("worker", func(ctx context.Context) {
+			worker(ctx, resultCh)
+		})
+	})
 }
 
 // worker performs work and respects context cancellation
@@ -118,9 +161,128 @@ func worker(ctx context.Context, resultCh chan<- int) {
 	}
 }
 
+// GoroutineManager launches named goroutines tied to one parent context, so
+// they can be cancelled and waited for together. A goroutine started with Go
+// can't outlive Shutdown unnoticed: anything still running when the timeout
+// expires is reported by name.
+type GoroutineManager struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int // live goroutines by name
+	closed  bool
+}
+
+func NewGoroutineManager(parent context.Context) *GoroutineManager {
+	ctx, cancel := context.WithCancel(parent)
+	return &GoroutineManager{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]int),
+	}
+}
+
+// Go runs fn in a new goroutine named name. fn must return once ctx is done.
+// After Shutdown, Go does nothing.
+func (m *GoroutineManager) Go(name string, fn func(ctx context.Context)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.running[name]++
+	m.wg.Add(1)
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			if m.running[name]--; m.running[name] == 0 {
+				delete(m.running, name)
+			}
+			m.mu.Unlock()
+			m.wg.Done()
+		}()
+		fn(m.ctx)
+	}()
+}
+
+// Running returns how many managed goroutines are live, by name
+func (m *GoroutineManager) Running() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	running := make(map[string]int, len(m.running))
+	for name, n := range m.running {
+		running[name] = n
+	}
+	return running
+}
+
+// Shutdown cancels the manager's context and waits up to timeout for every
+// managed goroutine to return. It returns a *ShutdownError naming those that
+// are still running.
+func (m *GoroutineManager) Shutdown(timeout time.Duration) error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return &ShutdownError{Timeout: timeout, Stragglers: m.Running()}
+	}
+}
+
+// ShutdownError lists the goroutines that ignored cancellation
+type ShutdownError struct {
+	Timeout    time.Duration
+	Stragglers map[string]int
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("goroutines still running %v after shutdown: %s", e.Timeout, formatManaged(e.Stragglers))
+}
+
+// formatManaged renders goroutine counts by name, e.g. "monitor=1 worker=3"
+func formatManaged(running map[string]int) string {
+	if len(running) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(running))
+	for name := range running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, running[name])
+	}
+	return strings.Join(parts, " ")
+}
+
 // doWork simulates some work being done
 func doWork() int {
 	time.Sleep(10 * time.Millisecond)
 	return 42
 }
 
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestGoroutineManager checks that Shutdown stops well-behaved goroutines
+// and names the ones that ignore their context.
+func TestGoroutineManager(t *testing.T) {
+	waitForCount := func(want int) int {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() != want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return runtime.NumGoroutine()
+	}
+	baseline := runtime.NumGoroutine()
+
+	// Well-behaved: every goroutine returns when ctx is cancelled
+	clean := NewGoroutineManager(context.Background())
+	for i := 0; i < 10; i++ {
+		clean.Go("worker", func(ctx context.Context) { <-ctx.Done() })
+	}
+	clean.Go("monitor", func(ctx context.Context) {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	check(t, fmt.Sprintf("11 goroutines registered: %s", formatManaged(clean.Running())),
+		clean.Running()["worker"] == 10 && clean.Running()["monitor"] == 1)
+	err := clean.Shutdown(time.Second)
+	check(t, fmt.Sprintf("Shutdown returns nil when all goroutines exit (err: %v)", err), err == nil)
+	check(t, "nothing is left running", len(clean.Running()) == 0)
+	n := waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutine count back to baseline (%d, baseline %d)", n, baseline), n == baseline)
+
+	clean.Go("late", func(ctx context.Context) { <-ctx.Done() })
+	check(t, "Go after Shutdown starts nothing", len(clean.Running()) == 0)
+
+	// Stragglers: one goroutine ignores ctx until it is released by hand
+	release := make(chan struct{})
+	mixed := NewGoroutineManager(context.Background())
+	mixed.Go("worker", func(ctx context.Context) { <-ctx.Done() })
+	mixed.Go("stubborn", func(ctx context.Context) { <-release })
+	err = mixed.Shutdown(50 * time.Millisecond)
+	var shutdownErr *ShutdownError
+	check(t, fmt.Sprintf("Shutdown reports the straggler: %v", err),
+		errors.As(err, &shutdownErr) && len(shutdownErr.Stragglers) == 1 && shutdownErr.Stragglers["stubborn"] == 1)
+	close(release)
+	n = waitForCount(baseline)
+	check(t, fmt.Sprintf("straggler exits once released (goroutines: %d)", n), n == baseline && len(mixed.Running()) == 0)
+}
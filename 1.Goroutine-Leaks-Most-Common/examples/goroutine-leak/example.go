@@ -1,25 +1,48 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutinegroup"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workload"
 )
 
 // This example demonstrates a classic goroutine leak where goroutines
 // are spawned to send on a channel, but there's no receiver.
 // Each goroutine blocks forever, causing them to accumulate.
 
+// Load profile: ramp up to 50 goroutines/second, hold, then ramp back down
+const (
+	peakRate = 50.0
+	warmup   = 2 * time.Second
+	steady   = 6 * time.Second
+	cooldown = 2 * time.Second
+)
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
 	// Start pprof server for profiling
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
 		fmt.Println("Collect goroutine profile with: curl http://localhost:6060/debug/pprof/goroutine > goroutine_fixedEX.pprof")
 		fmt.Println("View profile with: go tool pprof -http=:8081 goroutine_fixedEX.pprof")
 		fmt.Println()
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
@@ -27,6 +50,10 @@ func main() {
 	// Give pprof server time to start
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
 
 	// Simulate a leaky pattern - spawning goroutines that never terminate
@@ -41,10 +68,16 @@ func main() {
 
 	for time.Since(start) < duration {
 		<-ticker.C
-		fmt.Printf("[AFTER %v] Goroutines: %d\n", time.Since(start).Round(time.Second), runtime.NumGoroutine())
+		fmt.Printf("[AFTER %v] Goroutines: %d  |  Target rate: %.0f/s\n",
+			time.Since(start).Round(time.Second),
+			runtime.NumGoroutine(),
+			workload.Rate(time.Since(start), peakRate, warmup, steady, cooldown))
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		fmt.Printf("           By state: %s\n", goroutinegroup.Format(goroutinegroup.ByState()))
 	}
 
-	fmt.Println("\nLeak demonstrated. Goroutines continue to accumulate.")
+	fmt.Println("\nLeak demonstrated. Load has ramped back down to zero,")
+	fmt.Println("but every goroutine spawned along the way is still blocked.")
 	fmt.Println("Press Ctrl+C to stop")
 
 	// Keep running so you can collect profiles
@@ -56,18 +89,15 @@ func leakGoroutines() {
 	// Create an unbuffered channel
 	ch := make(chan int)
 
-	// Spawn goroutines every 20ms (50 per second)
-	ticker := time.NewTicker(20 * time.Millisecond)
-	defer ticker.Stop()
-
-	for range ticker.C {
+	// Spawn goroutines following the ramp profile (peak 50 per second)
+	workload.Ramp(context.Background(), peakRate, warmup, steady, cooldown, func() {
 		// Each goroutine tries to send on the channel
 		// Since there's no receiver, they all block forever
 		go func() {
 			result := doWork()
 			ch <- result // THIS BLOCKS FOREVER - no one reads from ch
 		}()
-	}
+	})
 }
 
 // doWork simulates some work being done
@@ -76,3 +106,14 @@ func doWork() int {
 	time.Sleep(10 * time.Millisecond)
 	return 42
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestProfilingMux requests the profiling endpoints from debugMux and
+// checks that http.DefaultServeMux has no handler for them
+func TestProfilingMux(t *testing.T) {
+	get := func(mux http.Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	heap := get(debugMux, "/debug/pprof/heap")
+	body := heap.Body.Bytes()
+	check(t, fmt.Sprintf("debugMux serves /debug/pprof/heap: %d, %d bytes of gzipped protobuf", heap.Code, len(body)),
+		heap.Code == http.StatusOK && len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b)
+
+	goroutines := get(debugMux, "/debug/pprof/goroutine?debug=1")
+	check(t, fmt.Sprintf("debugMux serves /debug/pprof/goroutine?debug=1 as text: %d", goroutines.Code),
+		goroutines.Code == http.StatusOK && strings.HasPrefix(goroutines.Body.String(), "goroutine profile:"))
+
+	index := get(debugMux, "/debug/pprof/")
+	check(t, "debugMux lists the profiles at /debug/pprof/", index.Code == http.StatusOK && strings.Contains(index.Body.String(), "\theap"))
+
+	unknown := get(debugMux, "/debug/pprof/nope")
+	check(t, fmt.Sprintf("an unknown profile is a 404: %d", unknown.Code), unknown.Code == http.StatusNotFound)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/profile"} {
+		_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil))
+		check(t, fmt.Sprintf("http.DefaultServeMux has no handler for %s", path), pattern == "")
+	}
+}
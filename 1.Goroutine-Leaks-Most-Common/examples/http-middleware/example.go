@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/audit"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example moves the classic goroutine leak into an HTTP server. It
+// drives requests through audit.LeakyMiddleware, which leaks one goroutine
+// per sampled request, and audit.FixedMiddleware, which doesn't, and
+// compares the goroutine count after each.
+
+var (
+	leakRate = flag.Float64("rate", 0.1, "fraction of requests that start a leaking goroutine")
+	requests = flag.Int("requests", 2000, "requests driven through each middleware")
+)
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	go func() {
+		fmt.Println("pprof server running on http://localhost:6060")
+		fmt.Println("Collect goroutine profile: curl http://localhost:6060/debug/pprof/goroutine?debug=1")
+		fmt.Println()
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
+			fmt.Printf("pprof server error: %v\n", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	expected := int(math.Floor(float64(*requests) * *leakRate))
+	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Printf("Driving %d requests through each middleware, %.0f%% sampled for audit\n\n",
+		*requests, *leakRate*100)
+
+	fixedGrowth := drive("FixedMiddleware", audit.FixedMiddleware(*leakRate))
+	leakyGrowth := drive("LeakyMiddleware", audit.LeakyMiddleware(*leakRate))
+
+	fmt.Println()
+	if fixedGrowth <= 5 {
+		fmt.Printf("✓ FixedMiddleware: goroutines flat (%+d)\n", fixedGrowth)
+	} else {
+		fmt.Printf("✗ FixedMiddleware: goroutines grew by %d\n", fixedGrowth)
+	}
+	if leakyGrowth >= expected {
+		fmt.Printf("✓ LeakyMiddleware: goroutines grew by %d (expected %d leaked)\n", leakyGrowth, expected)
+	} else {
+		fmt.Printf("✗ LeakyMiddleware: goroutines grew by only %d (expected %d leaked)\n", leakyGrowth, expected)
+	}
+
+	fmt.Println("\nThe leaked goroutines stay blocked in chan send for the life of the process.")
+	fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine?debug=1 | grep -A8 LeakyMiddleware")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// drive serves a trivial handler wrapped in mw, sends it *requests requests
+// and returns how many goroutines were left behind once the server is closed
+func drive(name string, mw func(http.Handler) http.Handler) int {
+	settle()
+	before := runtime.NumGoroutine()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	server := httptest.NewServer(mw(ok))
+
+	client := server.Client()
+	for i := 0; i < *requests; i++ {
+		resp, err := client.Get(fmt.Sprintf("%s/orders/%d", server.URL, i))
+		if err != nil {
+			fmt.Printf("request failed: %v\n", err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Close the server and idle connections so only leaked goroutines remain
+	client.CloseIdleConnections()
+	server.Close()
+	settle()
+	growth := runtime.NumGoroutine() - before
+
+	fmt.Printf("[%s] Goroutines: %d -> %d  |  Audits abandoned so far: %d\n",
+		name, before, before+growth, audit.Abandoned())
+	fmt.Printf("           %s\n", gcpercent.Stats())
+	return growth
+}
+
+// settle gives finished audits and closed connections time to exit
+func settle() {
+	time.Sleep(10 * audit.Duration)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -2,12 +2,26 @@ package main
 
 import (
 	"container/list"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
+	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // This example demonstrates a proper LRU cache with size limits
@@ -25,85 +39,1028 @@ type LRUCache struct {
 	capacity int
 	cache    map[string]*list.Element
 	lruList  *list.List
+
+	// accesses is nil until TrackWorkingSet is called
+	accesses *accessLog
+
+	telemetry   Telemetry
+	summaryName string // set by WithSummary
+
+	// generation is stamped on every entry by set. InvalidateAll bumps it,
+	// and an entry from an older generation is dropped the next time it is
+	// found.
+	generation uint64
+
+	// onEvict is nil unless WithEvictCallback is used. With
+	// WithEvictCallbackTimeout, evicted entries go through the evicted
+	// channel to a cleaner goroutine instead of being passed to onEvict
+	// under mu.
+	onEvict       func(key string, value *CachedObject)
+	evictTimeout  time.Duration
+	evicted       chan entry
+	stopCleaner   chan struct{}
+	cleanerDone   chan struct{}
+	closeOnce     sync.Once
+	evictDropped  int64 // evicted channel full
+	evictTimedOut int64 // callbacks abandoned after evictTimeout
+}
+
+// Telemetry receives the cache's events, so any metrics or logging backend
+// can observe it without LRUCache depending on one. Its methods are called
+// with the cache's lock held: they must be fast and must not call back into
+// the cache.
+type Telemetry interface {
+	RecordHit()
+	RecordMiss()
+	RecordEviction()
+	RecordSet()
+	RecordDelete()
+}
+
+// NoopTelemetry discards every event. It is the default, and costs an
+// interface call per event with no allocation.
+type NoopTelemetry struct{}
+
+func (NoopTelemetry) RecordHit()      {}
+func (NoopTelemetry) RecordMiss()     {}
+func (NoopTelemetry) RecordEviction() {}
+func (NoopTelemetry) RecordSet()      {}
+func (NoopTelemetry) RecordDelete()   {}
+
+// LogTelemetry logs every event to logger at debug level, so a handler
+// below debug drops them cheaply
+func LogTelemetry(logger *slog.Logger) Telemetry {
+	return logTelemetry{logger: logger}
+}
+
+type logTelemetry struct {
+	logger *slog.Logger
+}
+
+func (t logTelemetry) RecordHit()      { t.logger.Debug("cache hit") }
+func (t logTelemetry) RecordMiss()     { t.logger.Debug("cache miss") }
+func (t logTelemetry) RecordEviction() { t.logger.Debug("cache eviction") }
+func (t logTelemetry) RecordSet()      { t.logger.Debug("cache set") }
+func (t logTelemetry) RecordDelete()   { t.logger.Debug("cache delete") }
+
+// PrometheusTelemetry counts the cache's events in a <name>_events_total
+// counter, labelled by event, and registers it with reg
+func PrometheusTelemetry(reg prometheus.Registerer, name string) Telemetry {
+	events := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name + "_events_total",
+		Help: "LRU cache events by type.",
+	}, []string{"event"})
+	reg.MustRegister(events)
+
+	return prometheusTelemetry{
+		hits:      events.WithLabelValues("hit"),
+		misses:    events.WithLabelValues("miss"),
+		evictions: events.WithLabelValues("eviction"),
+		sets:      events.WithLabelValues("set"),
+		deletes:   events.WithLabelValues("delete"),
+	}
+}
+
+// prometheusTelemetry holds the counter for each label, resolved once so an
+// event is a single atomic add
+type prometheusTelemetry struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	sets      prometheus.Counter
+	deletes   prometheus.Counter
+}
+
+func (t prometheusTelemetry) RecordHit()      { t.hits.Inc() }
+func (t prometheusTelemetry) RecordMiss()     { t.misses.Inc() }
+func (t prometheusTelemetry) RecordEviction() { t.evictions.Inc() }
+func (t prometheusTelemetry) RecordSet()      { t.sets.Inc() }
+func (t prometheusTelemetry) RecordDelete()   { t.deletes.Inc() }
+
+// Option configures optional LRUCache behavior
+type Option func(*LRUCache)
+
+// WithTelemetry sends the cache's events to t
+func WithTelemetry(t Telemetry) Option {
+	return func(c *LRUCache) {
+		c.telemetry = t
+	}
+}
+
+// WithEvictCallback calls fn with every entry evicted for capacity; Delete
+// doesn't call it. On its own, fn runs with the cache's lock held, so a slow
+// fn stalls every Get and Set: add WithEvictCallbackTimeout for anything
+// that can block.
+func WithEvictCallback(fn func(key string, value *CachedObject)) Option {
+	return func(c *LRUCache) {
+		c.onEvict = fn
+	}
+}
+
+// WithSummary registers the cache in /debug/summary under name once it is
+// built, so its caller doesn't have to
+func WithSummary(name string) Option {
+	return func(c *LRUCache) {
+		c.summaryName = name
+	}
+}
+
+// evictQueueSize bounds how many evicted entries can wait for the cleaner
+const evictQueueSize = 1024
+
+// WithEvictCallbackTimeout moves the eviction callback off the lock. Evict
+// hands the entry to a background cleaner with a non-blocking send, dropping
+// it if evictQueueSize entries are already waiting. The cleaner runs the
+// callback in its own goroutine and waits at most d for it; a callback that
+// takes longer is abandoned, left to finish on its own, and the cleaner
+// moves on to the next entry. Close stops the cleaner.
+func WithEvictCallbackTimeout(d time.Duration) Option {
+	return func(c *LRUCache) {
+		c.evictTimeout = d
+	}
 }
 
 type entry struct {
-	key   string
-	value *CachedObject
+	key        string
+	value      *CachedObject
+	lastAccess time.Time
+	generation uint64
+}
+
+// KeyValue is one entry for SetMany
+type KeyValue struct {
+	Key   string
+	Value *CachedObject
 }
 
-func NewLRUCache(capacity int) *LRUCache {
-	return &LRUCache{
-		capacity: capacity,
-		cache:    make(map[string]*list.Element),
-		lruList:  list.New(),
+// KeyValueAge is one entry of a Snapshot, with the time it was last read or
+// written
+type KeyValueAge struct {
+	Key        string
+	Value      *CachedObject
+	LastAccess time.Time
+}
+
+// entryPool recycles evicted entries so a full cache doesn't allocate a new
+// entry for every Set. The list.Element wrapping each entry can't be pooled:
+// container/list allocates a fresh one on every PushFront.
+var entryPool = sync.Pool{
+	New: func() any { return new(entry) },
+}
+
+func NewLRUCache(capacity int, opts ...Option) *LRUCache {
+	c := &LRUCache{
+		capacity:  capacity,
+		cache:     make(map[string]*list.Element),
+		lruList:   list.New(),
+		telemetry: NoopTelemetry{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.onEvict != nil && c.evictTimeout > 0 {
+		c.evicted = make(chan entry, evictQueueSize)
+		c.stopCleaner = make(chan struct{})
+		c.cleanerDone = make(chan struct{})
+		go c.cleaner()
 	}
+	if c.summaryName != "" {
+		summary.Register(c.summaryName, c)
+	}
+	return c
+}
+
+// cleaner runs the eviction callback for each entry evict queued, giving
+// each call at most evictTimeout
+func (c *LRUCache) cleaner() {
+	defer close(c.cleanerDone)
+	for {
+		select {
+		case <-c.stopCleaner:
+			return
+		case e := <-c.evicted:
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				c.onEvict(e.key, e.value)
+			}()
+
+			timedOut := make(chan struct{})
+			timer := time.AfterFunc(c.evictTimeout, func() { close(timedOut) })
+			select {
+			case <-done:
+				timer.Stop()
+			case <-timedOut:
+				atomic.AddInt64(&c.evictTimedOut, 1)
+			case <-c.stopCleaner:
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// EvictCallbackStats returns how many evicted entries were dropped because
+// the cleaner's queue was full, and how many callbacks were abandoned after
+// the WithEvictCallbackTimeout limit
+func (c *LRUCache) EvictCallbackStats() (dropped, timedOut int64) {
+	return atomic.LoadInt64(&c.evictDropped), atomic.LoadInt64(&c.evictTimedOut)
+}
+
+// Close stops the eviction cleaner, if there is one, and removes the cache
+// from /debug/summary. Entries still queued are dropped without calling the
+// callback, and abandoned callbacks are not waited for. It is safe to call
+// more than once.
+func (c *LRUCache) Close() {
+	c.closeOnce.Do(func() {
+		if c.stopCleaner != nil {
+			close(c.stopCleaner)
+			<-c.cleanerDone
+		}
+		if c.summaryName != "" {
+			summary.Unregister(c.summaryName)
+		}
+	})
 }
 
 func (c *LRUCache) Set(key string, value *CachedObject) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.set(key, value)
+}
+
+// TrackWorkingSet starts recording when each key is accessed, so that
+// WorkingSetSize can answer for windows up to retention. Tracking costs an
+// allocation per newly seen key, so it is off by default.
+func (c *LRUCache) TrackWorkingSet(retention time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accesses = newAccessLog(retention)
+}
+
+// WorkingSetSize returns how many distinct keys were read or written in the
+// last window, including keys the cache has since evicted. A window longer
+// than the tracking retention is cut to it. Comparing the result with the
+// capacity shows whether the cache can hold what is actually in use. It
+// returns 0 unless TrackWorkingSet was called.
+func (c *LRUCache) WorkingSetSize(window time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accesses == nil {
+		return 0
+	}
+	return c.accesses.count(window)
+}
 
-	// If key exists, update and move to front
+// SetMany stores all entries under a single lock acquisition, in order, so a
+// later entry for the same key wins. It returns how many keys were new;
+// updates of keys already cached are not counted. A batch larger than the
+// capacity evicts its own earliest entries.
+func (c *LRUCache) SetMany(entries []KeyValue) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inserted := 0
+	for _, kv := range entries {
+		if c.set(kv.Key, kv.Value) {
+			inserted++
+		}
+	}
+	return inserted
+}
+
+// set stores value under key, evicting the oldest entry if the cache is over
+// capacity, and reports whether key was new. Caller must hold c.mu.
+func (c *LRUCache) set(key string, value *CachedObject) bool {
+	c.touch(key)
+	c.telemetry.RecordSet()
+
+	// If key exists, update and move to front. A stale entry is reused
+	// and counts as new.
+	gen := atomic.LoadUint64(&c.generation)
 	if elem, ok := c.cache[key]; ok {
 		c.lruList.MoveToFront(elem)
-		elem.Value.(*entry).value = value
-		return
+		e := elem.Value.(*entry)
+		stale := e.generation != gen
+		e.value, e.lastAccess, e.generation = value, time.Now(), gen
+		return stale
 	}
 
-	// Add new entry
-	elem := c.lruList.PushFront(&entry{key, value})
+	// Add new entry, reusing an evicted one when available
+	e := entryPool.Get().(*entry)
+	e.key, e.value, e.lastAccess, e.generation = key, value, time.Now(), gen
+	elem := c.lruList.PushFront(e)
 	c.cache[key] = elem
 
 	// Evict oldest if over capacity
 	if c.lruList.Len() > c.capacity {
-		oldest := c.lruList.Back()
-		if oldest != nil {
-			c.lruList.Remove(oldest)
-			delete(c.cache, oldest.Value.(*entry).key)
+		c.evict()
+	}
+	return true
+}
+
+// evict removes the least recently used entry. Caller must hold c.mu.
+func (c *LRUCache) evict() {
+	oldest := c.lruList.Back()
+	if oldest == nil {
+		return
+	}
+	e := *oldest.Value.(*entry) // copied: remove recycles the entry
+	c.remove(oldest)
+	c.telemetry.RecordEviction()
+
+	switch {
+	case c.evicted != nil:
+		select {
+		case c.evicted <- e:
+		default:
+			atomic.AddInt64(&c.evictDropped, 1)
 		}
+	case c.onEvict != nil:
+		c.onEvict(e.key, e.value)
 	}
 }
 
-func (c *LRUCache) Get(key string) (*CachedObject, bool) {
+// Delete removes key if present
+func (c *LRUCache) Delete(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if elem, ok := c.cache[key]; ok {
+		c.remove(elem)
+		c.telemetry.RecordDelete()
+	}
+}
+
+// remove unlinks elem and returns its entry to the pool. The entry is zeroed
+// first so the pool doesn't keep the removed value alive or hand its data to
+// the next Set. Caller must hold c.mu.
+func (c *LRUCache) remove(elem *list.Element) {
+	e := c.lruList.Remove(elem).(*entry)
+	delete(c.cache, e.key)
+
+	*e = entry{}
+	entryPool.Put(e)
+}
+
+func (c *LRUCache) Get(key string) (*CachedObject, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.touch(key)
+	if elem, ok := c.lookup(key); ok {
 		c.lruList.MoveToFront(elem)
-		return elem.Value.(*entry).value, true
+		c.telemetry.RecordHit()
+		e := elem.Value.(*entry)
+		e.lastAccess = time.Now()
+		return e.value, true
 	}
+	c.telemetry.RecordMiss()
 	return nil, false
 }
 
+// MustGet is Get for initialization code, such as reading back
+// configuration that startup has just loaded into a warm cache, where a
+// missing key is a programming error rather than a cache miss. It panics
+// if key is absent. Anywhere a key can be evicted, invalidated or simply not
+// loaded yet, use Get and handle the miss.
+func (c *LRUCache) MustGet(key string) *CachedObject {
+	value, ok := c.Get(key)
+	if !ok {
+		panic(fmt.Sprintf("cache: MustGet(%q): key not in cache (%d entries, capacity %d)", key, c.Len(), c.capacity))
+	}
+	return value
+}
+
+// MustSet is Set for initialization code. It panics if the cache can't keep
+// anything, which for now means a capacity below 1, where Set would evict
+// the value at once and the following MustGet would fail far from the
+// cause. Like MustGet, it is only for code where that would be a bug.
+func (c *LRUCache) MustSet(key string, value *CachedObject) {
+	if c.capacity < 1 {
+		panic(fmt.Sprintf("cache: MustSet(%q): capacity %d can't hold any entry", key, c.capacity))
+	}
+	c.Set(key, value)
+}
+
+// GetMany looks up all keys under a single lock acquisition and returns the
+// ones found. Each hit is moved to the front, as with Get.
+func (c *LRUCache) GetMany(keys []string) map[string]*CachedObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := make(map[string]*CachedObject, len(keys))
+	for _, key := range keys {
+		c.touch(key)
+		if elem, ok := c.lookup(key); ok {
+			c.lruList.MoveToFront(elem)
+			c.telemetry.RecordHit()
+			e := elem.Value.(*entry)
+			e.lastAccess = time.Now()
+			found[key] = e.value
+		} else {
+			c.telemetry.RecordMiss()
+		}
+	}
+	return found
+}
+
+// lookup returns key's element if it is from the current generation. A
+// stale entry is removed on the way, so invalidated entries are freed as
+// they are found instead of all at once. Caller must hold c.mu.
+func (c *LRUCache) lookup(key string) (*list.Element, bool) {
+	elem, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if elem.Value.(*entry).generation != atomic.LoadUint64(&c.generation) {
+		c.remove(elem)
+		return nil, false
+	}
+	return elem, true
+}
+
+// InvalidateAll makes every entry already in the cache stale, so the next
+// Get of any of them misses, and returns the new generation. It bumps a
+// counter without taking the lock or walking the cache, so it costs the
+// same for ten entries as for ten million. Stale entries are dropped when
+// Get, GetMany or Set finds them, or evicted as they reach the back of the
+// LRU list; until then they still count toward Len and the capacity.
+func (c *LRUCache) InvalidateAll() uint64 {
+	return atomic.AddUint64(&c.generation, 1)
+}
+
+// Generation returns the current generation, the number of InvalidateAll
+// calls so far
+func (c *LRUCache) Generation() uint64 {
+	return atomic.LoadUint64(&c.generation)
+}
+
 func (c *LRUCache) Len() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return c.lruList.Len()
 }
 
+// Summary reports the cache's size for /debug/summary
+func (c *LRUCache) Summary() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	summary := map[string]interface{}{
+		"len":        c.lruList.Len(),
+		"capacity":   c.capacity,
+		"generation": atomic.LoadUint64(&c.generation),
+	}
+	if c.accesses != nil {
+		summary["working_set"] = c.accesses.count(c.accesses.retention)
+	}
+	return summary
+}
+
+// SizeByPrefix sums len(Data) of the cached values per key prefix, the part
+// of the key before its last sep, so "user:123:avatar" and "user:123:prefs"
+// both count toward "user:123". Keys without sep are grouped under "". It
+// holds c.mu for one pass over the cache, so it is meant for debugging, not
+// for every request.
+func (c *LRUCache) SizeByPrefix(sep string) map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen := atomic.LoadUint64(&c.generation)
+	sizes := make(map[string]int64)
+	for key, elem := range c.cache {
+		if elem.Value.(*entry).generation != gen {
+			continue
+		}
+		prefix := ""
+		if i := strings.LastIndex(key, sep); i >= 0 {
+			prefix = key[:i]
+		}
+		var size int64
+		if value := elem.Value.(*entry).value; value != nil {
+			size = int64(len(value.Data))
+		}
+		sizes[prefix] += size
+	}
+	return sizes
+}
+
+// Snapshot copies every entry, most recently used first, under one short
+// lock acquisition. The caller can then iterate the copy as slowly as it
+// likes without blocking Get or Set. The cost is an allocation of Len()
+// entries per call; use ForEach to avoid it. Values are shared with the
+// cache, not copied.
+func (c *LRUCache) Snapshot() []KeyValueAge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen := atomic.LoadUint64(&c.generation)
+	entries := make([]KeyValueAge, 0, c.lruList.Len())
+	for elem := c.lruList.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry)
+		if e.generation != gen {
+			continue
+		}
+		entries = append(entries, KeyValueAge{Key: e.key, Value: e.value, LastAccess: e.lastAccess})
+	}
+	return entries
+}
+
+// ForEach calls fn for each entry, most recently used first, with the time
+// since the entry was last accessed, until fn returns false. It copies
+// nothing, but holds c.mu until the iteration ends, so every Get and Set
+// waits for fn to finish with all entries. fn must be fast and must not call
+// back into the cache. Visiting an entry doesn't count as an access.
+func (c *LRUCache) ForEach(fn func(key string, value *CachedObject, age time.Duration) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now, gen := time.Now(), atomic.LoadUint64(&c.generation)
+	for elem := c.lruList.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry)
+		if e.generation != gen {
+			continue
+		}
+		if !fn(e.key, e.value, now.Sub(e.lastAccess)) {
+			return
+		}
+	}
+}
+
+// touch records an access to key if working-set tracking is on. Caller must
+// hold c.mu.
+func (c *LRUCache) touch(key string) {
+	if c.accesses != nil {
+		c.accesses.touch(key)
+	}
+}
+
+// accessLog keeps the last access time of every key touched within retention,
+// most recent first. It is separate from the LRU list because it must also
+// remember keys the cache has evicted.
+type accessLog struct {
+	retention time.Duration
+	now       func() time.Time
+	order     *list.List // of *access, most recent first
+	byKey     map[string]*list.Element
+}
+
+type access struct {
+	key string
+	at  time.Time
+}
+
+func newAccessLog(retention time.Duration) *accessLog {
+	return &accessLog{
+		retention: retention,
+		now:       time.Now,
+		order:     list.New(),
+		byKey:     make(map[string]*list.Element),
+	}
+}
+
+// touch moves key to the front with the current time, then expires old
+// accesses from the back. Each access is expired once, so touch is O(1)
+// amortized however large the cache or the log.
+func (l *accessLog) touch(key string) {
+	now := l.now()
+	if elem, ok := l.byKey[key]; ok {
+		elem.Value.(*access).at = now
+		l.order.MoveToFront(elem)
+	} else {
+		l.byKey[key] = l.order.PushFront(&access{key: key, at: now})
+	}
+	l.expire(now)
+}
+
+// expire drops accesses older than retention, so the log can't grow without
+// bound while keys keep changing
+func (l *accessLog) expire(now time.Time) {
+	cutoff := now.Add(-l.retention)
+	for back := l.order.Back(); back != nil && back.Value.(*access).at.Before(cutoff); back = l.order.Back() {
+		delete(l.byKey, l.order.Remove(back).(*access).key)
+	}
+}
+
+// count walks from the most recent access and stops at the first one outside
+// window, so it costs the size of the answer, not of the cache
+func (l *accessLog) count(window time.Duration) int {
+	now := l.now()
+	l.expire(now)
+	if window >= l.retention {
+		return l.order.Len()
+	}
+
+	cutoff := now.Add(-window)
+	n := 0
+	for e := l.order.Front(); e != nil && !e.Value.(*access).at.Before(cutoff); e = e.Next() {
+		n++
+	}
+	return n
+}
+
+// StripedLRUCache is an LRU cache for write-heavy workloads. The key's hash
+// picks one of several stripe locks, and the map lookup and update run under
+// that lock alone, so Sets of keys on different stripes don't wait for each
+// other there. All keys still share a single LRU list behind listMu, which is
+// held only to link, move or unlink an element. Eviction order is therefore
+// the same as LRUCache's. The ShardedCache in resources/04-cache-patterns.md
+// goes further and splits the LRU order too.
+type StripedLRUCache struct {
+	capacity  int
+	stripes   []lockStripe
+	mask      uint32
+	shardFunc ShardFunc
+
+	listMu sync.Mutex
+	lru    *list.List // of *stripedEntry, most recent first
+}
+
+type lockStripe struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+}
+
+type stripedEntry struct {
+	key   string
+	value *CachedObject // guarded by the key's stripe lock
+
+	// evicted is set under listMu when the element leaves the list, which
+	// can happen before the key leaves its stripe's map
+	evicted bool
+}
+
+// ShardFunc hashes a key for StripedLRUCache. Only the low bits pick the
+// stripe, so they must be spread evenly over the cache's key space.
+type ShardFunc func(key string) uint32
+
+// DefaultShardFunc is 32-bit FNV-1a, the ShardFunc StripedLRUCache uses
+// unless WithShardFunc replaces it
+func DefaultShardFunc(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// StripedOption configures optional StripedLRUCache behavior
+type StripedOption func(*StripedLRUCache)
+
+// WithShardFunc hashes keys with fn instead of DefaultShardFunc, for a key
+// space that FNV-1a spreads poorly or a faster hash such as xxhash
+func WithShardFunc(fn ShardFunc) StripedOption {
+	return func(c *StripedLRUCache) {
+		c.shardFunc = fn
+	}
+}
+
+// NewStripedLRUCache returns a cache of capacity entries with stripeCount
+// stripe locks. stripeCount must be a power of two, so a stripe is picked by
+// masking the hash rather than dividing it; any other count panics.
+func NewStripedLRUCache(capacity, stripeCount int, opts ...StripedOption) *StripedLRUCache {
+	if stripeCount <= 0 || stripeCount&(stripeCount-1) != 0 {
+		panic(fmt.Sprintf("NewStripedLRUCache: stripeCount %d is not a power of two", stripeCount))
+	}
+	c := &StripedLRUCache{
+		capacity:  capacity,
+		stripes:   make([]lockStripe, stripeCount),
+		mask:      uint32(stripeCount - 1),
+		shardFunc: DefaultShardFunc,
+		lru:       list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for i := range c.stripes {
+		c.stripes[i].items = make(map[string]*list.Element)
+	}
+	return c
+}
+
+// stripeIndex returns the index of key's stripe
+func (c *StripedLRUCache) stripeIndex(key string) int {
+	return int(c.shardFunc(key) & c.mask)
+}
+
+// stripe returns key's stripe
+func (c *StripedLRUCache) stripe(key string) *lockStripe {
+	return &c.stripes[c.stripeIndex(key)]
+}
+
+func (c *StripedLRUCache) Set(key string, value *CachedObject) {
+	s := c.stripe(key)
+	s.mu.Lock()
+
+	if elem, ok := s.items[key]; ok {
+		e := elem.Value.(*stripedEntry)
+		e.value = value
+		c.listMu.Lock()
+		if !e.evicted {
+			c.lru.MoveToFront(elem)
+			c.listMu.Unlock()
+			s.mu.Unlock()
+			return
+		}
+		// Evicted by another Set that hasn't removed it from our map yet:
+		// store it as a new entry, or it would sit in the map unreachable by
+		// eviction
+		c.listMu.Unlock()
+	}
+
+	var victim *list.Element
+	c.listMu.Lock()
+	elem := c.lru.PushFront(&stripedEntry{key: key, value: value})
+	if c.lru.Len() > c.capacity {
+		victim = c.lru.Back()
+		c.lru.Remove(victim)
+		victim.Value.(*stripedEntry).evicted = true
+	}
+	c.listMu.Unlock()
+	s.items[key] = elem
+	s.mu.Unlock()
+
+	// Remove the victim from its own stripe only after releasing ours, so two
+	// Sets evicting from each other's stripes can't deadlock
+	if victim != nil {
+		e := victim.Value.(*stripedEntry)
+		vs := c.stripe(e.key)
+		vs.mu.Lock()
+		if vs.items[e.key] == victim {
+			delete(vs.items, e.key)
+		}
+		vs.mu.Unlock()
+	}
+}
+
+func (c *StripedLRUCache) Get(key string) (*CachedObject, bool) {
+	s := c.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*stripedEntry)
+	c.listMu.Lock()
+	evicted := e.evicted
+	if !evicted {
+		c.lru.MoveToFront(elem)
+	}
+	c.listMu.Unlock()
+	if evicted {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *StripedLRUCache) Len() int {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	return c.lru.Len()
+}
+
+// L2 is the larger, slower store behind a TieredCache's L1. A bigger
+// LRUCache satisfies it, and so would a wrapper around Redis or disk.
+type L2 interface {
+	Get(key string) (*CachedObject, bool)
+	Set(key string, value *CachedObject)
+}
+
+// TieredCache keeps a small hot LRUCache (L1) in front of an L2 store. L2
+// hits are promoted into L1; misses in both are loaded and stored in both.
+type TieredCache struct {
+	l1   *LRUCache
+	l2   L2
+	load func(key string) (*CachedObject, error)
+
+	l1Hits int64
+	l2Hits int64
+	loads  int64
+}
+
+func NewTieredCache(l1 *LRUCache, l2 L2, load func(key string) (*CachedObject, error)) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2, load: load}
+}
+
+func (t *TieredCache) Get(key string) (*CachedObject, error) {
+	if obj, ok := t.l1.Get(key); ok {
+		atomic.AddInt64(&t.l1Hits, 1)
+		return obj, nil
+	}
+	if obj, ok := t.l2.Get(key); ok {
+		atomic.AddInt64(&t.l2Hits, 1)
+		t.l1.Set(key, obj) // promote
+		return obj, nil
+	}
+
+	atomic.AddInt64(&t.loads, 1)
+	obj, err := t.load(key)
+	if err != nil {
+		return nil, err // errors aren't cached
+	}
+	t.l2.Set(key, obj)
+	t.l1.Set(key, obj)
+	return obj, nil
+}
+
+// Stats returns how many Gets were served by L1, by L2 and by the loader
+func (t *TieredCache) Stats() (l1Hits, l2Hits, loads int64) {
+	return atomic.LoadInt64(&t.l1Hits), atomic.LoadInt64(&t.l2Hits), atomic.LoadInt64(&t.loads)
+}
+
+// ExpiringMap is a bounded map where every key carries its own TTL. When the
+// map is full the oldest inserted key is evicted (FIFO), which is simpler and
+// cheaper than LRU when access recency doesn't matter. A single background
+// sweeper removes expired keys; call Close to stop it.
+type ExpiringMap[K comparable, V any] struct {
+	mu      sync.Mutex
+	maxSize int
+	items   map[K]*list.Element
+	order   *list.List // insertion order, newest at the front
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type expiringItem[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// defaultSweepInterval is the sweep interval NewExpiringMap uses when it is
+// given none
+const defaultSweepInterval = time.Second
+
+// NewExpiringMap creates a map holding at most maxSize keys and starts a
+// sweeper that removes expired keys every sweepInterval, or every
+// defaultSweepInterval if sweepInterval isn't positive (time.NewTicker would
+// panic)
+func NewExpiringMap[K comparable, V any](maxSize int, sweepInterval time.Duration) *ExpiringMap[K, V] {
+	if sweepInterval <= 0 {
+		sweepInterval = defaultSweepInterval
+	}
+	m := &ExpiringMap[K, V]{
+		maxSize: maxSize,
+		items:   make(map[K]*list.Element),
+		order:   list.New(),
+		stop:    make(chan struct{}),
+	}
+	go m.sweeper(sweepInterval)
+	return m
+}
+
+// Set stores value under key until ttl elapses. Updating an existing key
+// refreshes its value and TTL but keeps its original insertion position.
+func (m *ExpiringMap[K, V]) Set(key K, value V, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if elem, ok := m.items[key]; ok {
+		item := elem.Value.(*expiringItem[K, V])
+		item.value = value
+		item.expires = expires
+		return
+	}
+
+	m.items[key] = m.order.PushFront(&expiringItem[K, V]{key, value, expires})
+
+	// Evict the oldest insertion if over capacity
+	if m.order.Len() > m.maxSize {
+		m.removeElement(m.order.Back())
+	}
+}
+
+// Get returns the value for key if it is present and not yet expired
+func (m *ExpiringMap[K, V]) Get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	item := elem.Value.(*expiringItem[K, V])
+	if time.Now().After(item.expires) {
+		// Expired but not swept yet
+		m.removeElement(elem)
+		var zero V
+		return zero, false
+	}
+	return item.value, true
+}
+
+// Delete removes key if present
+func (m *ExpiringMap[K, V]) Delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		m.removeElement(elem)
+	}
+}
+
+// Len returns the number of keys, including expired ones not yet swept
+func (m *ExpiringMap[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Close stops the background sweeper
+func (m *ExpiringMap[K, V]) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+func (m *ExpiringMap[K, V]) removeElement(elem *list.Element) {
+	m.order.Remove(elem)
+	delete(m.items, elem.Value.(*expiringItem[K, V]).key)
+}
+
+// sweeper periodically removes expired keys until Close is called
+func (m *ExpiringMap[K, V]) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.removeExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *ExpiringMap[K, V]) removeExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for elem := m.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*expiringItem[K, V]).expires) {
+			m.removeElement(elem)
+		}
+		elem = prev
+	}
+}
+
 var (
 	// LRU cache with max 1000 items
 	cache *LRUCache
+
+	telemetryBackend = flag.String("telemetry", "none", "cache telemetry backend: none, log or prometheus (served at /metrics)")
 )
 
+// workingSetWindow is the window the monitor reports the working set over
+const workingSetWindow = 2 * time.Second
+
+// coverage returns the percentage of a working set that capacity can hold
+func coverage(capacity, workingSet int) float64 {
+	if workingSet <= capacity {
+		return 100
+	}
+	return 100 * float64(capacity) / float64(workingSet)
+}
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	// Initialize LRU cache with max 1000 items
-	cache = NewLRUCache(1000)
-	
+	telemetry, err := newTelemetry(*telemetryBackend)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	cache = NewLRUCache(1000, WithTelemetry(telemetry), WithSummary("lru_cache"))
+	cache.TrackWorkingSet(workingSetWindow)
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
 	// Start pprof server
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
 		fmt.Println("Collect heap profile: curl http://localhost:6060/debug/pprof/heap > heap_fixed.pprof")
 		fmt.Println("Compare with leaky: go tool pprof -base=heap.pprof heap_fixed.pprof")
 		fmt.Println()
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
 
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	fmt.Printf("[START] Heap Alloc: %d MB, Objects cached: %d\n",
@@ -126,40 +1083,132 @@ func main() {
 			time.Since(start).Round(time.Second),
 			m.Alloc/1024/1024,
 			cache.Len())
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		wss := cache.WorkingSetSize(workingSetWindow)
+		fmt.Printf("           Working set (last %v): %d keys  |  capacity 1000 covers %.0f%%\n",
+			workingSetWindow, wss, coverage(1000, wss))
+		fmt.Printf("           By prefix: %s\n", formatPrefixSizes(cache.SizeByPrefix("_")))
 	}
 
 	fmt.Println("\nMemory stabilized. Cache stays at max capacity.")
 	fmt.Println("Old items automatically evicted.")
 	fmt.Printf("Final cache size: %d objects\n", cache.Len())
+
+	fmt.Println("\n--- ExpiringMap: per-key TTL with a FIFO size bound ---")
+	demonstrateExpiringMap()
+
 	fmt.Println("Press Ctrl+C to stop")
 
 	// Keep running for profiling
 	select {}
 }
 
+// formatPrefixSizes lists prefixes largest first, so the namespace that
+// dominates memory leads the line
+func formatPrefixSizes(sizes map[string]int64) string {
+	prefixes := make([]string, 0, len(sizes))
+	for prefix := range sizes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if sizes[prefixes[i]] != sizes[prefixes[j]] {
+			return sizes[prefixes[i]] > sizes[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+
+	parts := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		if size := sizes[prefix]; size < 1024 {
+			parts[i] = fmt.Sprintf("%q %d B", prefix, size)
+		} else {
+			parts[i] = fmt.Sprintf("%q %d KB", prefix, size/1024)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// newTelemetry returns the backend named by -telemetry
+func newTelemetry(name string) (Telemetry, error) {
+	switch name {
+	case "none":
+		return NoopTelemetry{}, nil
+	case "log":
+		handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+		return LogTelemetry(slog.New(handler)), nil
+	case "prometheus":
+		debugMux.Handle("/metrics", promhttp.Handler())
+		return PrometheusTelemetry(prometheus.DefaultRegisterer, "lru_cache"), nil
+	}
+	return nil, fmt.Errorf("unknown -telemetry %q: want none, log or prometheus", name)
+}
+
+// demonstrateExpiringMap shows keys with different TTLs expiring independently
+// while the size bound evicts the oldest insertion
+func demonstrateExpiringMap() {
+	sessions := NewExpiringMap[string, *CachedObject](3, 50*time.Millisecond)
+	defer sessions.Close()
+
+	sessions.Set("short", &CachedObject{Key: "short"}, 100*time.Millisecond)
+	sessions.Set("long", &CachedObject{Key: "long"}, time.Minute)
+	time.Sleep(200 * time.Millisecond)
+
+	_, shortOK := sessions.Get("short")
+	_, longOK := sessions.Get("long")
+	fmt.Printf("After 200ms: short present=%v, long present=%v, size=%d\n", shortOK, longOK, sessions.Len())
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		sessions.Set(key, &CachedObject{Key: key}, time.Minute)
+	}
+	_, longOK = sessions.Get("long")
+	fmt.Printf("After 3 more inserts: long present=%v, size=%d (max: 3)\n", longOK, sessions.Len())
+}
+
+// cacheBatch is how many objects continuouslyCacheObjects stores per SetMany
+const cacheBatch = 100
+
 func continuouslyCacheObjects() {
 	counter := 0
-	ticker := time.NewTicker(200 * time.Microsecond) // 5000 objects per second
+	ticker := time.NewTicker(20 * time.Millisecond) // 100 objects per tick, 5000 per second
 	defer ticker.Stop()
 
+	batch := make([]KeyValue, 0, cacheBatch)
 	for range ticker.C {
-		counter++
-		key := fmt.Sprintf("key_%d", counter)
-
-		// Create object with 5 KB of data
-		obj := &CachedObject{
-			Key:       key,
-			Data:      make([]byte, 5*1024),
-			Timestamp: time.Now(),
+		batch = batch[:0]
+		for len(batch) < cacheBatch {
+			counter++
+			key := fmt.Sprintf("key_%d", counter)
+			batch = append(batch, KeyValue{Key: key, Value: newCachedObject(key)})
 		}
 
-		// Fill with some data
-		for i := range obj.Data {
-			obj.Data[i] = byte(i % 256)
-		}
+		// Store the batch under one lock - old items automatically evicted
+		cache.SetMany(batch)
+	}
+}
 
-		// Store in LRU cache - old items automatically evicted
-		cache.Set(key, obj)
+// newCachedObject returns an object holding 5 KB of data
+func newCachedObject(key string) *CachedObject {
+	obj := &CachedObject{
+		Key:       key,
+		Data:      make([]byte, 5*1024),
+		Timestamp: time.Now(),
 	}
+
+	// Fill with some data
+	for i := range obj.Data {
+		obj.Data[i] = byte(i % 256)
+	}
+	return obj
 }
 
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,966 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cachepkg "github.com/Danialsamadi/Memmory-leaks-go/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Allocation budgets for Set. Set must be O(1): the count may not grow with
+// the cache size.
+const (
+	// Set of a new key on a full cache: the list.Element (the entry comes
+	// from entryPool)
+	maxSetAllocs = 1
+	// Set of a key already in the cache only moves it to the front
+	maxUpdateAllocs = 0
+)
+
+// batchSize is how many entries one BenchmarkSetMany op writes, via Set or
+// SetMany
+const batchSize = 1000
+
+// testKeys returns n distinct keys, key_0 to key_<n-1>
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+	}
+	return keys
+}
+
+// TestSetAllocations measures Set with testing.AllocsPerRun on full caches
+// of increasing size against the budgets above
+func TestSetAllocations(t *testing.T) {
+	keys := testKeys(200_000)
+	obj := &CachedObject{Data: make([]byte, 5*1024)}
+
+	for _, capacity := range []int{100, 10_000, 100_000} {
+		c := NewLRUCache(capacity)
+		for i := 0; i < capacity; i++ {
+			c.Set(keys[i], obj)
+		}
+
+		next := capacity
+		setAllocs := testing.AllocsPerRun(1000, func() {
+			c.Set(keys[next%len(keys)], obj) // evicts the oldest entry
+			next++
+		})
+		updateAllocs := testing.AllocsPerRun(1000, func() {
+			c.Set(keys[(next-1)%len(keys)], obj)
+		})
+
+		if setAllocs > maxSetAllocs || updateAllocs > maxUpdateAllocs {
+			t.Errorf("capacity %d: Set allocates %.0f per new key and %.0f per update, want at most %d and %d",
+				capacity, setAllocs, updateAllocs, maxSetAllocs, maxUpdateAllocs)
+		}
+	}
+}
+
+// TestNoopTelemetryAllocatesNothing checks that the default telemetry costs
+// a hit and a miss no allocation
+func TestNoopTelemetryAllocatesNothing(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Set("a", &CachedObject{})
+	allocs := testing.AllocsPerRun(1000, func() {
+		c.Get("a")
+		c.Get("x")
+	})
+	if allocs != 0 {
+		t.Errorf("NoopTelemetry hit and miss allocate %.0f times, want 0", allocs)
+	}
+}
+
+// TestForEachAllocatesNothing measures both iterators on a full 1000-entry
+// cache. Snapshot pays for its copy; ForEach must not allocate.
+func TestForEachAllocatesNothing(t *testing.T) {
+	c := NewLRUCache(1000)
+	for _, key := range testKeys(1000) {
+		c.Set(key, &CachedObject{})
+	}
+	snapAllocs := testing.AllocsPerRun(100, func() { c.Snapshot() })
+	eachAllocs := testing.AllocsPerRun(100, func() {
+		c.ForEach(func(string, *CachedObject, time.Duration) bool { return true })
+	})
+
+	t.Logf("1000 entries: Snapshot %.0f allocs, ForEach %.0f", snapAllocs, eachAllocs)
+	if eachAllocs != 0 {
+		t.Errorf("ForEach allocates %.0f times, want 0", eachAllocs)
+	}
+}
+
+// TestInvalidateAll fills a cache, calls InvalidateAll and checks that every
+// earlier key misses while keys set afterwards hit, and that stale entries
+// are dropped as Get finds them and skipped by iteration
+func TestInvalidateAll(t *testing.T) {
+	c := NewLRUCache(100)
+	for i := range 10 {
+		key := fmt.Sprintf("old_%d", i)
+		c.Set(key, &CachedObject{Key: key})
+	}
+	if gen := c.InvalidateAll(); gen != 1 || c.Generation() != 1 {
+		t.Errorf("InvalidateAll = %d, Generation = %d, want 1", gen, c.Generation())
+	}
+	if got := c.Len(); got != 10 {
+		t.Errorf("Len right after InvalidateAll = %d, want 10: stale entries aren't walked", got)
+	}
+	for i := range 10 {
+		if _, hit := c.Get(fmt.Sprintf("old_%d", i)); hit {
+			t.Errorf("old_%d set before InvalidateAll hit", i)
+		}
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len after every stale Get = %d, want 0", got)
+	}
+
+	c.Set("old_0", &CachedObject{Key: "old_0"})
+	c.Set("new", &CachedObject{Key: "new"})
+	_, oldHit := c.Get("old_0")
+	_, newHit := c.Get("new")
+	if !oldHit || !newHit {
+		t.Errorf("keys set after InvalidateAll: old_0 hit %v, new hit %v, want both", oldHit, newHit)
+	}
+
+	// Stale entries are skipped by iteration and reused by Set
+	c.Set("stale", &CachedObject{Key: "stale"})
+	c.InvalidateAll()
+	c.Set("fresh", &CachedObject{Key: "fresh"})
+	var keys []string
+	for _, kv := range c.Snapshot() {
+		keys = append(keys, kv.Key)
+	}
+	if fmt.Sprint(keys) != "[fresh]" {
+		t.Errorf("Snapshot keys = %v, want [fresh]", keys)
+	}
+	if n := c.SetMany([]KeyValue{{Key: "stale", Value: &CachedObject{}}}); n != 1 {
+		t.Errorf("SetMany over a stale key added %d, want 1", n)
+	}
+	found := c.GetMany([]string{"new", "stale", "fresh"})
+	if len(found) != 2 || found["new"] != nil {
+		t.Errorf("GetMany found %v, want stale and fresh", slices.Sorted(maps.Keys(found)))
+	}
+}
+
+// BenchmarkInvalidateAll calls InvalidateAll on 10 and on 1M entries. It
+// walks nothing, so both cost the same few nanoseconds.
+func BenchmarkInvalidateAll(b *testing.B) {
+	for _, size := range []int{10, 1_000_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			c := NewLRUCache(size)
+			for i := range size {
+				c.Set(strconv.Itoa(i), &CachedObject{})
+			}
+			for b.Loop() {
+				c.InvalidateAll()
+			}
+		})
+	}
+}
+
+// BenchmarkSetEvicting measures Set on new keys against a full cache, which
+// is the steady state of continuouslyCacheObjects: every Set evicts an
+// entry. Without entryPool each Set allocated an entry and a list.Element;
+// with it only the list.Element is allocated.
+func BenchmarkSetEvicting(b *testing.B) {
+	keys := testKeys(100_000)
+	obj := &CachedObject{Data: make([]byte, 5*1024)}
+	c := NewLRUCache(1000)
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		c.Set(keys[i%len(keys)], obj)
+	}
+}
+
+// BenchmarkSetMany compares one SetMany of batchSize entries with batchSize
+// separate Set calls on a full cache. The difference is the cost of taking
+// and releasing c.mu batchSize-1 more times.
+func BenchmarkSetMany(b *testing.B) {
+	keys := testKeys(100_000)
+	obj := &CachedObject{Data: make([]byte, 5*1024)}
+	batches := make([][]KeyValue, len(keys)/batchSize)
+	for i := range batches {
+		batches[i] = make([]KeyValue, batchSize)
+		for j := range batches[i] {
+			batches[i][j] = KeyValue{Key: keys[i*batchSize+j], Value: obj}
+		}
+	}
+	perEntry := func(b *testing.B) {
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batchSize), "ns/entry")
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		c := NewLRUCache(1000)
+		for i := 0; b.Loop(); i++ {
+			for _, kv := range batches[i%len(batches)] {
+				c.Set(kv.Key, kv.Value)
+			}
+		}
+		perEntry(b)
+	})
+	b.Run("SetMany", func(b *testing.B) {
+		c := NewLRUCache(1000)
+		for i := 0; b.Loop(); i++ {
+			c.SetMany(batches[i%len(batches)])
+		}
+		perEntry(b)
+	})
+}
+
+// BenchmarkParallelSet runs Set from 4 goroutines per P on a full cache of
+// 1000, with one mutex and with 16 stripes
+func BenchmarkParallelSet(b *testing.B) {
+	keys := testKeys(5000)
+	bench := func(set func(key string, obj *CachedObject)) func(*testing.B) {
+		return func(b *testing.B) {
+			b.SetParallelism(4)
+			var next int64
+			obj := &CachedObject{}
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					set(keys[atomic.AddInt64(&next, 1)%int64(len(keys))], obj)
+				}
+			})
+		}
+	}
+	b.Run("LRUCache", bench(NewLRUCache(1000).Set))
+	b.Run("StripedLRUCache", bench(NewStripedLRUCache(1000, 16).Set))
+}
+
+// TestPrometheusTelemetry runs TestTelemetry's script against
+// PrometheusTelemetry on its own registry and reads the counters back
+func TestPrometheusTelemetry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewLRUCache(2, WithTelemetry(PrometheusTelemetry(reg, "test_cache")))
+	obj := &CachedObject{}
+	c.Set("a", obj)
+	c.Set("b", obj)
+	c.Get("a")                    // hit
+	c.Get("x")                    // miss
+	c.Set("c", obj)               // evicts b, the least recently used
+	c.Delete("a")                 // delete
+	c.Delete("a")                 // already gone: no event
+	c.GetMany([]string{"c", "b"}) // one hit, one miss
+	c.Set("c", obj)               // update: a set, no eviction
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetName() != "test_cache_events_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "event" {
+					got[l.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	want := map[string]float64{"set": 4, "hit": 2, "miss": 2, "eviction": 1, "delete": 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("test_cache_events_total = %v, want %v", got, want)
+	}
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestTieredCache checks that an L1 miss / L2 hit promotes the entry to L1,
+// that the next Get is an L1 hit, and that a miss in both calls the loader.
+func TestTieredCache(t *testing.T) {
+	l1 := NewLRUCache(2)
+	l2 := NewLRUCache(100)
+	var loaded []string
+	tc := NewTieredCache(l1, l2, func(key string) (*CachedObject, error) {
+		loaded = append(loaded, key)
+		return &CachedObject{Key: key, Timestamp: time.Now()}, nil
+	})
+
+	stats := func(l1Hits, l2Hits, loads int64) bool {
+		h1, h2, n := tc.Stats()
+		return h1 == l1Hits && h2 == l2Hits && n == loads
+	}
+
+	// L1 miss / L2 hit: served from L2 and promoted
+	warm := &CachedObject{Key: "warm"}
+	l2.Set("warm", warm)
+	obj, err := tc.Get("warm")
+	_, inL1 := l1.Get("warm")
+	check(t, "L1 miss / L2 hit returns the L2 entry", err == nil && obj == warm && stats(0, 1, 0))
+	check(t, "the L2 hit is promoted into L1", inL1)
+
+	// The next Get is an L1 hit
+	obj, err = tc.Get("warm")
+	check(t, "the next Get hits L1", err == nil && obj == warm && stats(1, 1, 0))
+
+	// Miss in both: loaded once, stored in both levels
+	obj, err = tc.Get("cold")
+	_, inL1 = l1.Get("cold")
+	_, inL2 := l2.Get("cold")
+	check(t, "a miss in both calls the loader", err == nil && obj != nil && obj.Key == "cold" && len(loaded) == 1 && stats(1, 1, 1))
+	check(t, "the loaded entry is stored in L1 and L2", inL1 && inL2)
+
+	// L1 evicts, L2 still has it: served from L2 without loading again
+	tc.Get("a")
+	tc.Get("b") // L1 (capacity 2) now holds a and b
+	_, inL1 = l1.Get("cold")
+	obj, err = tc.Get("cold")
+	check(t, "an entry evicted from L1 comes back from L2, not the loader",
+		!inL1 && err == nil && obj != nil && stats(1, 2, 3))
+}
+
+// TestWorkingSetSize drives a cache through a synthetic access pattern on a fake
+// clock: 500 keys over the first 10s, then 200 different keys over the next
+// 5s. WorkingSetSize must match the known distinct-key counts.
+func TestWorkingSetSize(t *testing.T) {
+	c := NewLRUCache(100)
+	c.TrackWorkingSet(time.Minute)
+	start := time.Now()
+	now := start
+	c.accesses.now = func() time.Time { return now }
+
+	obj := &CachedObject{}
+	// 2000 accesses cycling through a0..a499, one every 5ms from 0s to 9.995s
+	for i := 0; i < 2000; i++ {
+		now = start.Add(time.Duration(i) * 5 * time.Millisecond)
+		key := fmt.Sprintf("a%d", i%500)
+		if _, ok := c.Get(key); !ok {
+			c.Set(key, obj)
+		}
+	}
+	// 1000 accesses cycling through b0..b199, one every 5ms from 10s to 14.995s
+	for i := 0; i < 1000; i++ {
+		now = start.Add(10*time.Second + time.Duration(i)*5*time.Millisecond)
+		c.GetMany([]string{fmt.Sprintf("b%d", i%200)})
+	}
+	now = start.Add(15 * time.Second)
+
+	recent := c.WorkingSetSize(5 * time.Second)
+	check(t, fmt.Sprintf("last 5s: %d keys (want 200)", recent), recent == 200)
+	all := c.WorkingSetSize(15 * time.Second)
+	check(t, fmt.Sprintf("last 15s: %d keys (want 700, of which the cache holds %d)", all, c.Len()), all == 700)
+	clamped := c.WorkingSetSize(time.Hour)
+	check(t, fmt.Sprintf("a window past the 1m retention is cut to it: %d keys", clamped), clamped == 700)
+
+	c.Get("a0")
+	recent = c.WorkingSetSize(5 * time.Second)
+	check(t, fmt.Sprintf("re-reading an old key brings it back into the window: %d keys (want 201)", recent), recent == 201)
+
+	now = start.Add(2 * time.Minute)
+	c.Get("c0")
+	remembered := len(c.accesses.byKey)
+	check(t, fmt.Sprintf("accesses older than the retention are dropped: %d key(s) remembered (want 1)", remembered), remembered == 1)
+
+	t.Logf("capacity 100 covers %.0f%% of the last 5s", coverage(100, 200))
+}
+
+// TestStripedCache replays one random trace on LRUCache and
+// StripedLRUCache and compares every result, then hammers a StripedLRUCache
+// from several goroutines and checks that its stripes and LRU list still
+// agree.
+func TestStripedCache(t *testing.T) {
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+	}
+
+	// Single goroutine: same eviction order as LRUCache
+	plain := NewLRUCache(500)
+	striped := NewStripedLRUCache(500, 16)
+	rng := rand.New(rand.NewSource(1))
+	mismatches := 0
+	for i := 0; i < 50_000; i++ {
+		key := keys[rng.Intn(3000)]
+		if rng.Intn(2) == 0 {
+			obj := &CachedObject{Key: key}
+			plain.Set(key, obj)
+			striped.Set(key, obj)
+			continue
+		}
+		a, okA := plain.Get(key)
+		b, okB := striped.Get(key)
+		if okA != okB || a != b {
+			mismatches++
+		}
+	}
+	check(t, fmt.Sprintf("50000 random Sets and Gets give the same results as LRUCache (%d mismatches)", mismatches),
+		mismatches == 0 && plain.Len() == striped.Len())
+
+	// Concurrent writers: no entry lost from the list or left in a map
+	const writers, setsPerWriter, capacity = 8, 20_000, 1000
+	c := NewStripedLRUCache(capacity, 16)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < setsPerWriter; i++ {
+				key := keys[rng.Intn(len(keys))]
+				c.Set(key, &CachedObject{Key: key})
+				c.Get(keys[rng.Intn(len(keys))])
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	mapped := 0
+	for i := range c.stripes {
+		mapped += len(c.stripes[i].items)
+	}
+	consistent := true
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*stripedEntry)
+		if c.stripe(e.key).items[e.key] != elem || e.evicted || e.value.Key != e.key {
+			consistent = false
+		}
+	}
+	check(t, fmt.Sprintf("after %d concurrent Sets: %d in the list, %d in the stripe maps (want %d)",
+		writers*setsPerWriter, c.Len(), mapped, capacity), c.Len() == capacity && mapped == capacity)
+	check(t, "every list entry is in its stripe's map with its own value", consistent)
+}
+
+// sequentialIDShard is a ShardFunc for keys ending in a dense numeric ID, such
+// as "user:1042". The ID itself is the hash, so consecutive IDs land on
+// consecutive stripes. Keys without an ID fall back to DefaultShardFunc.
+func sequentialIDShard(key string) uint32 {
+	id, err := strconv.ParseUint(key[strings.LastIndexByte(key, ':')+1:], 10, 32)
+	if err != nil {
+		return DefaultShardFunc(key)
+	}
+	return uint32(id)
+}
+
+// TestShardFunc spreads 16,000 sequential user IDs over 16 stripes with
+// DefaultShardFunc, with sequentialIDShard and with a hash of the key's
+// length, and checks the stripe sizes of each. It also checks that the cache
+// works with a custom ShardFunc and that a stripe count that isn't a power
+// of two is rejected.
+func TestShardFunc(t *testing.T) {
+	const stripes, users = 16, 16_000
+
+	keys := make([]string, users)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	even := users / stripes
+
+	// spread returns the smallest and largest number of keys on one stripe
+	spread := func(c *StripedLRUCache) (lo, hi int) {
+		counts := make([]int, stripes)
+		for _, k := range keys {
+			counts[c.stripeIndex(k)]++
+		}
+		lo, hi = users, 0
+		for _, n := range counts {
+			if n < lo {
+				lo = n
+			}
+			if n > hi {
+				hi = n
+			}
+		}
+		return lo, hi
+	}
+
+	byFNV := NewStripedLRUCache(1000, stripes)
+	byID := NewStripedLRUCache(1000, stripes, WithShardFunc(sequentialIDShard))
+	byLength := NewStripedLRUCache(1000, stripes, WithShardFunc(func(key string) uint32 { return uint32(len(key)) }))
+
+	t.Logf("%d keys user:0 to user:%d over %d stripes (%d each if even)", users, users-1, stripes, even)
+	fnvLo, fnvHi := spread(byFNV)
+	idLo, idHi := spread(byID)
+	lenLo, lenHi := spread(byLength)
+	t.Logf("DefaultShardFunc (FNV-1a):  %5d to %5d per stripe", fnvLo, fnvHi)
+	t.Logf("sequentialIDShard:          %5d to %5d per stripe", idLo, idHi)
+	t.Logf("key length:                 %5d to %5d per stripe", lenLo, lenHi)
+
+	moved := 0
+	for _, k := range keys {
+		if byFNV.stripeIndex(k) != byID.stripeIndex(k) {
+			moved++
+		}
+	}
+	check(t, fmt.Sprintf("WithShardFunc changes the assignment: %d of %d keys on another stripe", moved, users), moved > users/2)
+	check(t, fmt.Sprintf("sequentialIDShard puts exactly %d keys on every stripe", even), idLo == even && idHi == even)
+	check(t, fmt.Sprintf("FNV-1a stays within 5%% of even (%d to %d)", fnvLo, fnvHi), fnvLo*100 >= even*95 && fnvHi*100 <= even*105)
+	check(t, fmt.Sprintf("a poor ShardFunc shows up: key length leaves stripes with %d keys and puts up to %d on one", lenLo, lenHi),
+		lenLo == 0 && lenHi > 2*even)
+
+	for _, k := range keys {
+		byID.Set(k, &CachedObject{Key: k})
+	}
+	found := 0
+	for _, k := range keys[users-1000:] {
+		if v, hit := byID.Get(k); hit && v.Key == k {
+			found++
+		}
+	}
+	check(t, fmt.Sprintf("the cache works with a custom ShardFunc: %d entries, %d of the newest 1000 found", byID.Len(), found),
+		byID.Len() == 1000 && found == 1000)
+
+	rejected := func(n int) (msg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg = fmt.Sprint(r)
+			}
+		}()
+		NewStripedLRUCache(1000, n)
+		return ""
+	}
+	msg := rejected(12)
+	check(t, fmt.Sprintf("12 stripes is rejected: %q", msg), msg != "")
+	check(t, "1, 2 and 64 stripes are accepted", rejected(1) == "" && rejected(2) == "" && rejected(64) == "")
+}
+
+// countingTelemetry counts each event, for TestTelemetry
+type countingTelemetry struct {
+	hits, misses, evictions, sets, deletes int
+}
+
+func (t *countingTelemetry) RecordHit()      { t.hits++ }
+func (t *countingTelemetry) RecordMiss()     { t.misses++ }
+func (t *countingTelemetry) RecordEviction() { t.evictions++ }
+func (t *countingTelemetry) RecordSet()      { t.sets++ }
+func (t *countingTelemetry) RecordDelete()   { t.deletes++ }
+
+// TestTelemetry runs a scripted sequence against a cache with a
+// countingTelemetry and checks every count
+func TestTelemetry(t *testing.T) {
+	counts := &countingTelemetry{}
+	c := NewLRUCache(2, WithTelemetry(counts))
+	obj := &CachedObject{}
+	c.Set("a", obj)
+	c.Set("b", obj)
+	c.Get("a")                    // hit
+	c.Get("x")                    // miss
+	c.Set("c", obj)               // evicts b, the least recently used
+	c.Delete("a")                 // delete
+	c.Delete("a")                 // already gone: no event
+	c.GetMany([]string{"c", "b"}) // one hit, one miss
+	c.Set("c", obj)               // update: a set, no eviction
+
+	check(t, fmt.Sprintf("sets: %d (want 4)", counts.sets), counts.sets == 4)
+	check(t, fmt.Sprintf("hits: %d (want 2)", counts.hits), counts.hits == 2)
+	check(t, fmt.Sprintf("misses: %d (want 2)", counts.misses), counts.misses == 2)
+	check(t, fmt.Sprintf("evictions: %d (want 1)", counts.evictions), counts.evictions == 1)
+	check(t, fmt.Sprintf("deletes: %d (want 1)", counts.deletes), counts.deletes == 1)
+}
+
+// TestSizeByPrefix fills a cache with keys under two prefixes plus one key
+// without a separator, and checks SizeByPrefix's totals
+func TestSizeByPrefix(t *testing.T) {
+	c := NewLRUCache(100)
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("user:123:item%d", i), &CachedObject{Data: make([]byte, 1000)})
+	}
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("session:abc:part%d", i), &CachedObject{Data: make([]byte, 5000)})
+	}
+	c.Set("config", &CachedObject{Data: make([]byte, 42)})
+
+	sizes := c.SizeByPrefix(":")
+	t.Logf("SizeByPrefix(\":\"): %s", formatPrefixSizes(sizes))
+	check(t, fmt.Sprintf("user:123 totals %d bytes (want 10000)", sizes["user:123"]), sizes["user:123"] == 10_000)
+	check(t, fmt.Sprintf("session:abc totals %d bytes (want 15000)", sizes["session:abc"]), sizes["session:abc"] == 15_000)
+	check(t, fmt.Sprintf("a key without the separator goes under \"\": %d bytes (want 42)", sizes[""]), sizes[""] == 42)
+	check(t, fmt.Sprintf("no other prefixes (%d total)", len(sizes)), len(sizes) == 3)
+}
+
+// TestIteration checks that Snapshot and ForEach visit entries most
+// recently used first with their ages, that ForEach stops when fn returns
+// false, and that a snapshot is unaffected by later writes. It also times how
+// long each holds the lock.
+func TestIteration(t *testing.T) {
+	c := NewLRUCache(10)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, &CachedObject{Key: key})
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.Get("a") // a is now the most recently used, b and c are 20ms old
+
+	snap := c.Snapshot()
+	var order []string
+	for _, kv := range snap {
+		order = append(order, kv.Key)
+	}
+	check(t, fmt.Sprintf("Snapshot order %v (want [a c b])", order), fmt.Sprint(order) == "[a c b]")
+	check(t, "Snapshot records a later LastAccess for the entry just read",
+		len(snap) == 3 && snap[0].LastAccess.After(snap[1].LastAccess))
+
+	var ages []time.Duration
+	order = order[:0]
+	c.ForEach(func(key string, value *CachedObject, age time.Duration) bool {
+		order = append(order, key)
+		ages = append(ages, age)
+		return true
+	})
+	check(t, fmt.Sprintf("ForEach order %v (want [a c b])", order), fmt.Sprint(order) == "[a c b]")
+	check(t, fmt.Sprintf("ForEach ages: a %v, b %v (want a < 20ms <= b)",
+		ages[0].Round(time.Millisecond), ages[2].Round(time.Millisecond)),
+		ages[0] < 20*time.Millisecond && ages[2] >= 20*time.Millisecond)
+
+	visited := 0
+	c.ForEach(func(string, *CachedObject, time.Duration) bool {
+		visited++
+		return visited < 2
+	})
+	check(t, fmt.Sprintf("ForEach stopped after %d entries when fn returned false (want 2)", visited), visited == 2)
+
+	c.Set("d", &CachedObject{Key: "d"})
+	c.Delete("a")
+	check(t, fmt.Sprintf("earlier snapshot unchanged by Set and Delete: %d entries, first %q", len(snap), snap[0].Key),
+		len(snap) == 3 && snap[0].Key == "a")
+
+	// The tradeoff on a full 1000-entry cache
+	big := NewLRUCache(1000)
+	for i := 0; i < 1000; i++ {
+		big.Set(fmt.Sprintf("key_%d", i), &CachedObject{})
+	}
+	// With per-entry work, Snapshot holds the lock only for the copy while
+	// ForEach holds it for the work as well
+	sink := 0
+	work := func(key string) {
+		for i := 0; i < 1000; i++ {
+			sink += int(key[i%len(key)])
+		}
+	}
+	start := time.Now()
+	entries := big.Snapshot()
+	snapHold := time.Since(start)
+	for _, kv := range entries {
+		work(kv.Key)
+	}
+	start = time.Now()
+	big.ForEach(func(key string, _ *CachedObject, _ time.Duration) bool {
+		work(key)
+		return true
+	})
+	eachHold := time.Since(start)
+	_ = sink
+	t.Logf("1000 entries, a few µs of work each:")
+	t.Logf("  Snapshot: lock held %v", snapHold.Round(time.Microsecond))
+	t.Logf("  ForEach:  lock held %v", eachHold.Round(time.Microsecond))
+}
+
+// TestMust loads a cache the way startup code would, reads it back with
+// MustGet, and checks that a missing key, an invalidated key and a cache of
+// capacity 0 panic with a message naming the key.
+func TestMust(t *testing.T) {
+	panicked := func(fn func()) (msg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg = fmt.Sprint(r)
+			}
+		}()
+		fn()
+		return ""
+	}
+
+	config := NewLRUCache(10)
+	for _, key := range []string{"config:db", "config:cache", "config:flags"} {
+		config.MustSet(key, &CachedObject{Key: key, Data: []byte("loaded")})
+	}
+	var value *CachedObject
+	msg := panicked(func() { value = config.MustGet("config:db") })
+	check(t, "MustGet returns a loaded key without panicking", msg == "" && value != nil && value.Key == "config:db")
+
+	msg = panicked(func() { config.MustGet("config:missing") })
+	check(t, fmt.Sprintf("MustGet of a missing key panics: %s", msg), strings.Contains(msg, `"config:missing"`))
+
+	config.InvalidateAll()
+	msg = panicked(func() { config.MustGet("config:flags") })
+	check(t, fmt.Sprintf("MustGet of an invalidated key panics: %s", msg), strings.Contains(msg, `"config:flags"`))
+
+	empty := NewLRUCache(0)
+	msg = panicked(func() { empty.MustSet("config:db", &CachedObject{}) })
+	check(t, fmt.Sprintf("MustSet on capacity 0 panics: %s", msg), strings.Contains(msg, "capacity 0"))
+	check(t, fmt.Sprintf("and stores nothing (Len %d)", empty.Len()), empty.Len() == 0)
+}
+
+// maxGetDuringEvict is the longest a Get may wait while a slow eviction
+// callback runs under WithEvictCallbackTimeout
+const maxGetDuringEvict = time.Millisecond
+
+// TestEvictCallbackTimeout runs a 100ms eviction callback and times Get
+// calls made while it runs. Without a timeout the callback holds the lock and
+// a Get waits for it; with WithEvictCallbackTimeout every Get must finish
+// within maxGetDuringEvict, the callback must be abandoned after the timeout
+// and still complete on its own, and a full queue must drop entries instead
+// of blocking.
+func TestEvictCallbackTimeout(t *testing.T) {
+	const slow = 100 * time.Millisecond
+	var called int64
+	slowFlush := func(key string, value *CachedObject) {
+		time.Sleep(slow) // e.g. writing the entry to disk
+		atomic.AddInt64(&called, 1)
+	}
+
+	// slowestGet evicts "a" from a one-entry cache in the background and
+	// returns the longest Get it sees while the callback runs
+	slowestGet := func(c *LRUCache) time.Duration {
+		c.Set("a", &CachedObject{})
+		go c.Set("b", &CachedObject{}) // evicts "a"
+		time.Sleep(5 * time.Millisecond)
+
+		var slowest time.Duration
+		for deadline := time.Now().Add(slow / 2); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			start := time.Now()
+			c.Get("b")
+			if d := time.Since(start); d > slowest {
+				slowest = d
+			}
+		}
+		return slowest
+	}
+
+	blocking := NewLRUCache(1, WithEvictCallback(slowFlush))
+	blocked := slowestGet(blocking)
+	check(t, fmt.Sprintf("without a timeout, Get waited %v for the callback under the lock", blocked.Round(time.Millisecond)),
+		blocked > 10*time.Millisecond)
+	time.Sleep(slow)
+
+	atomic.StoreInt64(&called, 0)
+	c := NewLRUCache(1, WithEvictCallback(slowFlush), WithEvictCallbackTimeout(10*time.Millisecond))
+	slowest := slowestGet(c)
+	check(t, fmt.Sprintf("with WithEvictCallbackTimeout(10ms), the slowest Get took %v (want < %v)", slowest, maxGetDuringEvict),
+		slowest < maxGetDuringEvict)
+	_, timedOut := c.EvictCallbackStats()
+	check(t, fmt.Sprintf("the callback was abandoned after the timeout: %d timed out (want 1)", timedOut), timedOut == 1)
+	time.Sleep(slow)
+	check(t, fmt.Sprintf("the abandoned callback still ran to completion: %d calls (want 1)", atomic.LoadInt64(&called)),
+		atomic.LoadInt64(&called) == 1)
+	c.Close()
+
+	// A callback that never returns, with a timeout too long to matter, keeps
+	// the cleaner on the first entry: the next evictQueueSize entries queue
+	// and the rest are dropped
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	stuck := NewLRUCache(1, WithEvictCallback(func(string, *CachedObject) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}), WithEvictCallbackTimeout(time.Hour))
+	stuck.Set("key_0", &CachedObject{})
+	stuck.Set("key_1", &CachedObject{})
+	<-started
+	const extra = 100
+	start := time.Now()
+	for i := 2; i < 2+evictQueueSize+extra; i++ {
+		stuck.Set(fmt.Sprintf("key_%d", i), &CachedObject{})
+	}
+	elapsed := time.Since(start)
+	dropped, _ := stuck.EvictCallbackStats()
+	check(t, fmt.Sprintf("with the cleaner stuck, %d evictions queued %d and dropped %d in %v (want %d dropped)",
+		evictQueueSize+extra, evictQueueSize, dropped, elapsed.Round(time.Microsecond), extra), dropped == extra)
+	stuck.Close()
+	close(release)
+}
+
+// evictionCache is the interface LRUCache, ClockCache and ClockProCache share
+type evictionCache interface {
+	Set(key string, value *CachedObject)
+	Get(key string) (*CachedObject, bool)
+	Delete(key string)
+	Len() int
+}
+
+// Workload for TestEvictionPolicies: Zipf-distributed reads over a working set of
+// policyWorkingSet keys, optionally interrupted by scans of keys read once
+const (
+	policyWorkingSet = 10_000
+	policyAccesses   = 500_000
+	policyZipfS      = 1.1
+	policyScanEvery  = 20_000 // accesses between scans
+	policyScanLen    = 5_000  // one-off keys per scan
+)
+
+// zipfTrace returns n keys drawn from a Zipf distribution over workingSet
+// keys, key_0 being the most popular. With scanEvery > 0, a scan of scanLen
+// keys that are never read again follows every scanEvery draws, like a batch
+// job or report that reads every row once.
+func zipfTrace(seed int64, n, workingSet, scanEvery, scanLen int) []string {
+	rng := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(rng, policyZipfS, 1, uint64(workingSet-1))
+	keys := make([]string, workingSet)
+	for i := range keys {
+		keys[i] = "key_" + strconv.Itoa(i)
+	}
+
+	trace := make([]string, 0, n)
+	scanned := 0
+	for len(trace) < n {
+		trace = append(trace, keys[zipf.Uint64()])
+		if scanEvery > 0 && len(trace)%scanEvery == 0 {
+			for i := 0; i < scanLen && len(trace) < n; i++ {
+				trace = append(trace, "scan_"+strconv.Itoa(scanned))
+				scanned++
+			}
+		}
+	}
+	return trace
+}
+
+// replayTrace reads every key of trace through c, setting it on a miss the
+// way a read-through cache would, and returns the hit rate and the mean cost
+// of one access. maxLen is the largest Len seen, sampled every 1000 accesses.
+func replayTrace(c evictionCache, trace []string) (hitRate float64, perAccess time.Duration, maxLen int) {
+	obj := &CachedObject{}
+	hits := 0
+	start := time.Now()
+	for i, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, obj)
+		}
+		if i%1000 == 0 {
+			if n := c.Len(); n > maxLen {
+				maxLen = n
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	return 100 * float64(hits) / float64(len(trace)), elapsed / time.Duration(len(trace)), maxLen
+}
+
+// TestEvictionPolicies replays a Zipf trace, with and without scans,
+// through LRUCache, ClockCache and ClockProCache at 10%, 25% and 50% of the
+// working set and logs their hit rates. pkg/cache tests ClockProCache's
+// bookkeeping.
+func TestEvictionPolicies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("replays 500,000-access traces")
+	}
+	workloads := []struct {
+		name  string
+		scans bool
+		trace []string
+	}{
+		{"zipf", false, zipfTrace(1, policyAccesses, policyWorkingSet, 0, 0)},
+		{"zipf + scans", true, zipfTrace(1, policyAccesses, policyWorkingSet, policyScanEvery, policyScanLen)},
+	}
+	policies := []struct {
+		name string
+		new  func(capacity int) evictionCache
+	}{
+		{"LRU", func(n int) evictionCache { return NewLRUCache(n) }},
+		{"CLOCK", func(n int) evictionCache { return cachepkg.NewClockCache[*CachedObject](n) }},
+		{"CLOCK-Pro", func(n int) evictionCache { return cachepkg.NewClockProCache[*CachedObject](n) }},
+	}
+
+	t.Logf("Zipf s=%.1f over %d keys, %d accesses; scans of %d one-off keys every %d accesses",
+		policyZipfS, policyWorkingSet, policyAccesses, policyScanLen, policyScanEvery)
+	t.Logf("%-14s %9s %10s %10s %10s", "workload", "capacity", "LRU", "CLOCK", "CLOCK-Pro")
+	withinCapacity, proBeatsLRUOnScans := true, true
+	costs := make([]time.Duration, len(policies))
+	for _, w := range workloads {
+		for _, pct := range []int{10, 25, 50} {
+			capacity := policyWorkingSet * pct / 100
+			rates := make([]float64, len(policies))
+			for i, p := range policies {
+				var maxLen int
+				var cost time.Duration
+				rates[i], cost, maxLen = replayTrace(p.new(capacity), w.trace)
+				withinCapacity = withinCapacity && maxLen <= capacity
+				if !w.scans && pct == 25 {
+					costs[i] = cost
+				}
+			}
+			t.Logf("%-14s %8d%% %9.1f%% %9.1f%% %9.1f%%", w.name, pct, rates[0], rates[1], rates[2])
+			if w.scans {
+				proBeatsLRUOnScans = proBeatsLRUOnScans && rates[2] > rates[0]
+			}
+		}
+	}
+	t.Logf("%-14s %9s %10v %10v %10v", "ns/access", "25%", costs[0], costs[1], costs[2])
+
+	check(t, "every cache stayed within its capacity", withinCapacity)
+	check(t, "CLOCK-Pro beats LRU on the scan workload at every capacity", proBeatsLRUOnScans)
+}
+
+// TestExpiringMap checks that keys set with different TTLs expire one by
+// one, each at its own deadline, that inserting past maxSize evicts the
+// oldest insertion and never grows the map, and that a sweep interval of 0
+// falls back to defaultSweepInterval instead of panicking, with the sweeper
+// still removing expired keys nobody reads.
+func TestExpiringMap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out defaultSweepInterval")
+	}
+	present := func(m *ExpiringMap[string, int], keys ...string) string {
+		var got []string
+		for _, key := range keys {
+			if _, found := m.Get(key); found {
+				got = append(got, key)
+			}
+		}
+		return strings.Join(got, ",")
+	}
+
+	ttls := NewExpiringMap[string, int](10, 10*time.Millisecond)
+	defer ttls.Close()
+	ttls.Set("100ms", 1, 100*time.Millisecond)
+	ttls.Set("300ms", 2, 300*time.Millisecond)
+	ttls.Set("1m", 3, time.Minute)
+	time.Sleep(200 * time.Millisecond)
+	got := present(ttls, "100ms", "300ms", "1m")
+	check(t, fmt.Sprintf("after 200ms only the 100ms key expired (present: %s)", got), got == "300ms,1m")
+	time.Sleep(200 * time.Millisecond)
+	got = present(ttls, "100ms", "300ms", "1m")
+	check(t, fmt.Sprintf("after 400ms the 300ms key expired too (present: %s)", got), got == "1m")
+
+	ttls.Set("1m", 4, 100*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	got = present(ttls, "1m")
+	check(t, fmt.Sprintf("re-setting a key replaces its TTL (present: %q)", got), got == "")
+
+	const maxSize = 5
+	bounded := NewExpiringMap[string, int](maxSize, time.Minute)
+	defer bounded.Close()
+	maxLen := 0
+	for i := 0; i < 3*maxSize; i++ {
+		bounded.Set(fmt.Sprintf("key_%d", i), i, time.Minute)
+		if n := bounded.Len(); n > maxLen {
+			maxLen = n
+		}
+	}
+	check(t, fmt.Sprintf("%d inserts never grew the map past %d (max Len %d)", 3*maxSize, maxSize, maxLen), maxLen == maxSize)
+	got = present(bounded, "key_9", "key_10", "key_11", "key_12", "key_13", "key_14")
+	check(t, fmt.Sprintf("the %d newest insertions survived (present: %s)", maxSize, got), got == "key_10,key_11,key_12,key_13,key_14")
+
+	var zero *ExpiringMap[string, int]
+	panicked := func() (r interface{}) {
+		defer func() { r = recover() }()
+		zero = NewExpiringMap[string, int](10, 0)
+		return nil
+	}()
+	check(t, fmt.Sprintf("a sweep interval of 0 doesn't panic (%v)", panicked), panicked == nil)
+	if zero != nil {
+		defer zero.Close()
+		zero.Set("unread", 1, 10*time.Millisecond)
+		time.Sleep(defaultSweepInterval + 200*time.Millisecond)
+		check(t, fmt.Sprintf("and its sweeper removed an unread expired key within %v (Len %d)", defaultSweepInterval, zero.Len()), zero.Len() == 0)
+	}
+}
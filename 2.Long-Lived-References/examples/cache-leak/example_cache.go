@@ -1,11 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This example demonstrates an unbounded cache that leaks memory
@@ -23,19 +29,26 @@ var (
 )
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	// Start pprof server
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
 		fmt.Println("Collect heap profile: curl http://localhost:6060/debug/pprof/heap > heap.pprof")
 		fmt.Println("View profile: go tool pprof -http=:8081 heap.pprof")
 		fmt.Println()
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
 
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	fmt.Printf("[START] Heap Alloc: %d MB, Objects cached: %d\n",
@@ -58,6 +71,7 @@ func main() {
 			time.Since(start).Round(time.Second),
 			m.Alloc/1024/1024,
 			len(cache))
+		fmt.Printf("           %s\n", gcpercent.Stats())
 	}
 
 	fmt.Println("\nLeak demonstrated. Cache grows unbounded.")
@@ -93,3 +107,13 @@ func continuouslyCacheObjects() {
 	}
 }
 
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This demonstrates the proper way to keep data from a request's context:
+// extract the values that are needed and let the context go, so the rest of
+// its chain can be collected when the request ends.
+
+// Upload is the request body, stored in the request's context by middleware
+type Upload struct {
+	Filename string
+	Body     []byte // 5 MB
+}
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	uploadKey
+)
+
+// AuditJob records a request to be written to the audit log later
+type AuditJob struct {
+	RequestID string // ✅ FIX: only what the audit log needs
+}
+
+var (
+	// Jobs wait here until a nightly batch writes them out
+	auditQueue []AuditJob
+)
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	go func() {
+		fmt.Println("pprof server: http://localhost:6060")
+		http.ListenAndServe("localhost:6060", debugMux)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	fmt.Println("Handling 100 uploads (5 MB each)...")
+
+	for i := 0; i < 100; i++ {
+		ctx := withUpload(context.Background(), i)
+		auditQueue = append(auditQueue, handleUploadCorrectly(ctx))
+	}
+
+	// Force GC
+	runtime.GC()
+	time.Sleep(100 * time.Millisecond)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	fmt.Printf("\n[AFTER Handling] Heap Alloc: %d MB\n", m.Alloc/1024/1024)
+	fmt.Printf("                   %s\n", gcpercent.Stats())
+	fmt.Printf("Audit queue holds only request IDs (100 × a few bytes)\n")
+	fmt.Printf("Contexts dropped, uploads freed by GC\n")
+	fmt.Println("\nPress Ctrl+C to stop")
+
+	// Keep running for profiling
+	select {}
+}
+
+// withUpload returns the context middleware would build for request n: a
+// request ID and the request body
+func withUpload(parent context.Context, n int) context.Context {
+	ctx := context.WithValue(parent, requestIDKey, fmt.Sprintf("req-%d", n))
+	return context.WithValue(ctx, uploadKey, &Upload{
+		Filename: fmt.Sprintf("upload_%d.bin", n),
+		Body:     make([]byte, 5*1024*1024),
+	})
+}
+
+func handleUploadCorrectly(ctx context.Context) AuditJob {
+	// ... store the upload ...
+
+	// ✅ FIX: copy the request ID out; ctx and its upload die with the request
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return AuditJob{RequestID: requestID}
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
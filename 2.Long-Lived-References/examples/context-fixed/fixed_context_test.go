@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestUploadReleased sets a finalizer on an upload as a GC sentinel. While a
+// job that stores the context is alive, the upload must survive GC. Once
+// only an extracted job is left, the finalizer must run.
+func TestUploadReleased(t *testing.T) {
+	collected := make(chan struct{})
+	ctx := withUpload(context.Background(), 1)
+	runtime.SetFinalizer(ctx.Value(uploadKey).(*Upload), func(*Upload) { close(collected) })
+
+	// The leaky version's job is the context itself. KeepAlive marks the end
+	// of its lifetime; after that only the extracted job is live.
+	held := ctx
+	job := handleUploadCorrectly(ctx)
+
+	if collectedAfterGC(collected) {
+		t.Error("upload collected while a stored context references it")
+	}
+	runtime.KeepAlive(held)
+
+	if !collectedAfterGC(collected) {
+		t.Errorf("upload survived GC with only the extracted job (%q) left", job.RequestID)
+	}
+	if job.RequestID != "req-1" {
+		t.Errorf("extracted job's request ID = %q, want req-1", job.RequestID)
+	}
+}
+
+// collectedAfterGC runs a few GCs and reports whether collected was closed by
+// the sentinel's finalizer. Finalizers run on their own goroutine after the
+// GC that finds the object unreachable, so it waits briefly after each one.
+func collectedAfterGC(collected <-chan struct{}) bool {
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			return true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example demonstrates the memory ballast pattern: a large, never-touched
+// []byte allocated at startup raises the live heap the GC sees, which pushes
+// the next GC trigger (2x live heap at GOGC=100) much higher. The same
+// allocation-heavy workload runs three times - plain, with ballast, and with
+// debug.SetGCPercent(200) - so you can compare GC cycles, pause time and GC CPU.
+
+type CachedObject struct {
+	Key       string
+	Data      []byte
+	Timestamp time.Time
+}
+
+var (
+	phaseDuration = flag.Duration("phase", 10*time.Second, "how long each phase runs")
+	ballastMB     = flag.Int("ballast", 256, "ballast size in MB")
+)
+
+// phaseResult captures what the GC did during one phase
+type phaseResult struct {
+	name       string
+	gcCycles   int64
+	pauseTotal time.Duration
+	gcCPU      float64 // seconds of CPU spent in the GC
+	heapAlloc  uint64
+	heapSys    uint64
+}
+
+func main() {
+	flag.Parse()
+
+	go func() {
+		fmt.Println("pprof server running on http://localhost:6060")
+		fmt.Println("Collect heap profile: curl http://localhost:6060/debug/pprof/heap > heap_ballast.pprof")
+		fmt.Println()
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
+			fmt.Printf("pprof server error: %v\n", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	if gogc := os.Getenv("GOGC"); gogc != "" {
+		fmt.Printf("NOTE: GOGC=%s is set in the environment; it applies to every phase\n\n", gogc)
+	}
+
+	// Count GC cycles as they happen rather than only sampling MemStats
+	var cycles atomic.Int64
+	startGCListener(func() { cycles.Add(1) })
+
+	var results []phaseResult
+
+	// Phase 1: default GC settings
+	results = append(results, runPhase("baseline (GOGC=100)", &cycles))
+
+	// Phase 2: ballast. The slice is never written, so the OS never backs
+	// its pages with physical memory, but the GC counts it as live heap.
+	ballast := make([]byte, *ballastMB<<20)
+	results = append(results, runPhase(fmt.Sprintf("ballast (%d MB)", *ballastMB), &cycles))
+	runtime.KeepAlive(ballast)
+	ballast = nil
+	runtime.GC()
+
+	// Phase 3: the same effect without ballast, using the GC percent knob.
+	// Running with GOGC=200 in the environment is equivalent.
+	old := debug.SetGCPercent(200)
+	results = append(results, runPhase("SetGCPercent(200)", &cycles))
+	debug.SetGCPercent(old)
+
+	fmt.Println("\n=== Comparison ===")
+	fmt.Printf("%-22s %10s %12s %10s %14s %12s\n", "phase", "GC cycles", "pause total", "GC CPU", "heap alloc", "heap sys")
+	for _, r := range results {
+		fmt.Printf("%-22s %10d %12v %9.3fs %11d MB %9d MB\n",
+			r.name, r.gcCycles, r.pauseTotal.Round(time.Microsecond), r.gcCPU,
+			r.heapAlloc/1024/1024, r.heapSys/1024/1024)
+	}
+
+	fmt.Println("\nBallast trades resident address space for fewer GC cycles.")
+	fmt.Println("SetGCPercent/GOGC scales the trigger with the live heap instead of a fixed offset,")
+	fmt.Println("so a real leak still grows the trigger - neither knob fixes a leak.")
+	fmt.Println("On Go 1.19+ prefer debug.SetMemoryLimit (GOMEMLIMIT) over ballast.")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// runPhase runs the allocation workload for one phase and reports GC activity
+func runPhase(name string, cycles *atomic.Int64) phaseResult {
+	runtime.GC()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	cyclesBefore := cycles.Load()
+	cpuBefore := gcCPUSeconds()
+
+	fmt.Printf("[PHASE] %s for %v\n", name, *phaseDuration)
+
+	done := make(chan struct{})
+	go allocateObjects(done)
+
+	ticker := time.NewTicker(2 * time.Second)
+	start := time.Now()
+	for time.Since(start) < *phaseDuration {
+		<-ticker.C
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Printf("[AFTER %v] Heap Alloc: %d MB  |  GC cycles: %d  |  Next GC at: %d MB\n",
+			time.Since(start).Round(time.Second),
+			m.Alloc/1024/1024,
+			cycles.Load()-cyclesBefore,
+			m.NextGC/1024/1024)
+	}
+	ticker.Stop()
+	close(done)
+
+	runtime.ReadMemStats(&after)
+	return phaseResult{
+		name:       name,
+		gcCycles:   cycles.Load() - cyclesBefore,
+		pauseTotal: time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+		gcCPU:      gcCPUSeconds() - cpuBefore,
+		heapAlloc:  after.HeapAlloc,
+		heapSys:    after.HeapSys,
+	}
+}
+
+// allocateObjects mimics example_cache.go's allocation rate (5000 objects of
+// 5 KB per second) but only keeps the most recent 1000, so the live heap is
+// small and stable and almost every allocation is garbage.
+func allocateObjects(done <-chan struct{}) {
+	recent := make([]*CachedObject, 1000)
+	ticker := time.NewTicker(200 * time.Microsecond)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		select {
+		case <-ticker.C:
+			obj := &CachedObject{
+				Key:       fmt.Sprintf("key_%d", i),
+				Data:      make([]byte, 5*1024),
+				Timestamp: time.Now(),
+			}
+			for j := range obj.Data {
+				obj.Data[j] = byte(j % 256)
+			}
+			recent[i%len(recent)] = obj
+		case <-done:
+			return
+		}
+	}
+}
+
+// startGCListener calls fn once after every GC cycle. It uses a finalizer on a
+// sentinel object that re-arms itself, since the runtime has no GC event hook.
+func startGCListener(fn func()) {
+	type sentinel struct{ _ [16]byte }
+	var arm func()
+	arm = func() {
+		s := &sentinel{}
+		runtime.SetFinalizer(s, func(*sentinel) {
+			fn()
+			arm()
+		})
+	}
+	arm()
+}
+
+// gcCPUSeconds returns the total CPU time spent in the GC so far
+func gcCPUSeconds() float64 {
+	sample := []metrics.Sample{{Name: "/cpu/classes/gc/total:cpu-seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return sample[0].Value.Float64()
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+// TestRecreatedMap fills and empties the map twice. The first time it is
+// only emptied, the second time it is also re-created. After a GC the
+// re-created map must retain less than a tenth of the emptied one's heap.
+func TestRecreatedMap(t *testing.T) {
+	const n = 500_000
+	fillAndEmpty := func() {
+		for i := range int64(n) {
+			sessions[i] = newSession(i)
+		}
+		for id := range sessions {
+			delete(sessions, id)
+		}
+	}
+
+	base := heapAllocBytes()
+	fillAndEmpty()
+	emptied := heapAllocBytes() - base
+
+	fillAndEmpty()
+	sessions = make(map[int64]Session)
+	recreated := heapAllocBytes() - base
+
+	if emptied <= 0 {
+		t.Fatalf("emptied map retains %d bytes after GC, want its buckets still held", emptied)
+	}
+	if recreated >= emptied/10 {
+		t.Errorf("re-created map retains %d KB after GC, want < %d KB (a tenth of the emptied map's)",
+			recreated/1024, emptied/10/1024)
+	}
+	t.Logf("re-creating the map released %d MB of buckets", (emptied-recreated)/1024/1024)
+}
+
+// heapAllocBytes forces a GC and returns the live heap as an int64, so
+// differences between two readings can go negative
+func heapAllocBytes() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
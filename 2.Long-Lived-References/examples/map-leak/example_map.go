@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This demonstrates that deleting keys from a map doesn't shrink it: len
+// drops to zero, but the buckets allocated while the map grew stay in place
+// for as long as the map itself is reachable.
+
+// Session is stored by value, so each entry lives inside the map's buckets
+type Session struct {
+	UserID   int64
+	Created  int64
+	LastSeen int64
+	Token    [40]byte
+}
+
+var (
+	sessions = make(map[int64]Session)
+
+	numSessions = flag.Int("sessions", 2_000_000, "how many sessions to add before deleting them all")
+)
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	go func() {
+		fmt.Println("pprof server: http://localhost:6060")
+		http.ListenAndServe("localhost:6060", debugMux)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	fmt.Printf("Adding %d sessions...\n", *numSessions)
+	for i := 0; i < *numSessions; i++ {
+		sessions[int64(i)] = newSession(int64(i))
+	}
+	fmt.Printf("\n[AFTER Adding] Heap Alloc: %d MB  |  len(sessions): %d\n", heapAllocMB(), len(sessions))
+
+	// Every session expires
+	for id := range sessions {
+		delete(sessions, id)
+	}
+
+	// BUG: the map is empty but keeps every bucket it grew
+	fmt.Printf("[AFTER Deleting] Heap Alloc: %d MB  |  len(sessions): %d\n", heapAllocMB(), len(sessions))
+	fmt.Printf("                   %s\n", gcpercent.Stats())
+	fmt.Println("All sessions deleted, but the map's buckets are still in memory!")
+	fmt.Println("\nPress Ctrl+C to stop")
+
+	// Keep running for profiling
+	select {}
+}
+
+func newSession(id int64) Session {
+	now := time.Now().UnixNano()
+	s := Session{UserID: id, Created: now, LastSeen: now}
+	copy(s.Token[:], strconv.FormatInt(id, 36))
+	return s
+}
+
+// heapAllocMB forces a GC and returns the live heap in MB
+func heapAllocMB() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc / 1024 / 1024
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
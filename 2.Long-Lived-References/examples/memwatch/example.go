@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example is a heap watchdog with two alert modes. Threshold mode fires
+// once Alloc passes a fixed size, like the 64 MB heap delta behind /healthz's
+// verdict. Growth-rate mode fires only when Alloc keeps rising faster than a
+// rate for a whole window. Two workloads show where a threshold goes wrong:
+// a one-time 64 MB allocation that then stays flat, and a slow leak that is
+// still under the threshold when the run ends.
+
+// WatchMode selects what a Watchdog alerts on
+type WatchMode int
+
+const (
+	ModeThreshold  WatchMode = iota // Alloc above a fixed size
+	ModeGrowthRate                  // Alloc rising faster than a rate across a window
+)
+
+func (m WatchMode) String() string {
+	if m == ModeThreshold {
+		return "threshold"
+	}
+	return "growth rate"
+}
+
+// rateSegments is how many parts a growth-rate window is split into. Each
+// part must grow on the last, so a single jump, which lifts one part over
+// the one before, can't fire the alert.
+const rateSegments = 4
+
+// WatchdogConfig holds a Watchdog's sampling interval and the settings of
+// both modes. A mode whose limit is 0 is off.
+type WatchdogConfig struct {
+	Interval   time.Duration // how often Alloc is sampled
+	Threshold  uint64        // threshold mode: bytes
+	GrowthRate float64       // growth-rate mode: bytes per second
+	Window     time.Duration // growth-rate mode: how long the growth must last
+}
+
+// Alert is passed to a Watchdog's callback when a mode fires
+type Alert struct {
+	Mode  WatchMode
+	At    time.Time
+	Alloc uint64
+	Rate  float64 // bytes per second across the window; growth-rate alerts only
+}
+
+func (a Alert) String() string {
+	if a.Mode == ModeGrowthRate {
+		return fmt.Sprintf("%s alert: Alloc %d MB, growing %.1f MB/s", a.Mode, a.Alloc>>20, a.Rate/(1<<20))
+	}
+	return fmt.Sprintf("%s alert: Alloc %d MB", a.Mode, a.Alloc>>20)
+}
+
+// allocSample is one reading of MemStats.Alloc
+type allocSample struct {
+	at    time.Time
+	alloc uint64
+}
+
+// Watchdog samples MemStats.Alloc and calls onAlert when a mode's condition
+// starts to hold. A mode fires once, then again only after its condition has
+// cleared, so a leak that keeps growing doesn't repeat the alert every sample.
+type Watchdog struct {
+	cfg     WatchdogConfig
+	onAlert func(Alert)
+
+	mu      sync.Mutex
+	samples []allocSample // the last Window of samples, oldest first
+	firing  [2]bool       // per mode: fired and not cleared since
+	alerts  [2]int        // per mode: how many times it fired
+	alloc   uint64        // the latest sample
+	rate    float64       // growth across the latest full window, bytes per second
+}
+
+// NewWatchdog returns a Watchdog that calls onAlert, on the goroutine running
+// Run, each time a mode fires
+func NewWatchdog(cfg WatchdogConfig, onAlert func(Alert)) *Watchdog {
+	return &Watchdog{cfg: cfg, onAlert: onAlert}
+}
+
+// Run samples Alloc every Interval until ctx is done
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			runtime.ReadMemStats(&m)
+			w.observe(now, m.Alloc)
+		}
+	}
+}
+
+// observe records one sample and evaluates both modes. It takes the time as
+// an argument so TestWatchdog can drive it with a simulated clock.
+func (w *Watchdog) observe(at time.Time, alloc uint64) {
+	w.mu.Lock()
+	var fired []Alert
+	w.alloc = alloc
+
+	if w.cfg.Threshold > 0 {
+		if w.update(ModeThreshold, alloc > w.cfg.Threshold) {
+			fired = append(fired, Alert{Mode: ModeThreshold, At: at, Alloc: alloc})
+		}
+	}
+
+	if w.cfg.GrowthRate > 0 {
+		w.samples = append(w.samples, allocSample{at, alloc})
+		// Keep one sample at or before the window's start, so a full
+		// history spans the whole window
+		start := at.Add(-w.cfg.Window)
+		drop := 0
+		for drop+1 < len(w.samples) && !w.samples[drop+1].at.After(start) {
+			drop++
+		}
+		w.samples = append(w.samples[:0], w.samples[drop:]...)
+
+		sustained, rate := w.growth(start)
+		w.rate = rate
+		if w.update(ModeGrowthRate, sustained) {
+			fired = append(fired, Alert{Mode: ModeGrowthRate, At: at, Alloc: alloc, Rate: rate})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, a := range fired {
+		w.onAlert(a)
+	}
+}
+
+// update records whether mode's condition holds and reports whether that
+// makes it fire. The caller holds w.mu.
+func (w *Watchdog) update(mode WatchMode, holds bool) bool {
+	fire := holds && !w.firing[mode]
+	w.firing[mode] = holds
+	if fire {
+		w.alerts[mode]++
+	}
+	return fire
+}
+
+// growth splits the window into rateSegments parts and takes the lowest
+// Alloc in each. Alloc also counts garbage, which rises between GCs and
+// falls at each one; the lowest reading in a part is the closest sample to
+// the live heap. The growth is sustained if every part's floor is above the
+// one before by more than GrowthRate. It returns the rate between the first
+// and last floors, or false and 0 until the samples span a whole window. The
+// caller holds w.mu.
+func (w *Watchdog) growth(start time.Time) (bool, float64) {
+	if len(w.samples) < 2 || w.samples[0].at.After(start) {
+		return false, 0
+	}
+	segment := w.cfg.Window / rateSegments
+	var floors [rateSegments]uint64
+	var seen [rateSegments]bool
+	for _, s := range w.samples {
+		i := int(s.at.Sub(start) / segment)
+		if i < 0 {
+			i = 0
+		}
+		if i >= rateSegments {
+			i = rateSegments - 1
+		}
+		if !seen[i] || s.alloc < floors[i] {
+			floors[i], seen[i] = s.alloc, true
+		}
+	}
+
+	sustained := true
+	for i := 1; i < rateSegments; i++ {
+		if !seen[i] || !seen[i-1] {
+			return false, 0
+		}
+		grown := float64(floors[i]) - float64(floors[i-1])
+		if grown/segment.Seconds() <= w.cfg.GrowthRate {
+			sustained = false
+		}
+	}
+	rate := (float64(floors[rateSegments-1]) - float64(floors[0])) / (segment.Seconds() * (rateSegments - 1))
+	return sustained, rate
+}
+
+// Alerts returns how many times mode has fired
+func (w *Watchdog) Alerts(mode WatchMode) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.alerts[mode]
+}
+
+// Rate returns the growth across the latest full window, in bytes per second
+func (w *Watchdog) Rate() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rate
+}
+
+// Summary reports both modes for /debug/summary
+func (w *Watchdog) Summary() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return map[string]interface{}{
+		"alloc_bytes":          w.alloc,
+		"threshold_bytes":      w.cfg.Threshold,
+		"threshold_alerts":     w.alerts[ModeThreshold],
+		"growth_bytes_per_sec": w.rate,
+		"growth_limit":         w.cfg.GrowthRate,
+		"growth_window":        w.cfg.Window.String(),
+		"growth_alerts":        w.alerts[ModeGrowthRate],
+	}
+}
+
+var (
+	thresholdMB = flag.Int("threshold", 48, "threshold mode: alert when Alloc exceeds this many MB (0 = off)")
+	rateMB      = flag.Float64("rate", 1, "growth-rate mode: alert when Alloc grows faster than this many MB/s across -window (0 = off)")
+	window      = flag.Duration("window", 4*time.Second, "growth-rate mode: how long the growth must last")
+	interval    = flag.Duration("interval", 100*time.Millisecond, "how often the watchdog samples Alloc")
+	runFor      = flag.Duration("run", 8*time.Second, "how long each workload runs")
+)
+
+// Slow leak: leakChunk every leakEvery, 2.5 MB/s
+const (
+	leakChunk = 256 << 10
+	leakEvery = 100 * time.Millisecond
+	spikeSize = 64 << 20
+)
+
+// workload allocates on its own goroutine until ctx is done, and returns what
+// it allocated so the caller can release it
+type workload struct {
+	name  string
+	leaks bool // whether the growth-rate mode should fire
+	run   func(ctx context.Context) [][]byte
+}
+
+var workloads = []workload{
+	{"one-time allocation: 64 MB, then flat", false, func(ctx context.Context) [][]byte {
+		held := [][]byte{make([]byte, spikeSize)}
+		<-ctx.Done()
+		return held
+	}},
+	{"slow leak: 256 KB every 100ms (2.5 MB/s)", true, func(ctx context.Context) [][]byte {
+		var leaked [][]byte
+		ticker := time.NewTicker(leakEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return leaked
+			case <-ticker.C:
+				leaked = append(leaked, make([]byte, leakChunk))
+			}
+		}
+	}},
+}
+
+func main() {
+	flag.Parse()
+
+	go func() {
+		fmt.Println("pprof server running on http://localhost:6060")
+		fmt.Println("Watchdog state: curl http://localhost:6060/debug/summary")
+		fmt.Println()
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
+			fmt.Printf("pprof server error: %v\n", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	cfg := WatchdogConfig{
+		Interval:   *interval,
+		Threshold:  uint64(*thresholdMB) << 20,
+		GrowthRate: *rateMB * (1 << 20),
+		Window:     *window,
+	}
+	fmt.Printf("Threshold: %d MB  |  Growth rate: %.1f MB/s sustained over %v\n", *thresholdMB, *rateMB, *window)
+
+	for _, wl := range workloads {
+		fmt.Printf("\n=== %s ===\n", wl.name)
+		runtime.GC()
+		start := time.Now()
+		dog := NewWatchdog(cfg, func(a Alert) {
+			fmt.Printf("[%v] %s\n", a.At.Sub(start).Round(100*time.Millisecond), a)
+		})
+		summary.Register("watchdog", dog)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *runFor)
+		go dog.Run(ctx)
+		done := make(chan [][]byte)
+		go func() { done <- wl.run(ctx) }()
+
+		ticker := time.NewTicker(2 * time.Second)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				waiting = false
+			case <-ticker.C:
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				fmt.Printf("[%v] Alloc: %d MB  |  Growth over the last %v: %.1f MB/s\n",
+					time.Since(start).Round(time.Second), m.Alloc>>20, *window, dog.Rate()/(1<<20))
+			}
+		}
+		ticker.Stop()
+		cancel()
+		held := <-done
+		fmt.Printf("Alerts: threshold %d, growth rate %d\n", dog.Alerts(ModeThreshold), dog.Alerts(ModeGrowthRate))
+		runtime.KeepAlive(held)
+	}
+
+	fmt.Println("\nThe threshold fired on an allocation that never grew, and missed the leak")
+	fmt.Println("because the run ended before it got big. The growth rate did the opposite.")
+	fmt.Println("Run both: a rate alert catches slow leaks early, a threshold still guards a hard limit.")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestWatchdog feeds the watchdog simulated samples, with a GC sawtooth of
+// garbage on top of the live heap
+func TestWatchdog(t *testing.T) {
+	cfg := WatchdogConfig{
+		Interval:   100 * time.Millisecond,
+		Threshold:  48 << 20,
+		GrowthRate: 1 << 20,
+		Window:     4 * time.Second,
+	}
+
+	// simulate samples live(at) every 100ms for d, plus up to 8 MB of garbage
+	// that builds up and is collected every 700ms
+	simulate := func(d time.Duration, live func(at time.Duration) uint64) (*Watchdog, []Alert) {
+		var alerts []Alert
+		dog := NewWatchdog(cfg, func(a Alert) { alerts = append(alerts, a) })
+		t0 := time.Unix(0, 0)
+		for at := time.Duration(0); at <= d; at += cfg.Interval {
+			garbage := uint64(at%(700*time.Millisecond)) * (8 << 20) / uint64(700*time.Millisecond)
+			dog.observe(t0.Add(at), live(at)+garbage)
+		}
+		return dog, alerts
+	}
+	const base = 4 << 20
+
+	// A steady 2 MB/s leak, under the threshold until 22s
+	dog, alerts := simulate(12*time.Second, func(at time.Duration) uint64 {
+		return base + uint64(at.Seconds()*(2<<20))
+	})
+	check(t, fmt.Sprintf("steady 2 MB/s leak: %d growth-rate alert(s) (want 1)", dog.Alerts(ModeGrowthRate)),
+		dog.Alerts(ModeGrowthRate) == 1)
+	if len(alerts) > 0 {
+		check(t, fmt.Sprintf("the alert fired after one full window, at %v, measuring %.1f MB/s",
+			alerts[0].At.Sub(time.Unix(0, 0)), alerts[0].Rate/(1<<20)),
+			alerts[0].At.Sub(time.Unix(0, 0)) >= cfg.Window && alerts[0].Rate > 1.5*(1<<20) && alerts[0].Rate < 2.5*(1<<20))
+	}
+	check(t, fmt.Sprintf("threshold mode stayed quiet (%d alerts)", dog.Alerts(ModeThreshold)),
+		dog.Alerts(ModeThreshold) == 0)
+
+	// One 100 MB allocation at 2s, then flat
+	dog, _ = simulate(12*time.Second, func(at time.Duration) uint64 {
+		if at >= 2*time.Second {
+			return base + 100<<20
+		}
+		return base
+	})
+	check(t, fmt.Sprintf("one 100 MB allocation, then flat: %d growth-rate alerts (want 0)", dog.Alerts(ModeGrowthRate)),
+		dog.Alerts(ModeGrowthRate) == 0)
+	check(t, fmt.Sprintf("threshold mode fired on it (%d alert)", dog.Alerts(ModeThreshold)),
+		dog.Alerts(ModeThreshold) == 1)
+
+	// Growth just under the rate
+	dog, _ = simulate(12*time.Second, func(at time.Duration) uint64 {
+		return base + uint64(at.Seconds()*(0.8*(1<<20)))
+	})
+	check(t, fmt.Sprintf("0.8 MB/s growth, under the 1 MB/s limit: %d growth-rate alerts (want 0)", dog.Alerts(ModeGrowthRate)),
+		dog.Alerts(ModeGrowthRate) == 0)
+
+	// A leak that stops and starts again fires twice
+	dog, _ = simulate(24*time.Second, func(at time.Duration) uint64 {
+		switch {
+		case at < 8*time.Second:
+			return base + uint64(at.Seconds()*(2<<20))
+		case at < 16*time.Second:
+			return base + 16<<20
+		default:
+			return base + 16<<20 + uint64((at-16*time.Second).Seconds()*(2<<20))
+		}
+	})
+	check(t, fmt.Sprintf("leak, pause, leak: %d growth-rate alerts (want 2, one per episode)", dog.Alerts(ModeGrowthRate)),
+		dog.Alerts(ModeGrowthRate) == 2)
+}
+
+// TestWatchdogWorkloads runs the watchdog against the real workloads on a 2s
+// window: only the slow leak may fire the growth-rate alert
+func TestWatchdogWorkloads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs each workload for 3 seconds")
+	}
+	short := WatchdogConfig{Interval: 50 * time.Millisecond, Threshold: 48 << 20, GrowthRate: 1 << 20, Window: 2 * time.Second}
+	for _, wl := range workloads {
+		runtime.GC()
+		dog := NewWatchdog(short, func(Alert) {})
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		go dog.Run(ctx)
+		held := wl.run(ctx)
+		cancel()
+		want := 0
+		if wl.leaks {
+			want = 1
+		}
+		check(t, fmt.Sprintf("real %s: %d growth-rate alert(s) (want %d), growth %.1f MB/s",
+			wl.name, dog.Alerts(ModeGrowthRate), want, dog.Rate()/(1<<20)),
+			dog.Alerts(ModeGrowthRate) == want)
+		runtime.KeepAlive(held)
+	}
+}
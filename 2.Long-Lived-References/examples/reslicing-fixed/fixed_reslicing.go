@@ -1,11 +1,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sliceutil"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This demonstrates the proper way to handle slice reslicing by copying
@@ -16,18 +24,25 @@ type FileHeader struct {
 	Header []byte
 }
 
-var (
-	headers []FileHeader
-)
+var headers []FileHeader
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
 	go func() {
 		fmt.Println("pprof server: http://localhost:6060")
-		http.ListenAndServe("localhost:6060", nil)
+		http.ListenAndServe("localhost:6060", debugMux)
 	}()
 
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	fmt.Println("Processing 100 files (10 MB each)...")
 
 	// Process 100 files, keeping only headers
@@ -44,6 +59,7 @@ func main() {
 	runtime.ReadMemStats(&m)
 
 	fmt.Printf("\n[AFTER Processing] Heap Alloc: %d MB\n", m.Alloc/1024/1024)
+	fmt.Printf("                   %s\n", gcpercent.Stats())
 	fmt.Printf("Kept only headers (1 KB each × 100 = 0.1 MB)\n")
 	fmt.Printf("Headers properly copied, arrays freed by GC\n")
 	fmt.Println("\nPress Ctrl+C to stop")
@@ -63,8 +79,7 @@ func processFileCorrectly(fileNum int) FileHeader {
 
 	// Extract and COPY header to new slice
 	// This allows fileData to be garbage collected
-	header := make([]byte, 1024)
-	copy(header, fileData[:1024])
+	header := sliceutil.CloneN(fileData, 1024)
 
 	// fileData can now be GC'd because no references remain
 
@@ -73,3 +88,14 @@ func processFileCorrectly(fileNum int) FileHeader {
 		Header: header, // Only 1 KB, independent of fileData
 	}
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
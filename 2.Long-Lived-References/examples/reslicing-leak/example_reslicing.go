@@ -1,11 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This demonstrates the slice reslicing memory trap where small slices
@@ -21,13 +27,20 @@ var (
 )
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	go func() {
 		fmt.Println("pprof server: http://localhost:6060")
-		http.ListenAndServe("localhost:6060", nil)
+		http.ListenAndServe("localhost:6060", debugMux)
 	}()
 
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	fmt.Println("Processing 100 files (10 MB each)...")
 
 	// Process 100 files, keeping only headers
@@ -44,6 +57,7 @@ func main() {
 	runtime.ReadMemStats(&m)
 
 	fmt.Printf("\n[AFTER Processing] Heap Alloc: %d MB\n", m.Alloc/1024/1024)
+	fmt.Printf("                   %s\n", gcpercent.Stats())
 	fmt.Printf("Kept only headers (1 KB each × 100 = 0.1 MB expected)\n")
 	fmt.Printf("But full arrays still in memory! (~1000 MB leaked)\n")
 	fmt.Println("\nPress Ctrl+C to stop")
@@ -70,3 +84,14 @@ func processFileBadly(fileNum int) FileHeader {
 		Header: header, // Keeps entire 10 MB array alive
 	}
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
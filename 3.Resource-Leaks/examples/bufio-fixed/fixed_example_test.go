@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestSegmentContents writes 20 segments into a temporary directory and
+// reads them back. Every segment must hold every record, in order and
+// intact, and no file may be left open.
+func TestSegmentContents(t *testing.T) {
+	const segments = 20
+
+	dir := t.TempDir()
+	// The first file opened makes the runtime open its poller's FDs (an
+	// epoll instance and an eventfd on Linux), which would otherwise count
+	// against the segments. Open and close one before the baseline.
+	warm, err := os.Create(filepath.Join(dir, "warmup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warm.Close()
+	fdsBefore := fdcount.Count()
+	e := &Exporter{dir: dir}
+	for i := 0; i < segments; i++ {
+		if err := e.writeSegment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := *recordsPerSegment
+	complete, anyPartial := 0, false
+	for i := 1; i <= segments; i++ {
+		n, partial, err := readSegment(filepath.Join(dir, fmt.Sprintf("segment-%06d.log", i)), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		complete += n
+		anyPartial = anyPartial || partial
+		if i == 1 {
+			t.Logf("segment-000001.log: %d of %d records complete, partial last record: %v", n, want, partial)
+		}
+	}
+	check(t, fmt.Sprintf("all %d records are in their files (%d found)", segments*want, complete),
+		complete == segments*want)
+	check(t, "no segment ends in a partial record", !anyPartial)
+	check(t, fmt.Sprintf("bytes on disk equal bytes written (%d KB)", e.bytesOnDisk/1024), e.bytesOnDisk == e.bytesWritten)
+	fdsAfter := fdcount.Count()
+	check(t, fmt.Sprintf("every segment file was closed (open FDs %d -> %d)", fdsBefore, fdsAfter), fdsAfter == fdsBefore)
+}
+
+// readSegment counts the complete, well-formed records of segment seg in the
+// file at path, and reports whether it ends part-way through a record
+func readSegment(path string, seg int) (complete int, partial bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := 0; len(data) >= recordSize && bytes.Equal(data[:recordSize], record(seg, i)); i++ {
+		complete++
+		data = data[recordSize:]
+	}
+	return complete, len(data) > 0, nil
+}
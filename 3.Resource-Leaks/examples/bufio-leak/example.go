@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example shows bufio.Writers that are never flushed. A bufio.Writer
+// only writes to its file when its buffer fills, so whatever is left in the
+// buffer when the program stops using it never reaches the disk: nothing
+// flushes it on Close, on garbage collection or on exit. Keeping the writers
+// around makes it a leak as well, holding a 64 KB buffer and an open file
+// per segment.
+
+// Exporter writes batches of records to segment files, one file per batch
+// BUG: segments are never flushed or closed, and every one is kept
+type Exporter struct {
+	mu           sync.Mutex
+	dir          string
+	segmentsMade int
+	bytesWritten int64 // handed to the bufio.Writers
+	bytesOnDisk  int64 // in the segment files once each batch was written
+	paths        []string
+	open         []*segment // BUG: grows by one writer and one file per batch
+}
+
+// segment is an open segment file and the writer in front of it
+type segment struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+const (
+	// writerBufferSize is the bufio.Writer buffer per segment
+	writerBufferSize = 64 * 1024
+	// recordSize is the length of every record, newline included
+	recordSize = 100
+	// maxSegmentsOnDisk is how many segment files rotation keeps
+	maxSegmentsOnDisk = 100
+)
+
+var (
+	recordsPerSegment = flag.Int("records", 1000, "records per segment file, 100 bytes each")
+	runFor            = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+)
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6060")
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
+	}()
+
+	dir, err := os.MkdirTemp("", "bufio-leak")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exporter := &Exporter{dir: dir}
+	summary.Register("exporter", exporter)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  Open FDs: %d  |  Segments in %s\n",
+		runtime.NumGoroutine(), fdcount.Count(), dir)
+	fmt.Printf("Each segment: %d records (%d KB) through a %d KB bufio.Writer\n",
+		*recordsPerSegment, *recordsPerSegment*recordSize/1024, writerBufferSize/1024)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(40 * time.Millisecond) // 25 segments/second
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	reportInterval := 2 * time.Second
+	lastReport := startTime
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nWorkload stopped")
+			exporter.report("[FINAL]")
+			fmt.Println("The buffered records are lost: exiting doesn't flush a bufio.Writer")
+			return
+		case <-ticker.C:
+		}
+
+		// BUG: writeSegment leaves the tail of every batch in its buffer
+		if err := exporter.writeSegment(); err != nil {
+			log.Printf("Error writing segment: %v", err)
+		}
+
+		if time.Since(lastReport) >= reportInterval {
+			exporter.report(fmt.Sprintf("[AFTER %.0fs]", time.Since(startTime).Seconds()))
+			lastReport = time.Now()
+		}
+	}
+}
+
+// writeSegment writes one batch of records to a new segment file
+func (e *Exporter) writeSegment() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.segmentsMade++
+	path := filepath.Join(e.dir, fmt.Sprintf("segment-%06d.log", e.segmentsMade))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, writerBufferSize)
+	for i := 0; i < *recordsPerSegment; i++ {
+		n, err := w.Write(record(e.segmentsMade, i))
+		e.bytesWritten += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	// BUG: no Flush and no Close. The writer has passed every full buffer
+	// on to the file, but the last partial one stays in memory, and the
+	// segment is kept "in case more records arrive" - they never do.
+	e.open = append(e.open, &segment{f: f, w: w})
+
+	if info, err := os.Stat(path); err == nil {
+		e.bytesOnDisk += info.Size()
+	}
+	e.rotate(path)
+	return nil
+}
+
+// rotate deletes segment files beyond maxSegmentsOnDisk. Deleting a file that
+// is still open doesn't free it: the kernel keeps it until its descriptor is
+// closed, and lsof lists it as (deleted).
+func (e *Exporter) rotate(path string) {
+	e.paths = append(e.paths, path)
+	for len(e.paths) > maxSegmentsOnDisk {
+		os.Remove(e.paths[0])
+		e.paths = e.paths[1:]
+	}
+}
+
+// record returns record i of segment seg, padded to recordSize bytes
+func record(seg, i int) []byte {
+	r := fmt.Appendf(make([]byte, 0, recordSize), "segment=%06d record=%06d payload=", seg, i)
+	r = append(r, bytes.Repeat([]byte("x"), recordSize-1-len(r))...)
+	return append(r, '\n')
+}
+
+// report prints the periodic status lines under label
+func (e *Exporter) report(label string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Printf("%s Segments: %d  |  Open FDs: %d  |  Heap Alloc: %d MB\n",
+		label, e.segmentsMade, fdcount.Count(), m.HeapAlloc/1024/1024)
+	fmt.Printf("           Written: %d KB  |  On disk: %d KB  |  Lost: %.0f%%\n",
+		e.bytesWritten/1024, e.bytesOnDisk/1024, e.lostPercent())
+	fmt.Printf("           Retained writers: %d (%d MB of buffers)\n",
+		len(e.open), len(e.open)*writerBufferSize/1024/1024)
+	fmt.Printf("           %s\n", gcpercent.Stats())
+}
+
+// lostPercent is the share of written bytes that never reached a file
+func (e *Exporter) lostPercent() float64 {
+	if e.bytesWritten == 0 {
+		return 0
+	}
+	return 100 * float64(e.bytesWritten-e.bytesOnDisk) / float64(e.bytesWritten)
+}
+
+// Summary reports the exporter's state in /debug/summary
+func (e *Exporter) Summary() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return map[string]interface{}{
+		"segments":         e.segmentsMade,
+		"bytes_written":    e.bytesWritten,
+		"bytes_on_disk":    e.bytesOnDisk,
+		"retained_writers": len(e.open),
+		"buffered_bytes":   e.buffered(),
+	}
+}
+
+// buffered returns the bytes waiting in the retained writers' buffers
+func (e *Exporter) buffered() int {
+	n := 0
+	for _, s := range e.open {
+		n += s.w.Buffered()
+	}
+	return n
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestSegmentContents writes 20 segments into a temporary directory and
+// reads them back. Every segment is expected to be truncated: the file ends
+// at the last full buffer, part-way through a record, and the rest of the
+// batch is only in memory.
+func TestSegmentContents(t *testing.T) {
+	const segments = 20
+
+	dir := t.TempDir()
+	e := &Exporter{dir: dir}
+	for i := 0; i < segments; i++ {
+		if err := e.writeSegment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := *recordsPerSegment
+	truncated, lostRecords := 0, 0
+	for i := 1; i <= segments; i++ {
+		complete, partial, err := readSegment(filepath.Join(dir, fmt.Sprintf("segment-%06d.log", i)), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete < want {
+			truncated++
+			lostRecords += want - complete
+		}
+		if i == 1 {
+			t.Logf("segment-000001.log: %d of %d records complete, partial last record: %v", complete, want, partial)
+		}
+	}
+	check(t, fmt.Sprintf("all %d segments are truncated (%d)", segments, truncated), truncated == segments)
+	check(t, fmt.Sprintf("%d of %d records never reached a file", lostRecords, segments*want), lostRecords > 0)
+	check(t, fmt.Sprintf("the missing %d KB is still in %d retained writers", e.buffered()/1024, len(e.open)),
+		len(e.open) == segments && int64(e.buffered()) == e.bytesWritten-e.bytesOnDisk)
+}
+
+// readSegment counts the complete, well-formed records of segment seg in the
+// file at path, and reports whether it ends part-way through a record
+func readSegment(path string, seg int) (complete int, partial bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := 0; len(data) >= recordSize && bytes.Equal(data[:recordSize], record(seg, i)); i++ {
+		complete++
+		data = data[recordSize:]
+	}
+	return complete, len(data) > 0, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example fixes the downloads in download-leak. Each body is streamed
+// into the hash through one fixed buffer per download, so memory no longer
+// grows with the body size. A body larger than -max-mb is refused: from its
+// Content-Length before reading anything, or by io.LimitReader when the
+// length isn't declared. Every body is closed, on error paths too.
+
+// Downloader fetches /api/big repeatedly and checksums each body
+// FIXED: bodies are streamed through a fixed buffer, capped at maxBytes and
+// always closed
+type Downloader struct {
+	client   *http.Client
+	url      string
+	maxBytes int64
+	heap     heapSampler
+
+	downloads int64 // bodies read and checksummed
+	failed    int64
+	bytes     int64 // body bytes hashed
+}
+
+// Download flags, identical in download-leak and download-fixed
+var (
+	sizeMB      = flag.Int("size-mb", 200, "size of each /api/big body in MB")
+	concurrency = flag.Int("concurrency", 4, "downloads in flight at once")
+	failEvery   = flag.Int("fail-every", 5, "the mock API answers every nth download with 503 and an error page (0 = never)")
+	runFor      = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+)
+
+// errorPageSize is the size of the mock API's 503 body
+const errorPageSize = 64 << 10
+
+var maxMB = flag.Int("max-mb", 256, "refuse bodies larger than this many MB")
+
+// errTooLarge is returned for a body over the Downloader's limit
+var errTooLarge = errors.New("body over the size limit")
+
+// errorDrainMax is the most of an error response's body read before Close,
+// so its connection can be reused; see http-nodrain-fixed
+const errorDrainMax = 1 << 20
+
+// copyBufferSize is the size of each download's buffer
+const copyBufferSize = 32 << 10
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	server, err := startMockServer("127.0.0.1:8091", *failEvery)
+	if err != nil {
+		log.Fatalf("Mock server error: %v", err)
+	}
+	defer server.Close()
+	d := NewDownloader(fmt.Sprintf("http://127.0.0.1:8091/api/big?bytes=%d", int64(*sizeMB)<<20), int64(*maxMB)<<20)
+	summary.Register("downloads", d)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	baseline := health.Read()
+	debugMux.HandleFunc("/healthz", health.Handler(baseline))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  URL: %s  |  Body: %d MB  |  Max: %d MB  |  Concurrency: %d  |  Fail every: %d\n",
+		runtime.NumGoroutine(), d.url, *sizeMB, *maxMB, *concurrency, *failEvery)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := sighandler.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	go d.heap.run(ctx, 10*time.Millisecond)
+	for i := 0; i < *concurrency; i++ {
+		go d.run(ctx)
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			if sighandler.Terminated(ctx) {
+				sighandler.LogLeakDump("/tmp/leakdump")
+			}
+			fmt.Println("\nWorkload stopped")
+			d.report("[FINAL]", baseline.OpenFDs, time.Since(start))
+			return
+		case <-ticker.C:
+		}
+		d.report(fmt.Sprintf("[AFTER %.0fs]", time.Since(start).Seconds()), baseline.OpenFDs, time.Since(start))
+
+		if d.heap.Peak() < int64(*sizeMB)<<20 {
+			fmt.Printf("✓ No leak! Peak heap stays below one body (%d MB)\n", *sizeMB)
+		}
+	}
+}
+
+// NewDownloader returns a Downloader for url that refuses bodies over
+// maxBytes
+func NewDownloader(url string, maxBytes int64) *Downloader {
+	return &Downloader{
+		client:   &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}},
+		url:      url,
+		maxBytes: maxBytes,
+	}
+}
+
+// run downloads until ctx is done, reusing one buffer
+func (d *Downloader) run(ctx context.Context) {
+	buf := make([]byte, copyBufferSize)
+	for ctx.Err() == nil {
+		n, _, err := d.download(ctx, buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				atomic.AddInt64(&d.failed, 1)
+			}
+			continue
+		}
+		atomic.AddInt64(&d.downloads, 1)
+		atomic.AddInt64(&d.bytes, n)
+	}
+}
+
+// download fetches d.url through buf and returns its size and SHA-256
+func (d *Downloader) download(ctx context.Context, buf []byte) (int64, string, error) {
+	return streamDownload(ctx, d.client, d.url, d.maxBytes, buf)
+}
+
+// streamDownload fetches url and hashes its body through buf, so memory use
+// doesn't depend on the body's size. A body over maxBytes fails with
+// errTooLarge: before reading, if its Content-Length says so, or once
+// maxBytes+1 bytes have been read, if it doesn't. The count returned is the
+// bytes read.
+func streamDownload(ctx context.Context, client *http.Client, url string, maxBytes int64, buf []byte) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	// FIX: closed on every path, after the success and errors alike
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Read the error page so the connection goes back to the pool
+		io.CopyN(io.Discard, resp.Body, errorDrainMax)
+		return 0, "", fmt.Errorf("download: %s", resp.Status)
+	}
+	// FIX: a declared length over the limit is refused before reading. The
+	// body is left unread, so its connection is dropped, not reused.
+	if resp.ContentLength > maxBytes {
+		return 0, "", fmt.Errorf("%w: Content-Length %d, limit %d", errTooLarge, resp.ContentLength, maxBytes)
+	}
+
+	// FIX: stream into the hash through buf. One byte past the limit is
+	// enough to tell an over-limit body from one that is exactly at it.
+	h := sha256.New()
+	n, err := io.CopyBuffer(h, io.LimitReader(resp.Body, maxBytes+1), buf)
+	if err != nil {
+		return n, "", err
+	}
+	if n > maxBytes {
+		return n, "", fmt.Errorf("%w: more than %d bytes", errTooLarge, maxBytes)
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return n, "", fmt.Errorf("download: read %d bytes, Content-Length %d", n, resp.ContentLength)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Summary reports download counts and peak heap for /debug/summary
+func (d *Downloader) Summary() map[string]interface{} {
+	return map[string]interface{}{
+		"downloads":    atomic.LoadInt64(&d.downloads),
+		"failed":       atomic.LoadInt64(&d.failed),
+		"bytes":        atomic.LoadInt64(&d.bytes),
+		"peak_heap_mb": d.heap.Peak() >> 20,
+	}
+}
+
+// report prints the periodic status lines under label
+func (d *Downloader) report(label string, baseFDs int, elapsed time.Duration) {
+	bytes := atomic.LoadInt64(&d.bytes)
+	fmt.Printf("%s Goroutines: %d  |  FDs: %+d  |  Downloads: %d ok, %d failed\n",
+		label, runtime.NumGoroutine(), fdcount.Count()-baseFDs,
+		atomic.LoadInt64(&d.downloads), atomic.LoadInt64(&d.failed))
+	fmt.Printf("           Processed: %d MB (%.0f MB/s)  |  Peak heap: %.1f MB\n",
+		bytes>>20, float64(bytes)/(1<<20)/elapsed.Seconds(), float64(d.heap.Peak())/(1<<20))
+	fmt.Printf("           %s\n", gcpercent.Stats())
+}
+
+// startMockServer serves /api/big?bytes=N on addr: N bytes of a fixed
+// pseudo-random pattern, with Content-Length unless chunked=1 is set. Every
+// failEvery-th request gets a 503 and an errorPageSize error page instead.
+func startMockServer(addr string, failEvery int) (*http.Server, error) {
+	pattern := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(pattern)
+	errorPage := []byte(strings.Repeat("upstream busy, retry later\n", errorPageSize/27+1)[:errorPageSize])
+	var served int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/big", func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt64(&served, 1); failEvery > 0 && n%int64(failEvery) == 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(errorPage)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(errorPage)
+			return
+		}
+		size, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "bytes must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("chunked") != "1" {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		for left := size; left > 0; {
+			chunk := pattern
+			if left < int64(len(chunk)) {
+				chunk = chunk[:left]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			left -= int64(len(chunk))
+		}
+	})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, nil
+}
+
+// heapSampler records the highest HeapAlloc seen. A sampled peak can miss a
+// spike between samples, so it is a lower bound.
+type heapSampler struct {
+	peak int64
+}
+
+// run samples the heap every interval until ctx is done
+func (h *heapSampler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for {
+		runtime.ReadMemStats(&m)
+		if cur := int64(m.HeapAlloc); cur > atomic.LoadInt64(&h.peak) {
+			atomic.StoreInt64(&h.peak, cur)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Peak returns the highest heap sampled so far, in bytes
+func (h *heapSampler) Peak() int64 {
+	return atomic.LoadInt64(&h.peak)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
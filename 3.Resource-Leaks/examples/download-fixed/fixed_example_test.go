@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestStreamedDownloads runs the mock API without failures and checks
+// streamDownload against a limit of 8 MB. Bodies at the limit, with and
+// without Content-Length, must give the same SHA-256 as io.ReadAll. Bodies
+// over it must fail with errTooLarge, a declared one before anything is
+// read. Streaming 64 MB must allocate next to nothing, and goroutines must
+// return to baseline.
+func TestStreamedDownloads(t *testing.T) {
+	const limit = 8 << 20
+
+	baseline := runtime.NumGoroutine()
+
+	addr := freeAddr(t)
+	server, err := startMockServer(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{}}
+	url := func(size int64, chunked bool) string {
+		u := fmt.Sprintf("http://%s/api/big?bytes=%d", addr, size)
+		if chunked {
+			u += "&chunked=1"
+		}
+		return u
+	}
+	// readAll is download-leak's path, with the body closed
+	readAll := func(u string) (int64, string, error) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		sum := sha256.Sum256(data)
+		return int64(len(data)), hex.EncodeToString(sum[:]), err
+	}
+	ctx := context.Background()
+	buf := make([]byte, copyBufferSize)
+
+	for _, chunked := range []bool{false, true} {
+		kind := "with Content-Length"
+		if chunked {
+			kind = "chunked"
+		}
+		n, streamed, err := streamDownload(ctx, client, url(limit, chunked), limit, buf)
+		_, whole, _ := readAll(url(limit, chunked))
+		check(t, fmt.Sprintf("a body at the limit, %s, streams with io.ReadAll's checksum (%d bytes, %.12s = %.12s, err=%v)", kind, n, streamed, whole, err),
+			err == nil && n == limit && streamed == whole)
+	}
+
+	n, _, err := streamDownload(ctx, client, url(limit+1, false), limit, buf)
+	check(t, fmt.Sprintf("one byte over, declared, is refused before reading (%d bytes read: %v)", n, err),
+		errors.Is(err, errTooLarge) && n == 0)
+	n, _, err = streamDownload(ctx, client, url(2*limit, true), limit, buf)
+	check(t, fmt.Sprintf("twice the limit, chunked, stops at limit+1 bytes (%d read: %v)", n, err),
+		errors.Is(err, errTooLarge) && n == limit+1)
+
+	// TotalAlloc counts every allocation, so unlike a sampled heap it can't
+	// miss a short-lived buffer
+	allocated := func(fn func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		fn()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	const big = 64 << 20
+	streamAlloc := allocated(func() { n, _, err = streamDownload(ctx, client, url(big, false), big, buf) })
+	check(t, fmt.Sprintf("streaming 64 MB allocated %d KB (err=%v)", streamAlloc>>10, err), err == nil && n == big && streamAlloc < 1<<20)
+	wholeAlloc := allocated(func() { n, _, err = readAll(url(big, false)) })
+	check(t, fmt.Sprintf("where io.ReadAll allocated %d MB", wholeAlloc>>20), err == nil && wholeAlloc >= big)
+
+	client.CloseIdleConnections()
+	server.Close()
+	settled := func(cond func() bool) {
+		for deadline := time.Now().Add(2 * time.Second); !cond() && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	settled(func() bool { return runtime.NumGoroutine() <= baseline })
+	check(t, fmt.Sprintf("goroutines back to baseline (%d -> %d)", baseline, runtime.NumGoroutine()), runtime.NumGoroutine() <= baseline)
+}
+
+// freeAddr returns a loopback address with a free port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
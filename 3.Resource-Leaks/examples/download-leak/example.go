@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example downloads large bodies the naive way. Each download reads the
+// whole response into memory with io.ReadAll before hashing it, so every
+// download in flight holds its full body, plus the copies ReadAll leaves
+// behind as it grows. A non-200 response is returned as an error without
+// closing its body, which pins the connection and its Transport goroutines.
+
+// Downloader fetches /api/big repeatedly and checksums each body
+// BUG: bodies are read whole with io.ReadAll, and not closed on error
+type Downloader struct {
+	client *http.Client
+	url    string
+	heap   heapSampler
+
+	downloads int64 // bodies read and checksummed
+	failed    int64
+	bytes     int64 // body bytes hashed
+}
+
+// Download flags, identical in download-leak and download-fixed
+var (
+	sizeMB      = flag.Int("size-mb", 200, "size of each /api/big body in MB")
+	concurrency = flag.Int("concurrency", 4, "downloads in flight at once")
+	failEvery   = flag.Int("fail-every", 5, "the mock API answers every nth download with 503 and an error page (0 = never)")
+	runFor      = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+)
+
+// errorPageSize is the size of the mock API's 503 body
+const errorPageSize = 64 << 10
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6060")
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
+	}()
+
+	server, err := startMockServer("127.0.0.1:8090", *failEvery)
+	if err != nil {
+		log.Fatalf("Mock server error: %v", err)
+	}
+	defer server.Close()
+	d := NewDownloader(fmt.Sprintf("http://127.0.0.1:8090/api/big?bytes=%d", int64(*sizeMB)<<20))
+	summary.Register("downloads", d)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	baseline := health.Read()
+	debugMux.HandleFunc("/healthz", health.Handler(baseline))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  URL: %s  |  Body: %d MB  |  Concurrency: %d  |  Fail every: %d\n",
+		runtime.NumGoroutine(), d.url, *sizeMB, *concurrency, *failEvery)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	go d.heap.run(ctx, 10*time.Millisecond)
+	for i := 0; i < *concurrency; i++ {
+		go d.run(ctx)
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	start := time.Now()
+	explained := false
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nWorkload stopped")
+			d.report("[FINAL]", baseline.OpenFDs, time.Since(start))
+			return
+		case <-ticker.C:
+		}
+		d.report(fmt.Sprintf("[AFTER %.0fs]", time.Since(start).Seconds()), baseline.OpenFDs, time.Since(start))
+
+		if d.heap.Peak() > 2*int64(*sizeMB)<<20 && !explained {
+			explained = true
+			fmt.Printf("\n⚠️  Peak heap %d MB for %d downloads of %d MB in flight.\n", d.heap.Peak()>>20, *concurrency, *sizeMB)
+			fmt.Println("io.ReadAll holds each whole body until it is hashed, and grows its buffer by")
+			fmt.Println("copying, so one download can briefly need more than twice its size. The 503s")
+			fmt.Println("are worse: their bodies are never closed, so each one keeps a connection and")
+			fmt.Println("two Transport goroutines. Watch FDs and goroutines climb with \"failed\".")
+			fmt.Println()
+		}
+	}
+}
+
+// NewDownloader returns a Downloader for url
+func NewDownloader(url string) *Downloader {
+	return &Downloader{
+		client: &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}},
+		url:    url,
+	}
+}
+
+// run downloads until ctx is done
+func (d *Downloader) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, _, err := d.download(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				atomic.AddInt64(&d.failed, 1)
+			}
+			continue
+		}
+		atomic.AddInt64(&d.downloads, 1)
+		atomic.AddInt64(&d.bytes, n)
+	}
+}
+
+// download fetches d.url and returns its size and SHA-256
+func (d *Downloader) download(ctx context.Context) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// BUG: returns without closing the body. The connection can't be
+		// reused or closed, and its read and write goroutines stay.
+		return 0, "", fmt.Errorf("download: %s", resp.Status)
+	}
+
+	// BUG: the whole body is held in memory, however large it is
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(data)
+	return int64(len(data)), hex.EncodeToString(sum[:]), nil
+}
+
+// Summary reports download counts and peak heap for /debug/summary
+func (d *Downloader) Summary() map[string]interface{} {
+	return map[string]interface{}{
+		"downloads":    atomic.LoadInt64(&d.downloads),
+		"failed":       atomic.LoadInt64(&d.failed),
+		"bytes":        atomic.LoadInt64(&d.bytes),
+		"peak_heap_mb": d.heap.Peak() >> 20,
+	}
+}
+
+// report prints the periodic status lines under label
+func (d *Downloader) report(label string, baseFDs int, elapsed time.Duration) {
+	bytes := atomic.LoadInt64(&d.bytes)
+	fmt.Printf("%s Goroutines: %d  |  FDs: %+d  |  Downloads: %d ok, %d failed\n",
+		label, runtime.NumGoroutine(), fdcount.Count()-baseFDs,
+		atomic.LoadInt64(&d.downloads), atomic.LoadInt64(&d.failed))
+	fmt.Printf("           Processed: %d MB (%.0f MB/s)  |  Peak heap: %.1f MB\n",
+		bytes>>20, float64(bytes)/(1<<20)/elapsed.Seconds(), float64(d.heap.Peak())/(1<<20))
+	fmt.Printf("           %s\n", gcpercent.Stats())
+}
+
+// startMockServer serves /api/big?bytes=N on addr: N bytes of a fixed
+// pseudo-random pattern, with Content-Length unless chunked=1 is set. Every
+// failEvery-th request gets a 503 and an errorPageSize error page instead.
+func startMockServer(addr string, failEvery int) (*http.Server, error) {
+	pattern := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(pattern)
+	errorPage := []byte(strings.Repeat("upstream busy, retry later\n", errorPageSize/27+1)[:errorPageSize])
+	var served int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/big", func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt64(&served, 1); failEvery > 0 && n%int64(failEvery) == 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(errorPage)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(errorPage)
+			return
+		}
+		size, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "bytes must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("chunked") != "1" {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		for left := size; left > 0; {
+			chunk := pattern
+			if left < int64(len(chunk)) {
+				chunk = chunk[:left]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			left -= int64(len(chunk))
+		}
+	})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, nil
+}
+
+// heapSampler records the highest HeapAlloc seen. A sampled peak can miss a
+// spike between samples, so it is a lower bound.
+type heapSampler struct {
+	peak int64
+}
+
+// run samples the heap every interval until ctx is done
+func (h *heapSampler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for {
+		runtime.ReadMemStats(&m)
+		if cur := int64(m.HeapAlloc); cur > atomic.LoadInt64(&h.peak) {
+			atomic.StoreInt64(&h.peak, cur)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Peak returns the highest heap sampled so far, in bytes
+func (h *heapSampler) Peak() int64 {
+	return atomic.LoadInt64(&h.peak)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// fdTestFiles is how many files the FD tests process. It stays well under
+// the usual 1024-descriptor soft limit.
+const fdTestFiles = 300
+
+// TestProcessFileCorrectlyCloses calls processFileCorrectly fdTestFiles times
+// and checks that at most one file was ever open and none is left, by the
+// tracker and by the kernel
+func TestProcessFileCorrectlyCloses(t *testing.T) {
+	dir := t.TempDir()
+	// The first file the process opens also creates the runtime poller's
+	// descriptors; open one before taking the baseline so they're in it
+	warmup, err := os.CreateTemp(dir, "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmup.Close()
+	files = &fdcount.Tracker{}
+
+	before := fdcount.Count()
+	if before < 0 {
+		t.Skip("no /proc/self/fd or /dev/fd on this platform")
+	}
+	fp := &FileProcessor{}
+	for i := 0; i < fdTestFiles; i++ {
+		if err := fp.processFileCorrectly(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if opened, closed := files.Balance(); opened != fdTestFiles || closed != opened {
+		t.Errorf("%d files opened, %d closed, want %d of each", opened, closed, fdTestFiles)
+	}
+	if got := files.Peak(); got > 1 {
+		t.Errorf("peak live files = %d, want at most 1", got)
+	}
+	if delta := fdcount.Count() - before; delta != 0 {
+		t.Errorf("kernel FDs changed by %d, want 0", delta)
+	}
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workspace"
 )
 
 // FileProcessor simulates a service that processes many files
@@ -15,27 +32,50 @@ import (
 type FileProcessor struct {
 	filesOpened int
 	filesClosed int
+
+	// fsync syncs each file before closing it; see closeDurably
+	fsync bool
+
+	// workspace holds the files; nil in tests
+	workspace *workspace.Workspace
 }
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	workspace.ApplyNofile()
+
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6060")
-		log.Fatal(http.ListenAndServe("localhost:6061", nil))
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
 	}()
 
-	processor := &FileProcessor{}
+	processor := &FileProcessor{fsync: *fsyncMode}
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	summary.Register("closers", closerSummary{})
+
+	if *readMode {
+		runReadMode()
+		return
+	}
 
 	// Print initial state
 	initialFDs := countOpenFileDescriptors()
 	fmt.Printf("[START] Open file descriptors: %d\n", initialFDs)
 
-	// Create temp directory for test files
-	tempDir, err := os.MkdirTemp("", "file-fixed-test")
+	// Create the workspace for test files. It is removed on return and on
+	// Ctrl+C, which is the only way out of a run that never returns.
+	ws, err := workspace.New("", "file-fixed-test", workspace.WithMaxBytes(*workspaceMax), workspace.WithSignalHandler(dumpAndExit))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer ws.Close()
+	tempDir := ws.Dir
+	processor.workspace = ws
 
 	// Simulate continuous file processing
 	ticker := time.NewTicker(20 * time.Millisecond) // 50 files/second
@@ -47,7 +87,12 @@ func main() {
 
 	for range ticker.C {
 		// FIXED: Files are properly closed
-		if err := processor.processFileCorrectly(tempDir); err != nil {
+		err := processor.processFileCorrectly(tempDir)
+		if isFDExhausted(err) {
+			// Never expected: at most one tracked file is open at a time
+			explainFDExhaustion(err)
+			os.Exit(1)
+		} else if err != nil {
 			log.Printf("Error processing file: %v", err)
 		}
 
@@ -57,10 +102,19 @@ func main() {
 			elapsed := time.Since(startTime).Seconds()
 			fmt.Printf("[AFTER %.0fs] Open FDs: %d  |  Files opened: %d  |  Files closed: %d\n",
 				elapsed, currentFDs, processor.filesOpened, processor.filesClosed)
+			fmt.Printf("           %s\n", gcpercent.Stats())
+			fmt.Printf("           Tracked files: %s\n", files)
+			fmt.Printf("           Workspace: %s\n", ws)
+			fmt.Printf("           Throughput: %.1f files/sec  |  %s\n",
+				float64(processor.filesOpened)/elapsed, fsyncs)
 
 			if currentFDs <= initialFDs+10 {
 				fmt.Println("✓ No leak! File descriptors stable")
 			}
+			if workspace.Nofile() > 0 && uint64(processor.filesOpened) > workspace.Nofile() {
+				fmt.Printf("✓ %d files opened under RLIMIT_NOFILE=%d without running out\n",
+					processor.filesOpened, workspace.FileLimit())
+			}
 
 			lastReport = time.Now()
 		}
@@ -68,19 +122,24 @@ func main() {
 }
 
 // processFileCorrectly opens a file and ensures it's closed with defer
-func (fp *FileProcessor) processFileCorrectly(tempDir string) error {
+//
+// With fsync set the file is synced first, and Sync and Close errors are joined
+// into the returned error instead of being logged
+func (fp *FileProcessor) processFileCorrectly(tempDir string) (err error) {
 	filename := fmt.Sprintf("%s/logfile_%d.txt", tempDir, fp.filesOpened)
 
 	// Open file
-	file, err := os.Create(filename)
+	file, err := files.Create(filename)
 	if err != nil {
 		return err
 	}
 
 	// ✅ FIX: Ensure file is closed when function returns
 	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("Error closing file: %v", err)
+		if fp.fsync {
+			err = errors.Join(err, closeDurably(file))
+		} else if cerr := file.Close(); cerr != nil {
+			log.Printf("Error closing file: %v", cerr)
 		}
 		fp.filesClosed++
 	}()
@@ -90,6 +149,7 @@ func (fp *FileProcessor) processFileCorrectly(tempDir string) error {
 	if _, err := file.Write(data); err != nil {
 		return err // File will still be closed by defer
 	}
+	fp.workspace.Record(filename, int64(len(data)))
 
 	fp.filesOpened++
 
@@ -106,3 +166,381 @@ func countOpenFileDescriptors() int {
 	// In reality, use: lsof -p <pid> | wc -l
 	return runtime.NumGoroutine() + len(os.Args) + 5 // Rough estimate
 }
+
+var (
+	readMode  = flag.Bool("read", false, "checksum pre-generated large files instead of running the write loop")
+	readFiles = flag.Int("read-files", 20, "number of files generated for -read")
+	readMB    = flag.Int("read-mb", 8, "size of each -read file in MB")
+)
+
+// streamBufferSize is the only file buffer the streaming path allocates
+const streamBufferSize = 32 * 1024
+
+// runReadMode checksums -read-files files of -read-mb MB each by streaming
+// them, reports heap and descriptors, then verifies the streaming path
+func runReadMode() {
+	tempDir, err := os.MkdirTemp("", "file-fixed-read")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	paths, err := generateInputs(tempDir, *readFiles, *readMB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Checksumming %d files of %d MB each, all at once...\n", len(paths), *readMB)
+
+	stop := watchHeap()
+	start := time.Now()
+	sums, err := streamChecksums(paths)
+	elapsed := time.Since(start)
+	peak := stop()
+	if err != nil {
+		log.Printf("Error reading files: %v", err)
+	}
+
+	fmt.Printf("[READ] Files: %d  |  Heap peak: %d MB  |  Took: %v\n",
+		len(sums), peak/1024/1024, elapsed.Round(time.Millisecond))
+	fmt.Printf("       Tracked files: %s  |  Peak open: %d\n", files, files.Peak())
+	fmt.Printf("       %s\n", gcpercent.Stats())
+
+	fmt.Println()
+	verifyStreaming(paths, sums)
+}
+
+// streamChecksums checksums every file concurrently, streaming each one
+// through its own fixed-size buffer
+func streamChecksums(paths []string) ([]string, error) {
+	sums := make([]string, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			sums[i], errs[i] = streamChecksum(path, make([]byte, streamBufferSize))
+		}(i, path)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return sums, err
+		}
+	}
+	return sums, nil
+}
+
+// streamChecksum hashes the file at path reading at most len(buf) bytes at a
+// time, so memory use doesn't depend on the file size
+func streamChecksum(path string, buf []byte) (string, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return "", err
+	}
+	// ✅ FIX: closed as soon as this file is done, not when the batch is
+	defer file.Close()
+
+	h := sha256.New()
+	// ✅ FIX: stream through buf. Hiding the file behind a plain io.Reader
+	// stops io.CopyBuffer from using *os.File's WriteTo, which would ignore
+	// buf and allocate its own.
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{file}, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyStreaming checks that streaming gives the same checksums as reading
+// each file whole, and that it allocates a small, fixed amount per file
+func verifyStreaming(paths, sums []string) {
+	mismatches := 0
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil || i >= len(sums) || checksum(data) != sums[i] {
+			mismatches++
+		}
+	}
+	if mismatches == 0 {
+		fmt.Printf("✓ Streaming checksums match read-all checksums for all %d files\n", len(paths))
+	} else {
+		fmt.Printf("✗ %d of %d streaming checksums differ from read-all\n", mismatches, len(paths))
+	}
+
+	buf := make([]byte, streamBufferSize)
+	streamChecksum(paths[0], buf) // the first call's allocations are one-off
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	streamChecksum(paths[0], buf)
+	runtime.ReadMemStats(&after)
+	allocated := after.TotalAlloc - before.TotalAlloc
+
+	fileSize := uint64(*readMB) * 1024 * 1024
+	if allocated < streamBufferSize {
+		fmt.Printf("✓ Streaming one %d MB file allocated %d bytes (buffer reused)\n",
+			*readMB, allocated)
+	} else {
+		fmt.Printf("✗ Streaming one %d MB file allocated %d bytes (%.1f%% of the file)\n",
+			*readMB, allocated, 100*float64(allocated)/float64(fileSize))
+	}
+	if files.Current() == 0 {
+		fmt.Println("✓ Every file closed")
+	} else {
+		fmt.Printf("✗ %d files still open\n", files.Current())
+	}
+}
+
+// checksum returns the hex SHA-256 of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// generateInputs writes n files of sizeMB MB into dir. Each file gets its own
+// deterministic byte pattern, so checksums are stable between runs.
+func generateInputs(dir string, n, sizeMB int) ([]string, error) {
+	chunk := make([]byte, 1024*1024)
+	paths := make([]string, n)
+	for i := range paths {
+		for j := range chunk {
+			chunk[j] = byte((j*31 + i) % 251)
+		}
+		paths[i] = fmt.Sprintf("%s/input_%d.dat", dir, i)
+		if err := writeChunks(paths[i], chunk, sizeMB); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// writeChunks writes chunk count times to a new file at path. Setup isn't
+// what this example measures, so it bypasses the tracker.
+func writeChunks(path string, chunk []byte, count int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i := 0; i < count; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchHeap samples HeapAlloc every 10ms until the returned func is called,
+// which reports the highest value seen
+func watchHeap() (stop func() uint64) {
+	var peak uint64
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-finished
+		return peak
+	}
+}
+
+// isFDExhausted reports whether err means the process (EMFILE) or the whole
+// system (ENFILE) has run out of file descriptors
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// explainFDExhaustion describes a descriptor-exhaustion error in terms of the
+// leak instead of letting it scroll past as one more log line
+func explainFDExhaustion(err error) {
+	fmt.Printf("\n✗ Out of file descriptors: %v\n", err)
+	fmt.Printf("   RLIMIT_NOFILE (soft): %d  |  Live tracked files: %d\n", workspace.FileLimit(), files.Current())
+	fmt.Println("   This is where a descriptor leak ends up: every open, accept and dial in")
+	fmt.Println("   the process now fails, not just this file processor.")
+}
+
+// files tracks every file this example opens
+var files = &fdcount.Tracker{}
+
+// TrackedCloser wraps any io.Closer so leaking it can be detected, the way
+// fdcount.Tracker does for files. It is in the open set from creation until
+// its first Close; if the garbage collector finds it still open, its
+// finalizer logs a warning and keeps it in the set marked as leaked. The
+// finalizer runs only after a GC cycle, so this finds leaks late, not at once.
+type TrackedCloser struct {
+	io.Closer
+	id     uint64
+	label  string
+	closed int32
+}
+
+// trackedClosers is the process-wide open set. It holds labels, not the
+// closers themselves, which would keep them reachable and their finalizers
+// from ever running.
+var trackedClosers = struct {
+	sync.Mutex
+	nextID uint64
+	open   map[uint64]trackedEntry
+	leaked int64
+}{open: make(map[uint64]trackedEntry)}
+
+// trackedEntry is an open set entry
+type trackedEntry struct {
+	label  string
+	leaked bool
+}
+
+// TrackCloser wraps c, labelled for OpenResources and the leak warning
+func TrackCloser(c io.Closer, label string) *TrackedCloser {
+	trackedClosers.Lock()
+	trackedClosers.nextID++
+	t := &TrackedCloser{Closer: c, id: trackedClosers.nextID, label: label}
+	trackedClosers.open[t.id] = trackedEntry{label: label}
+	trackedClosers.Unlock()
+
+	runtime.SetFinalizer(t, func(t *TrackedCloser) {
+		trackedClosers.Lock()
+		trackedClosers.open[t.id] = trackedEntry{label: t.label, leaked: true}
+		n := atomic.AddInt64(&trackedClosers.leaked, 1)
+		trackedClosers.Unlock()
+		log.Printf("closer leak: %s was garbage collected without Close (%d leaked)", t.label, n)
+	})
+	return t
+}
+
+// Close removes the closer from the open set and closes it. Only the first
+// call counts; later calls are passed to the wrapped closer unchanged.
+func (t *TrackedCloser) Close() error {
+	if atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		runtime.SetFinalizer(t, nil)
+		trackedClosers.Lock()
+		delete(trackedClosers.open, t.id)
+		trackedClosers.Unlock()
+	}
+	return t.Closer.Close()
+}
+
+// OpenResources names every tracked closer not yet closed, oldest first.
+// Those garbage collected while open are marked as leaked.
+func OpenResources() []string {
+	trackedClosers.Lock()
+	defer trackedClosers.Unlock()
+	ids := make([]uint64, 0, len(trackedClosers.open))
+	for id := range trackedClosers.open {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		e := trackedClosers.open[id]
+		names[i] = e.label
+		if e.leaked {
+			names[i] += " (leaked: garbage collected without Close)"
+		}
+	}
+	return names
+}
+
+// closerSummary reports the open set in /debug/summary
+type closerSummary struct{}
+
+func (closerSummary) Summary() map[string]interface{} {
+	trackedClosers.Lock()
+	defer trackedClosers.Unlock()
+	return map[string]interface{}{
+		"open":   len(trackedClosers.open),
+		"leaked": trackedClosers.leaked,
+	}
+}
+
+var fsyncMode = flag.Bool("fsync", false, "Sync each file before closing it and return Sync and Close errors instead of logging them")
+
+// durableFile is what closeDurably needs from a file, so a wrapper whose Sync
+// fails can stand in for *fdcount.File
+type durableFile interface {
+	Sync() error
+	Close() error
+}
+
+// fsyncStats records how long Sync takes, so the monitor can show what
+// durability costs in throughput
+type fsyncStats struct {
+	calls int64
+	nanos int64
+}
+
+// fsyncs collects the latency of every closeDurably call
+var fsyncs = &fsyncStats{}
+
+func (s *fsyncStats) record(d time.Duration) {
+	atomic.AddInt64(&s.calls, 1)
+	atomic.AddInt64(&s.nanos, int64(d))
+}
+
+// String formats the call count, mean latency and the files/sec that fsync
+// alone would allow
+func (s *fsyncStats) String() string {
+	calls := atomic.LoadInt64(&s.calls)
+	if calls == 0 {
+		return "fsync: off"
+	}
+	avg := time.Duration(atomic.LoadInt64(&s.nanos) / calls)
+	ceiling := 0.0
+	if avg > 0 {
+		ceiling = float64(time.Second) / float64(avg)
+	}
+	return fmt.Sprintf("fsync: %d calls, avg %v (caps throughput at ~%.0f files/sec)",
+		calls, avg.Round(time.Microsecond), ceiling)
+}
+
+// closeDurably flushes f to stable storage, then closes it. The file is closed
+// even if Sync fails, and both errors go back to the caller: a failed Sync
+// means the data may never reach the disk, which Close alone won't report.
+func closeDurably(f durableFile) error {
+	start := time.Now()
+	syncErr := f.Sync()
+	fsyncs.record(time.Since(start))
+	return errors.Join(syncErr, f.Close())
+}
+
+var workspaceMax = flag.Int64("workspace-max", 0, "cap on bytes kept in the temp workspace; the oldest files are deleted past it (0 = no cap)")
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
+
+// dumpAndExit is the workspace's signal handler: a SIGTERM also writes a leak
+// dump, after the workspace is removed, and every signal then exits as
+// workspace.ExitOnSignal does
+func dumpAndExit(sig os.Signal) {
+	if sig == syscall.SIGTERM {
+		sighandler.LogLeakDump("/tmp/leakdump")
+	}
+	workspace.ExitOnSignal(sig)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Allocation budgets. They sit a little above what the current code needs,
+// so noise passes but a regression fails: a per-call buffer, a read-all
+// fallback or a leaked wrapper shows up immediately.
+const (
+	// processFileCorrectly: file name, log line, *os.File, fdcount.File and
+	// the deferred closure
+	maxProcessAllocs = 12
+	maxProcessBytes  = 1024
+
+	// streamChecksum with a reused buffer: file, hasher and hex digest. The
+	// byte budget is independent of the file size.
+	maxStreamAllocs = 16
+	maxStreamBytes  = 2048
+
+	// Streaming must allocate under 1% of what reading the file whole does
+	maxStreamToReadAll = 0.01
+)
+
+// measureAllocs returns fn's allocations per call from testing.AllocsPerRun
+// and its allocated bytes per call from a MemStats TotalAlloc delta
+func measureAllocs(fn func()) (allocs float64, bytes uint64) {
+	const runs = 20
+	allocs = testing.AllocsPerRun(runs, fn)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		fn()
+	}
+	runtime.ReadMemStats(&after)
+	return allocs, (after.TotalAlloc - before.TotalAlloc) / runs
+}
+
+// TestAllocationBudgets measures the fixed code paths against the budgets
+// above, with os.ReadFile plus checksum as the read-all reference
+func TestAllocationBudgets(t *testing.T) {
+	tempDir := t.TempDir()
+	paths, err := generateInputs(tempDir, 1, *readMB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := &FileProcessor{}
+	processAllocs, processBytes := measureAllocs(func() { fp.processFileCorrectly(tempDir) })
+
+	buf := make([]byte, streamBufferSize)
+	streamAllocs, streamBytes := measureAllocs(func() { streamChecksum(paths[0], buf) })
+	readAllAllocs, readAllBytes := measureAllocs(func() {
+		data, _ := os.ReadFile(paths[0])
+		checksum(data)
+	})
+
+	t.Logf("processFileCorrectly: %.0f allocs, %d bytes", processAllocs, processBytes)
+	t.Logf("streamChecksum:       %.0f allocs, %d bytes", streamAllocs, streamBytes)
+	t.Logf("os.ReadFile+checksum: %.0f allocs, %d bytes", readAllAllocs, readAllBytes)
+
+	if processAllocs > maxProcessAllocs || processBytes > maxProcessBytes {
+		t.Errorf("processFileCorrectly: %.0f allocs, %d bytes; want at most %d, %d",
+			processAllocs, processBytes, maxProcessAllocs, maxProcessBytes)
+	}
+	if streamAllocs > maxStreamAllocs || streamBytes > maxStreamBytes {
+		t.Errorf("streamChecksum (%d MB file): %.0f allocs, %d bytes; want at most %d, %d",
+			*readMB, streamAllocs, streamBytes, maxStreamAllocs, maxStreamBytes)
+	}
+	if float64(streamBytes) > maxStreamToReadAll*float64(readAllBytes) {
+		t.Errorf("streamChecksum allocates %.3f%% of read-all, want under %.0f%%",
+			100*float64(streamBytes)/float64(readAllBytes), 100*maxStreamToReadAll)
+	}
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestTrackedClosers wraps a closed and an unclosed closer and drops both,
+// then checks that after a GC only the unclosed one is reported, as leaked
+// and by its label, and that a live unclosed one is reported as open.
+func TestTrackedClosers(t *testing.T) {
+	contains := func(names []string, want string) bool {
+		for _, name := range names {
+			if name == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Start from an empty open set, so a -count rerun doesn't see the
+	// previous run's leaked closer
+	trackedClosers.Lock()
+	trackedClosers.open = make(map[uint64]trackedEntry)
+	trackedClosers.Unlock()
+
+	tempDir := t.TempDir()
+	open := func(label string) *TrackedCloser {
+		f, err := os.Create(filepath.Join(tempDir, label))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TrackCloser(f, label)
+	}
+
+	held := open("held.txt")
+	func() {
+		open("closed.txt").Close()
+		open("dropped.txt") // never closed
+	}()
+	names := OpenResources()
+	check(t, fmt.Sprintf("before GC: %q (want held.txt and dropped.txt open)", names),
+		len(names) == 2 && contains(names, "held.txt") && contains(names, "dropped.txt"))
+
+	// A GC queues the finalizer, which then runs on its own goroutine
+	want := "dropped.txt (leaked: garbage collected without Close)"
+	for deadline := time.Now().Add(2 * time.Second); !contains(OpenResources(), want) && time.Now().Before(deadline); {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	names = OpenResources()
+	check(t, fmt.Sprintf("after GC: %q (want dropped.txt leaked)", names), contains(names, want))
+	check(t, "held.txt, still reachable, is open and not leaked", contains(names, "held.txt"))
+	check(t, "closed.txt is not reported", !contains(names, "closed.txt"))
+
+	held.Close()
+	names = OpenResources()
+	check(t, fmt.Sprintf("after closing held.txt: %q (want only the leaked one)", names), len(names) == 1 && names[0] == want)
+	check(t, "a second Close is passed through to the file", held.Close() != nil)
+}
+
+// TestDurability checks closeDurably's error propagation with failingFile,
+// then runs one real file through the -fsync path
+func TestDurability(t *testing.T) {
+	tempDir := t.TempDir()
+
+	errSync := errors.New("sync: input/output error")
+	errClose := errors.New("close: input/output error")
+
+	f := &failingFile{syncErr: errSync}
+	err := closeDurably(f)
+	check(t, "Sync error is returned", errors.Is(err, errSync))
+	check(t, "file is still closed after a failed Sync", f.closed)
+
+	f = &failingFile{syncErr: errSync, closeErr: errClose}
+	err = closeDurably(f)
+	check(t, "Sync and Close errors are both returned", errors.Is(err, errSync) && errors.Is(err, errClose))
+
+	f = &failingFile{closeErr: errClose}
+	err = closeDurably(f)
+	check(t, "Close error is returned when Sync succeeds", errors.Is(err, errClose) && !errors.Is(err, errSync))
+
+	check(t, "no error when Sync and Close succeed", closeDurably(&failingFile{}) == nil)
+
+	calls := atomic.LoadInt64(&fsyncs.calls)
+	fp := &FileProcessor{fsync: true}
+	err = fp.processFileCorrectly(tempDir)
+	check(t, "a real file goes through the fsync path without error", err == nil)
+	check(t, "its Sync latency was recorded", atomic.LoadInt64(&fsyncs.calls) == calls+1)
+}
+
+// failingFile is a durableFile whose Sync and Close return the given errors
+type failingFile struct {
+	syncErr  error
+	closeErr error
+	closed   bool
+}
+
+func (f *failingFile) Sync() error { return f.syncErr }
+
+func (f *failingFile) Close() error {
+	f.closed = true
+	return f.closeErr
+}
@@ -1,40 +1,74 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workspace"
 )
 
 // FileProcessor simulates a service that processes many files
 // BUG: Files are opened but never closed, leaking file descriptors
 type FileProcessor struct {
 	filesOpened int
+
+	// workspace holds the files; nil in tests
+	workspace *workspace.Workspace
 }
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	workspace.ApplyNofile()
+
+	// Runs before the pprof server so only the processed files count
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6060")
-		log.Fatal(http.ListenAndServe("localhost:6060", nil))
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
 	}()
 
 	processor := &FileProcessor{}
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	if *readMode {
+		runReadMode()
+		return
+	}
+
 	// Print initial state
 	initialFDs := countOpenFileDescriptors()
 	fmt.Printf("[START] Open file descriptors: %d\n", initialFDs)
 
-	// Create temp directory for test files
-	tempDir, err := os.MkdirTemp("", "file-leak-test")
+	// Create the workspace for test files. It is removed on return and on
+	// Ctrl+C, which is the only way out of a run that never returns.
+	ws, err := workspace.New("", "file-leak-test", workspace.WithMaxBytes(*workspaceMax))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer ws.Close()
+	tempDir := ws.Dir
+	processor.workspace = ws
 
 	// Simulate continuous file processing
 	ticker := time.NewTicker(20 * time.Millisecond) // 50 files/second
@@ -44,10 +78,23 @@ func main() {
 	reportInterval := 2 * time.Second
 	lastReport := startTime
 
+	// Once descriptors run out, stop creating files but keep the leaked ones
+	// open and keep reporting, so the end state can still be inspected
+	sustaining := false
+
 	for range ticker.C {
 		// BUG: processFile leaks file descriptors
-		if err := processor.processFileBadly(tempDir); err != nil {
-			log.Printf("Error processing file: %v", err)
+		if !sustaining {
+			err := processor.processFileBadly(tempDir)
+			if isFDExhausted(err) {
+				explainFDExhaustion(err)
+				fmt.Println("   Sustain mode: no new files; the leaked ones stay open for inspection.")
+				fmt.Println("   Run: lsof -p", os.Getpid(), "| wc -l")
+				fmt.Println()
+				sustaining = true
+			} else if err != nil {
+				log.Printf("Error processing file: %v", err)
+			}
 		}
 
 		// Report every 2 seconds
@@ -56,6 +103,9 @@ func main() {
 			elapsed := time.Since(startTime).Seconds()
 			fmt.Printf("[AFTER %.0fs] Open FDs: %d  |  Files opened: %d\n",
 				elapsed, currentFDs, processor.filesOpened)
+			fmt.Printf("           %s\n", gcpercent.Stats())
+			fmt.Printf("           Tracked files: %s\n", files)
+			fmt.Printf("           Workspace: %s\n", ws)
 
 			if currentFDs > initialFDs+100 {
 				fmt.Println("\n WARNING: File descriptor leak detected!")
@@ -74,7 +124,7 @@ func (fp *FileProcessor) processFileBadly(tempDir string) error {
 	filename := fmt.Sprintf("%s/logfile_%d.txt", tempDir, fp.filesOpened)
 
 	// BUG: File is opened but never closed!
-	file, err := os.Create(filename)
+	file, err := files.Create(filename)
 	if err != nil {
 		return err
 	}
@@ -84,6 +134,7 @@ func (fp *FileProcessor) processFileBadly(tempDir string) error {
 	if _, err := file.Write(data); err != nil {
 		return err // Early return without closing file!
 	}
+	fp.workspace.Record(filename, int64(len(data)))
 
 	fp.filesOpened++
 
@@ -100,3 +151,178 @@ func countOpenFileDescriptors() int {
 	// In reality, use: lsof -p <pid> | wc -l
 	return runtime.NumGoroutine() + len(os.Args) + 5 // Rough estimate
 }
+
+var (
+	readMode  = flag.Bool("read", false, "checksum pre-generated large files instead of running the write loop")
+	readFiles = flag.Int("read-files", 20, "number of files generated for -read")
+	readMB    = flag.Int("read-mb", 8, "size of each -read file in MB")
+)
+
+// runReadMode checksums -read-files files of -read-mb MB each and reports
+// the heap and descriptors the read path leaves behind
+func runReadMode() {
+	tempDir, err := os.MkdirTemp("", "file-leak-read")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	paths, err := generateInputs(tempDir, *readFiles, *readMB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Checksumming %d files of %d MB each, all at once...\n", len(paths), *readMB)
+
+	stop := watchHeap()
+	start := time.Now()
+	sums, err := readAllBadly(paths)
+	elapsed := time.Since(start)
+	peak := stop()
+	if err != nil {
+		log.Printf("Error reading files: %v", err)
+	}
+
+	fmt.Printf("[READ] Files: %d  |  Heap peak: %d MB  |  Took: %v\n",
+		len(sums), peak/1024/1024, elapsed.Round(time.Millisecond))
+	fmt.Printf("       Tracked files: %s\n", files)
+	fmt.Printf("       %s\n", gcpercent.Stats())
+
+	fmt.Println("\nBoth leaks at once: the heap peaked at the size of every file together,")
+	fmt.Println("and every descriptor is still open after the checksums are done.")
+	fmt.Println("Run: lsof -p", os.Getpid(), "| grep file-leak-read")
+	fmt.Println("Press Ctrl+C to stop")
+	select {}
+}
+
+// readAllBadly checksums every file concurrently by reading it whole, the way
+// os.ReadFile does - but without os.ReadFile's Close
+// BUG: all contents are in memory at the same time, and no file is closed
+func readAllBadly(paths []string) ([]string, error) {
+	contents := make([][]byte, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			file, err := files.Open(path)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			// BUG: file is never closed, and the whole file is kept in memory
+			contents[i], errs[i] = io.ReadAll(file)
+		}(i, path)
+	}
+	wg.Wait()
+
+	sums := make([]string, 0, len(paths))
+	for i, data := range contents {
+		if errs[i] != nil {
+			return sums, errs[i]
+		}
+		sums = append(sums, checksum(data))
+	}
+	return sums, nil
+}
+
+// checksum returns the hex SHA-256 of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// generateInputs writes n files of sizeMB MB into dir. Each file gets its own
+// deterministic byte pattern, so checksums are stable between runs.
+func generateInputs(dir string, n, sizeMB int) ([]string, error) {
+	chunk := make([]byte, 1024*1024)
+	paths := make([]string, n)
+	for i := range paths {
+		for j := range chunk {
+			chunk[j] = byte((j*31 + i) % 251)
+		}
+		paths[i] = fmt.Sprintf("%s/input_%d.dat", dir, i)
+		if err := writeChunks(paths[i], chunk, sizeMB); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// writeChunks writes chunk count times to a new file at path. Setup isn't
+// what this example measures, so it bypasses the tracker.
+func writeChunks(path string, chunk []byte, count int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i := 0; i < count; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchHeap samples HeapAlloc every 10ms until the returned func is called,
+// which reports the highest value seen
+func watchHeap() (stop func() uint64) {
+	var peak uint64
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-finished
+		return peak
+	}
+}
+
+// isFDExhausted reports whether err means the process (EMFILE) or the whole
+// system (ENFILE) has run out of file descriptors
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// explainFDExhaustion describes a descriptor-exhaustion error in terms of the
+// leak instead of letting it scroll past as one more log line
+func explainFDExhaustion(err error) {
+	fmt.Printf("\n✗ Out of file descriptors: %v\n", err)
+	fmt.Printf("   RLIMIT_NOFILE (soft): %d  |  Live tracked files: %d\n", workspace.FileLimit(), files.Current())
+	fmt.Println("   This is where a descriptor leak ends up: every open, accept and dial in")
+	fmt.Println("   the process now fails, not just this file processor.")
+}
+
+// files tracks every file this example opens
+var files = &fdcount.Tracker{}
+
+var workspaceMax = flag.Int64("workspace-max", 0, "cap on bytes kept in the temp workspace; the oldest files are deleted past it (0 = no cap)")
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// fdTestFiles is how many files the FD tests process. It stays well under
+// the usual 1024-descriptor soft limit, so even the leaky version can't run out.
+const fdTestFiles = 300
+
+// TestProcessFileBadlyLeaks calls processFileBadly fdTestFiles times and
+// checks that every file is still open afterwards, by the tracker and by the
+// kernel. It guards the demo in the other direction: a refactor that
+// accidentally fixes the leak fails it.
+func TestProcessFileBadlyLeaks(t *testing.T) {
+	dir := t.TempDir()
+	// The first file the process opens also creates the runtime poller's
+	// descriptors; open one before taking the baseline so they're in it
+	warmup, err := os.CreateTemp(dir, "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmup.Close()
+	files = &fdcount.Tracker{}
+
+	before := fdcount.Count()
+	if before < 0 {
+		t.Skip("no /proc/self/fd or /dev/fd on this platform")
+	}
+	fp := &FileProcessor{}
+	for i := 0; i < fdTestFiles; i++ {
+		if err := fp.processFileBadly(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := files.Current(); got != fdTestFiles {
+		t.Errorf("tracked live files = %d, want %d: every file should leak", got, fdTestFiles)
+	}
+	if delta := fdcount.Count() - before; delta < fdTestFiles {
+		t.Errorf("kernel FDs grew by %d, want at least %d", delta, fdTestFiles)
+	}
+}
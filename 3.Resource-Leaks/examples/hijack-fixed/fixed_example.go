@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// TunnelProxy forwards raw TCP streams to a backend after hijacking the
+// client's HTTP connection, the way a CONNECT or WebSocket proxy does.
+// After Hijack, net/http no longer manages the connection: closing it, and
+// stopping every goroutine that reads from it, is entirely the handler's job.
+// FIXED: both connections are closed on every path, and the handler waits
+// for the reader goroutine to finish before returning.
+type TunnelProxy struct {
+	backends map[string]string // tunnel name -> backend address
+
+	tunnelsOpened int64
+	tunnelsClosed int64
+	dialFailures  int64
+}
+
+func (p *TunnelProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend, ok := p.backends[strings.TrimPrefix(r.URL.Path, "/tunnel/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %v", err)
+		return
+	}
+	// ✅ FIX: the hijacked connection is ours now - close it on every path
+	defer clientConn.Close()
+
+	backendConn, err := net.Dial("tcp", backend)
+	if err != nil {
+		// ✅ FIX: answer the client; the deferred Close releases the socket
+		atomic.AddInt64(&p.dialFailures, 1)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer backendConn.Close()
+	atomic.AddInt64(&p.tunnelsOpened, 1)
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	// backend -> client; done is closed when this reader goroutine exits
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(clientConn, backendConn)
+	}()
+
+	// client -> backend, until the client hangs up
+	io.Copy(backendConn, clientBuf)
+
+	// ✅ FIX: closing the backend side unblocks the reader's Read, and
+	// waiting on done guarantees no goroutine outlives the handler
+	backendConn.Close()
+	<-done
+	atomic.AddInt64(&p.tunnelsClosed, 1)
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	proxyAddr, proxy := startTunnelProxy()
+	time.Sleep(100 * time.Millisecond) // Let servers start
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Print initial state
+	fmt.Printf("[START] Goroutines: %d  |  Open FDs: %d\n", runtime.NumGoroutine(), fdcount.Count())
+	fmt.Println("Opening 20 tunnels/second; clients send one message and hang up.")
+	fmt.Print("Every 10th tunnel targets a backend that refuses connections.\n\n")
+
+	// Simulate clients opening short-lived tunnels
+	ticker := time.NewTicker(50 * time.Millisecond) // 20 tunnels/second
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	reportInterval := 2 * time.Second
+	lastReport := startTime
+
+	for n := 1; ; n++ {
+		<-ticker.C
+		target := "echo"
+		if n%10 == 0 {
+			target = "down"
+		}
+		if err := useTunnel(proxyAddr, target); err != nil && target == "echo" {
+			log.Printf("Error using tunnel: %v", err)
+		}
+
+		// Report every 2 seconds
+		if time.Since(lastReport) >= reportInterval {
+			goroutines := runtime.NumGoroutine()
+			elapsed := time.Since(startTime).Seconds()
+			fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Open FDs: %d  |  Tunnels: %d  |  Closed: %d  |  Dial failures: %d\n",
+				elapsed, goroutines, fdcount.Count(),
+				atomic.LoadInt64(&proxy.tunnelsOpened), atomic.LoadInt64(&proxy.tunnelsClosed),
+				atomic.LoadInt64(&proxy.dialFailures))
+			fmt.Printf("           %s\n", gcpercent.Stats())
+
+			if goroutines <= 10 {
+				fmt.Println("✓ No leak! Every tunnel closed both connections and its reader goroutine")
+			}
+
+			lastReport = time.Now()
+		}
+	}
+}
+
+// startTunnelProxy starts an echo backend and the proxy in front of it and
+// returns the proxy's address. The "down" tunnel points at a closed port.
+func startTunnelProxy() (string, *TunnelProxy) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go serveEcho(echo)
+
+	// Reserve a port, then close it so dialing it is refused
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+
+	proxy := &TunnelProxy{backends: map[string]string{
+		"echo": echo.Addr().String(),
+		"down": downAddr,
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(ln, proxy)
+
+	return ln.Addr().String(), proxy
+}
+
+// serveEcho is a streaming backend: it echoes lines and keeps each connection
+// open until the proxy closes it, like a WebSocket or server-push service
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		}(conn)
+	}
+}
+
+// useTunnel opens a tunnel, sends one line, reads the echo and hangs up
+func useTunnel(proxyAddr, target string) error {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+
+	fmt.Fprintf(conn, "GET /tunnel/%s HTTP/1.1\r\nHost: proxy\r\n\r\n", target)
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading tunnel status: %w", err)
+	}
+	if !strings.Contains(status, " 200 ") {
+		return fmt.Errorf("tunnel refused: %s", strings.TrimSpace(status))
+	}
+	r.ReadString('\n') // blank line ending the header
+
+	fmt.Fprintln(conn, "ping")
+	if _, err := r.ReadString('\n'); err != nil {
+		return fmt.Errorf("reading echo: %w", err)
+	}
+	return nil
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
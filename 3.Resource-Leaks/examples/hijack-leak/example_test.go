@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/netsim"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestPipeTunnels serves the proxy, and an echo backend behind it, over
+// netsim Networks, with no listener and no socket. It checks the leak: tunnels
+// to the echo backend work, but the proxy closes neither side of any of them
+// and leaves two goroutines per tunnel behind; a tunnel to a refused backend
+// gets no answer; and a client that drops mid-echo still leaves its backend
+// open.
+func TestPipeTunnels(t *testing.T) {
+	const tunnels = 10
+
+	socketsBefore := fdcount.Sockets()
+	start := time.Now()
+
+	backends := netsim.NewNetwork()
+	go serveEcho(backends)
+	proxy := &TunnelProxy{
+		backends: map[string]string{"echo": "echo", "down": "down"},
+		dial: func(network, addr string) (net.Conn, error) {
+			if addr == "echo" {
+				return backends.Dial(context.Background(), network, addr)
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		},
+	}
+	front := netsim.NewNetwork()
+	go http.Serve(front, proxy)
+	baseline := runtime.NumGoroutine()
+
+	failed := 0
+	for i := 0; i < tunnels; i++ {
+		conn, _ := front.Dial(context.Background(), "pipe", "proxy")
+		if err := tunnelOver(conn, "echo"); err != nil {
+			failed++
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // let the handlers return
+	check(t, fmt.Sprintf("%d tunnels echoed and hung up, %d failed", tunnels, failed), failed == 0)
+	accepted, closed := backends.Counts()
+	check(t, fmt.Sprintf("the proxy closed none of their backend pipes (%d opened, %d closed)", accepted, closed), accepted == tunnels && closed == 0)
+	grown := runtime.NumGoroutine() - baseline
+	check(t, fmt.Sprintf("and %d goroutines stayed behind, 2 per tunnel: the backend reader and the echo", grown), grown >= 2*tunnels)
+
+	conn, _ := front.Dial(context.Background(), "pipe", "proxy")
+	err := tunnelOver(conn, "down")
+	check(t, fmt.Sprintf("a tunnel to a refused backend got no answer (%v)", err), errors.Is(err, os.ErrDeadlineExceeded))
+
+	conn, _ = front.Dial(context.Background(), "pipe", "proxy")
+	established := len("HTTP/1.1 200 Connection Established\r\n\r")
+	err = tunnelOver(netsim.DropAfter(conn, established+2), "echo")
+	time.Sleep(50 * time.Millisecond)
+	accepted, closed = backends.Counts()
+	check(t, fmt.Sprintf("a client dropped mid-echo (%v) still left its backend open (%d opened, %d closed)", err, accepted, closed),
+		errors.Is(err, io.ErrUnexpectedEOF) && accepted == tunnels+1 && closed == 0)
+
+	accepted, closed = front.Counts()
+	check(t, fmt.Sprintf("no hijacked connection was closed by the proxy (%d accepted, %d closed)", accepted, closed), accepted == tunnels+2 && closed == 0)
+	if socketsBefore >= 0 {
+		check(t, fmt.Sprintf("no socket opened: %d before, %d after, all in %v", socketsBefore, fdcount.Sockets(), time.Since(start).Round(time.Millisecond)),
+			fdcount.Sockets() == socketsBefore)
+	} else {
+		t.Log("socket count unavailable on this platform, skipped")
+	}
+}
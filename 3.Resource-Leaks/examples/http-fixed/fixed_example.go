@@ -2,84 +2,655 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/cache"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutineresources"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/mockapi"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // APIGateway simulates a service that makes HTTP requests to external APIs
 // FIXED: HTTP response bodies are properly closed and timeouts are set
 type APIGateway struct {
-	requestsMade int
-	mockServer   *http.Server
+	requestsMade int64
+	upstreamHits int64 // requests the mock API actually served
+	retries      int64 // extra attempts made by fetchWithRetry
+	cancelled    int64 // -cancel-demo requests abandoned at their deadline
+	inFlight     int64 // -cancel-demo requests still waiting for the mock API
+	mock         *mockapi.Server
 	client       *http.Client
+	config       ClientConfig
+	trace        *httptrace.ClientTrace
+	connsUsed    ConnReuse
+	dialer       *CountingDialer // the client's connections; nil with WithDefaultTransport
+}
+
+// ClientConfig holds the client and Transport settings NewAPIGateway builds
+// its http.Client from. A zero timeout means no limit, as in net/http.
+type ClientConfig struct {
+	Timeout               time.Duration // whole request, including reading the body
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// DefaultClientConfig is what NewAPIGateway uses without options
+var DefaultClientConfig = ClientConfig{
+	Timeout:               5 * time.Second,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	IdleConnTimeout:       30 * time.Second,
+	DialTimeout:           2 * time.Second,
+	TLSHandshakeTimeout:   2 * time.Second,
+	ResponseHeaderTimeout: 2 * time.Second,
+}
+
+// Option configures an APIGateway
+type Option func(*APIGateway)
+
+// WithClientConfig replaces DefaultClientConfig
+func WithClientConfig(cfg ClientConfig) Option {
+	return func(gw *APIGateway) {
+		gw.config = cfg
+	}
 }
 
+// WithDefaultTransport makes the gateway behave like http.Get: no client
+// timeout and a copy of http.DefaultTransport, which keeps only 2 idle
+// connections per host. It exists to compare against the tuned client.
+func WithDefaultTransport() Option {
+	return func(gw *APIGateway) {
+		gw.client = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+}
+
+// NewAPIGateway returns a gateway with a dedicated http.Client built from
+// DefaultClientConfig or the options
+func NewAPIGateway(opts ...Option) *APIGateway {
+	gw := &APIGateway{config: DefaultClientConfig}
+	for _, opt := range opts {
+		opt(gw)
+	}
+	if gw.client == nil {
+		gw.dialer = NewCountingDialer(&net.Dialer{Timeout: gw.config.DialTimeout, KeepAlive: 30 * time.Second})
+		gw.client = gw.config.newClient(gw.dialer)
+	}
+	gw.trace = gw.connsUsed.Trace()
+	return gw
+}
+
+// newClient builds an http.Client from the config that dials through dialer
+func (cfg ClientConfig) newClient(dialer *CountingDialer) *http.Client {
+	// ✅ FIX: Use custom HTTP client with proper settings
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		},
+	}
+}
+
+// ConnReuse counts, through httptrace, what happens to the client's
+// connections: how many were created by a new dial, how many requests reused
+// one from the pool, and how many times a connection went back to the idle
+// pool after a response. A body that is neither read to EOF nor closed never
+// goes back, so the next request has to dial again.
+type ConnReuse struct {
+	created     int64 // ConnectDone without error
+	reused      int64 // GotConn with Reused set
+	wasIdle     int64 // of those, how many had been idle rather than just released
+	idleReturns int64 // PutIdleConn without error
+}
+
+// ReuseCounts is a snapshot of a ConnReuse
+type ReuseCounts struct {
+	Created, Reused, WasIdle, IdleReturns int64
+}
+
+// Trace returns a ClientTrace that feeds r
+func (r *ConnReuse) Trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				atomic.AddInt64(&r.created, 1)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+			atomic.AddInt64(&r.reused, 1)
+			if info.WasIdle {
+				atomic.AddInt64(&r.wasIdle, 1)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil {
+				atomic.AddInt64(&r.idleReturns, 1)
+			}
+		},
+	}
+}
+
+// Counts returns the totals so far
+func (r *ConnReuse) Counts() ReuseCounts {
+	return ReuseCounts{
+		Created:     atomic.LoadInt64(&r.created),
+		Reused:      atomic.LoadInt64(&r.reused),
+		WasIdle:     atomic.LoadInt64(&r.wasIdle),
+		IdleReturns: atomic.LoadInt64(&r.idleReturns),
+	}
+}
+
+// ReuseRatio is the fraction of connections handed to requests that came
+// from the pool, 0 before the first request
+func (c ReuseCounts) ReuseRatio() float64 {
+	if c.Created+c.Reused == 0 {
+		return 0
+	}
+	return float64(c.Reused) / float64(c.Created+c.Reused)
+}
+
+func (r *ConnReuse) String() string {
+	c := r.Counts()
+	return fmt.Sprintf("created %d  |  reused %d (was idle %d)  |  idle returns %d  |  reuse %.0f%%",
+		c.Created, c.Reused, c.WasIdle, c.IdleReturns, 100*c.ReuseRatio())
+}
+
+// CountingDialer wraps a net.Dialer and counts the connections it makes, the
+// dials that failed, and the connections since closed by whoever held them.
+// As a Transport's DialContext, dialed minus closed is every connection the
+// Transport holds, in use or idle. httptrace sees connections created and
+// reused but never closed, so it can't tell an idle pool that
+// IdleConnTimeout will drain from connections pinned by unclosed bodies.
+type CountingDialer struct {
+	dialer    *net.Dialer
+	dialed    int64
+	failed    int64
+	closed    int64
+	peak      int64 // most connections established at once
+	dialNanos int64 // time spent in DialContext, successful or not
+}
+
+// NewCountingDialer returns a CountingDialer that dials with d, or with a
+// zero net.Dialer if d is nil
+func NewCountingDialer(d *net.Dialer) *CountingDialer {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return &CountingDialer{dialer: d}
+}
+
+// DialContext dials and counts; it has the signature of Transport.DialContext
+func (d *CountingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	atomic.AddInt64(&d.dialNanos, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddInt64(&d.failed, 1)
+		return nil, err
+	}
+	established := atomic.AddInt64(&d.dialed, 1) - atomic.LoadInt64(&d.closed)
+	for {
+		peak := atomic.LoadInt64(&d.peak)
+		if established <= peak || atomic.CompareAndSwapInt64(&d.peak, peak, established) {
+			break
+		}
+	}
+	return &countedConn{Conn: conn, dialer: d}, nil
+}
+
+// countedConn counts its first Close
+type countedConn struct {
+	net.Conn
+	dialer *CountingDialer
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.dialer.closed, 1) })
+	return c.Conn.Close()
+}
+
+// DialStats is a snapshot of a CountingDialer
+type DialStats struct {
+	Dialed, Failed, Closed int64
+	Peak                   int64         // most connections established at once
+	DialTime               time.Duration // total time spent dialing
+}
+
+// Established is how many connections are open: dialed and not yet closed
+func (s DialStats) Established() int64 {
+	return s.Dialed - s.Closed
+}
+
+func (s DialStats) String() string {
+	return fmt.Sprintf("established %d  |  dialed %d  |  closed %d  |  failed %d", s.Established(), s.Dialed, s.Closed, s.Failed)
+}
+
+// Stats returns the totals so far
+func (d *CountingDialer) Stats() DialStats {
+	return DialStats{
+		Dialed:   atomic.LoadInt64(&d.dialed),
+		Failed:   atomic.LoadInt64(&d.failed),
+		Closed:   atomic.LoadInt64(&d.closed),
+		Peak:     atomic.LoadInt64(&d.peak),
+		DialTime: time.Duration(atomic.LoadInt64(&d.dialNanos)),
+	}
+}
+
+// WaitEstablished waits up to timeout for at most max connections to be
+// established and returns the stats it stopped at
+func (d *CountingDialer) WaitEstablished(max int64, timeout time.Duration) DialStats {
+	for deadline := time.Now().Add(timeout); d.Stats().Established() > max && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return d.Stats()
+}
+
+// failEvery is shared with http-leak: injected upstream errors are where an
+// unclosed body costs its connection
+var failEvery = flag.Int("fail-every", 0, "make the mock API answer every Nth /api/data request with 503 and an error body (0 = never)")
+
+// endpoint is shared with http-leak, so both can be pointed at the same
+// failure mode
+var endpoint = flag.String("endpoint", "/api/data", "mock API path and query to fetch, e.g. /api/slow?delay=10s, /api/hang, /api/flaky?rate=0.3 or /api/big?bytes=5000000")
+
+// errBadStatus is wrapped by Fetch for non-200 responses
+var errBadStatus = errors.New("bad status")
+
+// retryAttempts is shared with http-leak, whose retry loop skips the closes
+var retryAttempts = flag.Int("retry", 0, "fetch through fetchWithRetry, making up to this many attempts per request (0 = Fetch, no retries)")
+
+// cancelDemo is shared with http-leak, which ignores the deadline
+var cancelDemo = flag.Bool("cancel-demo", false, "send every 5th request to /api/slow?delay=30s with a 50ms deadline, on its own goroutine")
+
+// -cancel-demo requests: every cancelEvery-th tick fetches cancelPath with a
+// cancelDeadline deadline instead of the endpoint
+const (
+	cancelEvery    = 5 // 20% of requests
+	cancelDeadline = 50 * time.Millisecond
+	cancelPath     = "/api/slow?delay=30s"
+)
+
+// Lifecycle flags, identical in http-leak and http-fixed so runs line up
+var (
+	runFor       = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+	slowHandler  = flag.Duration("slow-handler", 5*time.Second, "log mock API handlers still running after this long (0 = never)")
+	closeTimeout = flag.Duration("close-timeout", 5*time.Second, "how long the mock server's shutdown waits for in-flight requests before closing their connections")
+)
+
+// Client flags, passed to NewAPIGateway as a ClientConfig
+var (
+	clientTimeout   = flag.Duration("client-timeout", DefaultClientConfig.Timeout, "http.Client Timeout for a whole request")
+	maxIdle         = flag.Int("max-idle", DefaultClientConfig.MaxIdleConns, "Transport MaxIdleConns")
+	maxIdlePerHost  = flag.Int("max-idle-per-host", DefaultClientConfig.MaxIdleConnsPerHost, "Transport MaxIdleConnsPerHost")
+	idleConnTimeout = flag.Duration("idle-timeout", DefaultClientConfig.IdleConnTimeout, "Transport IdleConnTimeout")
+	dialTimeout     = flag.Duration("dial-timeout", DefaultClientConfig.DialTimeout, "net.Dialer Timeout")
+	tlsTimeout      = flag.Duration("tls-timeout", DefaultClientConfig.TLSHandshakeTimeout, "Transport TLSHandshakeTimeout")
+	headerTimeout   = flag.Duration("header-timeout", DefaultClientConfig.ResponseHeaderTimeout, "Transport ResponseHeaderTimeout")
+)
+
+// clientConfigFromFlags returns the ClientConfig set on the command line
+func clientConfigFromFlags() ClientConfig {
+	return ClientConfig{
+		Timeout:               *clientTimeout,
+		MaxIdleConns:          *maxIdle,
+		MaxIdleConnsPerHost:   *maxIdlePerHost,
+		IdleConnTimeout:       *idleConnTimeout,
+		DialTimeout:           *dialTimeout,
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *headerTimeout,
+	}
+}
+
+var compareClients = flag.Bool("compare-clients", false, "send concurrent bursts through the tuned client and a default one and print their connection reuse, then exit")
+
+var (
+	ciMode     = flag.Bool("ci", false, "after the workload, wait out -idle-timeout and exit 1 if more than -ci-max-conns client connections are still established")
+	ciMaxConns = flag.Int64("ci-max-conns", 0, "client connections allowed to stay established after the idle timeout with -ci")
+)
+
+var (
+	churnMode     = flag.String("mode", "", "compare connection churn over -churn-requests requests: a (new Client and Transport per call), b (the shared tuned client) or both, then exit")
+	churnRequests = flag.Int("churn-requests", 1000, "requests per -mode run")
+	churnProfiles = flag.String("churn-profiles", ".", "directory -mode writes each run's goroutine profile to")
+)
+
+// ciDuration is how long -ci runs the workload without -duration
+const ciDuration = 5 * time.Second
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	if _, ok := churnRuns[*churnMode]; *churnMode != "" && !ok {
+		log.Fatalf("-mode must be a, b or both, not %q", *churnMode)
+	}
+	if *ciMode {
+		if *idleConnTimeout <= 0 {
+			log.Fatal("-ci needs a positive -idle-timeout: idle connections are only closed after it")
+		}
+		if *runFor == 0 {
+			*runFor = ciDuration
+		}
+	}
+
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6061")
-		log.Fatal(http.ListenAndServe("localhost:6061", nil))
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
 	}()
 
-	gateway := &APIGateway{
-		// ✅ FIX: Use custom HTTP client with proper settings
-		client: &http.Client{
-			Timeout: 5 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        10,
-				MaxIdleConnsPerHost: 2,
-				IdleConnTimeout:     30 * time.Second,
-			},
-		},
-	}
+	gateway := NewAPIGateway(WithClientConfig(clientConfigFromFlags()))
 
 	// Start a mock HTTP server to make requests against
 	gateway.startMockServer()
 	time.Sleep(100 * time.Millisecond) // Let server start
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	debugMux.HandleFunc("/debug/conntrack", conns.Handler())
+
+	if *compareClients {
+		compareConnReuse(gateway)
+		return
+	}
+	if *churnMode != "" {
+		compareTransportChurn("http://localhost:8081/api/data", churnRuns[*churnMode], *churnRequests, *churnProfiles)
+		return
+	}
+
 	// Print initial state
 	initialGoroutines := runtime.NumGoroutine()
-	fmt.Printf("[START] Goroutines: %d\n", initialGoroutines)
+	fmt.Printf("[START] Goroutines: %d  |  Endpoint: %s\n", initialGoroutines, *endpoint)
+	retryPolicy := DefaultRetryPolicy
+	if *retryAttempts > 0 {
+		retryPolicy.MaxAttempts = *retryAttempts
+		fmt.Printf("Retrying 5xx and connection errors: up to %d attempts\n", retryPolicy.MaxAttempts)
+	}
+	if *cancelDemo {
+		fmt.Printf("Every %dth request: %s with a %v deadline\n", cancelEvery, cancelPath, cancelDeadline)
+	}
 
-	// Simulate continuous API calls
-	ticker := time.NewTicker(40 * time.Millisecond) // 25 requests/second
-	defer ticker.Stop()
+	// The workload runs until Ctrl+C or -duration, then the mock server is shut down
+	ctx, stop := sighandler.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	// Simulate continuous API calls: -rate requests/second in total from
+	// -concurrency requesters, ramped up over -ramp
+	load := &LoadGenerator{Rate: *rate, Concurrency: *concurrency, Ramp: *ramp}
+	loadDone := make(chan struct{})
+	go func() {
+		defer close(loadDone)
+		load.Run(ctx, func(ctx context.Context, n int64) {
+			// FIXED: fetchDataCorrectly properly closes connections, and
+			// fetchWithRetry closes every attempt's body
+			// Injected 503s are expected with -fail-every, so only other errors are logged
+			var err error
+			if *cancelDemo && n%cancelEvery == 0 {
+				go gateway.fetchWithDeadline(ctx)
+			} else if *retryAttempts > 0 {
+				_, err = gateway.fetchWithRetry(ctx, "http://localhost:8081"+*endpoint, retryPolicy)
+			} else {
+				_, err = gateway.fetchDataCorrectly(ctx)
+			}
+			if err != nil && !errors.Is(err, errBadStatus) && ctx.Err() == nil {
+				log.Printf("Error fetching data: %v", err)
+			}
+			// Every 5th request also asks for an export, a heavier kind of request
+			if n%5 == 0 {
+				if _, err := gateway.Fetch(ctx, "http://localhost:8081/api/export"); err != nil && ctx.Err() == nil {
+					log.Printf("Error fetching export: %v", err)
+				}
+			}
+		})
+	}()
 
+	// Report every 2 seconds
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
 	startTime := time.Now()
-	reportInterval := 2 * time.Second
-	lastReport := startTime
 
-	for range ticker.C {
-		// FIXED: fetchDataCorrectly properly closes connections
-		if _, err := gateway.fetchDataCorrectly(); err != nil {
-			log.Printf("Error fetching data: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			// Every requester has returned once loadDone is closed
+			<-loadDone
+			if sighandler.Terminated(ctx) {
+				sighandler.LogLeakDump("/tmp/leakdump")
+			}
+			ciPassed := !*ciMode || checkIdleConns(gateway)
+			shutdown(gateway)
+			if !ciPassed {
+				os.Exit(1)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		goroutines := runtime.NumGoroutine()
+		elapsed := time.Since(startTime).Seconds()
+		fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Requests made: %d",
+			elapsed, goroutines, atomic.LoadInt64(&gateway.requestsMade))
+		if *retryAttempts > 0 {
+			fmt.Printf("  |  Retries: %d", atomic.LoadInt64(&gateway.retries))
+		}
+		if *cancelDemo {
+			fmt.Printf("  |  Cancelled: %d  |  In flight: %d (server %d)",
+				atomic.LoadInt64(&gateway.cancelled), atomic.LoadInt64(&gateway.inFlight), gateway.mock.InFlight())
+		}
+		fmt.Println()
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		fmt.Printf("           Load: %s\n", load.Report())
+		fmt.Printf("           Server conns: %s\n", conns.Stats())
+		fmt.Printf("           Client conns: %s\n", &gateway.connsUsed)
+		fmt.Printf("           Dialer: %s\n", gateway.dialer.Stats())
+		fmt.Printf("           Per route: %s\n", usage)
+
+		// The load generator and its requesters add concurrency+1
+		if goroutines <= initialGoroutines+*concurrency+6 {
+			fmt.Println("✓ No leak! Connections properly reused")
 		}
+	}
+}
+
+// Load generator flags, shared by http-leak and http-fixed
+var (
+	rate        = flag.Float64("rate", 25, "requests per second in total, once -ramp is over")
+	concurrency = flag.Int("concurrency", 1, "requesters sending in parallel; past what they can keep up with, requests are dropped")
+	ramp        = flag.Duration("ramp", 0, "rise linearly from 0 to -rate over this long (0 = start at -rate)")
+)
 
-		// Report every 2 seconds
-		if time.Since(lastReport) >= reportInterval {
-			goroutines := runtime.NumGoroutine()
-			elapsed := time.Since(startTime).Seconds()
-			fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Requests made: %d\n",
-				elapsed, goroutines, gateway.requestsMade)
+// loadTick is how often LoadGenerator works out which calls are due
+const loadTick = 10 * time.Millisecond
+
+// LoadGenerator calls a function at a target rate from a fixed set of
+// requester goroutines. The rate rises linearly from zero to Rate over Ramp,
+// then holds. When every requester is busy, calls wait for one, but no more
+// than one per requester: the rest are dropped and counted, so a slow
+// upstream shows up as an achieved rate below the target rather than as a
+// backlog that grows without bound.
+type LoadGenerator struct {
+	Rate        float64       // calls per second across all requesters
+	Concurrency int           // requester goroutines; less than 1 means 1
+	Ramp        time.Duration // time to rise from 0 to Rate; 0 starts at Rate
+
+	calls   int64 // calls made, updated atomically
+	dropped int64 // calls dropped while every requester was busy
+
+	mu        sync.Mutex
+	started   time.Time
+	lastAt    time.Time // when Report last ran
+	lastCalls int64     // calls at that time
+}
 
-			if goroutines <= initialGoroutines+5 {
-				fmt.Println("✓ No leak! Connections properly reused")
+// TargetRate returns the target calls per second at elapsed into the run
+func (g *LoadGenerator) TargetRate(elapsed time.Duration) float64 {
+	if g.Ramp > 0 && elapsed < g.Ramp {
+		return g.Rate * float64(elapsed) / float64(g.Ramp)
+	}
+	return g.Rate
+}
+
+// requesters returns the number of requester goroutines Run starts
+func (g *LoadGenerator) requesters() int {
+	if g.Concurrency < 1 {
+		return 1
+	}
+	return g.Concurrency
+}
+
+// Run calls fn until ctx ends, passing ctx and the call's number, from 1.
+// fn must return soon after ctx ends, because Run returns only once every
+// requester has, so nothing it started is left running.
+func (g *LoadGenerator) Run(ctx context.Context, fn func(ctx context.Context, n int64)) {
+	due := make(chan int64)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < g.requesters(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case n := <-due:
+					fn(ctx, n)
+					atomic.AddInt64(&g.calls, 1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	g.mu.Lock()
+	g.started, g.lastAt = start, start
+	g.mu.Unlock()
+
+	ticker := time.NewTicker(loadTick)
+	defer ticker.Stop()
+	last := start
+	owed := 0.0 // calls due but not yet handed to a requester
+	var n int64
+	for {
+		select {
+		case now := <-ticker.C:
+			owed += g.TargetRate(now.Sub(start)) * now.Sub(last).Seconds()
+			last = now
+			if backlog := owed - float64(g.requesters()); backlog >= 1 {
+				atomic.AddInt64(&g.dropped, int64(backlog))
+				owed -= float64(int64(backlog))
+			}
+			for ; owed >= 1; owed-- {
+				n++
+				select {
+				case due <- n:
+				case <-ctx.Done():
+					return
+				}
 			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			lastReport = time.Now()
+// Report formats the rate achieved since the last Report, or since Run
+// started, against the target now
+func (g *LoadGenerator) Report() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	calls := atomic.LoadInt64(&g.calls)
+	var achieved, target float64
+	if !g.started.IsZero() {
+		if d := now.Sub(g.lastAt).Seconds(); d > 0 {
+			achieved = float64(calls-g.lastCalls) / d
 		}
+		target = g.TargetRate(now.Sub(g.started))
 	}
+	g.lastAt, g.lastCalls = now, calls
+	return fmt.Sprintf("achieved %.1f/s of %.1f/s  |  concurrency %d  |  dropped %d",
+		achieved, target, g.requesters(), atomic.LoadInt64(&g.dropped))
 }
 
 // fetchDataCorrectly makes an HTTP request and ensures the response body is closed
-func (gw *APIGateway) fetchDataCorrectly() ([]byte, error) {
+func (gw *APIGateway) fetchDataCorrectly(ctx context.Context) ([]byte, error) {
+	return gw.Fetch(ctx, "http://localhost:8081"+*endpoint)
+}
+
+// fetchWithDeadline fetches cancelPath with a cancelDeadline deadline. When
+// it passes, the Transport abandons the request and closes its connection,
+// and the mock API's handler sees its request context end, so neither side
+// keeps a goroutine for the remaining 30s.
+func (gw *APIGateway) fetchWithDeadline(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, cancelDeadline)
+	defer cancel()
+	atomic.AddInt64(&gw.inFlight, 1)
+	defer atomic.AddInt64(&gw.inFlight, -1)
+
+	_, err := gw.Fetch(ctx, "http://localhost:8081"+cancelPath)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		atomic.AddInt64(&gw.cancelled, 1)
+	case err != nil && ctx.Err() == nil:
+		log.Printf("Error fetching %s: %v", cancelPath, err)
+	}
+}
+
+// Fetch GETs url and returns the whole body. ctx bounds the request,
+// including reading the body.
+func (gw *APIGateway) Fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), gw.trace))
+
 	// ✅ FIX: Use client with timeout
-	resp, err := gw.client.Get("http://localhost:8081/api/data")
+	resp, err := gw.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +665,7 @@ func (gw *APIGateway) fetchDataCorrectly() ([]byte, error) {
 	// Check status
 	if resp.StatusCode != 200 {
 		// Body will still be closed by defer
-		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("%w: %d", errBadStatus, resp.StatusCode)
 	}
 
 	// Read body
@@ -104,39 +675,431 @@ func (gw *APIGateway) fetchDataCorrectly() ([]byte, error) {
 		return nil, err
 	}
 
-	gw.requestsMade++
+	atomic.AddInt64(&gw.requestsMade, 1)
 
 	// Response body will be closed automatically by defer
 	return data, nil
 }
 
-// startMockServer creates a simple HTTP server for testing
-func (gw *APIGateway) startMockServer() {
-	mux := http.NewServeMux()
+// RetryPolicy controls fetchWithRetry
+type RetryPolicy struct {
+	MaxAttempts int           // attempts in total, including the first
+	BaseDelay   time.Duration // backoff ceiling before the second attempt, doubled for each one after
+	MaxDelay    time.Duration // cap on the backoff ceiling
+}
+
+// DefaultRetryPolicy makes up to 4 attempts, waiting up to 50ms, 100ms and
+// 200ms between them
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+// backoff returns the wait before attempt n (1 for the first retry): a
+// uniformly random duration up to BaseDelay×2^(n-1), capped at MaxDelay. The
+// full jitter keeps clients that failed together from retrying together.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	ceiling := p.BaseDelay << (n - 1)
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
 
-	mux.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
+// maxRetryDrain caps how much of a failed attempt's body is read before it
+// is closed; past that, dropping the connection is cheaper than reading on
+const maxRetryDrain = 64 << 10
+
+// fetchWithRetry GETs url like Fetch, but retries connection errors and 5xx
+// responses up to policy.MaxAttempts attempts with exponential backoff and
+// full jitter. It stops early when ctx ends. Every attempt's body is drained
+// and closed before the next attempt starts, so a retry storm never holds
+// more than one connection per call.
+func (gw *APIGateway) fetchWithRetry(ctx context.Context, url string, policy RetryPolicy) ([]byte, error) {
+	var err error
+	for n := 0; n < policy.MaxAttempts; n++ {
+		if n > 0 {
+			atomic.AddInt64(&gw.retries, 1)
+			timer := time.NewTimer(policy.backoff(n))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("%w after %d attempts, last: %v", ctx.Err(), n, err)
+			}
+		}
+
+		var data []byte
+		var retry bool
+		data, retry, err = gw.attempt(ctx, url)
+		if !retry {
+			return data, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", policy.MaxAttempts, err)
+}
+
+// attempt makes one request for fetchWithRetry and reports whether its
+// failure is worth retrying
+func (gw *APIGateway) attempt(ctx context.Context, url string) (data []byte, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), gw.trace))
+
+	resp, err := gw.client.Do(req)
+	if err != nil {
+		// A connection error is transient, unless it is ctx ending
+		return nil, ctx.Err() == nil, err
+	}
+
+	// ✅ FIX: the drain and close are deferred here, once per attempt. A
+	// defer in fetchWithRetry's loop would hold every failed attempt's body,
+	// and its connection, until the last attempt returned.
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryDrain))
+		resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("%w: %d", errBadStatus, resp.StatusCode)
+	case resp.StatusCode != 200:
+		return nil, false, fmt.Errorf("%w: %d", errBadStatus, resp.StatusCode)
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	atomic.AddInt64(&gw.requestsMade, 1)
+	return data, false, nil
+}
+
+// startMockServer starts the mock API on :8081 with the example's /api/data
+// and /api/export
+func (gw *APIGateway) startMockServer() {
+	gw.mock = mockapi.New(*slowHandler, conns)
+	gw.mock.HandleFunc("/api/data", usage.Track("/api/data", func(w http.ResponseWriter, r *http.Request) {
+		hit := atomic.AddInt64(&gw.upstreamHits, 1)
 		// Simulate some processing time
 		time.Sleep(10 * time.Millisecond)
+		if *failEvery > 0 && hit%int64(*failEvery) == 0 {
+			http.Error(w, strings.Repeat("upstream busy ", 100), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"ok","data":"test-%d"}`, gw.requestsMade)
-	})
+		body := fmt.Sprintf(`{"status":"ok","data":"test-%d"}`, hit)
+		goroutineresources.RecordAlloc(r.Context(), int64(len(body)))
+		io.WriteString(w, body)
+	}))
+	gw.mock.HandleFunc("/api/export", usage.Track("/api/export", serveExport))
+	if err := gw.mock.Start(":8081"); err != nil {
+		log.Fatalf("Mock server error: %v", err)
+	}
+}
+
+// conns tracks the mock server's connections
+var conns = conntrack.New()
+
+// usage sums what each request to the mock API used, per route
+var usage = goroutineresources.NewRoutes()
+
+// serveExport renders a report into a temporary file and streams it back,
+// the kind of request that costs a descriptor and a buffer per call
+func serveExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body := []byte(strings.Repeat(`{"row":"export"}`+"\n", 512))
+	goroutineresources.RecordAlloc(ctx, int64(cap(body)))
 
-	gw.mockServer = &http.Server{
-		Addr:    ":8081",
-		Handler: mux,
+	f, err := os.CreateTemp("", "export-*.json")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	goroutineresources.RecordFDOpen(ctx)
+	// ✅ FIX: close and remove the file whichever way the handler returns
+	defer func() {
+		f.Close()
+		goroutineresources.RecordFDClose(ctx)
+		os.Remove(f.Name())
+	}()
 
-	go func() {
-		if err := gw.mockServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("Mock server error: %v", err)
+	if _, err := f.Write(body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, f)
+}
+
+// Stop shuts the mock server down gracefully, see mockapi.Server.Stop
+func (gw *APIGateway) Stop(ctx context.Context) (mockapi.StopReport, error) {
+	if gw.mock != nil {
+		return gw.mock.Stop(ctx)
+	}
+	return mockapi.StopReport{}, nil
+}
+
+// shutdown stops the mock server within -close-timeout and prints what is
+// left, in the same format as http-leak
+func shutdown(gw *APIGateway) {
+	fmt.Println("\nWorkload stopped - shutting down the mock server")
+	ctx, cancel := context.WithTimeout(context.Background(), *closeTimeout)
+	report, err := gw.Stop(ctx)
+	cancel()
+	fmt.Printf("Mock server stopped: %s\n", report)
+	if err != nil {
+		log.Printf("Mock server didn't drain within %v: %v", *closeTimeout, err)
+	}
+	gw.client.CloseIdleConnections()
+	waitConnsClosed(time.Second)
+	fmt.Printf("[FINAL] Goroutines: %d  |  Requests made: %d\n",
+		runtime.NumGoroutine(), atomic.LoadInt64(&gw.requestsMade))
+	fmt.Printf("           Server conns: %s\n", conns.Stats())
+	fmt.Printf("           Client conns: %s\n", &gw.connsUsed)
+}
+
+// checkIdleConns is the -ci check. It runs after the workload and before the
+// mock server shuts down, which would close every connection and hide a
+// leak. Once the Transport's IdleConnTimeout has passed, idle connections
+// are closed, so the ones still established are pinned by a body nobody
+// closed. It reports whether at most -ci-max-conns are left.
+func checkIdleConns(gw *APIGateway) bool {
+	fmt.Printf("\n[CI] Workload stopped. Dialer: %s\n", gw.dialer.Stats())
+	start := time.Now()
+	s := gw.dialer.WaitEstablished(*ciMaxConns, gw.config.IdleConnTimeout+time.Second)
+	if s.Established() > *ciMaxConns {
+		fmt.Printf("[CI] ✗ %d client connections still established %v later, past the %v idle timeout (max %d)\n",
+			s.Established(), time.Since(start).Round(time.Millisecond), gw.config.IdleConnTimeout, *ciMaxConns)
+		fmt.Println("[CI]   Idle connections would have been closed by now: these are held by unclosed bodies")
+		return false
+	}
+	fmt.Printf("[CI] ✓ %d client connections established %v later, within the %v idle timeout (max %d)\n",
+		s.Established(), time.Since(start).Round(time.Millisecond), gw.config.IdleConnTimeout, *ciMaxConns)
+	return true
+}
+
+// waitConnsClosed waits up to timeout for the server's connections to report
+// StateClosed, which their goroutines do as they unwind just after Shutdown
+// returns. It reports whether none is left.
+func waitConnsClosed(timeout time.Duration) bool {
+	live := func() int {
+		s := conns.Stats()
+		return s.New + s.Active + s.Idle
+	}
+	for deadline := time.Now().Add(timeout); live() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return live() == 0
+}
+
+// burst sends n concurrent requests to url and waits for them
+func (gw *APIGateway) burst(url string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gw.Fetch(context.Background(), url); err != nil {
+				log.Printf("Error fetching data: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Bursts sent by -compare-clients and TestConnReuse
+const (
+	burstRounds = 20
+	burstSize   = 8
+)
+
+// compareConnReuse sends the same concurrent bursts through the gateway's
+// tuned client and through a default one. Both drain and close every body,
+// so the only difference is the Transport: with 2 idle connections per host,
+// the default one closes most of each burst's connections and dials new ones
+// for the next.
+func compareConnReuse(tuned *APIGateway) {
+	url := "http://localhost:8081/api/data"
+	fmt.Printf("Sending %d bursts of %d concurrent requests to %s...\n\n", burstRounds, burstSize, url)
+	fmt.Printf("%-28s %8s %8s %9s %13s %15s\n", "client", "created", "reused", "was idle", "idle returns", "server accepts")
+
+	for _, c := range []struct {
+		name string
+		gw   *APIGateway
+	}{
+		{fmt.Sprintf("tuned (%d idle per host)", tuned.config.MaxIdleConnsPerHost), tuned},
+		{"default (2 idle per host)", NewAPIGateway(WithDefaultTransport())},
+	} {
+		acceptedBefore := conns.Stats().Accepted
+		for round := 0; round < burstRounds; round++ {
+			c.gw.burst(url, burstSize)
 		}
-	}()
+		n := c.gw.connsUsed.Counts()
+		fmt.Printf("%-28s %8d %8d %9d %13d %15d\n", c.name, n.Created, n.Reused, n.WasIdle, n.IdleReturns,
+			conns.Stats().Accepted-acceptedBefore)
+		c.gw.client.CloseIdleConnections()
+	}
+	fmt.Printf("\n           %s\n", gcpercent.Stats())
 }
 
-// Graceful shutdown example
-func (gw *APIGateway) Shutdown(ctx context.Context) error {
-	if gw.mockServer != nil {
-		return gw.mockServer.Shutdown(ctx)
+// churnWorkers is how many goroutines send -mode's requests, so the shared
+// client needs more than one connection
+const churnWorkers = burstSize
+
+// churnRuns maps -mode to the runs it makes
+var churnRuns = map[string][]string{"a": {"a"}, "b": {"b"}, "both": {"a", "b"}}
+
+// churnResult is what one -mode run cost
+type churnResult struct {
+	Name       string
+	Dial       DialStats
+	Goroutines int // left running when the requests were done
+	Took       time.Duration
+	Profile    string // goroutine profile written at the end of the run
+}
+
+// runChurn sends requests to url from churnWorkers goroutines. Run "a"
+// builds a new Client and Transport for every call, the way code that
+// constructs a client inside its request function does. Every call dials,
+// and each abandoned Transport keeps its idle connection and the
+// connection's two goroutines, because a zero Transport never times idle
+// connections out. Run "b" sends everything through one client built from
+// the command line's ClientConfig. Both dial through a CountingDialer and
+// drain and close every body. The goroutine profile is written to dir
+// before cleaning up, so it shows what the run left behind.
+func runChurn(name, url string, requests int, dir string) churnResult {
+	r := churnResult{Name: name}
+	baseline := runtime.NumGoroutine()
+	dialer := NewCountingDialer(&net.Dialer{Timeout: *dialTimeout, KeepAlive: 30 * time.Second})
+
+	var (
+		mu         sync.Mutex
+		transports []*http.Transport // run a's, kept only to clean up afterwards
+	)
+	shared := clientConfigFromFlags().newClient(dialer)
+	clientFor := func() *http.Client {
+		if name == "b" {
+			return shared
+		}
+		// BUG (on purpose): a new Transport per call, never closed
+		t := &http.Transport{DialContext: dialer.DialContext}
+		mu.Lock()
+		transports = append(transports, t)
+		mu.Unlock()
+		return &http.Client{Transport: t}
+	}
+
+	start := time.Now()
+	var (
+		wg   sync.WaitGroup
+		next int64
+	)
+	for w := 0; w < churnWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(requests) {
+				resp, err := clientFor().Get(url)
+				if err != nil {
+					log.Printf("Error fetching data: %v", err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	r.Took = time.Since(start)
+	r.Dial = dialer.Stats()
+	r.Goroutines = runtime.NumGoroutine() - baseline
+
+	r.Profile = filepath.Join(dir, "churn-"+name+".goroutine.pprof")
+	if f, err := os.Create(r.Profile); err != nil {
+		log.Printf("Error writing goroutine profile: %v", err)
+		r.Profile = "-"
+	} else {
+		pprof.Lookup("goroutine").WriteTo(f, 0)
+		f.Close()
+	}
+
+	// Clean up so the next run starts from the same baseline
+	shared.CloseIdleConnections()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+	dialer.WaitEstablished(0, time.Second)
+	// The server's side of each connection ends a moment after the client's
+	for deadline := time.Now().Add(2 * time.Second); runtime.NumGoroutine() > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r
+}
+
+// compareTransportChurn makes each of runs against url and prints their
+// costs side by side
+func compareTransportChurn(url string, runs []string, requests int, dir string) {
+	fmt.Printf("Sending %d requests to %s from %d goroutines...\n\n", requests, url, churnWorkers)
+	labels := map[string]string{"a": "a: Transport per call", "b": "b: shared client"}
+
+	var results []churnResult
+	for _, name := range runs {
+		results = append(results, runChurn(name, url, requests, dir))
+	}
+
+	row := func(label string, cell func(churnResult) string) {
+		fmt.Printf("%-26s", label)
+		for _, r := range results {
+			fmt.Printf(" %-26s", cell(r))
+		}
+		fmt.Println()
 	}
-	return nil
+	row("", func(r churnResult) string { return labels[r.Name] })
+	row("connections established", func(r churnResult) string { return strconv.FormatInt(r.Dial.Dialed, 10) })
+	row("peak simultaneous", func(r churnResult) string { return strconv.FormatInt(r.Dial.Peak, 10) })
+	row("total dial time", func(r churnResult) string { return r.Dial.DialTime.Round(time.Microsecond).String() })
+	row("goroutines left running", func(r churnResult) string { return fmt.Sprintf("%+d", r.Goroutines) })
+	row("took", func(r churnResult) string { return r.Took.Round(time.Millisecond).String() })
+	row("goroutine profile", func(r churnResult) string { return r.Profile })
+	fmt.Printf("\n           %s\n", gcpercent.Stats())
+}
+
+// CachingGateway puts a pkg/cache LRUCache in front of APIGateway.Fetch. Concurrent
+// misses for the same URL are coalesced into a single upstream request, so a
+// cold or just-evicted URL can't set off a stampede against the API.
+type CachingGateway struct {
+	gw    *APIGateway
+	cache *cache.LRUCache[[]byte]
+}
+
+func NewCachingGateway(gw *APIGateway, capacity int) *CachingGateway {
+	return &CachingGateway{gw: gw, cache: cache.NewLRUCache[[]byte](capacity)}
+}
+
+// Fetch returns the cached body for url, loading it upstream on a miss.
+// Every caller shares the same slice, so it must not be modified. The load is
+// shared by every waiter, so it runs without any one caller's ctx.
+func (cg *CachingGateway) Fetch(url string) ([]byte, error) {
+	return cg.cache.GetOrLoad(url, func() ([]byte, error) {
+		return cg.gw.Fetch(context.Background(), url)
+	})
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
 }
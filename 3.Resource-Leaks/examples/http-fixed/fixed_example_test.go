@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/mockapi"
+)
+
+// TestFetchReleasesEverything calls Fetch a few thousand times against an
+// httptest server that fails every 10th request with a body, so both the
+// 200 path and the drain-on-error path run. With every body drained and
+// closed the client reuses one connection, and once it and the server are
+// closed the goroutine count is back at its baseline.
+func TestFetchReleasesEverything(t *testing.T) {
+	const fetches = 3000
+
+	baseline := runtime.NumGoroutine()
+
+	var served int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&served, 1)%10 == 0 {
+			http.Error(w, strings.Repeat("upstream error ", 100), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	var newConns int64
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	server.Start()
+
+	gw := NewAPIGateway()
+	var failed int64
+	for i := 0; i < fetches; i++ {
+		if _, err := gw.Fetch(context.Background(), server.URL); err != nil {
+			failed++
+		}
+	}
+	during := runtime.NumGoroutine()
+
+	if made := atomic.LoadInt64(&gw.requestsMade); made+failed != fetches || failed != fetches/10 {
+		t.Errorf("%d requests: %d ok, %d failed; want %d ok, %d non-200 drained and closed",
+			fetches, made, failed, fetches-fetches/10, fetches/10)
+	}
+	if n := atomic.LoadInt64(&newConns); n != 1 {
+		t.Errorf("server accepted %d connections for %d requests, want 1: every body released for reuse", n, fetches)
+	}
+
+	gw.client.CloseIdleConnections()
+	server.Close()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > baseline {
+		t.Errorf("goroutines: %d before, %d during, %d after closing; want <= %d", baseline, during, after, baseline)
+	}
+}
+
+// TestCachingGatewayCoalesces sends 20 concurrent requests for one URL
+// through a CachingGateway while the upstream is slow, and checks that the
+// upstream served exactly one of them and every caller got its body
+func TestCachingGatewayCoalesces(t *testing.T) {
+	const concurrent = 20
+
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := atomic.AddInt64(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"status":"ok","data":"test-%d"}`, hit)
+	}))
+	defer server.Close()
+	gw := NewAPIGateway()
+	defer gw.client.CloseIdleConnections()
+	cg := NewCachingGateway(gw, 100)
+
+	bodies := make([][]byte, concurrent)
+	errs := make([]error, concurrent)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range concurrent {
+		wg.Go(func() {
+			<-start
+			bodies[i], errs[i] = cg.Fetch(server.URL)
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("upstream served %d requests for %d concurrent callers, want 1", n, concurrent)
+	}
+	cached, ok := cg.cache.Get(server.URL)
+	if !ok || string(cached) != `{"status":"ok","data":"test-1"}` {
+		t.Fatalf("cached body = %q, %v, want the first response", cached, ok)
+	}
+	for i := range bodies {
+		if errs[i] != nil || !bytes.Equal(bodies[i], cached) {
+			t.Errorf("caller %d got %q, %v, want the cached body", i, bodies[i], errs[i])
+		}
+	}
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestConnReuse checks keepalive reuse against an httptest server. With
+// bodies drained and closed, sequential requests share one connection and
+// concurrent bursts reuse the same burstSize connections. The default
+// Transport's 2 idle connections per host make the same bursts dial again,
+// and closing bodies without reading them prevents reuse entirely.
+func TestConnReuse(t *testing.T) {
+	body := strings.Repeat("x", 1<<20) // too large to be read ahead before Close
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond) // keep a burst's requests in flight together
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	gw := NewAPIGateway()
+	for i := 0; i < 100; i++ {
+		gw.Fetch(context.Background(), server.URL)
+	}
+	n := gw.connsUsed.Counts()
+	check(t, fmt.Sprintf("100 sequential requests: created %d, reused %d, was idle %d (want 1 created, 99 reused)", n.Created, n.Reused, n.WasIdle),
+		n.Created == 1 && n.Reused == 99 && n.WasIdle == 99)
+	check(t, fmt.Sprintf("every response returned its connection to the idle pool: %d idle returns (want 100)", n.IdleReturns),
+		n.IdleReturns == 100)
+	check(t, fmt.Sprintf("reuse ratio %.2f (want >= %.2f)", n.ReuseRatio(), minReuseRatio), n.ReuseRatio() >= minReuseRatio)
+	gw.client.CloseIdleConnections()
+
+	dialedBy := func(gw *APIGateway) int64 {
+		for round := 0; round < burstRounds; round++ {
+			gw.burst(server.URL, burstSize)
+		}
+		gw.client.CloseIdleConnections()
+		return gw.connsUsed.Counts().Created
+	}
+	tuned := dialedBy(NewAPIGateway())
+	check(t, fmt.Sprintf("%d bursts of %d, tuned client: created %d (want <= %d)", burstRounds, burstSize, tuned, burstSize),
+		tuned <= burstSize)
+	churned := dialedBy(NewAPIGateway(WithDefaultTransport()))
+	check(t, fmt.Sprintf("%d bursts of %d, default Transport: created %d (want more than the tuned client)", burstRounds, burstSize, churned),
+		churned > tuned)
+
+	undrained := NewAPIGateway()
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), undrained.trace))
+		if resp, err := undrained.client.Do(req); err == nil {
+			resp.Body.Close() // closed but not read: the connection can't be reused
+		}
+	}
+	undrained.client.CloseIdleConnections()
+	n = undrained.connsUsed.Counts()
+	check(t, fmt.Sprintf("10 requests closed without reading: created %d, reused %d, idle returns %d (want 10 created)", n.Created, n.Reused, n.IdleReturns),
+		n.Created == 10 && n.Reused == 0 && n.IdleReturns == 0)
+}
+
+// TestRetryStorm checks fetchWithRetry against httptest servers through a
+// bodyCounter. After a storm of concurrent calls against a mostly failing
+// server, no body may be left open and the goroutine count must be back at
+// its baseline. It also checks the attempt count against a server that
+// always fails and against a closed port, and that ctx ends a backoff.
+func TestRetryStorm(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	var served int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&served, 1)%5 != 0 {
+			http.Error(w, strings.Repeat("upstream busy ", 100), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+
+	gw := NewAPIGateway()
+	counter := &bodyCounter{next: gw.client.Transport}
+	gw.client.Transport = counter
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	var succeeded, exhausted, other int64
+	var wg sync.WaitGroup
+	for i := 0; i < stormCallers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < stormCalls; j++ {
+				_, err := gw.fetchWithRetry(context.Background(), server.URL, policy)
+				switch {
+				case err == nil:
+					atomic.AddInt64(&succeeded, 1)
+				case errors.Is(err, errBadStatus):
+					atomic.AddInt64(&exhausted, 1)
+				default:
+					atomic.AddInt64(&other, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	calls := int64(stormCallers * stormCalls)
+	retries := atomic.LoadInt64(&gw.retries)
+	t.Logf("Retry storm: %d callers x %d calls, 4 of 5 responses are 503", stormCallers, stormCalls)
+	t.Logf("%d succeeded, %d gave up after %d attempts, %d retries, %d requests served",
+		succeeded, exhausted, policy.MaxAttempts, retries, served)
+	check(t, fmt.Sprintf("every call ended in success or a 5xx after its last attempt (%d other errors)", other),
+		succeeded+exhausted == calls)
+	check(t, fmt.Sprintf("every retry reached the server (%d served = %d calls + %d retries)", served, calls, retries),
+		served == calls+retries)
+	check(t, fmt.Sprintf("%d of %d response bodies left open", atomic.LoadInt64(&counter.open), counter.trips),
+		atomic.LoadInt64(&counter.open) == 0)
+
+	gw.client.CloseIdleConnections()
+	server.Close()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	check(t, fmt.Sprintf("goroutines back to baseline after closing (%d -> %d)", baseline, after), after <= baseline)
+
+	// A server that always fails gets exactly MaxAttempts requests
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	tripsBefore := atomic.LoadInt64(&counter.trips)
+	_, err := gw.fetchWithRetry(context.Background(), down.URL, policy)
+	check(t, fmt.Sprintf("an always-500 server got %d attempts (%v)", atomic.LoadInt64(&counter.trips)-tripsBefore, err),
+		errors.Is(err, errBadStatus) && atomic.LoadInt64(&counter.trips)-tripsBefore == int64(policy.MaxAttempts))
+
+	// A 4xx is the caller's problem: no retry
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	tripsBefore = atomic.LoadInt64(&counter.trips)
+	_, err = gw.fetchWithRetry(context.Background(), notFound.URL, policy)
+	check(t, fmt.Sprintf("a 404 was not retried (%d attempt)", atomic.LoadInt64(&counter.trips)-tripsBefore),
+		errors.Is(err, errBadStatus) && atomic.LoadInt64(&counter.trips)-tripsBefore == 1)
+
+	// Connection errors are retried too
+	refused := down.URL
+	down.Close()
+	notFound.Close()
+	tripsBefore = atomic.LoadInt64(&counter.trips)
+	_, err = gw.fetchWithRetry(context.Background(), refused, policy)
+	check(t, fmt.Sprintf("a closed port got %d attempts (%v)", atomic.LoadInt64(&counter.trips)-tripsBefore, err),
+		err != nil && atomic.LoadInt64(&counter.trips)-tripsBefore == int64(policy.MaxAttempts))
+
+	// ctx ends a backoff wait
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	start := time.Now()
+	_, err = gw.fetchWithRetry(ctx, refused, RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Second, MaxDelay: 10 * time.Second})
+	cancel()
+	took := time.Since(start)
+	check(t, fmt.Sprintf("ctx ended the backoff after %v (%v)", took.Round(time.Millisecond), err),
+		errors.Is(err, context.DeadlineExceeded) && took < time.Second)
+	check(t, fmt.Sprintf("0 response bodies left open in total (%d)", atomic.LoadInt64(&counter.open)),
+		atomic.LoadInt64(&counter.open) == 0)
+}
+
+// TestCountingDialer checks CountingDialer as a Transport's DialContext
+// against an httptest server. Drained and closed bodies share one idle
+// connection that IdleConnTimeout closes; unclosed bodies keep theirs
+// established past it until they are closed; CloseIdleConnections closes an
+// idle one at once; and a failed dial is counted as failed, not established.
+func TestCountingDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1<<20)) // too large to be read ahead before Close
+	}))
+	defer server.Close()
+
+	dialer := NewCountingDialer(nil)
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, IdleConnTimeout: dialerIdleTimeout}}
+	get := func() *http.Response {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			check(t, fmt.Sprintf("GET %s: %v", server.URL, err), false)
+			return nil
+		}
+		return resp
+	}
+
+	for i := 0; i < 20; i++ {
+		if resp := get(); resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	s := dialer.Stats()
+	check(t, fmt.Sprintf("20 drained and closed bodies: %s (want 1 dialed, 1 established and idle)", s),
+		s.Dialed == 1 && s.Established() == 1)
+	s = dialer.WaitEstablished(0, dialerIdleTimeout+time.Second)
+	check(t, fmt.Sprintf("after the %v idle timeout: %s (want 0 established)", dialerIdleTimeout, s), s.Established() == 0)
+
+	var open []*http.Response
+	for i := 0; i < 5; i++ {
+		if resp := get(); resp != nil {
+			open = append(open, resp)
+		}
+	}
+	time.Sleep(2 * dialerIdleTimeout)
+	s = dialer.Stats()
+	check(t, fmt.Sprintf("5 unclosed bodies, twice the idle timeout later: %s (want 5 established)", s), s.Established() == 5)
+	for _, resp := range open {
+		resp.Body.Close() // not read, so the Transport closes the connection
+	}
+	s = dialer.WaitEstablished(0, time.Second)
+	check(t, fmt.Sprintf("closing them unread: %s (want 0 established)", s), s.Established() == 0)
+
+	if resp := get(); resp != nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	client.CloseIdleConnections()
+	s = dialer.Stats()
+	check(t, fmt.Sprintf("CloseIdleConnections on 1 idle connection: %s (want 0 established at once)", s), s.Established() == 0)
+
+	closedPort := "127.0.0.1:1"
+	if l, err := net.Listen("tcp", "127.0.0.1:0"); err == nil {
+		closedPort = l.Addr().String()
+		l.Close()
+	}
+	before := dialer.Stats()
+	if conn, err := dialer.DialContext(context.Background(), "tcp", closedPort); err == nil {
+		conn.Close()
+	}
+	s = dialer.Stats()
+	check(t, fmt.Sprintf("dialing a closed port: %s (want 1 more failed, none dialed)", s),
+		s.Failed == before.Failed+1 && s.Dialed == before.Dialed)
+}
+
+// TestLoadGenerator runs LoadGenerator against functions that wait on ctx
+// instead of a server. It checks the achieved rate at full rate and over a
+// ramp, that a saturated generator drops calls instead of queueing them,
+// and that the goroutine count is back at its baseline when Run returns,
+// whether its context timed out or the process got SIGINT.
+func TestLoadGenerator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the generator for about 3s")
+	}
+	waitForCount := func(want int) int {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return runtime.NumGoroutine()
+	}
+	sleep := func(d time.Duration) func(context.Context, int64) {
+		return func(ctx context.Context, _ int64) {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}
+	}
+	near := func(got, want float64) bool { return got >= 0.85*want && got <= 1.15*want }
+
+	// os/signal starts a goroutine of its own on first use, which never
+	// exits; start it before the baseline
+	_, stopWarmup := signal.NotifyContext(context.Background(), os.Interrupt)
+	stopWarmup()
+	baseline := runtime.NumGoroutine()
+
+	run := func(g *LoadGenerator, d time.Duration, fn func(context.Context, int64)) (calls, dropped int64) {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		g.Run(ctx, fn)
+		return atomic.LoadInt64(&g.calls), atomic.LoadInt64(&g.dropped)
+	}
+
+	g := &LoadGenerator{Rate: 200, Concurrency: 4}
+	calls, dropped := run(g, time.Second, sleep(time.Millisecond))
+	check(t, fmt.Sprintf("rate 200/s for 1s: %d calls, %d dropped (want about 200, none dropped)", calls, dropped),
+		near(float64(calls), 200) && dropped == 0)
+	n := waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d when the duration ends (baseline %d)", n, baseline), n <= baseline)
+
+	g = &LoadGenerator{Rate: 200, Concurrency: 4, Ramp: time.Second}
+	calls, _ = run(g, time.Second, sleep(time.Millisecond))
+	check(t, fmt.Sprintf("ramping from 0 to 200/s over 1s: %d calls (want about 100)", calls), near(float64(calls), 100))
+
+	g = &LoadGenerator{Rate: 200, Concurrency: 2}
+	calls, dropped = run(g, time.Second, sleep(50*time.Millisecond))
+	check(t, fmt.Sprintf("2 requesters at 50ms a call, asked for 200/s: %d calls, %d dropped (want about 40, the rest dropped)", calls, dropped),
+		near(float64(calls), 40) && dropped >= 100)
+	n = waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d after a saturated run (baseline %d)", n, baseline), n <= baseline)
+
+	// Every call blocks until the run ends, and SIGINT ends it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	g = &LoadGenerator{Rate: 500, Concurrency: 8}
+	time.AfterFunc(200*time.Millisecond, func() { syscall.Kill(os.Getpid(), syscall.SIGINT) })
+	start := time.Now()
+	g.Run(ctx, func(ctx context.Context, _ int64) { <-ctx.Done() })
+	stop()
+	check(t, fmt.Sprintf("SIGINT ended a run with 8 blocked requesters after %v", time.Since(start).Round(time.Millisecond)),
+		time.Since(start) < time.Second)
+	n = waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d after SIGINT (baseline %d)", n, baseline), n <= baseline)
+}
+
+// TestTransportChurn runs both -mode runs against a mockapi.Server on a free port
+// and checks that the shared client establishes at least 10 times fewer
+// connections than a Transport per call, that a Transport per call dials
+// for every request and leaves goroutines behind, and that both profiles
+// were written.
+func TestTransportChurn(t *testing.T) {
+	const requests = 200
+	mock := mockapi.New(*slowHandler, conns)
+	mock.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"ok"}`)
+	})
+	if err := mock.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *closeTimeout)
+		defer cancel()
+		mock.Stop(ctx)
+	}()
+	dir := t.TempDir()
+
+	a := runChurn("a", mock.URL()+"/api/data", requests, dir)
+	b := runChurn("b", mock.URL()+"/api/data", requests, dir)
+	t.Logf("%d requests: a established %d (peak %d, dialing %v), b established %d (peak %d, dialing %v)",
+		requests, a.Dial.Dialed, a.Dial.Peak, a.Dial.DialTime.Round(time.Microsecond),
+		b.Dial.Dialed, b.Dial.Peak, b.Dial.DialTime.Round(time.Microsecond))
+
+	check(t, fmt.Sprintf("a Transport per call dialed for every request: %d", a.Dial.Dialed), a.Dial.Dialed == requests)
+	check(t, fmt.Sprintf("the shared client established %d, at least 10x fewer", b.Dial.Dialed),
+		b.Dial.Dialed > 0 && b.Dial.Dialed*10 <= a.Dial.Dialed)
+	check(t, fmt.Sprintf("the shared client never held more than %d at once: peak %d", churnWorkers, b.Dial.Peak), b.Dial.Peak <= churnWorkers)
+	// Each open connection is two client goroutines and one server goroutine
+	check(t, fmt.Sprintf("abandoned Transports left %+d goroutines, the shared client %+d", a.Goroutines, b.Goroutines),
+		a.Goroutines >= 2*requests && b.Goroutines <= 3*churnWorkers)
+	for _, r := range []churnResult{a, b} {
+		info, err := os.Stat(r.Profile)
+		check(t, fmt.Sprintf("run %s wrote %s", r.Name, filepath.Base(r.Profile)), err == nil && info.Size() > 0)
+	}
+}
+
+// minReuseRatio is the reuse ratio TestConnReuse requires of 100 sequential
+// requests with drained and closed bodies; the ideal is 0.99
+const minReuseRatio = 0.95
+
+// bodyCounter is a RoundTripper that counts response bodies handed out and
+// not yet closed, for TestRetryStorm
+type bodyCounter struct {
+	next  http.RoundTripper
+	trips int64 // round trips attempted, including failed ones
+	open  int64 // bodies returned and not yet closed
+}
+
+func (c *bodyCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&c.trips, 1)
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.open, 1)
+	resp.Body = &countedBody{ReadCloser: resp.Body, counter: c}
+	return resp, nil
+}
+
+// countedBody decrements its counter on the first Close
+type countedBody struct {
+	io.ReadCloser
+	counter *bodyCounter
+	once    sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.counter.open, -1) })
+	return b.ReadCloser.Close()
+}
+
+// Retry storm run by TestRetryStorm: stormCallers goroutines each make
+// stormCalls fetchWithRetry calls against a server that fails 4 requests in 5
+const (
+	stormCallers = 20
+	stormCalls   = 25
+)
+
+// dialerIdleTimeout is the IdleConnTimeout TestCountingDialer gives its
+// Transport
+const dialerIdleTimeout = 200 * time.Millisecond
@@ -1,124 +1,590 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/httptrace"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/mockapi"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // APIGateway simulates a service that makes HTTP requests to external APIs
 // BUG: HTTP response bodies are not closed, leaking connections
 type APIGateway struct {
-	requestsMade int
-	mockServer   *http.Server
+	requestsMade int64
+	upstreamHits int64 // requests the mock API actually served
+	retries      int64 // extra attempts made by fetchWithRetryBadly
+	inFlight     int64 // -cancel-demo requests still waiting for the mock API
+	mock         *mockapi.Server
+	baseURL      string // upstream to fetch from; empty means the mock API on :8080
+	connsUsed    ConnReuse
+
+	// Bodies left open, by the path that returned without closing them.
+	// Every counter here is updated with sync/atomic: the fetches run on
+	// several goroutines with -cancel-demo and in TestConcurrentFetches.
+	leakedOnSuccess int64 // read to EOF, so the Transport still reuses the connection
+	leakedOnError   int64 // unread on an early return, which pins the connection
+}
+
+// url returns path on the gateway's upstream
+func (gw *APIGateway) url(path string) string {
+	if gw.baseURL != "" {
+		return gw.baseURL + path
+	}
+	return "http://localhost:8080" + path
 }
 
+// failEvery is shared with http-fixed: injected upstream errors are where an
+// unclosed body costs its connection
+var failEvery = flag.Int("fail-every", 0, "make the mock API answer every Nth /api/data request with 503 and an error body (0 = never)")
+
+// errBadStatus is wrapped by fetchDataBadly for non-200 responses
+var errBadStatus = errors.New("bad status")
+
+// retryAttempts is shared with http-fixed, whose fetchWithRetry closes every
+// attempt's body
+var retryAttempts = flag.Int("retry", 0, "fetch through fetchWithRetryBadly, making up to this many attempts per request (0 = no retries)")
+
+// endpoint is shared with http-fixed, so both can be pointed at the same
+// failure mode
+var endpoint = flag.String("endpoint", "/api/data", "mock API path and query to fetch, e.g. /api/slow?delay=10s, /api/hang, /api/flaky?rate=0.3 or /api/big?bytes=5000000")
+
+// cancelDemo is shared with http-fixed, whose Fetch gives up at the deadline
+var cancelDemo = flag.Bool("cancel-demo", false, "send every 5th request to /api/slow?delay=30s with a 50ms deadline, on its own goroutine")
+
+// -cancel-demo requests: every cancelEvery-th tick fetches cancelPath with a
+// cancelDeadline deadline instead of the endpoint
+const (
+	cancelEvery    = 5 // 20% of requests
+	cancelDeadline = 50 * time.Millisecond
+	cancelPath     = "/api/slow?delay=30s"
+)
+
+var (
+	runFor       = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+	slowHandler  = flag.Duration("slow-handler", 5*time.Second, "log mock API handlers still running after this long (0 = never)")
+	closeTimeout = flag.Duration("close-timeout", 5*time.Second, "how long stopMockServer waits for in-flight requests before closing their connections")
+)
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6060")
-		log.Fatal(http.ListenAndServe("localhost:6060", nil))
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
 	}()
 
 	gateway := &APIGateway{}
-	
+
 	// Start a mock HTTP server to make requests against
 	gateway.startMockServer()
 	time.Sleep(100 * time.Millisecond) // Let server start
-	
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	debugMux.HandleFunc("/debug/conntrack", conns.Handler())
+
 	// Print initial state
-	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
-	
-	// Simulate continuous API calls
-	ticker := time.NewTicker(40 * time.Millisecond) // 25 requests/second
+	fmt.Printf("[START] Goroutines: %d  |  Endpoint: %s\n", runtime.NumGoroutine(), *endpoint)
+	if *retryAttempts > 0 {
+		fmt.Printf("Retrying 5xx and connection errors: up to %d attempts\n", *retryAttempts)
+	}
+	if *cancelDemo {
+		fmt.Printf("Every %dth request: %s with a %v deadline\n", cancelEvery, cancelPath, cancelDeadline)
+	}
+
+	// The workload runs until Ctrl+C or -duration, then the mock server is shut down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	// Simulate continuous API calls: -rate requests/second in total from
+	// -concurrency requesters, ramped up over -ramp
+	load := &LoadGenerator{Rate: *rate, Concurrency: *concurrency, Ramp: *ramp}
+	loadDone := make(chan struct{})
+	go func() {
+		defer close(loadDone)
+		load.Run(ctx, func(ctx context.Context, n int64) {
+			// BUG: fetchDataBadly leaks HTTP connections, and
+			// fetchWithRetryBadly leaks every failed attempt's
+			// Injected 503s are expected with -fail-every, so only other errors are logged
+			var err error
+			if *cancelDemo && n%cancelEvery == 0 {
+				go gateway.fetchIgnoringDeadline(ctx)
+			} else if *retryAttempts > 0 {
+				_, err = gateway.fetchWithRetryBadly(ctx, *retryAttempts)
+			} else {
+				_, err = gateway.fetchDataBadly(ctx)
+			}
+			if err != nil && !errors.Is(err, errBadStatus) && ctx.Err() == nil {
+				log.Printf("Error fetching data: %v", err)
+			}
+		})
+	}()
+
+	// Report every 2 seconds
+	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
-	
 	startTime := time.Now()
-	reportInterval := 2 * time.Second
-	lastReport := startTime
-	
+
 	for {
 		select {
+		case <-ctx.Done():
+			<-loadDone
+			shutdown(gateway)
+			return
 		case <-ticker.C:
-			// BUG: fetchDataBadly leaks HTTP connections
-			if _, err := gateway.fetchDataBadly(); err != nil {
-				log.Printf("Error fetching data: %v", err)
+		}
+
+		goroutines := runtime.NumGoroutine()
+		elapsed := time.Since(startTime).Seconds()
+		fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Requests made: %d",
+			elapsed, goroutines, atomic.LoadInt64(&gateway.requestsMade))
+		if *retryAttempts > 0 {
+			fmt.Printf("  |  Retries: %d", atomic.LoadInt64(&gateway.retries))
+		}
+		if *cancelDemo {
+			// Nothing is ever cancelled: every deadline is ignored
+			fmt.Printf("  |  Cancelled: 0  |  In flight: %d (server %d)",
+				atomic.LoadInt64(&gateway.inFlight), gateway.mock.InFlight())
+		}
+		fmt.Println()
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		fmt.Printf("           Load: %s\n", load.Report())
+		fmt.Printf("           Server conns: %s\n", conns.Stats())
+		fmt.Printf("           Client conns: %s\n", &gateway.connsUsed)
+		fmt.Printf("           %s\n", gateway.leakSummary())
+
+		// The load generator and its requesters account for the first few
+		if goroutines > 20+*concurrency {
+			fmt.Println("\n⚠️  WARNING: Connection leak detected!")
+			fmt.Println("Many goroutines stuck in HTTP read/write")
+			fmt.Println("pprof server running on http://localhost:6060")
+			fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine > goroutine.pprof")
+		}
+	}
+}
+
+// Load generator flags, shared by http-leak and http-fixed
+var (
+	rate        = flag.Float64("rate", 25, "requests per second in total, once -ramp is over")
+	concurrency = flag.Int("concurrency", 1, "requesters sending in parallel; past what they can keep up with, requests are dropped")
+	ramp        = flag.Duration("ramp", 0, "rise linearly from 0 to -rate over this long (0 = start at -rate)")
+)
+
+// loadTick is how often LoadGenerator works out which calls are due
+const loadTick = 10 * time.Millisecond
+
+// LoadGenerator calls a function at a target rate from a fixed set of
+// requester goroutines. The rate rises linearly from zero to Rate over Ramp,
+// then holds. When every requester is busy, calls wait for one, but no more
+// than one per requester: the rest are dropped and counted, so a slow
+// upstream shows up as an achieved rate below the target rather than as a
+// backlog that grows without bound.
+type LoadGenerator struct {
+	Rate        float64       // calls per second across all requesters
+	Concurrency int           // requester goroutines; less than 1 means 1
+	Ramp        time.Duration // time to rise from 0 to Rate; 0 starts at Rate
+
+	calls   int64 // calls made, updated atomically
+	dropped int64 // calls dropped while every requester was busy
+
+	mu        sync.Mutex
+	started   time.Time
+	lastAt    time.Time // when Report last ran
+	lastCalls int64     // calls at that time
+}
+
+// TargetRate returns the target calls per second at elapsed into the run
+func (g *LoadGenerator) TargetRate(elapsed time.Duration) float64 {
+	if g.Ramp > 0 && elapsed < g.Ramp {
+		return g.Rate * float64(elapsed) / float64(g.Ramp)
+	}
+	return g.Rate
+}
+
+// requesters returns the number of requester goroutines Run starts
+func (g *LoadGenerator) requesters() int {
+	if g.Concurrency < 1 {
+		return 1
+	}
+	return g.Concurrency
+}
+
+// Run calls fn until ctx ends, passing ctx and the call's number, from 1.
+// fn must return soon after ctx ends, because Run returns only once every
+// requester has, so nothing it started is left running.
+func (g *LoadGenerator) Run(ctx context.Context, fn func(ctx context.Context, n int64)) {
+	due := make(chan int64)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < g.requesters(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case n := <-due:
+					fn(ctx, n)
+					atomic.AddInt64(&g.calls, 1)
+				case <-ctx.Done():
+					return
+				}
 			}
-			
-			// Report every 2 seconds
-			if time.Since(lastReport) >= reportInterval {
-				goroutines := runtime.NumGoroutine()
-				elapsed := time.Since(startTime).Seconds()
-				fmt.Printf("[AFTER %.0fs] Goroutines: %d  |  Requests made: %d\n", 
-					elapsed, goroutines, gateway.requestsMade)
-				
-				if goroutines > 20 {
-					fmt.Println("\n⚠️  WARNING: Connection leak detected!")
-					fmt.Println("Many goroutines stuck in HTTP read/write")
-					fmt.Println("pprof server running on http://localhost:6060")
-					fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine > goroutine.pprof")
+		}()
+	}
+
+	start := time.Now()
+	g.mu.Lock()
+	g.started, g.lastAt = start, start
+	g.mu.Unlock()
+
+	ticker := time.NewTicker(loadTick)
+	defer ticker.Stop()
+	last := start
+	owed := 0.0 // calls due but not yet handed to a requester
+	var n int64
+	for {
+		select {
+		case now := <-ticker.C:
+			owed += g.TargetRate(now.Sub(start)) * now.Sub(last).Seconds()
+			last = now
+			if backlog := owed - float64(g.requesters()); backlog >= 1 {
+				atomic.AddInt64(&g.dropped, int64(backlog))
+				owed -= float64(int64(backlog))
+			}
+			for ; owed >= 1; owed-- {
+				n++
+				select {
+				case due <- n:
+				case <-ctx.Done():
+					return
 				}
-				
-				lastReport = time.Now()
 			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Report formats the rate achieved since the last Report, or since Run
+// started, against the target now
+func (g *LoadGenerator) Report() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	calls := atomic.LoadInt64(&g.calls)
+	var achieved, target float64
+	if !g.started.IsZero() {
+		if d := now.Sub(g.lastAt).Seconds(); d > 0 {
+			achieved = float64(calls-g.lastCalls) / d
 		}
+		target = g.TargetRate(now.Sub(g.started))
 	}
+	g.lastAt, g.lastCalls = now, calls
+	return fmt.Sprintf("achieved %.1f/s of %.1f/s  |  concurrency %d  |  dropped %d",
+		achieved, target, g.requesters(), atomic.LoadInt64(&g.dropped))
 }
 
-// fetchDataBadly makes an HTTP request but NEVER closes the response body
-func (gw *APIGateway) fetchDataBadly() ([]byte, error) {
+// fetchDataBadly makes an HTTP request but NEVER closes the response body.
+// ctx only ends the workload on Ctrl+C or -duration; nothing times out a
+// slow or hanging upstream.
+func (gw *APIGateway) fetchDataBadly(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gw.url(*endpoint), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), gw.connsUsed.Trace()))
+
 	// BUG: Using default HTTP client with no timeouts
-	resp, err := http.Get("http://localhost:8080/api/data")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	// BUG: Response body is never closed!
 	// This keeps the HTTP connection open indefinitely
-	
+
 	// Check status
 	if resp.StatusCode != 200 {
 		// BUG: Early return without closing body
-		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+		atomic.AddInt64(&gw.leakedOnError, 1)
+		return nil, fmt.Errorf("%w: %d", errBadStatus, resp.StatusCode)
 	}
-	
+
 	// Read body
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		// BUG: Another early return without closing body
+		atomic.AddInt64(&gw.leakedOnError, 1)
 		return nil, err
 	}
-	
-	gw.requestsMade++
-	
+
+	atomic.AddInt64(&gw.requestsMade, 1)
+	atomic.AddInt64(&gw.leakedOnSuccess, 1)
+
 	// Response body never closed - connection leaks!
 	return data, nil
 }
 
-// startMockServer creates a simple HTTP server for testing
+// fetchIgnoringDeadline gives its request a cancelDeadline deadline, then
+// ignores it: the request is built without ctx, so the default client waits
+// the full 30s for /api/slow, holding a goroutine and a connection, and the
+// body is never closed. Every call the loop makes while one is waiting adds
+// another.
+func (gw *APIGateway) fetchIgnoringDeadline(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, cancelDeadline)
+	defer cancel()
+	atomic.AddInt64(&gw.inFlight, 1)
+	defer atomic.AddInt64(&gw.inFlight, -1)
+
+	// BUG: http.NewRequest, not NewRequestWithContext - ctx never reaches
+	// the request
+	req, err := http.NewRequest(http.MethodGet, gw.url(cancelPath), nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), gw.connsUsed.Trace()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	// BUG: the body is never closed either, nor read, so this one pins its
+	// connection as surely as an error would
+	atomic.AddInt64(&gw.leakedOnError, 1)
+	dl, _ := ctx.Deadline()
+	log.Printf("Slow request answered %d, %v past its deadline", resp.StatusCode, time.Since(dl).Round(time.Second))
+}
+
+// Backoff for fetchWithRetryBadly, the same as http-fixed's DefaultRetryPolicy
+const (
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// fetchWithRetryBadly retries connection errors and 5xx responses with
+// exponential backoff and full jitter, like http-fixed's fetchWithRetry. It
+// drains and closes the final response's body, but not the bodies of the
+// attempts that failed before it.
+func (gw *APIGateway) fetchWithRetryBadly(ctx context.Context, attempts int) ([]byte, error) {
+	var resp *http.Response
+	var err error
+	for n := 0; n < attempts; n++ {
+		if n > 0 {
+			atomic.AddInt64(&gw.retries, 1)
+			ceiling := retryBaseDelay << (n - 1)
+			if ceiling > retryMaxDelay {
+				ceiling = retryMaxDelay
+			}
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(ceiling) + 1))):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		req, rerr := http.NewRequestWithContext(ctx, http.MethodGet, gw.url(*endpoint), nil)
+		if rerr != nil {
+			return nil, rerr
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), gw.connsUsed.Trace()))
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			break
+		}
+		// BUG: a 5xx response is dropped here and resp reassigned on the
+		// next attempt. Its body is never closed, so its connection can't
+		// be reused or freed, and every retry dials a new one.
+		if err == nil {
+			atomic.AddInt64(&gw.leakedOnError, 1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the last attempt's body is closed
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%w: %d", errBadStatus, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&gw.requestsMade, 1)
+	return data, nil
+}
+
+// leakSummary reports the bodies left open on each path. Only the error
+// paths cost connections: compare leakedOnError with the connections created.
+func (gw *APIGateway) leakSummary() string {
+	return fmt.Sprintf("Bodies left open: %d on success (read to EOF, connection reused)  |  %d on error paths (unread, connection pinned)",
+		atomic.LoadInt64(&gw.leakedOnSuccess), atomic.LoadInt64(&gw.leakedOnError))
+}
+
+// ConnReuse counts, through httptrace, what happens to the client's
+// connections: how many were created by a new dial, how many requests reused
+// one from the pool, and how many times a connection went back to the idle
+// pool after a response. A body that is neither read to EOF nor closed never
+// goes back, so the next request has to dial again.
+type ConnReuse struct {
+	created     int64 // ConnectDone without error
+	reused      int64 // GotConn with Reused set
+	wasIdle     int64 // of those, how many had been idle rather than just released
+	idleReturns int64 // PutIdleConn without error
+}
+
+// ReuseCounts is a snapshot of a ConnReuse
+type ReuseCounts struct {
+	Created, Reused, WasIdle, IdleReturns int64
+}
+
+// Trace returns a ClientTrace that feeds r
+func (r *ConnReuse) Trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				atomic.AddInt64(&r.created, 1)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+			atomic.AddInt64(&r.reused, 1)
+			if info.WasIdle {
+				atomic.AddInt64(&r.wasIdle, 1)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil {
+				atomic.AddInt64(&r.idleReturns, 1)
+			}
+		},
+	}
+}
+
+// Counts returns the totals so far
+func (r *ConnReuse) Counts() ReuseCounts {
+	return ReuseCounts{
+		Created:     atomic.LoadInt64(&r.created),
+		Reused:      atomic.LoadInt64(&r.reused),
+		WasIdle:     atomic.LoadInt64(&r.wasIdle),
+		IdleReturns: atomic.LoadInt64(&r.idleReturns),
+	}
+}
+
+// ReuseRatio is the fraction of connections handed to requests that came
+// from the pool, 0 before the first request
+func (c ReuseCounts) ReuseRatio() float64 {
+	if c.Created+c.Reused == 0 {
+		return 0
+	}
+	return float64(c.Reused) / float64(c.Created+c.Reused)
+}
+
+func (r *ConnReuse) String() string {
+	c := r.Counts()
+	return fmt.Sprintf("created %d  |  reused %d (was idle %d)  |  idle returns %d  |  reuse %.0f%%",
+		c.Created, c.Reused, c.WasIdle, c.IdleReturns, 100*c.ReuseRatio())
+}
+
+// startMockServer starts the mock API on :8080 with the example's /api/data
 func (gw *APIGateway) startMockServer() {
-	mux := http.NewServeMux()
-	
-	mux.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
+	gw.mock = mockapi.New(*slowHandler, conns)
+	gw.mock.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
+		hit := atomic.AddInt64(&gw.upstreamHits, 1)
 		// Simulate some processing time
 		time.Sleep(10 * time.Millisecond)
+		if *failEvery > 0 && hit%int64(*failEvery) == 0 {
+			http.Error(w, strings.Repeat("upstream busy ", 100), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"ok","data":"test-%d"}`, gw.requestsMade)
+		fmt.Fprintf(w, `{"status":"ok","data":"test-%d"}`, hit)
 	})
-	
-	gw.mockServer = &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	if err := gw.mock.Start(":8080"); err != nil {
+		log.Fatalf("Mock server error: %v", err)
 	}
-	
-	go func() {
-		if err := gw.mockServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("Mock server error: %v", err)
-		}
-	}()
 }
 
+// stopMockServer shuts the mock server down gracefully, see mockapi.Server.Stop
+func (gw *APIGateway) stopMockServer(ctx context.Context) (mockapi.StopReport, error) {
+	return gw.mock.Stop(ctx)
+}
+
+// shutdown stops the mock server within -close-timeout and prints what is left
+func shutdown(gw *APIGateway) {
+	fmt.Println("\nWorkload stopped - shutting down the mock server")
+	ctx, cancel := context.WithTimeout(context.Background(), *closeTimeout)
+	report, err := gw.stopMockServer(ctx)
+	cancel()
+	fmt.Printf("Mock server stopped: %s\n", report)
+	if err != nil {
+		log.Printf("Mock server didn't drain within %v: %v", *closeTimeout, err)
+	}
+	waitConnsClosed(time.Second)
+	fmt.Printf("[FINAL] Goroutines: %d  |  Requests made: %d\n", runtime.NumGoroutine(), atomic.LoadInt64(&gw.requestsMade))
+	fmt.Printf("           Server conns: %s\n", conns.Stats())
+	fmt.Printf("           Client conns: %s\n", &gw.connsUsed)
+	fmt.Printf("           %s\n", gw.leakSummary())
+}
+
+// waitConnsClosed waits up to timeout for the server's connections to report
+// StateClosed, which their goroutines do as they unwind just after Shutdown
+// returns. It reports whether none is left.
+func waitConnsClosed(timeout time.Duration) bool {
+	live := func() int {
+		s := conns.Stats()
+		return s.New + s.Active + s.Idle
+	}
+	for deadline := time.Now().Add(timeout); live() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return live() == 0
+}
+
+// conns tracks the mock server's connections
+var conns = conntrack.New()
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
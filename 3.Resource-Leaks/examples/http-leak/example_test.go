@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/mockapi"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/netsim"
+)
+
+// TestConcurrentFetches runs fetchDataBadly from several goroutines at once
+// against an httptest server that fails every failEveryN-th request and,
+// like a status page, writes the gateway's request count into every
+// response. Every fetch must be counted exactly once, on the right path, and
+// only the error path may cost connections. Run it with go test -race, so
+// the race detector also checks every access to the counters.
+func TestConcurrentFetches(t *testing.T) {
+	const (
+		workers    = 8
+		perWorker  = 50
+		failEveryN = 5
+	)
+
+	gw := &APIGateway{}
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1)%failEveryN == 0 {
+			http.Error(w, strings.Repeat("upstream busy ", 100), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"ok","requests_made":%d}`, atomic.LoadInt64(&gw.requestsMade))
+	}))
+	gw.baseURL = server.URL
+
+	// fetchDataBadly uses the default client, which keeps 2 idle connections
+	// per host. With more workers than that, healthy connections would be
+	// closed and redialed too, hiding which ones the error path cost.
+	transport := http.DefaultTransport.(*http.Transport)
+	idlePerHost := transport.MaxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = workers
+	t.Cleanup(func() {
+		transport.CloseIdleConnections()
+		transport.MaxIdleConnsPerHost = idlePerHost
+	})
+
+	var wg sync.WaitGroup
+	var failed int64
+	for w := 0; w < workers; w++ {
+		wg.Go(func() {
+			for i := 0; i < perWorker; i++ {
+				if _, err := gw.fetchDataBadly(context.Background()); err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	server.CloseClientConnections()
+	server.Close()
+
+	total := int64(workers * perWorker)
+	made, onSuccess, onError := atomic.LoadInt64(&gw.requestsMade), atomic.LoadInt64(&gw.leakedOnSuccess), atomic.LoadInt64(&gw.leakedOnError)
+	created := gw.connsUsed.Counts().Created
+	t.Logf("%s", gw.leakSummary())
+	t.Logf("Client conns: %s", &gw.connsUsed)
+
+	if made+failed != total {
+		t.Errorf("%d made + %d failed, want every one of %d fetches counted once", made, failed, total)
+	}
+	if failed != total/failEveryN {
+		t.Errorf("%d fetches failed, want one in %d: %d", failed, failEveryN, total/failEveryN)
+	}
+	if onSuccess != made || onError != failed {
+		t.Errorf("successes left %d bodies open and failures %d, want %d and %d", onSuccess, onError, made, failed)
+	}
+	if created < onError || created > onError+workers {
+		t.Errorf("%d connections created for %d errors and %d workers, want between %d and %d",
+			created, onError, workers, onError, onError+workers)
+	}
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestMockServerShutdown leaks a few responses against the mock server and
+// stops it with a slow request in flight. It checks that the request drained,
+// the Serve goroutine is gone, the connections are closed and port 8080 can
+// be bound again, then that a request outliving the deadline is cut off on
+// time.
+func TestMockServerShutdown(t *testing.T) {
+	// startMockServer needs port 8080, where TestLeakBudgets may be running
+	// this example
+	ln, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		t.Skipf("port 8080 unavailable: %v", err)
+	}
+	ln.Close()
+
+	gw := &APIGateway{}
+	gw.startMockServer()
+	for i := 0; i < 5; i++ {
+		if _, err := gw.fetchDataBadly(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, fmt.Sprintf("mock server running: %d Serve goroutine, %s", serveGoroutines(), conns.Stats()),
+		serveGoroutines() == 1)
+
+	slow := startSlowRequest(gw.mock, "/api/slow?delay=300ms")
+	ctx, cancel := context.WithTimeout(context.Background(), *closeTimeout)
+	report, err := gw.stopMockServer(ctx)
+	cancel()
+	check(t, fmt.Sprintf("stopMockServer drained within %v: %s (err=%v)", *closeTimeout, report, err),
+		err == nil && report.Took < *closeTimeout)
+	check(t, "the slow request was counted as drained", report.InFlight == 1 && report.Drained == 1 && report.Forced == 0)
+	res := <-slow
+	check(t, fmt.Sprintf("the slow request completed with %d after %v (err=%v)", res.status, res.took.Round(10*time.Millisecond), res.err),
+		res.err == nil && res.status == http.StatusOK && res.took >= 300*time.Millisecond)
+	check(t, fmt.Sprintf("Serve goroutine exited: %d left", serveGoroutines()), serveGoroutines() == 0)
+
+	check(t, fmt.Sprintf("no live server connections: %s", conns.Stats()), waitConnsClosed(time.Second))
+
+	ln, err = net.Listen("tcp", ":8080")
+	check(t, fmt.Sprintf("port 8080 released (err=%v)", err), err == nil)
+	if ln != nil {
+		ln.Close()
+	}
+
+	// A request that outlives the deadline has its connection closed
+	const deadline = 200 * time.Millisecond
+	mock := mockapi.New(*slowHandler, conns)
+	if err := mock.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	slow = startSlowRequest(mock, "/api/slow?delay=10s")
+	ctx, cancel = context.WithTimeout(context.Background(), deadline)
+	report, err = mock.Stop(ctx)
+	cancel()
+	check(t, fmt.Sprintf("Stop gave up at its %v deadline: %s (err=%v)", deadline, report, err),
+		errors.Is(err, context.DeadlineExceeded) && report.Took < deadline+300*time.Millisecond)
+	check(t, "the 10s request was counted as forcibly closed", report.InFlight == 1 && report.Forced == 1 && report.Drained == 0)
+	res = <-slow
+	check(t, fmt.Sprintf("its client saw the connection close (err=%v)", res.err), res.err != nil)
+}
+
+// slowResult is how a request started by startSlowRequest ended
+type slowResult struct {
+	status int
+	took   time.Duration
+	err    error
+}
+
+// startSlowRequest fetches path from mock in the background and returns once
+// the server is handling it
+func startSlowRequest(mock *mockapi.Server, path string) <-chan slowResult {
+	done := make(chan slowResult, 1)
+	before := mock.InFlight()
+	go func() {
+		start := time.Now()
+		resp, err := http.Get(mock.URL() + path)
+		if err != nil {
+			done <- slowResult{took: time.Since(start), err: err}
+			return
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		done <- slowResult{status: resp.StatusCode, took: time.Since(start), err: err}
+	}()
+	for deadline := time.Now().Add(time.Second); mock.InFlight() == before && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return done
+}
+
+// serveGoroutines counts goroutines started by mockapi.Server.Start, which is
+// only the one running Serve; connection goroutines are started by Serve
+// itself
+func serveGoroutines() int {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	return strings.Count(string(buf[:n]), "mockapi.(*Server).Start in goroutine")
+}
+
+// TestPipeNetwork runs fetchDataBadly against a handler served over a
+// netsim.Network, with no listener and no socket. It checks what the leak
+// costs on each path: bodies read to EOF still return their connection,
+// error bodies left unread pin theirs, a SlowWriter server is waited out,
+// and a DropAfter connection fails the read with io.ErrUnexpectedEOF.
+func TestPipeNetwork(t *testing.T) {
+	// run swaps these for each network; put them back for the other tests
+	transport, path := http.DefaultClient.Transport, *endpoint
+	t.Cleanup(func() { http.DefaultClient.Transport, *endpoint = transport, path })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"ok"}`)
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, strings.Repeat("upstream busy ", 70), http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 4096))
+	})
+
+	// run serves mux over a new netsim.Network and makes n fetches of path
+	// through fetchDataBadly, which uses http.DefaultClient
+	run := func(path string, n int, wrap func(*netsim.Network)) (*netsim.Network, *APIGateway, []error) {
+		network := netsim.NewNetwork()
+		if wrap != nil {
+			wrap(network)
+		}
+		go http.Serve(network, mux)
+		http.DefaultClient.Transport = &http.Transport{DialContext: network.Dial}
+		gw := &APIGateway{baseURL: "http://netsim"}
+		*endpoint = path
+		var errs []error
+		for i := 0; i < n; i++ {
+			if _, err := gw.fetchDataBadly(context.Background()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return network, gw, errs
+	}
+	socketsBefore := fdcount.Sockets()
+	start := time.Now()
+
+	network, _, errs := run("/ok", 20, nil)
+	accepted, _ := network.Counts()
+	check(t, fmt.Sprintf("20 fetches read to EOF: %d failed, over %d pipe: unclosed but drained bodies still return it", len(errs), accepted),
+		len(errs) == 0 && accepted == 1)
+
+	network, gw, errs := run("/fail", 10, nil)
+	accepted, closed := network.Counts()
+	check(t, fmt.Sprintf("10 fetches answered 503: %d failed with errBadStatus, %d left on the error path", len(errs), atomic.LoadInt64(&gw.leakedOnError)),
+		len(errs) == 10 && errors.Is(errs[0], errBadStatus) && atomic.LoadInt64(&gw.leakedOnError) == 10)
+	check(t, fmt.Sprintf("each unread body pinned its pipe: %d dialed, %d closed", accepted, closed), accepted == 10 && closed == 0)
+
+	fetchStart := time.Now()
+	_, _, errs = run("/big", 1, func(n *netsim.Network) {
+		n.ServerWrap = func(c net.Conn) net.Conn { return netsim.SlowWriter(c, 40000) }
+	})
+	took := time.Since(fetchStart)
+	check(t, fmt.Sprintf("4 KB from a SlowWriter at 40 KB/s took %v (err=%v)", took.Round(time.Millisecond), errs),
+		len(errs) == 0 && took >= 100*time.Millisecond && took < time.Second)
+
+	network, gw, errs = run("/big", 1, func(n *netsim.Network) {
+		n.ClientWrap = func(c net.Conn) net.Conn { return netsim.DropAfter(c, 1000) }
+	})
+	check(t, fmt.Sprintf("a connection dropped after 1000 bytes failed the read with io.ErrUnexpectedEOF (%v)", errs),
+		len(errs) == 1 && errors.Is(errs[0], io.ErrUnexpectedEOF) && atomic.LoadInt64(&gw.leakedOnError) == 1)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, closed := network.Counts(); closed == 1 {
+			break
+		}
+	}
+	_, closed = network.Counts()
+	check(t, fmt.Sprintf("and the server saw the connection go (%d closed)", closed), closed == 1)
+
+	if socketsBefore >= 0 {
+		check(t, fmt.Sprintf("no socket opened: %d before, %d after, all in %v", socketsBefore, fdcount.Sockets(), time.Since(start).Round(time.Millisecond)),
+			fdcount.Sockets() == socketsBefore)
+	} else {
+		t.Log("socket count unavailable on this platform, skipped")
+	}
+}
+
+// TestLoadGenerator runs LoadGenerator against functions that wait on ctx
+// instead of a server. It checks the achieved rate at full rate and over a
+// ramp, that a saturated generator drops calls instead of queueing them,
+// and that the goroutine count is back at its baseline when Run returns,
+// whether its context timed out or the process got SIGINT.
+func TestLoadGenerator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the generator for about 3s")
+	}
+	waitForCount := func(want int) int {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return runtime.NumGoroutine()
+	}
+	sleep := func(d time.Duration) func(context.Context, int64) {
+		return func(ctx context.Context, _ int64) {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}
+	}
+	near := func(got, want float64) bool { return got >= 0.85*want && got <= 1.15*want }
+
+	// os/signal starts a goroutine of its own on first use, which never
+	// exits; start it before the baseline
+	_, stopWarmup := signal.NotifyContext(context.Background(), os.Interrupt)
+	stopWarmup()
+	baseline := runtime.NumGoroutine()
+
+	run := func(g *LoadGenerator, d time.Duration, fn func(context.Context, int64)) (calls, dropped int64) {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		g.Run(ctx, fn)
+		return atomic.LoadInt64(&g.calls), atomic.LoadInt64(&g.dropped)
+	}
+
+	g := &LoadGenerator{Rate: 200, Concurrency: 4}
+	calls, dropped := run(g, time.Second, sleep(time.Millisecond))
+	check(t, fmt.Sprintf("rate 200/s for 1s: %d calls, %d dropped (want about 200, none dropped)", calls, dropped),
+		near(float64(calls), 200) && dropped == 0)
+	n := waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d when the duration ends (baseline %d)", n, baseline), n <= baseline)
+
+	g = &LoadGenerator{Rate: 200, Concurrency: 4, Ramp: time.Second}
+	calls, _ = run(g, time.Second, sleep(time.Millisecond))
+	check(t, fmt.Sprintf("ramping from 0 to 200/s over 1s: %d calls (want about 100)", calls), near(float64(calls), 100))
+
+	g = &LoadGenerator{Rate: 200, Concurrency: 2}
+	calls, dropped = run(g, time.Second, sleep(50*time.Millisecond))
+	check(t, fmt.Sprintf("2 requesters at 50ms a call, asked for 200/s: %d calls, %d dropped (want about 40, the rest dropped)", calls, dropped),
+		near(float64(calls), 40) && dropped >= 100)
+	n = waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d after a saturated run (baseline %d)", n, baseline), n <= baseline)
+
+	// Every call blocks until the run ends, and SIGINT ends it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	g = &LoadGenerator{Rate: 500, Concurrency: 8}
+	time.AfterFunc(200*time.Millisecond, func() { syscall.Kill(os.Getpid(), syscall.SIGINT) })
+	start := time.Now()
+	g.Run(ctx, func(ctx context.Context, _ int64) { <-ctx.Done() })
+	stop()
+	check(t, fmt.Sprintf("SIGINT ended a run with 8 blocked requesters after %v", time.Since(start).Round(time.Millisecond)),
+		time.Since(start) < time.Second)
+	n = waitForCount(baseline)
+	check(t, fmt.Sprintf("goroutines back to %d after SIGINT (baseline %d)", n, baseline), n <= baseline)
+}
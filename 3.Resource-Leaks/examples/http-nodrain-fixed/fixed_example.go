@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This is the fixed version of http-nodrain. The status code is still all that
+// matters, but the body is read to EOF before Close, so the connection goes
+// back to the idle pool and the next request reuses it instead of dialing and,
+// with -tls, handshaking again. The read is capped by -drain-max: past that,
+// dropping the connection is cheaper than reading a body nobody wants.
+
+// APIGateway polls an upstream service for report status
+// FIX: response bodies are drained, up to drainMax bytes, before Close
+type APIGateway struct {
+	requestsMade int64
+	mockServer   *httptest.Server
+	client       *http.Client
+	reportURL    string
+	connsUsed    ConnReuse
+	latency      latencyStats  // whole request, from Do to Close
+	handshakes   TLSHandshakes // with -tls
+	drainMax     int64         // most bytes read from an unwanted body before Close
+}
+
+var (
+	useTLS = flag.Bool("tls", false, "serve the mock API over TLS, so every new connection also costs a handshake")
+	bodyKB = flag.Int("body-kb", 1024, "size of each /api/report response in KB; net/http drains up to 256 KB itself on Close")
+	runFor = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+
+	drainMax = flag.Int64("drain-max", defaultDrainMax, "read at most this many bytes of an unwanted body before Close; larger bodies drop their connection")
+)
+
+// defaultDrainMax is the -drain-max default, four times the default body
+const defaultDrainMax = 4 << 20
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	gateway := &APIGateway{drainMax: *drainMax}
+
+	// Start a mock HTTP server to make requests against
+	gateway.startMockServer("127.0.0.1:8083", *bodyKB*1024)
+	defer gateway.mockServer.Close()
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	debugMux.HandleFunc("/debug/conntrack", conns.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  Mock API: %s  |  Body: %d KB  |  Drain max: %d KB\n",
+		runtime.NumGoroutine(), gateway.reportURL, *bodyKB, *drainMax/1024)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := sighandler.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	// Simulate continuous API calls
+	ticker := time.NewTicker(40 * time.Millisecond) // 25 requests/second
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	reportInterval := 2 * time.Second
+	lastReport := startTime
+
+	for {
+		select {
+		case <-ctx.Done():
+			if sighandler.Terminated(ctx) {
+				sighandler.LogLeakDump("/tmp/leakdump")
+			}
+			fmt.Println("\nWorkload stopped")
+			gateway.report("[FINAL]")
+			return
+		case <-ticker.C:
+		}
+
+		// FIX: reportReady drains the body before closing it
+		if _, err := gateway.reportReady(); err != nil {
+			log.Printf("Error polling report: %v", err)
+		}
+
+		// Report every 2 seconds
+		if time.Since(lastReport) >= reportInterval {
+			gateway.report(fmt.Sprintf("[AFTER %.0fs]", time.Since(startTime).Seconds()))
+			lastReport = time.Now()
+		}
+	}
+}
+
+// reportReady asks the upstream whether the report is ready; only the status
+// code matters
+func (gw *APIGateway) reportReady() (bool, error) {
+	start := time.Now()
+	defer func() { gw.latency.observe(time.Since(start)) }()
+
+	req, err := gw.newRequest()
+	if err != nil {
+		return false, err
+	}
+	resp, err := gw.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	// FIX: read what's left of the body before Close so the connection can
+	// go back to the idle pool
+	defer drainAndClose(resp.Body, gw.drainMax)
+	atomic.AddInt64(&gw.requestsMade, 1)
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// drainAndClose reads and discards up to limit bytes of body, then closes it.
+// A body read to EOF lets the Transport reuse its connection; one with more
+// than limit bytes left is closed unread and its connection dropped.
+func drainAndClose(body io.ReadCloser, limit int64) {
+	io.CopyN(io.Discard, body, limit)
+	body.Close()
+}
+
+// newRequest builds a GET for the report, traced by connsUsed and, for TLS,
+// by the handshake timer
+func (gw *APIGateway) newRequest() (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, gw.reportURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), gw.connsUsed.Trace())
+	ctx = httptrace.WithClientTrace(ctx, gw.handshakes.Trace())
+	return req.WithContext(ctx), nil
+}
+
+// report prints the periodic status lines under label
+func (gw *APIGateway) report(label string) {
+	requests := atomic.LoadInt64(&gw.requestsMade)
+	fmt.Printf("%s Goroutines: %d  |  Requests made: %d\n", label, runtime.NumGoroutine(), requests)
+	fmt.Printf("           %s\n", gcpercent.Stats())
+	fmt.Printf("           Server conns: %s\n", conns.Stats())
+	fmt.Printf("           Client conns: %s\n", &gw.connsUsed)
+
+	var perHundred float64
+	if requests > 0 {
+		perHundred = 100 * float64(gw.connsUsed.Counts().Created) / float64(requests)
+	}
+	line := fmt.Sprintf("Created per 100 requests: %.0f  |  Latency: %s", perHundred, gw.latency.take())
+	if *useTLS {
+		line += fmt.Sprintf("  |  TLS handshakes: %s", gw.handshakes.interval.take())
+	}
+	fmt.Printf("           %s\n", line)
+	if *useTLS {
+		fmt.Printf("           Handshakes so far: %s\n", gw.handshakes.String(requests))
+	}
+}
+
+// startMockServer serves a bodySize /api/report on addr, over TLS with -tls. The
+// certificate is generated at startup; httptest builds a client that trusts it.
+func (gw *APIGateway) startMockServer(addr string, bodySize int) {
+	body := bytes.Repeat([]byte("r"), bodySize)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/report", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	})
+
+	ln, err := conns.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Mock server error: %v", err)
+	}
+	gw.mockServer = httptest.NewUnstartedServer(mux)
+	gw.mockServer.Listener.Close()
+	gw.mockServer.Listener = ln
+	gw.mockServer.Config.ConnState = conns.ConnState
+	if *useTLS {
+		cert, err := selfSignedCert()
+		if err != nil {
+			log.Fatalf("Mock server certificate: %v", err)
+		}
+		gw.mockServer.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		gw.mockServer.StartTLS()
+	} else {
+		gw.mockServer.Start()
+	}
+
+	transport := gw.mockServer.Client().Transport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 10
+	gw.client = &http.Client{Timeout: 5 * time.Second, Transport: transport}
+	gw.reportURL = gw.mockServer.URL + "/api/report"
+}
+
+// latencyStats accumulates durations for one report interval
+type latencyStats struct {
+	mu      sync.Mutex
+	count   int
+	total   time.Duration
+	longest time.Duration
+}
+
+func (s *latencyStats) observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.total += d
+	if d > s.longest {
+		s.longest = d
+	}
+}
+
+// take formats the interval's count, mean and max, and starts a new interval
+func (s *latencyStats) take() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mean time.Duration
+	if s.count > 0 {
+		mean = s.total / time.Duration(s.count)
+	}
+	out := fmt.Sprintf("%d, mean %v, max %v", s.count, mean.Round(time.Microsecond), s.longest.Round(time.Microsecond))
+	s.count, s.total, s.longest = 0, 0, 0
+	return out
+}
+
+// TLSHandshakes counts, through httptrace, the client's TLS handshakes and
+// the time spent in them. Each one is a new connection's cost on top of the
+// dial: a key exchange and a certificate check, a few hundred microseconds of
+// CPU on loopback and one or two more round trips on a real network.
+type TLSHandshakes struct {
+	done     int64 // TLSHandshakeDone without error
+	failed   int64 // TLSHandshakeDone with an error
+	nanos    int64 // total time in successful handshakes
+	interval latencyStats
+}
+
+// Trace returns a ClientTrace that feeds h. Use a new one for each request:
+// it holds the start time of that request's handshake.
+func (h *TLSHandshakes) Trace() *httptrace.ClientTrace {
+	var start time.Time
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { start = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				atomic.AddInt64(&h.failed, 1)
+				return
+			}
+			d := time.Since(start)
+			atomic.AddInt64(&h.done, 1)
+			atomic.AddInt64(&h.nanos, int64(d))
+			h.interval.observe(d)
+		},
+	}
+}
+
+// Totals returns the handshakes so far, the failed ones, and the time spent
+// in the successful ones
+func (h *TLSHandshakes) Totals() (done, failed int64, total time.Duration) {
+	return atomic.LoadInt64(&h.done), atomic.LoadInt64(&h.failed), time.Duration(atomic.LoadInt64(&h.nanos))
+}
+
+// String formats the totals, with the handshake time spread over requests
+func (h *TLSHandshakes) String(requests int64) string {
+	done, failed, total := h.Totals()
+	var perRequest time.Duration
+	if requests > 0 {
+		perRequest = total / time.Duration(requests)
+	}
+	return fmt.Sprintf("%d (%d failed), %v in total  |  %v of handshake per request",
+		done, failed, total.Round(time.Microsecond), perRequest.Round(time.Microsecond))
+}
+
+// selfSignedCert generates an ECDSA certificate for 127.0.0.1 and localhost,
+// valid for a day, so no key or certificate is kept on disk
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"Mock API"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ConnReuse counts, through httptrace, what happens to the client's
+// connections: how many were created by a new dial, how many requests reused
+// one from the pool, and how many times a connection went back to the idle
+// pool after a response. A body that is neither read to EOF nor closed never
+// goes back, so the next request has to dial again.
+type ConnReuse struct {
+	created     int64 // ConnectDone without error
+	reused      int64 // GotConn with Reused set
+	wasIdle     int64 // of those, how many had been idle rather than just released
+	idleReturns int64 // PutIdleConn without error
+}
+
+// ReuseCounts is a snapshot of a ConnReuse
+type ReuseCounts struct {
+	Created, Reused, WasIdle, IdleReturns int64
+}
+
+// Trace returns a ClientTrace that feeds r
+func (r *ConnReuse) Trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				atomic.AddInt64(&r.created, 1)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+			atomic.AddInt64(&r.reused, 1)
+			if info.WasIdle {
+				atomic.AddInt64(&r.wasIdle, 1)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil {
+				atomic.AddInt64(&r.idleReturns, 1)
+			}
+		},
+	}
+}
+
+// Counts returns the totals so far
+func (r *ConnReuse) Counts() ReuseCounts {
+	return ReuseCounts{
+		Created:     atomic.LoadInt64(&r.created),
+		Reused:      atomic.LoadInt64(&r.reused),
+		WasIdle:     atomic.LoadInt64(&r.wasIdle),
+		IdleReturns: atomic.LoadInt64(&r.idleReturns),
+	}
+}
+
+// ReuseRatio is the fraction of connections handed to requests that came
+// from the pool, 0 before the first request
+func (c ReuseCounts) ReuseRatio() float64 {
+	if c.Created+c.Reused == 0 {
+		return 0
+	}
+	return float64(c.Reused) / float64(c.Created+c.Reused)
+}
+
+func (r *ConnReuse) String() string {
+	c := r.Counts()
+	return fmt.Sprintf("created %d  |  reused %d (was idle %d)  |  idle returns %d  |  reuse %.0f%%",
+		c.Created, c.Reused, c.WasIdle, c.IdleReturns, 100*c.ReuseRatio())
+}
+
+// conns tracks the mock server's connections
+var conns = conntrack.New()
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// drainRequests is how many requests each TestDrainReuse case makes
+const drainRequests = 100
+
+// tlsRequests is how many requests each TestHandshakes case makes
+const tlsRequests = 200
+
+// TestDrainReuse polls a mock server on a free port with 1 MB bodies, three
+// ways: drained under the default cap, which should reuse one connection;
+// drained under a cap smaller than the body, which should dial for every
+// request; and closed unread, as in http-nodrain.
+func TestDrainReuse(t *testing.T) {
+	const bodySize = 1 << 20 // well past the 256 KB net/http drains itself on Close
+	created := func(drainMax int64, closeOnly bool) int64 {
+		gw := &APIGateway{drainMax: drainMax}
+		gw.startMockServer("127.0.0.1:0", bodySize)
+		defer gw.mockServer.Close()
+		for i := 0; i < drainRequests; i++ {
+			if closeOnly {
+				req, _ := gw.newRequest()
+				if resp, err := gw.client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+				continue
+			}
+			if _, err := gw.reportReady(); err != nil {
+				check(t, fmt.Sprintf("request %d: %v", i, err), false)
+				return -1
+			}
+		}
+		gw.client.CloseIdleConnections()
+		return gw.connsUsed.Counts().Created
+	}
+
+	n := created(defaultDrainMax, false)
+	check(t, fmt.Sprintf("%d requests drained under a %d KB cap: created %d (want <= 2)", drainRequests, defaultDrainMax/1024, n),
+		n >= 1 && n <= 2)
+	n = created(bodySize/2, false)
+	check(t, fmt.Sprintf("%d requests with a %d KB cap below the body size: created %d (want %d)", drainRequests, bodySize/2/1024, n, drainRequests),
+		n == drainRequests)
+	n = created(0, true)
+	check(t, fmt.Sprintf("%d requests closed without reading: created %d (want %d)", drainRequests, n, drainRequests),
+		n == drainRequests)
+}
+
+// TestHandshakes runs tlsRequests requests against a TLS mock server
+// on a free port with drained bodies, then with bodies closed unread, and
+// checks that TLSHandshakes counts one handshake per new connection: a
+// handful for the first and one per request for the second. A client that
+// doesn't trust the certificate must count a failed handshake.
+func TestHandshakes(t *testing.T) {
+	useTLSFlag := *useTLS
+	*useTLS = true
+	t.Cleanup(func() { *useTLS = useTLSFlag })
+
+	const bodySize = 1 << 20
+	run := func(closeOnly bool) *APIGateway {
+		gw := &APIGateway{drainMax: defaultDrainMax}
+		gw.startMockServer("127.0.0.1:0", bodySize)
+		defer gw.mockServer.Close()
+		for i := 0; i < tlsRequests; i++ {
+			if !closeOnly {
+				gw.reportReady()
+				continue
+			}
+			req, _ := gw.newRequest()
+			if resp, err := gw.client.Do(req); err == nil {
+				atomic.AddInt64(&gw.requestsMade, 1)
+				resp.Body.Close()
+			}
+		}
+		gw.client.CloseIdleConnections()
+		return gw
+	}
+
+	drained := run(false)
+	done, failed, drainedTime := drained.handshakes.Totals()
+	created := drained.connsUsed.Counts().Created
+	check(t, fmt.Sprintf("%d drained requests: %s", tlsRequests, drained.handshakes.String(tlsRequests)),
+		done >= 1 && done <= 2 && failed == 0 && drainedTime > 0)
+	check(t, fmt.Sprintf("one handshake per new connection: %d handshakes, %d created", done, created), done == created)
+
+	undrained := run(true)
+	done, failed, undrainedTime := undrained.handshakes.Totals()
+	check(t, fmt.Sprintf("%d requests closed unread: %s", tlsRequests, undrained.handshakes.String(tlsRequests)),
+		done == tlsRequests && failed == 0)
+	check(t, fmt.Sprintf("undrained bodies spent %v in handshakes, drained ones %v", undrainedTime.Round(time.Microsecond), drainedTime.Round(time.Microsecond)),
+		undrainedTime > drainedTime)
+
+	// The server logs the handshake the client aborts; that's expected here
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	gw := &APIGateway{}
+	gw.startMockServer("127.0.0.1:0", 1)
+	gw.client = &http.Client{Transport: &http.Transport{}} // trusts only the system roots
+	req, _ := gw.newRequest()
+	if resp, err := gw.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	gw.mockServer.Close()
+	done, failed, _ = gw.handshakes.Totals()
+	check(t, fmt.Sprintf("a client that doesn't trust the certificate: %d done, %d failed (want 0, 1)", done, failed),
+		done == 0 && failed == 1)
+}
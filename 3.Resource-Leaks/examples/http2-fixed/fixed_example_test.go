@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestStreamRelease runs a feed server allowing 8 streams per connection.
+// Against it, 100 polls through latestEvent must share one connection and
+// leave no stream active, while 8 bodies left open must stall the 9th
+// request until they are closed.
+func TestStreamRelease(t *testing.T) {
+	const limit, polls = 8, 100
+
+	baseline := runtime.NumGoroutine()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	server, err := startFeedServer(addr, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + addr + "/api/feed"
+
+	// settled waits up to a second for no stream to be active
+	settled := func() StreamStats {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			s := streams.Stats()
+			if len(s.PerConn) == 0 || s.PerConn[0] == 0 {
+				return s
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return streams.Stats()
+	}
+
+	// latestEvent closes every body
+	feed := &FeedClient{client: newH2Client(true), url: url}
+	start := time.Now()
+	failed := 0
+	for i := 0; i < polls; i++ {
+		if _, err := feed.latestEvent(context.Background()); err != nil {
+			failed++
+		}
+	}
+	took := time.Since(start)
+	s := settled()
+	check(t, fmt.Sprintf("%d polls with Close: %d failed, in %v", polls, failed, took.Round(time.Millisecond)),
+		failed == 0 && took < 5*time.Second)
+	check(t, fmt.Sprintf("they shared one connection and left no stream active (%s)", s), s.Accepted == 1 && len(s.PerConn) == 1 && s.PerConn[0] == 0)
+	feed.client.CloseIdleConnections()
+
+	// The leak: read the first line and keep the body open
+	leaky := newH2Client(true)
+	var open []io.ReadCloser
+	for i := 0; i < limit; i++ {
+		resp, err := leaky.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufio.NewReader(resp.Body).ReadString('\n')
+		open = append(open, resp.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	_, err = leaky.Do(req)
+	cancel()
+	s = streams.Stats()
+	check(t, fmt.Sprintf("with %d bodies open, request %d stalled (%v)", limit, limit+1, err), errors.Is(err, context.DeadlineExceeded))
+	check(t, fmt.Sprintf("with %d streams active on one connection and no new one dialed (%s)", limit, s),
+		s.Accepted == 2 && len(s.PerConn) == 1 && s.PerConn[0] == limit)
+
+	for _, body := range open {
+		body.Close()
+	}
+	s = settled()
+	check(t, fmt.Sprintf("closing them released every stream (%s)", s), len(s.PerConn) == 1 && s.PerConn[0] == 0)
+	resp, err := leaky.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	check(t, fmt.Sprintf("and the same connection serves requests again (err=%v, accepted %d)", err, streams.Stats().Accepted),
+		err == nil && streams.Stats().Accepted == 2)
+
+	leaky.CloseIdleConnections()
+	server.Close()
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(t, fmt.Sprintf("goroutines back to baseline (%d -> %d)", baseline, runtime.NumGoroutine()), runtime.NumGoroutine() <= baseline)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example shows the HTTP/2 form of the unclosed-body leak. Over
+// HTTP/1.1 each unclosed body pins its own connection, so goroutines and file
+// descriptors climb. HTTP/2 multiplexes every request as a stream on one
+// connection, so an unclosed body pins a stream instead. Nothing grows that a
+// descriptor count would show. Once the server's MaxConcurrentStreams are
+// all pinned, the next request waits for a stream that never frees up, and
+// the service stops.
+
+// FeedClient polls an upstream event feed for its newest event
+// BUG: response bodies are never closed
+type FeedClient struct {
+	client  *http.Client
+	url     string
+	ok      int64
+	waiting int64 // requests inside client.Do
+	since   int64 // when the current request started, UnixNano
+}
+
+// The feed: feedEvents events of feedEventSize bytes, 1 MB per response
+const (
+	feedEvents    = 1024
+	feedEventSize = 1024
+)
+
+// Feed flags, identical in http2-leak and http2-fixed
+var (
+	maxStreams = flag.Int("max-streams", 32, "the feed server's HTTP/2 MaxConcurrentStreams per connection")
+	strict     = flag.Bool("strict", true, "set StrictMaxConcurrentRequests: wait for a free stream instead of dialing another connection")
+	runFor     = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+)
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6060")
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
+	}()
+
+	server, err := startFeedServer("127.0.0.1:8084", *maxStreams)
+	if err != nil {
+		log.Fatalf("Feed server error: %v", err)
+	}
+	defer server.Close()
+	time.Sleep(100 * time.Millisecond) // Let both servers start
+	feed := &FeedClient{client: newH2Client(*strict), url: "http://127.0.0.1:8084/api/feed"}
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	baseline := health.Read()
+	debugMux.HandleFunc("/healthz", health.Handler(baseline))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	debugMux.HandleFunc("/debug/streams", streams.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  Feed: %s over h2c  |  MaxConcurrentStreams: %d  |  Strict: %v\n",
+		runtime.NumGoroutine(), feed.url, *maxStreams, *strict)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	// Reports come from their own goroutine, because the request loop is
+	// about to stop moving
+	go feed.reportEvery(ctx, 2*time.Second, baseline.OpenFDs)
+
+	// Simulate continuous API calls
+	ticker := time.NewTicker(40 * time.Millisecond) // 25 requests/second
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nWorkload stopped")
+			feed.report("[FINAL]", baseline.OpenFDs)
+			return
+		case <-ticker.C:
+		}
+
+		// BUG: latestEvent never closes the body
+		if _, err := feed.latestEvent(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error polling feed: %v", err)
+		}
+	}
+}
+
+// latestEvent returns the first line of the feed, the newest event. ctx only
+// ends the workload; there is no per-request timeout.
+func (f *FeedClient) latestEvent(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return "", err
+	}
+	atomic.StoreInt64(&f.since, time.Now().UnixNano())
+	atomic.AddInt64(&f.waiting, 1)
+	resp, err := f.client.Do(req)
+	atomic.AddInt64(&f.waiting, -1)
+	if err != nil {
+		return "", err
+	}
+
+	// BUG: the rest of the 1 MB body is never read and the body never
+	// closed. Over HTTP/2 that keeps the stream open: the server's handler
+	// blocks once the stream's flow-control window is full, and the stream
+	// counts against MaxConcurrentStreams until the connection dies.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	atomic.AddInt64(&f.ok, 1)
+	return line, nil
+}
+
+// reportEvery calls report every interval until ctx is done, and explains
+// the stall the first time a request has waited a whole interval
+func (f *FeedClient) reportEvery(ctx context.Context, interval time.Duration, baseFDs int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	explained := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.report(fmt.Sprintf("[AFTER %.0fs]", time.Since(start).Seconds()), baseFDs)
+
+		if wait := f.waitedFor(); wait >= interval && !explained {
+			explained = true
+			fmt.Printf("\n⚠️  Requests stalled: the current one has waited %v, yet FDs and connections are flat.\n", wait.Round(time.Second))
+			fmt.Println("HTTP/2 multiplexes every request as a stream on one connection. Each unclosed")
+			fmt.Printf("body keeps its stream open, and the server allows %d streams per connection.\n", *maxStreams)
+			fmt.Println("With all of them pinned, the Transport waits for a free stream that never")
+			fmt.Println("comes. No descriptor is leaked, so an FD or connection count never shows it;")
+			fmt.Println("the active stream count does: curl http://localhost:6060/debug/streams")
+			fmt.Println()
+		}
+	}
+}
+
+// waitedFor returns how long the request in client.Do has been waiting, or 0
+func (f *FeedClient) waitedFor() time.Duration {
+	if atomic.LoadInt64(&f.waiting) == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.since)))
+}
+
+// report prints the periodic status lines under label
+func (f *FeedClient) report(label string, baseFDs int) {
+	fmt.Printf("%s Goroutines: %d  |  FDs: %+d  |  Requests: %d ok, %d waiting",
+		label, runtime.NumGoroutine(), fdcount.Count()-baseFDs, atomic.LoadInt64(&f.ok), atomic.LoadInt64(&f.waiting))
+	if wait := f.waitedFor(); wait > 0 {
+		fmt.Printf(" (for %v)", wait.Round(100*time.Millisecond))
+	}
+	fmt.Println()
+	fmt.Printf("           Server conns: %s\n", streams.Stats())
+	fmt.Printf("           %s\n", gcpercent.Stats())
+}
+
+// startFeedServer serves /api/feed on addr over h2c, HTTP/2 without TLS,
+// allowing maxStreams concurrent streams per connection. Each response is
+// feedEvents one-line events, flushed as it goes, so a handler whose client
+// stops reading blocks once the stream's flow-control window is full.
+func startFeedServer(addr string, maxStreams int) (*http.Server, error) {
+	line := strings.Repeat("e", feedEventSize-1) + "\n"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/feed", func(w http.ResponseWriter, r *http.Request) {
+		defer streams.begin(r.Context())()
+		flusher, _ := w.(http.Flusher)
+		for i := 0; i < feedEvents; i++ {
+			if _, err := io.WriteString(w, line); err != nil {
+				return // the client reset the stream
+			}
+			if i%64 == 63 && flusher != nil {
+				flusher.Flush()
+			}
+		}
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:     mux,
+		ConnContext: streams.connContext,
+		ConnState:   streams.connState,
+		HTTP2:       &http.HTTP2Config{MaxConcurrentStreams: maxStreams},
+	}
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(ln)
+	return server, nil
+}
+
+// newH2Client returns a client that speaks only h2c, so every request is a
+// stream on a shared connection. With strict, the Transport never opens a
+// second connection to the same host: a request that finds every stream in
+// use waits for one. The receive buffer is kept small, so a stream nobody
+// reads pins 256 KB on the client rather than the default 4 MB.
+func newH2Client(strict bool) *http.Client {
+	transport := &http.Transport{
+		HTTP2: &http.HTTP2Config{
+			StrictMaxConcurrentRequests: strict,
+			MaxReceiveBufferPerStream:   256 << 10,
+		},
+	}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+// StreamTracker counts, on the server, the connections accepted and the
+// streams being served on each one. Go's HTTP/2 server runs every stream's
+// handler on its own goroutine, so an active stream is a handler that hasn't
+// returned.
+type StreamTracker struct {
+	accepted int64
+
+	mu     sync.Mutex
+	active map[net.Conn]int
+}
+
+type trackedConnKey struct{}
+
+// streams tracks the feed server
+var streams = &StreamTracker{active: make(map[net.Conn]int)}
+
+// connContext is the server's ConnContext: it tags each connection's
+// requests with the connection
+func (t *StreamTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, trackedConnKey{}, c)
+}
+
+// connState is the server's ConnState callback
+func (t *StreamTracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		t.accepted++
+		t.active[c] = 0
+	case http.StateClosed:
+		delete(t.active, c)
+	}
+}
+
+// begin counts a stream on ctx's connection and returns the func that
+// uncounts it
+func (t *StreamTracker) begin(ctx context.Context) func() {
+	c, _ := ctx.Value(trackedConnKey{}).(net.Conn)
+	t.mu.Lock()
+	t.active[c]++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		if _, ok := t.active[c]; ok {
+			t.active[c]--
+		}
+		t.mu.Unlock()
+	}
+}
+
+// StreamStats is a snapshot of a StreamTracker
+type StreamStats struct {
+	Accepted int64 `json:"accepted"`
+	PerConn  []int `json:"active_streams_per_conn"`
+}
+
+// Stats returns the active stream count of every open connection
+func (t *StreamTracker) Stats() StreamStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := StreamStats{Accepted: t.accepted, PerConn: []int{}}
+	for _, n := range t.active {
+		s.PerConn = append(s.PerConn, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(s.PerConn)))
+	return s
+}
+
+func (s StreamStats) String() string {
+	return fmt.Sprintf("%d open, accepted %d  |  active streams per conn: %v", len(s.PerConn), s.Accepted, s.PerConn)
+}
+
+// Handler serves Stats as JSON, registered at /debug/streams
+func (t *StreamTracker) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example fixes the reverse proxy in proxy-leak. The outbound request
+// carries the client's context, so a client that leaves cancels it, even
+// while the copy waits on a stalled upstream. The upstream body is closed on
+// every path out of the copy loop, so no connection outlives its copy.
+
+// Proxy forwards every request to one upstream and copies the response back
+// FIXED: the outbound request is cancelled with the client's, and the
+// upstream body is always closed
+type Proxy struct {
+	upstream string // base URL, without a trailing slash
+	client   *http.Client
+	conns    *connCounter
+	copied   int64 // bytes copied to clients
+	copies   *copyTracker
+}
+
+// An export: exportChunks chunks of exportChunkSize bytes, chunkInterval
+// apart, 128 KB over 800ms
+const (
+	exportChunks    = 8
+	exportChunkSize = 16 << 10
+	chunkInterval   = 100 * time.Millisecond
+)
+
+// Proxy flags, identical in proxy-leak and proxy-fixed
+var (
+	cancelRate = flag.Float64("cancel-rate", 0.3, "fraction of clients that give up mid-transfer")
+	stallEvery = flag.Int("stall-every", 8, "the upstream stalls every nth export after its first chunk (0 = never)")
+	runFor     = flag.Duration("duration", 0, "stop the workload after this long (0 = run until Ctrl+C)")
+)
+
+// clientTimeout is how long a patient client waits for a whole export
+const clientTimeout = 2 * time.Second
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	upstream, err := startUpstream("127.0.0.1:8088", *stallEvery)
+	if err != nil {
+		log.Fatalf("Upstream error: %v", err)
+	}
+	defer upstream.Close()
+	proxy := NewProxy("http://127.0.0.1:8088")
+	front, err := startProxy("127.0.0.1:8089", proxy)
+	if err != nil {
+		log.Fatalf("Proxy error: %v", err)
+	}
+	defer front.Close()
+	clients := &Clients{client: newClient(), url: "http://127.0.0.1:8089/api/export"}
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	baseline := health.Read()
+	debugMux.HandleFunc("/healthz", health.Handler(baseline))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+	debugMux.HandleFunc("/debug/proxy", proxy.Handler())
+
+	fmt.Printf("[START] Goroutines: %d  |  Proxy: %s -> %s  |  Cancel rate: %.0f%%  |  Stall every: %d\n",
+		runtime.NumGoroutine(), clients.url, proxy.upstream, *cancelRate*100, *stallEvery)
+
+	// The workload runs until Ctrl+C or -duration
+	ctx, stop := sighandler.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	go clients.run(ctx, 100*time.Millisecond, *cancelRate) // 10 requests/second
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			if sighandler.Terminated(ctx) {
+				sighandler.LogLeakDump("/tmp/leakdump")
+			}
+			fmt.Println("\nWorkload stopped")
+			report("[FINAL]", baseline.OpenFDs, proxy, clients)
+			return
+		case <-ticker.C:
+		}
+		report(fmt.Sprintf("[AFTER %.0fs]", time.Since(start).Seconds()), baseline.OpenFDs, proxy, clients)
+
+		if s := proxy.Stats(); s.Leaked == 0 && s.Orphaned == 0 {
+			fmt.Println("✓ No leak! Every upstream body closed, no copy outlives its client")
+		}
+	}
+}
+
+// NewProxy returns a Proxy for the upstream at base
+func NewProxy(base string) *Proxy {
+	conns := &connCounter{}
+	return &Proxy{
+		upstream: base,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext:         conns.dial,
+			MaxIdleConnsPerHost: 32,
+		}},
+		conns:  conns,
+		copies: newCopyTracker(),
+	}
+}
+
+// ServeHTTP forwards r to the upstream and copies the response to w
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// ✅ FIX: the outbound request carries the client's context. When the
+	// client leaves, the server cancels it, the Transport closes the upstream
+	// connection, and a Read blocked on a stalled upstream returns.
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, p.upstream+r.URL.RequestURI(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Header = r.Header.Clone()
+	resp, err := p.client.Do(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	body, end := p.copies.begin(r.Context(), resp.Body)
+	defer end()
+	// ✅ FIX: closed on every path out of the copy loop, the failed write
+	// included. Defers run last in, first out, so it is closed before end
+	// checks.
+	defer body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return // the client has gone
+			}
+			atomic.AddInt64(&p.copied, int64(n))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ProxyStats is a snapshot of a Proxy
+type ProxyStats struct {
+	UpstreamOpen   int64 `json:"upstream_conns_open"`
+	UpstreamDialed int64 `json:"upstream_conns_dialed"`
+	CopiedBytes    int64 `json:"copied_bytes"`
+	CopyStats
+}
+
+// Stats returns the proxy's upstream connections, bytes copied and copies
+func (p *Proxy) Stats() ProxyStats {
+	dialed, closed := p.conns.counts()
+	return ProxyStats{
+		UpstreamOpen:   dialed - closed,
+		UpstreamDialed: dialed,
+		CopiedBytes:    atomic.LoadInt64(&p.copied),
+		CopyStats:      p.copies.Stats(),
+	}
+}
+
+// Handler serves Stats as JSON, registered at /debug/proxy
+func (p *Proxy) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// connCounter counts a Transport's connections. Its dial wraps each one, so
+// the Transport's Close is seen.
+type connCounter struct {
+	dialed int64
+	closed int64
+}
+
+func (c *connCounter) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.dialed, 1)
+	return &countedConn{Conn: conn, counter: c}, nil
+}
+
+// counts returns the connections dialed and closed so far
+func (c *connCounter) counts() (dialed, closed int64) {
+	return atomic.LoadInt64(&c.dialed), atomic.LoadInt64(&c.closed)
+}
+
+type countedConn struct {
+	net.Conn
+	counter *connCounter
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.counter.closed, 1) })
+	return c.Conn.Close()
+}
+
+// copyTracker follows each copy of an upstream body to a client: those
+// running, those still running for a client that has gone, and those that
+// ended with the upstream body open
+type copyTracker struct {
+	mu       sync.Mutex
+	active   map[*trackedBody]context.Context
+	finished int64
+	leaked   int64
+}
+
+func newCopyTracker() *copyTracker {
+	return &copyTracker{active: make(map[*trackedBody]context.Context)}
+}
+
+// trackedBody records whether the upstream body was closed
+type trackedBody struct {
+	io.ReadCloser
+	closed int32
+}
+
+func (b *trackedBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+// begin starts tracking a copy of body for the client request whose context
+// is ctx. It returns the body to read and close, and the func that ends the
+// copy.
+func (t *copyTracker) begin(ctx context.Context, body io.ReadCloser) (*trackedBody, func()) {
+	b := &trackedBody{ReadCloser: body}
+	t.mu.Lock()
+	t.active[b] = ctx
+	t.mu.Unlock()
+	return b, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.active, b)
+		t.finished++
+		if atomic.LoadInt32(&b.closed) == 0 {
+			t.leaked++
+		}
+	}
+}
+
+// CopyStats is a snapshot of a copyTracker
+type CopyStats struct {
+	Active   int   `json:"copies_active"`
+	Orphaned int   `json:"copies_for_departed_clients"`
+	Finished int64 `json:"copies_finished"`
+	Leaked   int64 `json:"copies_leaked"`
+}
+
+// Stats counts the copies. Orphaned ones are active copies whose client
+// request's context has ended; Leaked ones finished without closing the
+// upstream body.
+func (t *copyTracker) Stats() CopyStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := CopyStats{Active: len(t.active), Finished: t.finished, Leaked: t.leaked}
+	for _, ctx := range t.active {
+		if ctx.Err() != nil {
+			s.Orphaned++
+		}
+	}
+	return s
+}
+
+// startUpstream serves /api/export on addr. Every stallEvery-th export
+// stalls after its first chunk until its connection closes, like a backend
+// stuck on a lock.
+func startUpstream(addr string, stallEvery int) (*http.Server, error) {
+	chunk := bytes.Repeat([]byte("x"), exportChunkSize)
+	var served int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&served, 1)
+		w.Header().Set("Content-Length", strconv.Itoa(exportChunks*exportChunkSize))
+		flusher, _ := w.(http.Flusher)
+		for i := 0; i < exportChunks; i++ {
+			if i > 0 {
+				if i == 1 && stallEvery > 0 && n%int64(stallEvery) == 0 {
+					<-r.Context().Done()
+					return
+				}
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(chunkInterval):
+				}
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	})
+	return serve(addr, mux)
+}
+
+// startProxy serves proxy on addr
+func startProxy(addr string, proxy *Proxy) (*http.Server, error) {
+	return serve(addr, proxy)
+}
+
+func serve(addr string, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+	return server, nil
+}
+
+// Clients request exports through the proxy. A share of them are
+// impatient and give up mid-transfer, after 100-700ms; the others wait up to
+// clientTimeout.
+type Clients struct {
+	client    *http.Client
+	url       string
+	completed int64
+	gaveUp    int64
+	timedOut  int64
+	failed    int64
+}
+
+// newClient returns the clients' http.Client. Giving up on a request closes
+// its connection to the proxy, which is how the proxy sees the client leave.
+func newClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 32}}
+}
+
+// run starts a request every interval until ctx is done
+func (c *Clients) run(ctx context.Context, interval time.Duration, cancelRate float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		go c.fetch(ctx, rand.Float64() < cancelRate)
+	}
+}
+
+// fetch downloads one export, giving up after a random 100-700ms if
+// impatient
+func (c *Clients) fetch(ctx context.Context, impatient bool) {
+	patience := clientTimeout
+	if impatient {
+		patience = 100*time.Millisecond + time.Duration(rand.Int63n(int64(600*time.Millisecond)))
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, patience)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, c.url, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := c.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	switch {
+	case ctx.Err() != nil:
+		// The workload stopped
+	case err == nil:
+		atomic.AddInt64(&c.completed, 1)
+	case errors.Is(err, context.DeadlineExceeded) && impatient:
+		atomic.AddInt64(&c.gaveUp, 1)
+	case errors.Is(err, context.DeadlineExceeded):
+		atomic.AddInt64(&c.timedOut, 1)
+	default:
+		atomic.AddInt64(&c.failed, 1)
+	}
+}
+
+// report prints the periodic status lines under label
+func report(label string, baseFDs int, proxy *Proxy, clients *Clients) {
+	s := proxy.Stats()
+	fmt.Printf("%s Goroutines: %d  |  FDs: %+d  |  Clients: %d completed, %d gave up, %d timed out, %d failed\n",
+		label, runtime.NumGoroutine(), fdcount.Count()-baseFDs, atomic.LoadInt64(&clients.completed),
+		atomic.LoadInt64(&clients.gaveUp), atomic.LoadInt64(&clients.timedOut), atomic.LoadInt64(&clients.failed))
+	fmt.Printf("           Upstream conns: %d open, %d dialed  |  Proxied: %.1f MB\n",
+		s.UpstreamOpen, s.UpstreamDialed, float64(s.CopiedBytes)/(1<<20))
+	fmt.Printf("           Copies: %d active, %d for departed clients, %d finished, %d leaked\n",
+		s.Active, s.Orphaned, s.Finished, s.Leaked)
+	fmt.Printf("           %s\n", gcpercent.Stats())
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
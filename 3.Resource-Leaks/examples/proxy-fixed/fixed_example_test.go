@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestCancelledBurst runs an upstream that stalls every 4th export, and
+// the proxy in front of it. After one whole export, a burst of 40 clients
+// each read the first chunk of an export and give up. Every copy must end
+// with its upstream body closed, every upstream connection must be closed,
+// and goroutines must return to baseline.
+func TestCancelledBurst(t *testing.T) {
+	const burst, stall = 40, 4
+
+	baseline := runtime.NumGoroutine()
+
+	upstreamAddr, proxyAddr := freeAddr(t), freeAddr(t)
+	upstream, err := startUpstream(upstreamAddr, stall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy("http://" + upstreamAddr)
+	front, err := startProxy(proxyAddr, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + proxyAddr + "/api/export"
+	client := newClient()
+
+	// settled waits up to two seconds for cond
+	settled := func(cond func() bool) {
+		for deadline := time.Now().Add(2 * time.Second); !cond() && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var got int64
+	resp, err := client.Get(url)
+	if err == nil {
+		got, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	check(t, fmt.Sprintf("a patient client got the whole export (%d of %d bytes, err=%v)", got, exportChunks*exportChunkSize, err),
+		err == nil && got == exportChunks*exportChunkSize)
+
+	// Each client cancels its request once the first chunk is in; every 4th
+	// export has stalled by then
+	var wg sync.WaitGroup
+	var gaveUp int64
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			if _, err := io.ReadFull(resp.Body, make([]byte, exportChunkSize)); err == nil {
+				atomic.AddInt64(&gaveUp, 1)
+			}
+			cancel()
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	check(t, fmt.Sprintf("%d of %d clients read the first chunk and gave up mid-transfer", gaveUp, burst), gaveUp == burst)
+
+	settled(func() bool { return proxy.Stats().Active == 0 })
+	s := proxy.Stats()
+	check(t, fmt.Sprintf("every copy ended, stalled ones included (%d active, %d finished)", s.Active, s.Finished),
+		s.Active == 0 && s.Finished == burst+1)
+	check(t, fmt.Sprintf("each with its upstream body closed (%d leaked)", s.Leaked), s.Leaked == 0)
+
+	// The patient client's upstream connection is idle, ready for reuse
+	proxy.client.CloseIdleConnections()
+	settled(func() bool { return proxy.Stats().UpstreamOpen == 0 })
+	s = proxy.Stats()
+	check(t, fmt.Sprintf("every upstream connection was closed (%d dialed, %d open)", s.UpstreamDialed, s.UpstreamOpen), s.UpstreamOpen == 0)
+
+	client.CloseIdleConnections()
+	front.Close()
+	upstream.Close()
+	settled(func() bool { return runtime.NumGoroutine() <= baseline })
+	check(t, fmt.Sprintf("goroutines back to baseline (%d -> %d)", baseline, runtime.NumGoroutine()), runtime.NumGoroutine() <= baseline)
+}
+
+// freeAddr returns a loopback address with a free port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
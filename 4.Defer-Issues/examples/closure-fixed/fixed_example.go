@@ -1,10 +1,22 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/mux"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // Connection simulates a closeable resource (database connection, file handle, etc.)
@@ -28,13 +40,24 @@ func (c *Connection) Close() error {
 }
 
 func main() {
+	flag.Parse()
+	if *muxStreams > 0 {
+		compareMultiplexing(*muxStreams)
+		return
+	}
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Serve a process summary next to pprof
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	// Start pprof server for analysis
 	go func() {
-		http.ListenAndServe("localhost:6061", nil)
+		http.ListenAndServe("localhost:6061", debugMux)
 	}()
 
-	fmt.Println("=== Closure Variable Capture - FIXED Demo ===\n")
-	fmt.Println("Demonstrating three correct patterns:\n")
+	fmt.Print("=== Closure Variable Capture - FIXED Demo ===\n\n")
+	fmt.Print("Demonstrating three correct patterns:\n\n")
 
 	fmt.Println("Pattern 1: Pass as function argument")
 	fmt.Println("=========================================")
@@ -137,3 +160,142 @@ func createConnections() []*Connection {
 	}
 	return connections
 }
+
+var muxStreams = flag.Int("mux", 0, "open this many logical connections as TCP connections, then as mux.Multiplexer streams, and compare goroutines and descriptors, then exit")
+
+// compareMultiplexing sends one message on each of n logical connections,
+// first with a TCP connection and a server goroutine per logical connection,
+// then as n streams over one mux.Multiplexer. It prints the goroutines and
+// descriptors in use while all n are open.
+func compareMultiplexing(n int) {
+	fmt.Printf("Opening %d logical connections, each sending one message...\n\n", n)
+	fmt.Printf("%-22s %8s %12s %6s %10s\n", "mode", "logical", "goroutines", "FDs", "delivered")
+
+	type result struct {
+		goroutines, fds int
+		delivered       int64
+	}
+	print := func(mode string, r result) {
+		fmt.Printf("%-22s %8d %+12d %+6d %6d/%d\n", mode, n, r.goroutines, r.fds, r.delivered, n)
+	}
+	message := func(i int) []byte { return []byte(fmt.Sprintf("hello from logical connection %d", i)) }
+
+	// One TCP connection per logical connection, each read on its own goroutine
+	perConn := func() result {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+		baseG, baseFD := runtime.NumGoroutine(), fdcount.Count()
+
+		var accepted, delivered atomic.Int64
+		var wg sync.WaitGroup
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				accepted.Add(1)
+				wg.Add(1)
+				go func(c net.Conn) {
+					defer wg.Done()
+					defer c.Close()
+					if b, err := io.ReadAll(c); err == nil && len(b) > 0 {
+						delivered.Add(1)
+					}
+				}(c)
+			}
+		}()
+
+		conns := make([]net.Conn, n)
+		for i := range conns {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				log.Fatalf("dial %d: %v (raise ulimit -n, or lower -mux)", i, err)
+			}
+			c.Write(message(i))
+			conns[i] = c
+		}
+		for accepted.Load() < int64(n) {
+			time.Sleep(time.Millisecond)
+		}
+		r := result{goroutines: runtime.NumGoroutine() - baseG, fds: fdcount.Count() - baseFD}
+		for _, c := range conns {
+			c.Close()
+		}
+		wg.Wait()
+		r.delivered = delivered.Load()
+		return r
+	}
+
+	// n streams over one connection, read by one Serve goroutine per side
+	multiplexed := func() result {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+		baseG, baseFD := runtime.NumGoroutine(), fdcount.Count()
+
+		serverConn := make(chan net.Conn, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConn <- c
+		}()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client := mux.New(c)
+		server := mux.New(<-serverConn)
+		done := make(chan struct{}, 2)
+		for _, m := range []*mux.Multiplexer{client, server} {
+			go func(m *mux.Multiplexer) {
+				if err := m.Serve(); err != nil {
+					log.Printf("Serve: %v", err)
+				}
+				done <- struct{}{}
+			}(m)
+		}
+
+		for i := 0; i < n; i++ {
+			client.Open(uint32(i)).Write(message(i))
+		}
+		for server.Streams() < n {
+			time.Sleep(time.Millisecond)
+		}
+		r := result{goroutines: runtime.NumGoroutine() - baseG, fds: fdcount.Count() - baseFD}
+
+		for i := 0; i < n; i++ {
+			client.Open(uint32(i)).Close()
+		}
+		for i := 0; i < n; i++ {
+			s := server.Open(uint32(i))
+			if b, err := io.ReadAll(s); err == nil && string(b) == string(message(i)) {
+				r.delivered++
+			}
+			s.Close()
+		}
+		client.Close()
+		server.Close()
+		<-done
+		<-done
+		return r
+	}
+
+	print("one conn each", perConn())
+	print("one Multiplexer", multiplexed())
+
+	fmt.Println("\nGoroutines and FDs are the increase while every logical connection is open.")
+	fmt.Println("With a Multiplexer, another stream costs a buffer, not a socket and a goroutine.")
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
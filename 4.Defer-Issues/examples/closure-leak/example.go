@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"sync"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // Connection simulates a closeable resource (database connection, file handle, etc.)
@@ -28,12 +30,15 @@ func (c *Connection) Close() error {
 }
 
 func main() {
+	// Serve a process summary next to pprof
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	// Start pprof server for analysis
 	go func() {
-		http.ListenAndServe("localhost:6060", nil)
+		http.ListenAndServe("localhost:6060", debugMux)
 	}()
 
-	fmt.Println("=== Closure Variable Capture Bug Demo ===\n")
+	fmt.Print("=== Closure Variable Capture Bug Demo ===\n\n")
 	fmt.Println("Creating 5 connections with closure capture bug...")
 	fmt.Println()
 
@@ -82,3 +87,8 @@ func demonstrateClosureBug() {
 	// When this function returns, all 5 defers execute
 	// But they all captured the same 'connPtr' variable which now points to connections[4]
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
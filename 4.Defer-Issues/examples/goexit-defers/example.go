@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// runtime.Goexit ends the calling goroutine. Unlike return, it unwinds every
+// frame of the goroutine, running all pending defers on the way. Unlike
+// panic, it can't be recovered: recover returns nil while Goexit unwinds.
+// testing.T.FailNow (and Fatal, Fatalf, SkipNow) calls Goexit, so the same
+// rules apply in tests - and when it is called from a goroutine the test
+// started, only that goroutine stops.
+
+// Resource is a closeable handle that reports when it is closed
+type Resource struct {
+	Name string
+}
+
+func (r *Resource) Close() {
+	fmt.Printf("  deferred Close: %s\n", r.Name)
+}
+
+func main() {
+	// Serve a process summary next to pprof
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Start pprof server for analysis
+	go func() {
+		http.ListenAndServe("localhost:6060", debugMux)
+	}()
+
+	fmt.Println("=== runtime.Goexit vs return vs panic ===")
+
+	fmt.Println("\n--- 1. return: only the returning function's defers run ---")
+	runInGoroutine(func() { outer(false) })
+
+	fmt.Println("\n--- 2. Goexit: every frame's defers run, then the goroutine ends ---")
+	runInGoroutine(func() { outer(true) })
+
+	fmt.Println("\n--- 3. recover catches panic but not Goexit ---")
+	runInGoroutine(func() { recoverFrom(func() { panic("boom") }) })
+	runInGoroutine(func() { recoverFrom(runtime.Goexit) })
+
+	fmt.Println("\n--- 4. FailNow-style Goexit skips code that isn't deferred ---")
+	demonstrateSkippedDone()
+
+	fmt.Println("\n=== Analysis ===")
+	fmt.Println("Goexit ran all 3 accumulated defers and the caller's defer too, but nothing after")
+	fmt.Println("the call. recover() returned nil for it, so a recover-based wrapper can't stop it.")
+	fmt.Println("Cleanup written as plain statements (wg.Done(), a send on a result channel) is")
+	fmt.Println("skipped, and whoever waits for it leaks. t.FailNow from a goroutine other than the")
+	fmt.Println("test's behaves the same way. Put cleanup in defers, and report failures from")
+	fmt.Println("helper goroutines with t.Error or a channel instead.")
+	fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine?debug=1 | grep -A5 Wait")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// runInGoroutine runs fn on a new goroutine and waits for it to end, however
+// it ends
+func runInGoroutine(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	<-done
+}
+
+// outer holds one defer of its own and calls inner, which accumulates three
+func outer(exit bool) {
+	defer fmt.Println("  outer: deferred cleanup")
+	inner(exit)
+	fmt.Println("  outer: inner returned, continuing")
+}
+
+// inner registers 3 defers, then either returns or calls runtime.Goexit
+func inner(exit bool) {
+	for _, name := range []string{"A", "B", "C"} {
+		r := &Resource{Name: name}
+		defer r.Close()
+	}
+	if exit {
+		fmt.Println("  inner: calling runtime.Goexit with 3 defers pending")
+		runtime.Goexit()
+		fmt.Println("  inner: after Goexit (never printed)")
+	}
+	fmt.Println("  inner: returning with 3 defers pending")
+}
+
+// recoverFrom calls fn under a recover-based wrapper, the pattern used to
+// keep one failing task from crashing a worker
+func recoverFrom(fn func()) {
+	defer func() {
+		r := recover()
+		fmt.Printf("  recover() = %v\n", r)
+	}()
+	fn()
+	fmt.Println("  fn returned normally (never printed)")
+}
+
+// errCheckFailed stands in for a failed assertion in a test helper
+var errCheckFailed = errors.New("check failed")
+
+// mustSucceed is a FailNow-style helper: on error it ends the goroutine
+func mustSucceed(err error) {
+	if err != nil {
+		runtime.Goexit()
+	}
+}
+
+// demonstrateSkippedDone starts three workers that call wg.Done() at the end
+// instead of deferring it. One of them fails a mustSucceed check, so its
+// Done never runs and the waiter blocks forever.
+func demonstrateSkippedDone() {
+	before := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			r := &Resource{Name: fmt.Sprintf("worker %d file", i)}
+			defer r.Close() // runs: Goexit unwinds defers
+
+			var err error
+			if i == 1 {
+				err = errCheckFailed
+			}
+			mustSucceed(err)
+
+			wg.Done() // BUG: skipped when mustSucceed calls Goexit
+		}(i)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait() // BUG: waits for a Done that will never come
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		fmt.Println("  wg.Wait returned (unexpected)")
+	case <-time.After(500 * time.Millisecond):
+		fmt.Println("  ⚠️  wg.Wait still blocked after 500ms: worker 1's wg.Done() was skipped")
+	}
+	fmt.Printf("  Goroutines: %d before, %d after (the waiter leaked)\n", before, runtime.NumGoroutine())
+
+	// ✅ FIX: defer wg.Done() so it runs however the worker ends
+	var fixed sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		fixed.Add(1)
+		go func(i int) {
+			defer fixed.Done()
+			var err error
+			if i == 1 {
+				err = errCheckFailed
+			}
+			mustSucceed(err)
+		}(i)
+	}
+	fixed.Wait()
+	fmt.Println("  ✓ with defer wg.Done(), Wait returns even though worker 1 called Goexit")
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example fixes goroutine-closure-leak by passing the connection to the
+// goroutine as an argument. Arguments are evaluated when the go statement
+// runs, so each goroutine gets its own copy no matter when it is scheduled.
+// The program exits with status 1 unless every connection was queried and
+// closed exactly once, so it doubles as a check.
+
+const numConnections = 5
+
+// Connection simulates a pooled database connection
+type Connection struct {
+	ID      int
+	Address string
+	queries int64 // updated atomically
+	closes  int64 // updated atomically
+}
+
+func (c *Connection) Query(q string) {
+	atomic.AddInt64(&c.queries, 1)
+}
+
+func (c *Connection) Close() error {
+	atomic.AddInt64(&c.closes, 1)
+	return nil
+}
+
+func main() {
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Serve a process summary next to pprof
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Start pprof server for analysis
+	go func() {
+		http.ListenAndServe("localhost:6061", debugMux)
+	}()
+
+	fmt.Println("=== Goroutine Closure Capture - FIXED Demo ===")
+	fmt.Println()
+	fmt.Printf("Starting one goroutine per connection for %d connections...\n\n", numConnections)
+
+	connections := createConnections()
+	demonstrateFixWithArgument(connections)
+
+	if !reportUsage(connections) {
+		fmt.Println("\n✗ Some connections were not used exactly once")
+		os.Exit(1)
+	}
+	fmt.Printf("\n✓ All %d connections queried and closed exactly once!\n", numConnections)
+}
+
+// demonstrateFixWithArgument starts one worker per connection, handing each
+// worker its connection as an argument
+func demonstrateFixWithArgument(connections []*Connection) {
+	var wg sync.WaitGroup
+
+	// Same start barrier as the buggy version: the loop finishes before any
+	// worker runs, which is the worst case for a captured variable
+	start := make(chan struct{})
+
+	var conn *Connection
+	for i := 0; i < len(connections); i++ {
+		conn = connections[i]
+		wg.Add(1)
+		// ✅ FIX: pass 'conn' as an argument - its current value is copied
+		// into 'c' before the goroutine starts
+		go func(c *Connection) {
+			defer wg.Done()
+			<-start
+			defer c.Close()
+			c.Query("SELECT 1")
+		}(conn)
+	}
+
+	close(start)
+	wg.Wait()
+}
+
+// reportUsage prints each connection's query and close counts and reports
+// whether every connection was used and closed exactly once
+func reportUsage(connections []*Connection) bool {
+	ok := true
+	for _, c := range connections {
+		queries, closes := atomic.LoadInt64(&c.queries), atomic.LoadInt64(&c.closes)
+		mark := "✓"
+		if queries != 1 || closes != 1 {
+			mark = "✗"
+			ok = false
+		}
+		fmt.Printf("  %s Connection %d at %s: queries=%d closes=%d\n", mark, c.ID, c.Address, queries, closes)
+	}
+	return ok
+}
+
+func createConnections() []*Connection {
+	connections := make([]*Connection, numConnections)
+	for i := range connections {
+		connections[i] = &Connection{
+			ID:      i,
+			Address: fmt.Sprintf("0x%x", 0xc000010200+i*8),
+		}
+	}
+	return connections
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example is the goroutine twin of the closure-leak defer demo.
+// A loop assigns each connection to a variable declared OUTSIDE the loop and
+// starts `go func() { use(conn) }()`. Go 1.22's per-iteration loop variables
+// don't help here: every goroutine captures the same outer variable, so they
+// all run against whatever it holds when they get scheduled - usually the
+// last connection. Instead of relying on print interleaving, every connection
+// counts its queries and closes with atomics, so the damage is measurable.
+
+const numConnections = 5
+
+// Connection simulates a pooled database connection
+type Connection struct {
+	ID      int
+	Address string
+	queries int64 // updated atomically
+	closes  int64 // updated atomically
+}
+
+func (c *Connection) Query(q string) {
+	atomic.AddInt64(&c.queries, 1)
+}
+
+func (c *Connection) Close() error {
+	atomic.AddInt64(&c.closes, 1)
+	return nil
+}
+
+func main() {
+	// Serve a process summary next to pprof
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// Start pprof server for analysis
+	go func() {
+		http.ListenAndServe("localhost:6060", debugMux)
+	}()
+
+	fmt.Println("=== Goroutine Closure Capture Bug Demo ===")
+	fmt.Println()
+	fmt.Printf("Starting one goroutine per connection for %d connections...\n\n", numConnections)
+
+	connections := createConnections()
+	demonstrateGoroutineClosureBug(connections)
+
+	ok := reportUsage(connections)
+
+	fmt.Println("\n=== Analysis ===")
+	if ok {
+		fmt.Println("Every connection was used exactly once (unexpected for the buggy version).")
+		return
+	}
+	fmt.Println("BUG: All goroutines captured the same variable 'conn' by reference.")
+	fmt.Printf("By the time they ran, 'conn' held connection %d, so it was queried and closed\n", numConnections-1)
+	fmt.Printf("%d times while connections 0-%d were never used and never closed - leaked.\n",
+		numConnections, numConnections-2)
+}
+
+// demonstrateGoroutineClosureBug starts one worker per connection but every
+// worker closes over the shared outer variable
+func demonstrateGoroutineClosureBug(connections []*Connection) {
+	var wg sync.WaitGroup
+
+	// The workers wait until the loop has finished, like a batch that starts
+	// all workers together. That makes the outcome deterministic; without it
+	// the goroutines race the loop and the damage changes from run to run.
+	start := make(chan struct{})
+
+	// BUG: declared outside the loop, so there is only one 'conn' for all
+	// iterations - Go 1.22 loop-variable semantics don't apply to it
+	var conn *Connection
+	for i := 0; i < len(connections); i++ {
+		conn = connections[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			// BUG: reads 'conn' when the goroutine runs, not when it was started
+			defer conn.Close()
+			conn.Query("SELECT 1")
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+}
+
+// reportUsage prints each connection's query and close counts and reports
+// whether every connection was used and closed exactly once
+func reportUsage(connections []*Connection) bool {
+	ok := true
+	for _, c := range connections {
+		queries, closes := atomic.LoadInt64(&c.queries), atomic.LoadInt64(&c.closes)
+		mark := "✓"
+		if queries != 1 || closes != 1 {
+			mark = "✗"
+			ok = false
+		}
+		fmt.Printf("  %s Connection %d at %s: queries=%d closes=%d\n", mark, c.ID, c.Address, queries, closes)
+	}
+	return ok
+}
+
+func createConnections() []*Connection {
+	connections := make([]*Connection, numConnections)
+	for i := range connections {
+		connections[i] = &Connection{
+			ID:      i,
+			Address: fmt.Sprintf("0x%x", 0xc000010200+i*8),
+		}
+	}
+	return connections
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
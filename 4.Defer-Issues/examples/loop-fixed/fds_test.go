@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// TestFilesStayBounded runs processFilesCorrectly and then
+// processFilesConcurrently over testFileCount files each with no delay,
+// and checks that the tracker's peak never exceeded one file, then the worker
+// count, and that the kernel count is back where it started
+func TestFilesStayBounded(t *testing.T) {
+	const workers = 8
+	dir := t.TempDir()
+	// The first file the process opens also creates the runtime poller's
+	// descriptors; open one before taking the baseline so they're in it
+	warmup, err := os.CreateTemp(dir, "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmup.Close()
+
+	files = &fdcount.Tracker{Observe: observeFileLatency}
+	savedDelay := *delay
+	*delay = 0
+	t.Cleanup(func() { *delay = savedDelay })
+
+	before := fdcount.Count()
+	if before < 0 {
+		t.Skip("no /proc/self/fd or /dev/fd on this platform")
+	}
+	fp := &FileProcessor{}
+	fp.processFilesCorrectly(dir, testFileCount)
+	sequentialPeak := files.Peak()
+	fp.processFilesConcurrently(dir, testFileCount, workers)
+
+	if opened, closed := files.Balance(); opened != 2*testFileCount || closed != opened {
+		t.Errorf("%d files opened, %d closed, want %d of each", opened, closed, 2*testFileCount)
+	}
+	if sequentialPeak > 1 {
+		t.Errorf("sequential peak live files = %d, want at most 1", sequentialPeak)
+	}
+	if got := files.Peak(); got > workers {
+		t.Errorf("concurrent peak live files = %d, want at most %d", got, workers)
+	}
+	if delta := fdcount.Count() - before; delta != 0 {
+		t.Errorf("kernel FDs changed by %d, want 0", delta)
+	}
+}
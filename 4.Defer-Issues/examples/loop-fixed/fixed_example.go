@@ -1,14 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/histogram"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workspace"
 )
 
 // FileProcessor demonstrates the correct pattern: extracting to a function
@@ -16,30 +32,62 @@ import (
 type FileProcessor struct {
 	filesProcessed int64
 	filesClosed    int64
+
+	// fsync syncs each file before closing it; see closeDurably
+	fsync bool
+
+	// stacked cleans up through a DeferStack; see processFilesCorrectly
+	stacked bool
+
+	// workspace holds the files; nil in tests
+	workspace *workspace.Workspace
 }
 
+// Workload flags, identical in loop-leak and loop-fixed so runs are comparable
+var (
+	numFiles = flag.Int("files", 500, "number of files to process")
+	fileSize = flag.Int("file-size", 0, "bytes written to each file (0 = a single log line)")
+	delay    = flag.Duration("delay", 10*time.Millisecond, "pause after each file")
+	workdir  = flag.String("workdir", "", "directory for the temp files (default: system temp dir)")
+)
+
+var assertPeak = flag.Bool("assert-peak", false, "exit 1 unless the peak number of files open at once matches this variant's bound")
+
+var workers = flag.Int("workers", 1, "number of files processed concurrently (1 = sequential)")
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	workspace.ApplyNofile()
+
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6061")
-		log.Fatal(http.ListenAndServe("localhost:6061", nil))
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
 	}()
 
-	processor := &FileProcessor{}
+	processor := &FileProcessor{fsync: *fsyncMode, stacked: *deferStack}
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
 
 	// Print initial state
 	initialFDs := countOpenFileDescriptors()
 	fmt.Printf("[START] Open file descriptors: %d\n\n", initialFDs)
 
-	// Create temp directory for test files
-	tempDir, err := os.MkdirTemp("", "defer-loop-fixed-test")
+	// Create the workspace for test files. It is removed on return and on
+	// Ctrl+C, which is the only way out of a run that never returns.
+	ws, err := workspace.New(*workdir, "defer-loop-fixed-test", workspace.WithMaxBytes(*workspaceMax), workspace.WithSignalHandler(dumpAndExit))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer ws.Close()
+	tempDir := ws.Dir
+	processor.workspace = ws
 
-	fmt.Println("Processing 500 files with extracted function pattern...")
-	fmt.Println("Watch file descriptors stay stable!\n")
+	fmt.Printf("Processing %d files with extracted function pattern (%d at a time)...\n", *numFiles, *workers)
+	fmt.Print("Watch file descriptors stay stable!\n\n")
 
 	// Start monitoring goroutine
 	done := make(chan bool)
@@ -57,9 +105,14 @@ func main() {
 				closed := atomic.LoadInt64(&processor.filesClosed)
 				fmt.Printf("[AFTER %.0fs] Open FDs: %d  |  Files processed: %d  |  Files closed: %d\n",
 					elapsed, currentFDs, processed, closed)
+				fmt.Printf("           %s\n", gcpercent.Stats())
+				fmt.Printf("           Tracked files: %s\n", files)
+				fmt.Printf("           Workspace: %s\n", ws)
+				fmt.Printf("           Throughput: %.1f files/sec  |  %s\n",
+					float64(processed)/elapsed, fsyncs)
 
-				if currentFDs <= initialFDs+5 {
-					fmt.Println("✓ No leak! File descriptors stable (max 1 file open at a time)")
+				if currentFDs <= initialFDs+*workers+5 {
+					fmt.Printf("✓ No leak! File descriptors stable (max %d file(s) open at a time)\n", *workers)
 				}
 			case <-done:
 				return
@@ -68,7 +121,12 @@ func main() {
 	}()
 
 	// Process files with the correct extracted function pattern
-	processor.processFilesCorrectly(tempDir, 500)
+	start := time.Now()
+	if *workers > 1 {
+		processor.processFilesConcurrently(tempDir, *numFiles, *workers)
+	} else {
+		processor.processFilesCorrectly(tempDir, *numFiles)
+	}
 
 	// Stop monitoring
 	done <- true
@@ -76,17 +134,63 @@ func main() {
 	fmt.Println("\n--- All files processed and closed immediately ---")
 	finalFDs := countOpenFileDescriptors()
 	fmt.Printf("[FINAL] Open FDs: %d (same as start - no accumulation)\n", finalFDs)
+	fmt.Printf("[FINAL] Tracked files: %s (peak %d open at once)\n", files, files.Peak())
+	fmt.Printf("[FINAL] Throughput: %.1f files/sec  |  %s\n",
+		float64(atomic.LoadInt64(&processor.filesProcessed))/time.Since(start).Seconds(), fsyncs)
+	printLatency()
+	if workspace.Nofile() > 0 && uint64(*numFiles) > workspace.Nofile() {
+		fmt.Printf("[FINAL] ✓ %d files processed under RLIMIT_NOFILE=%d without running out\n",
+			*numFiles, workspace.FileLimit())
+	}
+
+	if *assertPeak && !peakWithinBound() {
+		ws.Close() // os.Exit skips the deferred Close
+		os.Exit(1)
+	}
+}
+
+// peakWithinBound checks the fix's claim: sequentially at most 2 files are
+// open at once (1 plus slack for a Close racing the next Create), and with
+// -workers at most one per worker
+func peakWithinBound() bool {
+	bound := int64(2)
+	if int64(*workers) > bound {
+		bound = int64(*workers)
+	}
+	peak := files.Peak()
+	if peak > bound {
+		fmt.Printf("[ASSERT] ✗ Peak open files: %d, bound %d - files are being held open\n", peak, bound)
+		return false
+	}
+	fmt.Printf("[ASSERT] ✓ Peak open files: %d (bound %d)\n", peak, bound)
+	return true
 }
 
 // processFilesCorrectly demonstrates the FIX: extract to a separate function
 // Each file is opened, processed, and closed before moving to the next
+// With stacked, the loop runs each file's cleanups itself from a DeferStack
 func (fp *FileProcessor) processFilesCorrectly(tempDir string, numFiles int) {
 	fmt.Printf("Entering processFilesCorrectly - will process %d files with proper cleanup\n\n", numFiles)
 
+	// Two cleanups per file: the Close, and the Flush of the writer on it
+	stack := NewDeferStack(2)
 	for i := 0; i < numFiles; i++ {
-		// ✅ FIX: Extract file processing to separate function
-		// Defer executes at end of processOneFile, not end of this function
-		err := fp.processOneFile(tempDir, i)
+		var err error
+		if fp.stacked {
+			// ✅ FIX: processStacked pushes the file's cleanups and
+			// RunAll runs them, newest first, before the next iteration
+			err = fp.processStacked(stack, tempDir, i)
+			stack.RunAll()
+		} else {
+			// ✅ FIX: Extract file processing to separate function
+			// Defer executes at end of processOneFile, not end of this function
+			err = fp.processOneFile(tempDir, i)
+		}
+		if isFDExhausted(err) {
+			// Never expected: only the current file is open
+			explainFDExhaustion(err)
+			os.Exit(1)
+		}
 		if err != nil {
 			log.Printf("Error processing file %d: %v", i, err)
 		}
@@ -98,12 +202,56 @@ func (fp *FileProcessor) processFilesCorrectly(tempDir string, numFiles int) {
 		atomic.LoadInt64(&fp.filesClosed))
 }
 
+// processFilesConcurrently applies the same fix with up to workers goroutines.
+// The buffered channel is a semaphore: a slot is taken before processOneFile
+// opens its file and given back only after processOneFile has closed it, so
+// at most workers files are ever open at once.
+func (fp *FileProcessor) processFilesConcurrently(tempDir string, numFiles, workers int) {
+	fmt.Printf("Entering processFilesConcurrently - will process %d files with %d workers\n\n", numFiles, workers)
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < numFiles; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := fp.processOneFile(tempDir, index)
+			if isFDExhausted(err) {
+				// Never expected: the semaphore caps open files at workers
+				explainFDExhaustion(err)
+				os.Exit(1)
+			}
+			if err != nil {
+				log.Printf("Error processing file %d: %v", index, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Printf("\nLoop complete. All %d files processed and closed.\n", numFiles)
+	fmt.Printf("Files processed: %d, Files closed: %d\n",
+		atomic.LoadInt64(&fp.filesProcessed),
+		atomic.LoadInt64(&fp.filesClosed))
+
+	if peak := files.Peak(); peak <= int64(workers) {
+		fmt.Printf("✓ Peak open files: %d (bound: %d workers)\n", peak, workers)
+	} else {
+		fmt.Printf("✗ Peak open files: %d exceeded the bound of %d workers\n", peak, workers)
+	}
+}
+
 // processOneFile handles a single file - defer executes at end of THIS function
-func (fp *FileProcessor) processOneFile(tempDir string, index int) error {
+// With fsync set the file is synced first, and Sync and Close errors are joined
+// into the returned error instead of being logged
+func (fp *FileProcessor) processOneFile(tempDir string, index int) (err error) {
 	filename := fmt.Sprintf("%s/logfile_%d.txt", tempDir, index)
 
 	// Create the file
-	file, err := os.Create(filename)
+	file, err := files.Create(filename)
 	if err != nil {
 		return err
 	}
@@ -111,27 +259,180 @@ func (fp *FileProcessor) processOneFile(tempDir string, index int) error {
 	// ✅ FIX: This defer executes when processOneFile returns
 	// NOT when the calling function's loop ends!
 	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("Error closing file: %v", err)
+		if fp.fsync {
+			err = errors.Join(err, closeDurably(file))
+		} else if cerr := file.Close(); cerr != nil {
+			log.Printf("Error closing file: %v", cerr)
 		}
 		atomic.AddInt64(&fp.filesClosed, 1)
 	}()
 
 	// Simulate some work
-	data := []byte(fmt.Sprintf("Log entry %d - timestamp: %v\n", index, time.Now()))
-	if _, err := file.Write(data); err != nil {
+	entry := logEntry(index)
+	if _, err := file.Write(entry); err != nil {
 		return err
 	}
+	fp.workspace.Record(filename, int64(len(entry)))
 
 	atomic.AddInt64(&fp.filesProcessed, 1)
 
 	// Slow down to match the leaky version timing
-	time.Sleep(10 * time.Millisecond)
+	time.Sleep(*delay)
 
 	return nil
 	// File is closed HERE by defer, before next iteration
 }
 
+// ProcessFiles opens each of names in dir and calls fn on it, with at most
+// maxOpen files open at once. It is processFilesConcurrently made reusable:
+// a slot in the semaphore is taken before a file is opened and given back
+// after it is closed, and the Close is deferred in the function that opened
+// the file, so every file is closed whatever fn does. A failed file doesn't
+// stop the others; ProcessFiles returns all their errors joined, each naming
+// its file.
+func ProcessFiles(dir string, names []string, maxOpen int, fn func(*os.File) error) error {
+	if maxOpen < 1 {
+		return fmt.Errorf("ProcessFiles: maxOpen is %d, want at least 1", maxOpen)
+	}
+
+	sem := make(chan struct{}, maxOpen)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, name := range names {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := processFile(filepath.Join(dir, name), fn); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// processFile opens path, calls fn on it and closes it, returning fn's error
+// joined with Close's
+func processFile(path string, fn func(*os.File) error) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, f.Close()) }()
+	return fn(f)
+}
+
+var deferStack = flag.Bool("defer-stack", false, "clean up each file through a DeferStack run by the loop instead of processOneFile's defer (sequential only)")
+
+// DeferStack holds cleanup closures and runs them newest first, like stacked
+// defers. Unlike defers, they run when the caller says: a loop can push an
+// iteration's cleanups and call RunAll at the end of that iteration, so
+// nothing accumulates. It is bounded: a Push past the limit panics, because
+// it means a RunAll was skipped and the loop is accumulating after all. Like
+// the defers it stands in for, it is not safe for concurrent use.
+type DeferStack struct {
+	fns   []func()
+	limit int
+}
+
+// NewDeferStack returns an empty DeferStack that holds up to limit closures
+func NewDeferStack(limit int) *DeferStack {
+	if limit < 1 {
+		panic(fmt.Sprintf("NewDeferStack: limit %d, want at least 1", limit))
+	}
+	return &DeferStack{fns: make([]func(), 0, limit), limit: limit}
+}
+
+// Push adds fn to the top of the stack
+func (s *DeferStack) Push(fn func()) {
+	if len(s.fns) == s.limit {
+		panic(fmt.Sprintf("DeferStack: %d closures already pending; is a RunAll missing?", s.limit))
+	}
+	s.fns = append(s.fns, fn)
+}
+
+// Len returns how many closures are waiting to run
+func (s *DeferStack) Len() int {
+	return len(s.fns)
+}
+
+// RunAll runs the pushed closures in reverse push order and leaves the stack
+// empty and ready for reuse. Each closure is popped before it runs, so it
+// runs once even if RunAll is called again. As with defers, a closure that
+// panics doesn't stop the ones pushed before it, and the panic carries on
+// once they have run.
+func (s *DeferStack) RunAll() {
+	if len(s.fns) == 0 {
+		return
+	}
+	top := len(s.fns) - 1
+	fn := s.fns[top]
+	s.fns[top] = nil // drop what the closure captured
+	s.fns = s.fns[:top]
+	defer s.RunAll()
+	fn()
+}
+
+// processStacked does processOneFile's work but leaves the cleanup to the
+// caller: it pushes the file's Close, then the Flush of the bufio.Writer on
+// it, so RunAll flushes before it closes. A pushed closure has no result, so
+// Flush, Sync and Close errors are logged even with fsync set.
+func (fp *FileProcessor) processStacked(stack *DeferStack, tempDir string, index int) error {
+	filename := fmt.Sprintf("%s/logfile_%d.txt", tempDir, index)
+
+	file, err := files.Create(filename)
+	if err != nil {
+		return err
+	}
+	stack.Push(func() {
+		var err error
+		if fp.fsync {
+			err = closeDurably(file)
+		} else {
+			err = file.Close()
+		}
+		if err != nil {
+			log.Printf("Error closing file: %v", err)
+		}
+		atomic.AddInt64(&fp.filesClosed, 1)
+	})
+
+	w := bufio.NewWriter(file)
+	stack.Push(func() {
+		if err := w.Flush(); err != nil {
+			log.Printf("Error flushing file: %v", err)
+		}
+	})
+
+	entry := logEntry(index)
+	if _, err := w.Write(entry); err != nil {
+		return err
+	}
+	fp.workspace.Record(filename, int64(len(entry)))
+
+	atomic.AddInt64(&fp.filesProcessed, 1)
+
+	// Slow down to match the leaky version timing
+	time.Sleep(*delay)
+	return nil
+}
+
+// logEntry returns the data written to file index, padded to -file-size
+func logEntry(index int) []byte {
+	data := []byte(fmt.Sprintf("Log entry %d - timestamp: %v\n", index, time.Now()))
+	if pad := *fileSize - len(data); pad > 0 {
+		data = append(data, bytes.Repeat([]byte{'.'}, pad)...)
+	}
+	return data
+}
+
 // countOpenFileDescriptors returns approximate count of open file descriptors
 func countOpenFileDescriptors() int {
 	// Try to read from /dev/fd on macOS or /proc/self/fd on Linux
@@ -145,5 +446,126 @@ func countOpenFileDescriptors() int {
 	return runtime.NumGoroutine() + 5
 }
 
+// isFDExhausted reports whether err means the process (EMFILE) or the whole
+// system (ENFILE) has run out of file descriptors
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// explainFDExhaustion describes a descriptor-exhaustion error in terms of the
+// leak instead of letting it scroll past as one more log line
+func explainFDExhaustion(err error) {
+	fmt.Printf("\n✗ Out of file descriptors: %v\n", err)
+	fmt.Printf("   RLIMIT_NOFILE (soft): %d  |  Live tracked files: %d\n", workspace.FileLimit(), files.Current())
+	fmt.Println("   This is where a descriptor leak ends up: every open, accept and dial in")
+	fmt.Println("   the process now fails, not just this file processor.")
+}
+
+// files tracks every file this example opens
+var files = &fdcount.Tracker{Observe: observeFileLatency}
+
+var fsyncMode = flag.Bool("fsync", false, "Sync each file before closing it and return Sync and Close errors instead of logging them")
+
+// durableFile is what closeDurably needs from a file, so a wrapper whose Sync
+// fails can stand in for *fdcount.File
+type durableFile interface {
+	Sync() error
+	Close() error
+}
+
+// fsyncStats records how long Sync takes, so the monitor can show what
+// durability costs in throughput
+type fsyncStats struct {
+	calls int64
+	nanos int64
+}
+
+// fsyncs collects the latency of every closeDurably call
+var fsyncs = &fsyncStats{}
+
+func (s *fsyncStats) record(d time.Duration) {
+	atomic.AddInt64(&s.calls, 1)
+	atomic.AddInt64(&s.nanos, int64(d))
+}
+
+// String formats the call count, mean latency and the files/sec that fsync
+// alone would allow
+func (s *fsyncStats) String() string {
+	calls := atomic.LoadInt64(&s.calls)
+	if calls == 0 {
+		return "fsync: off"
+	}
+	avg := time.Duration(atomic.LoadInt64(&s.nanos) / calls)
+	ceiling := 0.0
+	if avg > 0 {
+		ceiling = float64(time.Second) / float64(avg)
+	}
+	return fmt.Sprintf("fsync: %d calls, avg %v (caps throughput at ~%.0f files/sec)",
+		calls, avg.Round(time.Microsecond), ceiling)
+}
+
+// closeDurably flushes f to stable storage, then closes it. The file is closed
+// even if Sync fails, and both errors go back to the caller: a failed Sync
+// means the data may never reach the disk, which Close alone won't report.
+func closeDurably(f durableFile) error {
+	start := time.Now()
+	syncErr := f.Sync()
+	fsyncs.record(time.Since(start))
+	return errors.Join(syncErr, f.Close())
+}
+
+var workspaceMax = flag.Int64("workspace-max", 0, "cap on bytes kept in the temp workspace; the oldest files are deleted past it (0 = no cap)")
+
+// latencyBuckets are the histogram bucket upper bounds used for file
+// operations, in a 1-2-5 series from 1µs to 1s
+var latencyBuckets = histogram.Series125(time.Microsecond, time.Second)
 
+// fileLatency records how long each tracked file's open, write and close take
+var fileLatency = struct {
+	open, write, close *histogram.Histogram
+}{
+	open:  histogram.New(latencyBuckets),
+	write: histogram.New(latencyBuckets),
+	close: histogram.New(latencyBuckets),
+}
+
+// observeFileLatency records a tracked file operation in fileLatency
+func observeFileLatency(op fdcount.Op, d time.Duration) {
+	switch op {
+	case fdcount.OpCreate:
+		fileLatency.open.Observe(d)
+	case fdcount.OpWrite:
+		fileLatency.write.Observe(d)
+	case fdcount.OpClose:
+		fileLatency.close.Observe(d)
+	}
+}
 
+// printLatency prints the per-file latency percentiles, to show whether
+// holding many files open slows the operations down
+func printLatency() {
+	fmt.Printf("[FINAL] Latency  open:  %s\n", fileLatency.open)
+	fmt.Printf("                 write: %s\n", fileLatency.write)
+	fmt.Printf("                 close: %s\n", fileLatency.close)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
+
+// dumpAndExit is the workspace's signal handler: a SIGTERM also writes a leak
+// dump, after the workspace is removed, and every signal then exits as
+// workspace.ExitOnSignal does
+func dumpAndExit(sig os.Signal) {
+	if sig == syscall.SIGTERM {
+		sighandler.LogLeakDump("/tmp/leakdump")
+	}
+	workspace.ExitOnSignal(sig)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// Closes per benchmark op, and defers per pending-defer measurement
+const (
+	benchIterations   = 1_000_000
+	pendingIterations = 100_000
+)
+
+// benchResource stands in for a file. Close only counts, so the benchmarks
+// measure defer itself rather than the close syscall.
+type benchResource struct {
+	closes int64
+}
+
+func (r *benchResource) Close() error {
+	r.closes++
+	return nil
+}
+
+// closeWithDefer has a single defer outside any loop, so the compiler
+// open-codes it: no defer record, just an inline call at each return
+//
+//go:noinline
+func closeWithDefer(r *benchResource) {
+	defer r.Close()
+}
+
+// closeManually calls Close directly, the baseline without defer
+//
+//go:noinline
+func closeManually(r *benchResource) {
+	r.Close()
+}
+
+// deferInLoop is the leak pattern: a defer in a loop can't be open-coded,
+// so every iteration pushes a defer record that stays pending until return
+//
+//go:noinline
+func deferInLoop(r *benchResource, n int) {
+	for i := 0; i < n; i++ {
+		defer r.Close()
+	}
+}
+
+// measurePendingDefers reads MemStats before deferInLoop's pattern starts and
+// again while all n defers are still pending, and returns the difference
+func measurePendingDefers(r *benchResource, n int) (heapBytes, heapObjects uint64) {
+	var before, during runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	func() {
+		for i := 0; i < n; i++ {
+			defer r.Close()
+		}
+		runtime.ReadMemStats(&during)
+	}()
+	if during.HeapAlloc < before.HeapAlloc {
+		return 0, 0
+	}
+	return during.HeapAlloc - before.HeapAlloc, during.HeapObjects - before.HeapObjects
+}
+
+// BenchmarkDefers closes benchIterations resources per op in the three ways
+// and reports the cost per close. A defer in a loop can't be open-coded, so
+// it is the only case that allocates.
+func BenchmarkDefers(b *testing.B) {
+	r := &benchResource{}
+	cases := []struct {
+		name string
+		run  func()
+	}{
+		{"OpenCoded", func() {
+			for i := 0; i < benchIterations; i++ {
+				closeWithDefer(r)
+			}
+		}},
+		{"InLoop", func() { deferInLoop(r, benchIterations) }},
+		{"ManualClose", func() {
+			for i := 0; i < benchIterations; i++ {
+				closeManually(r)
+			}
+		}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				c.run()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchIterations), "ns/close")
+		})
+	}
+}
+
+// TestPendingDefersHoldHeap checks that defers pending in a loop hold heap
+// until the function returns: at least one object per defer
+func TestPendingDefersHoldHeap(t *testing.T) {
+	held, heapObjects := measurePendingDefers(&benchResource{}, pendingIterations)
+	t.Logf("%d pending defers in one function hold %d KB of heap in %d objects (%d B each)",
+		pendingIterations, held/1024, heapObjects, held/pendingIterations)
+	if heapObjects < pendingIterations {
+		t.Errorf("%d pending defers hold %d heap objects, want at least one each", pendingIterations, heapObjects)
+	}
+}
+
+// testFileCount is how many files the tests process. It stays well under
+// the usual 1024-descriptor soft limit.
+const testFileCount = 300
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestProcessFiles writes testFileCount files and reads them back through
+// ProcessFiles with maxOpen 4. fn counts how many of its calls overlap, and
+// a sampler reads the kernel's FD count while it runs; neither may exceed
+// maxOpen, every file must be read, and the FD count must be back at its
+// baseline afterwards. A missing file and a failing fn must be reported by
+// name without stopping the rest.
+func TestProcessFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	const maxOpen = 4
+	names := make([]string, testFileCount)
+	var wantBytes int64
+	for i := range names {
+		names[i] = fmt.Sprintf("input_%d.txt", i)
+		entry := logEntry(i)
+		if err := os.WriteFile(filepath.Join(tempDir, names[i]), entry, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		wantBytes += int64(len(entry))
+	}
+
+	// Sample the kernel's count until ProcessFiles returns. The sampler's
+	// own ReadDir descriptor is in the baseline too.
+	fdsBefore := fdcount.Count()
+	var fdPeak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := int64(fdcount.Count() - fdsBefore); n > atomic.LoadInt64(&fdPeak) {
+				atomic.StoreInt64(&fdPeak, n)
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	var live, livePeak, calls, readBytes int64
+	err := ProcessFiles(tempDir, names, maxOpen, func(f *os.File) error {
+		n := atomic.AddInt64(&live, 1)
+		defer atomic.AddInt64(&live, -1)
+		for {
+			peak := atomic.LoadInt64(&livePeak)
+			if n <= peak || atomic.CompareAndSwapInt64(&livePeak, peak, n) {
+				break
+			}
+		}
+		atomic.AddInt64(&calls, 1)
+		data, err := io.ReadAll(f)
+		atomic.AddInt64(&readBytes, int64(len(data)))
+		time.Sleep(200 * time.Microsecond) // hold the file so calls overlap
+		return err
+	})
+	close(stop)
+	<-sampled
+
+	check(t, fmt.Sprintf("ProcessFiles returned %v", err), err == nil)
+	check(t, fmt.Sprintf("%d of %d files read, %d of %d bytes", calls, len(names), readBytes, wantBytes),
+		calls == int64(len(names)) && readBytes == wantBytes)
+	check(t, fmt.Sprintf("peak overlapping fn calls: %d (bound %d)", livePeak, maxOpen), livePeak > 1 && livePeak <= maxOpen)
+	if fdsBefore >= 0 {
+		check(t, fmt.Sprintf("peak sampled kernel FDs above baseline: %d (bound %d)", fdPeak, maxOpen), fdPeak <= maxOpen)
+		delta := fdcount.Count() - fdsBefore
+		check(t, fmt.Sprintf("kernel FDs changed by %d after ProcessFiles (want 0)", delta), delta == 0)
+	} else {
+		t.Log("kernel FD count unavailable on this platform, skipped")
+	}
+
+	// One file is missing and fn fails on another; the rest still run
+	failing := names[7]
+	calls = 0
+	err = ProcessFiles(tempDir, append([]string{"missing.txt"}, names[:20]...), maxOpen, func(f *os.File) error {
+		atomic.AddInt64(&calls, 1)
+		if filepath.Base(f.Name()) == failing {
+			return errors.New("bad record")
+		}
+		return nil
+	})
+	msg := fmt.Sprint(err)
+	check(t, fmt.Sprintf("errors name their files: %q", strings.ReplaceAll(msg, "\n", "; ")),
+		errors.Is(err, os.ErrNotExist) && strings.Contains(msg, "missing.txt") && strings.Contains(msg, failing+": bad record"))
+	check(t, fmt.Sprintf("the other files were still processed: %d calls (want 20)", calls), calls == 20)
+	if fdsBefore >= 0 {
+		delta := fdcount.Count() - fdsBefore
+		check(t, fmt.Sprintf("kernel FDs changed by %d after the failures (want 0)", delta), delta == 0)
+	}
+	check(t, "maxOpen 0 is rejected", ProcessFiles(tempDir, names, 0, nil) != nil)
+}
+
+// TestDeferStack checks RunAll's order and that each closure runs exactly
+// once, also across reuse and a panicking closure, and that Push past the
+// limit panics. It then runs processFilesCorrectly with stacked over
+// testFileCount files and checks that each was flushed and closed before
+// the next was opened.
+func TestDeferStack(t *testing.T) {
+	var order []int
+	runs := make(map[int]int)
+	push := func(s *DeferStack, from, to int) {
+		for i := from; i < to; i++ {
+			s.Push(func() { order = append(order, i); runs[i]++ })
+		}
+	}
+
+	stack := NewDeferStack(8)
+	push(stack, 0, 5)
+	stack.RunAll()
+	check(t, fmt.Sprintf("RunAll ran 5 closures in reverse push order: %v", order), fmt.Sprint(order) == "[4 3 2 1 0]")
+	stack.RunAll()
+	once := len(runs) == 5
+	for _, n := range runs {
+		once = once && n == 1
+	}
+	check(t, fmt.Sprintf("each ran exactly once, and a second RunAll ran nothing (%d pending)", stack.Len()), once && len(order) == 5 && stack.Len() == 0)
+
+	order = nil
+	push(stack, 5, 7)
+	stack.RunAll()
+	check(t, fmt.Sprintf("reused, the stack ran only the 2 new closures: %v", order), fmt.Sprint(order) == "[6 5]" && runs[0] == 1)
+
+	order = nil
+	push(stack, 7, 8)
+	stack.Push(func() { panic("cleanup failed") })
+	push(stack, 8, 9)
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		stack.RunAll()
+	}()
+	check(t, fmt.Sprintf("a panicking closure didn't stop the one pushed before it (%v), and its panic followed (%v)", order, recovered),
+		fmt.Sprint(order) == "[8 7]" && recovered == "cleanup failed" && stack.Len() == 0)
+
+	recovered = nil
+	func() {
+		defer func() { recovered = recover() }()
+		small := NewDeferStack(2)
+		push(small, 0, 3)
+	}()
+	check(t, fmt.Sprintf("a third Push onto a stack of 2 panicked (%v)", recovered), recovered != nil)
+
+	files = &fdcount.Tracker{Observe: observeFileLatency}
+	savedDelay := *delay
+	*delay = 0
+	t.Cleanup(func() { *delay = savedDelay })
+	tempDir := t.TempDir()
+	fp := &FileProcessor{stacked: true}
+	fp.processFilesCorrectly(tempDir, testFileCount)
+
+	opened, closed := files.Balance()
+	check(t, fmt.Sprintf("%d files opened, %d closed, peak %d open at once (bound 1)", opened, closed, files.Peak()),
+		opened == testFileCount && closed == opened && files.Peak() <= 1)
+	complete := 0
+	for i := range testFileCount {
+		data, err := os.ReadFile(fmt.Sprintf("%s/logfile_%d.txt", tempDir, i))
+		if err == nil && bytes.HasPrefix(data, []byte(fmt.Sprintf("Log entry %d ", i))) {
+			complete++
+		}
+	}
+	check(t, fmt.Sprintf("%d of %d files hold their entry: flushed before closed", complete, testFileCount), complete == testFileCount)
+}
+
+// TestWorkerBound runs processFilesConcurrently with K workers for each K
+// in 1, 8 and 64, on a fresh tracker, and checks that at most K files were
+// open at once and all of them were closed. Each file stays open for a
+// millisecond so the workers really overlap.
+func TestWorkerBound(t *testing.T) {
+	tempDir := t.TempDir()
+	savedDelay := *delay
+	*delay = time.Millisecond
+	t.Cleanup(func() { *delay = savedDelay })
+	for _, k := range []int{1, 8, 64} {
+		files = &fdcount.Tracker{Observe: observeFileLatency}
+		numFiles := 4 * k
+		if numFiles < 100 {
+			numFiles = 100
+		}
+		fp := &FileProcessor{}
+		fp.processFilesConcurrently(tempDir, numFiles, k)
+
+		opened, closed := files.Balance()
+		check(t, fmt.Sprintf("K=%d: peak %d open at once (bound %d), %d opened, %d closed", k, files.Peak(), k, opened, closed),
+			files.Peak() <= int64(k) && opened == int64(numFiles) && closed == opened)
+	}
+}
+
+// TestDurability checks closeDurably's error propagation with failingFile,
+// then runs one real file through the -fsync path
+func TestDurability(t *testing.T) {
+	tempDir := t.TempDir()
+	errSync := errors.New("sync: input/output error")
+	errClose := errors.New("close: input/output error")
+
+	f := &failingFile{syncErr: errSync}
+	err := closeDurably(f)
+	check(t, "Sync error is returned", errors.Is(err, errSync))
+	check(t, "file is still closed after a failed Sync", f.closed)
+
+	f = &failingFile{syncErr: errSync, closeErr: errClose}
+	err = closeDurably(f)
+	check(t, "Sync and Close errors are both returned", errors.Is(err, errSync) && errors.Is(err, errClose))
+
+	f = &failingFile{closeErr: errClose}
+	err = closeDurably(f)
+	check(t, "Close error is returned when Sync succeeds", errors.Is(err, errClose) && !errors.Is(err, errSync))
+
+	check(t, "no error when Sync and Close succeed", closeDurably(&failingFile{}) == nil)
+
+	calls := atomic.LoadInt64(&fsyncs.calls)
+	fp := &FileProcessor{fsync: true}
+	err = fp.processOneFile(tempDir, 0)
+	check(t, "a real file goes through the fsync path without error", err == nil)
+	check(t, "its Sync latency was recorded", atomic.LoadInt64(&fsyncs.calls) == calls+1)
+}
+
+// failingFile is a durableFile whose Sync and Close return the given errors
+type failingFile struct {
+	syncErr  error
+	closeErr error
+	closed   bool
+}
+
+func (f *failingFile) Sync() error { return f.syncErr }
+
+func (f *failingFile) Close() error {
+	f.closed = true
+	return f.closeErr
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/histogram"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/workspace"
 )
 
 // FileProcessor demonstrates the defer-in-loop anti-pattern
@@ -19,31 +35,80 @@ import (
 // until the function returns
 type FileProcessor struct {
 	filesProcessed int64
-	pendingDefers  int64
+
+	// workspace holds the files; nil in tests
+	workspace *workspace.Workspace
 }
 
+// defers tracks the Close calls processFilesBadly defers
+var defers = newDeferTracker()
+
+// Workload flags, identical in loop-leak and loop-fixed so runs are comparable
+var (
+	numFiles = flag.Int("files", 500, "number of files to process")
+	fileSize = flag.Int("file-size", 0, "bytes written to each file (0 = a single log line)")
+	delay    = flag.Duration("delay", 10*time.Millisecond, "pause after each file")
+	workdir  = flag.String("workdir", "", "directory for the temp files (default: system temp dir)")
+)
+
+var assertPeak = flag.Bool("assert-peak", false, "exit 1 unless the peak number of files open at once matches this variant's bound")
+
+var (
+	failAt     = flag.Int("fail-at", 0, "make file N fail so processFilesBadly returns early (0 = never)")
+	fatalDemo  = flag.Bool("fatal", false, "show that log.Fatal skips deferred Flush/Close, using a child process")
+	fatalChild = flag.String("fatal-child", "", "internal: directory the -fatal child writes into")
+)
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	workspace.ApplyNofile()
+
+	// The log.Fatal demo runs in a child process and needs no pprof server
+	if *fatalChild != "" {
+		runFatalChild(*fatalChild)
+		return
+	}
+	if *fatalDemo {
+		demonstrateFatalSkipsDefers()
+		return
+	}
+
 	// Start pprof server
 	go func() {
 		log.Println("pprof server running on http://localhost:6060")
-		log.Fatal(http.ListenAndServe("localhost:6060", nil))
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
 	}()
 
 	processor := &FileProcessor{}
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	// Print initial state
 	initialFDs := countOpenFileDescriptors()
 	fmt.Printf("[START] Open file descriptors: %d\n\n", initialFDs)
 
-	// Create temp directory for test files
-	tempDir, err := os.MkdirTemp("", "defer-loop-leak-test")
+	// Create the workspace for test files. It is removed on return and on
+	// Ctrl+C, which is the only way out of a run that never returns.
+	ws, err := workspace.New(*workdir, "defer-loop-leak-test", workspace.WithMaxBytes(*workspaceMax))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer ws.Close()
+	tempDir := ws.Dir
+	processor.workspace = ws
 
-	fmt.Println("Processing 500 files with defer-in-loop pattern...")
-	fmt.Println("Watch file descriptors grow until function returns!\n")
+	fmt.Printf("Processing %d files with defer-in-loop pattern...\n", *numFiles)
+	fmt.Print("Watch file descriptors grow until function returns!\n\n")
+	checkFileLimit(initialFDs)
+
+	// Warn once a fifth of the files are being held open (100 for the default 500)
+	leakThreshold := *numFiles / 5
+	if leakThreshold < 1 {
+		leakThreshold = 1
+	}
 
 	// Start monitoring goroutine
 	done := make(chan bool)
@@ -58,11 +123,14 @@ func main() {
 				currentFDs := countOpenFileDescriptors()
 				elapsed := time.Since(startTime).Seconds()
 				processed := atomic.LoadInt64(&processor.filesProcessed)
-				pending := atomic.LoadInt64(&processor.pendingDefers)
+				pending := defers.Pending()
 				fmt.Printf("[AFTER %.0fs] Open FDs: %d  |  Files processed: %d  |  Pending defers: %d\n",
 					elapsed, currentFDs, processed, pending)
+				fmt.Printf("           %s\n", gcpercent.Stats())
+				fmt.Printf("           Tracked files: %s\n", files)
+				fmt.Printf("           Workspace: %s\n", ws)
 
-				if currentFDs > initialFDs+100 {
+				if currentFDs > initialFDs+leakThreshold {
 					fmt.Println("\n⚠️  WARNING: Defer accumulation detected!")
 					fmt.Println("All files remain open until the function returns.")
 				}
@@ -72,27 +140,87 @@ func main() {
 		}
 	}()
 
+	// Record every Close so an early return can be checked file by file
+	var closedOrder []string
+	files.OnClose = func(name string) {
+		closedOrder = append(closedOrder, filepath.Base(name))
+	}
+
+	// Show the pending count falling as the function unwinds
+	step := int64(*numFiles / 4)
+	if step < 1 {
+		step = 1
+	}
+	defers.onRun = func(name string, pending int64) {
+		if pending%step == 0 {
+			fmt.Printf("[UNWIND] Pending defers: %d\n", pending)
+		}
+	}
+
 	// Process files with the buggy defer-in-loop pattern
-	processor.processFilesBadly(tempDir, 500)
+	err = processor.processFilesBadly(tempDir, *numFiles)
 
 	// Stop monitoring
 	done <- true
 
 	fmt.Println("\n--- Function returned, all defers have now executed ---")
+	if err != nil {
+		reportEarlyReturn(err, closedOrder, *numFiles)
+	}
 	finalFDs := countOpenFileDescriptors()
 	fmt.Printf("[FINAL] Open FDs: %d (back to normal after defers executed)\n", finalFDs)
+	fmt.Printf("[FINAL] Tracked files: %s (peak %d open at once)\n", files, files.Peak())
+	fmt.Printf("[FINAL] Pending defers: %d\n", defers.Pending())
+	printLatency()
+
+	if *assertPeak && !peakMatchesLeak() {
+		ws.Close() // os.Exit skips the deferred Close
+		os.Exit(1)
+	}
+}
+
+// peakMatchesLeak checks the claim this example exists to show: with defer in
+// the loop, every file opened is still open when the last one is. That is
+// *numFiles files unless -fail-at or running out of descriptors stopped the
+// loop early. If the peak is lower, processFilesBadly has been fixed by
+// accident and no longer demonstrates the leak.
+func peakMatchesLeak() bool {
+	opened, _ := files.Balance()
+	peak := files.Peak()
+	if peak != opened {
+		fmt.Printf("[ASSERT] ✗ Peak open files: %d of %d opened - the defers no longer accumulate\n", peak, opened)
+		return false
+	}
+	fmt.Printf("[ASSERT] ✓ Peak open files: %d of %d opened (all held at once)\n", peak, opened)
+	return true
 }
 
 // processFilesBadly demonstrates the ANTI-PATTERN: defer inside a loop
-// All 500 files will be opened and stay open until this function returns
-func (fp *FileProcessor) processFilesBadly(tempDir string, numFiles int) {
+// Every file will be opened and stay open until this function returns
+func (fp *FileProcessor) processFilesBadly(tempDir string, numFiles int) error {
 	fmt.Printf("Entering processFilesBadly - will open %d files with defer in loop\n\n", numFiles)
 
 	for i := 0; i < numFiles; i++ {
 		filename := fmt.Sprintf("%s/logfile_%d.txt", tempDir, i)
 
+		// Injected failure: return early with only some defers registered
+		if *failAt > 0 && i == *failAt {
+			fmt.Printf("\n✗ File %d failed - returning early with %d pending defers\n",
+				i, defers.Pending())
+			return fmt.Errorf("injected failure at file %d", i)
+		}
+
 		// Create the file
-		file, err := os.Create(filename)
+		file, err := files.Create(filename)
+		if isFDExhausted(err) {
+			// The pending defers hold every descriptor we have; further
+			// Creates would all fail the same way, so stop here
+			explainFDExhaustion(err)
+			fmt.Printf("   %d pending defers hold them; they close only when this function returns.\n",
+				defers.Pending())
+			fmt.Printf("   Stopping early at file %d - %d files skipped.\n", i, numFiles-i)
+			break
+		}
 		if err != nil {
 			log.Printf("Error creating file: %v", err)
 			continue
@@ -101,27 +229,151 @@ func (fp *FileProcessor) processFilesBadly(tempDir string, numFiles int) {
 		// BUG: This defer accumulates!
 		// It won't execute until processFilesBadly returns
 		// All files stay open during the entire loop!
+		// (Tracked first so it is uncounted right after the Close runs)
+		defer defers.Track("close")()
 		defer file.Close()
-		atomic.AddInt64(&fp.pendingDefers, 1)
 
 		// Simulate some work
-		data := []byte(fmt.Sprintf("Log entry %d - timestamp: %v\n", i, time.Now()))
-		if _, err := file.Write(data); err != nil {
+		entry := logEntry(i)
+		if _, err := file.Write(entry); err != nil {
 			log.Printf("Error writing to file: %v", err)
 			continue
 		}
+		fp.workspace.Record(filename, int64(len(entry)))
 
 		atomic.AddInt64(&fp.filesProcessed, 1)
 
 		// Slow down to see the accumulation
-		time.Sleep(10 * time.Millisecond)
+		time.Sleep(*delay)
 	}
 
-	fmt.Printf("\nLoop complete. All %d files processed.\n", numFiles)
+	fmt.Printf("\nLoop complete. %d of %d files processed.\n", atomic.LoadInt64(&fp.filesProcessed), numFiles)
 	fmt.Printf("Pending defers: %d - about to execute as function returns...\n",
-		atomic.LoadInt64(&fp.pendingDefers))
+		defers.Pending())
 
 	// All defers execute HERE, in LIFO order
+	return nil
+}
+
+// reportEarlyReturn shows exactly which defers ran after processFilesBadly
+// returned early: one per file opened before the failure, none for the files
+// the loop never reached
+func reportEarlyReturn(err error, closedOrder []string, numFiles int) {
+	opened, closed := files.Balance()
+	fmt.Printf("processFilesBadly returned early: %v\n", err)
+	fmt.Printf("Defers executed: %d  |  Files opened: %d  |  Files never opened: %d\n",
+		closed, opened, int64(numFiles)-opened)
+	if len(closedOrder) > 0 {
+		fmt.Printf("Closed in LIFO order: %s first ... %s last\n",
+			closedOrder[0], closedOrder[len(closedOrder)-1])
+	}
+
+	// Ground truth from the tracker: exactly the files before the failure
+	ok := int64(len(closedOrder)) == opened
+	for i, name := range closedOrder {
+		if name != fmt.Sprintf("logfile_%d.txt", len(closedOrder)-1-i) {
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Printf("✓ Files 0-%d closed by their defers; files %d-%d never existed, so no defer was registered\n",
+			opened-1, opened, numFiles-1)
+	} else {
+		fmt.Println("✗ Closed files don't match the files opened before the failure")
+	}
+}
+
+// demonstrateFatalSkipsDefers runs this program again as a child that writes
+// buffered data behind a deferred Flush and Close, then calls log.Fatal. The
+// parent checks the files on disk: log.Fatal calls os.Exit, which doesn't run
+// deferred calls, so nothing was flushed.
+func demonstrateFatalSkipsDefers() {
+	dir, err := os.MkdirTemp(*workdir, "defer-fatal-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Child: opening 5 files, deferring Flush and Close, writing, then log.Fatal...")
+	cmd := exec.Command(exe, "-fatal-child", dir)
+	output, err := cmd.CombinedOutput()
+	fmt.Printf("Child output: %s", output)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		fmt.Println("✓ Child exited with status 1 from log.Fatal")
+	} else {
+		fmt.Printf("✗ Expected exit status 1, got: %v\n", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	empty := 0
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Size() == 0 {
+			empty++
+		}
+	}
+	if len(entries) > 0 && empty == len(entries) {
+		fmt.Printf("✓ All %d files are empty: the deferred Flush never ran\n", len(entries))
+	} else {
+		fmt.Printf("✗ %d of %d files are empty\n", empty, len(entries))
+	}
+	fmt.Println("\nos.Exit and log.Fatal end the process without running deferred calls.")
+	fmt.Println("The OS closes the descriptors, but data still sitting in user-space buffers is lost.")
+}
+
+// runFatalChild is the child side of demonstrateFatalSkipsDefers and
+// TestFatalSkipsDefers
+func runFatalChild(dir string) {
+	for i := 0; i < 5; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("buffered_%d.txt", i)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := bufio.NewWriter(f)
+		defer f.Close()
+		defer w.Flush() // runs before Close... if it runs at all
+
+		fmt.Fprintf(w, "Log entry %d\n", i) // sits in the 4 KB buffer
+	}
+
+	log.Fatal("simulated fatal error - skipping all 10 deferred calls")
+}
+
+// logEntry returns the data written to file index, padded to -file-size
+func logEntry(index int) []byte {
+	data := []byte(fmt.Sprintf("Log entry %d - timestamp: %v\n", index, time.Now()))
+	if pad := *fileSize - len(data); pad > 0 {
+		data = append(data, bytes.Repeat([]byte{'.'}, pad)...)
+	}
+	return data
+}
+
+// checkFileLimit explains up front when -files can't fit under RLIMIT_NOFILE.
+// Since Go 1.19 the os package raises the soft limit to the hard limit at
+// startup, so this is the limit the loop will actually hit.
+func checkFileLimit(openFDs int) {
+	limit := workspace.FileLimit()
+	if limit == 0 || limit > math.MaxInt32 {
+		return
+	}
+
+	headroom := int(limit) - openFDs
+	if *numFiles <= headroom {
+		return
+	}
+	fmt.Printf("⚠️  -files=%d won't fit: RLIMIT_NOFILE is %d and %d descriptors are already open.\n",
+		*numFiles, limit, openFDs)
+	fmt.Printf("Defer-in-loop holds every file open, so Create will fail with EMFILE after about %d files.\n", headroom)
+	fmt.Print("The loop stops there instead of failing on every remaining file.\n\n")
 }
 
 // countOpenFileDescriptors returns count of open file descriptors
@@ -152,3 +404,127 @@ func countOpenFileDescriptors() int {
 	// Last resort: rough estimate
 	return runtime.NumGoroutine() + 5
 }
+
+// isFDExhausted reports whether err means the process (EMFILE) or the whole
+// system (ENFILE) has run out of file descriptors
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// explainFDExhaustion describes a descriptor-exhaustion error in terms of the
+// leak instead of letting it scroll past as one more log line
+func explainFDExhaustion(err error) {
+	fmt.Printf("\n✗ Out of file descriptors: %v\n", err)
+	fmt.Printf("   RLIMIT_NOFILE (soft): %d  |  Live tracked files: %d\n", workspace.FileLimit(), files.Current())
+	fmt.Println("   This is where a descriptor leak ends up: every open, accept and dial in")
+	fmt.Println("   the process now fails, not just this file processor.")
+}
+
+// deferTracker counts deferred calls that have been registered but haven't
+// run yet. Register one with
+//
+//	defer tracker.Track("close")()
+//
+// The defer statement calls Track immediately, counting the call as pending.
+// The func it returns is what gets deferred, and it uncounts the call when
+// the surrounding function returns, panics or unwinds.
+type deferTracker struct {
+	mu      sync.Mutex
+	pending map[string]int64
+	total   int64
+
+	// onRun, if set, is called after each tracked defer runs with the number
+	// still pending
+	onRun func(name string, pending int64)
+}
+
+func newDeferTracker() *deferTracker {
+	return &deferTracker{pending: make(map[string]int64)}
+}
+
+// Track counts one pending deferred call named name and returns the func to
+// defer. Calling the returned func more than once has no further effect.
+func (t *deferTracker) Track(name string) func() {
+	t.mu.Lock()
+	t.pending[name]++
+	t.total++
+	t.mu.Unlock()
+
+	var ran int32
+	return func() {
+		if !atomic.CompareAndSwapInt32(&ran, 0, 1) {
+			return
+		}
+		t.mu.Lock()
+		t.pending[name]--
+		t.total--
+		pending := t.total
+		t.mu.Unlock()
+		if t.onRun != nil {
+			t.onRun(name, pending)
+		}
+	}
+}
+
+// Pending returns how many tracked defers haven't run yet
+func (t *deferTracker) Pending() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// PendingFor returns how many tracked defers named name haven't run yet
+func (t *deferTracker) PendingFor(name string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending[name]
+}
+
+// files tracks every file this example opens
+var files = &fdcount.Tracker{Observe: observeFileLatency}
+
+var workspaceMax = flag.Int64("workspace-max", 0, "cap on bytes kept in the temp workspace; the oldest files are deleted past it (0 = no cap)")
+
+// latencyBuckets are the histogram bucket upper bounds used for file
+// operations, in a 1-2-5 series from 1µs to 1s
+var latencyBuckets = histogram.Series125(time.Microsecond, time.Second)
+
+// fileLatency records how long each tracked file's open, write and close take
+var fileLatency = struct {
+	open, write, close *histogram.Histogram
+}{
+	open:  histogram.New(latencyBuckets),
+	write: histogram.New(latencyBuckets),
+	close: histogram.New(latencyBuckets),
+}
+
+// observeFileLatency records a tracked file operation in fileLatency
+func observeFileLatency(op fdcount.Op, d time.Duration) {
+	switch op {
+	case fdcount.OpCreate:
+		fileLatency.open.Observe(d)
+	case fdcount.OpWrite:
+		fileLatency.write.Observe(d)
+	case fdcount.OpClose:
+		fileLatency.close.Observe(d)
+	}
+}
+
+// printLatency prints the per-file latency percentiles, to show whether
+// holding many files open slows the operations down
+func printLatency() {
+	fmt.Printf("[FINAL] Latency  open:  %s\n", fileLatency.open)
+	fmt.Printf("                 write: %s\n", fileLatency.write)
+	fmt.Printf("                 close: %s\n", fileLatency.close)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openAtExit is the child's log output. log.Fatal writes its message and
+// then calls os.Exit, so on that write it also reports how many of the
+// child's files are still open: the ones whose deferred Close never ran.
+type openAtExit struct{ dir string }
+
+func (o openAtExit) Write(p []byte) (int, error) {
+	os.Stderr.Write(p)
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return len(p), nil
+	}
+	open := 0
+	for _, e := range entries {
+		if target, err := os.Readlink("/proc/self/fd/" + e.Name()); err == nil && strings.HasPrefix(target, o.dir) {
+			open++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "open at exit: %d\n", open)
+	return len(p), nil
+}
+
+// TestFatalSkipsDefers re-runs the test binary as a child that runs
+// runFatalChild, the child side of -fatal. log.Fatal must end it with status
+// 1 while all 5 files are still open, and leave them empty: neither the
+// deferred Flush nor the deferred Close ran.
+func TestFatalSkipsDefers(t *testing.T) {
+	if dir := os.Getenv("LOOP_LEAK_FATAL_DIR"); dir != "" {
+		log.SetOutput(openAtExit{dir: dir})
+		runFatalChild(dir)
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatalSkipsDefers$")
+	cmd.Env = append(os.Environ(), "LOOP_LEAK_FATAL_DIR="+dir)
+	output, err := cmd.CombinedOutput()
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Fatalf("child exited with %v, want status 1 from log.Fatal; output:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "simulated fatal error") {
+		t.Errorf("child output %q has no log.Fatal message", output)
+	}
+	if _, err := os.Stat("/proc/self/fd"); err == nil && !strings.Contains(string(output), "open at exit: 5\n") {
+		t.Errorf("child output %q, want all 5 files still open at log.Fatal", output)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "buffered_*.txt"))
+	if len(files) != 5 {
+		t.Fatalf("%d files in %s, want 5", len(files), dir)
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f); err != nil || info.Size() != 0 {
+			t.Errorf("%s: %v, want it empty: the deferred Flush never ran", f, err)
+		}
+	}
+}
+
+// TestDeferTracker checks the tracker's counts across looped, nested and
+// panicking registrations
+func TestDeferTracker(t *testing.T) {
+	tr := newDeferTracker()
+	pending := func(desc string, got, want int64) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s: %d pending, want %d", desc, got, want)
+		}
+	}
+
+	// Looped: every iteration's defer stays pending until the function returns
+	func() {
+		for i := 0; i < 10; i++ {
+			defer tr.Track("close")()
+		}
+		pending("inside a loop of 10 defers", tr.Pending(), 10)
+	}()
+	pending("after the looping function returns", tr.Pending(), 0)
+
+	// Nested: an inner function's defers run when it returns, the outer
+	// function's stay pending
+	func() {
+		defer tr.Track("outer")()
+		func() {
+			for i := 0; i < 3; i++ {
+				defer tr.Track("inner")()
+			}
+			pending("inner function, 1 outer + 3 inner", tr.Pending(), 4)
+		}()
+		pending("back in the outer function", tr.Pending(), 1)
+		pending("of them named inner", tr.PendingFor("inner"), 0)
+	}()
+	pending("after both return", tr.Pending(), 0)
+
+	// Panicking: deferred calls still run while the panic unwinds
+	func() {
+		defer func() { recover() }()
+		for i := 0; i < 5; i++ {
+			defer tr.Track("close")()
+		}
+		panic("unwind")
+	}()
+	pending("after a panic unwinds 5 defers", tr.Pending(), 0)
+
+	// The returned func only uncounts once
+	done := tr.Track("close")
+	done()
+	done()
+	pending("after calling one returned func twice", tr.Pending(), 0)
+}
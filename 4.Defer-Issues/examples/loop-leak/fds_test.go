@@ -0,0 +1,66 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// fdTestFiles is how many files the FD tests process. It stays well under
+// the usual 1024-descriptor soft limit, so even the leaky version can't run out.
+const fdTestFiles = 300
+
+// TestProcessFilesBadlyHoldsEveryFile runs processFilesBadly over
+// fdTestFiles files with no delay and checks that every file was open at
+// once: the tracker's peak and the kernel's count, sampled when the first
+// deferred Close runs, both equal the file count. It fails if the leak is
+// gone, so a refactor can't accidentally fix the demo.
+func TestProcessFilesBadlyHoldsEveryFile(t *testing.T) {
+	dir := t.TempDir()
+	// The first file the process opens also creates the runtime poller's
+	// descriptors; open one before taking the baseline so they're in it
+	warmup, err := os.CreateTemp(dir, "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmup.Close()
+
+	files = &fdcount.Tracker{Observe: observeFileLatency}
+	savedDelay := *delay
+	*delay = 0
+	t.Cleanup(func() {
+		*delay = savedDelay
+		defers.onRun = nil
+	})
+
+	before := fdcount.Count()
+	if before < 0 {
+		t.Skip("no /proc/self/fd or /dev/fd on this platform")
+	}
+	atUnwind := -1
+	defers.onRun = func(name string, pending int64) {
+		// The first Track func runs right after the first Close, so one file
+		// has just been closed
+		if atUnwind < 0 {
+			atUnwind = fdcount.Count() + 1
+		}
+	}
+
+	fp := &FileProcessor{}
+	if err := fp.processFilesBadly(dir, fdTestFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := files.Peak(); got != fdTestFiles {
+		t.Errorf("peak live files = %d, want %d: all open until the function returned", got, fdTestFiles)
+	}
+	if delta := atUnwind - before; delta != fdTestFiles {
+		t.Errorf("kernel FDs held when the defers started running = %d, want %d", delta, fdTestFiles)
+	}
+	if files.Current() != 0 || defers.Pending() != 0 {
+		t.Errorf("after return: %d live files, %d pending defers, want 0 and 0", files.Current(), defers.Pending())
+	}
+}
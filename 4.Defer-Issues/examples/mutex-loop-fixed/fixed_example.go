@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example is the FIXED version of the mutex defer-in-loop demo.
+// Snapshot moves the per-shard work into snapshotShard, so each deferred
+// Unlock runs at the end of one iteration and only one shard is ever locked.
+// RecordBatches unlocks explicitly instead of deferring inside its loop.
+
+const (
+	numShards  = 16
+	numWorkers = 32
+)
+
+var (
+	increments int64
+	snapshots  int64
+	maxWaitNs  int64 // longest single Increment since the last report
+
+	deadlock = flag.Bool("deadlock", false, "run the single-mutex variant (fixed: returns immediately)")
+)
+
+type shard struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// ShardedCounter spreads keys over shards so writers rarely contend
+type ShardedCounter struct {
+	shards [numShards]*shard
+
+	// statsMu guards batches, a single lock shared by all shards
+	statsMu sync.Mutex
+	batches int
+}
+
+func NewShardedCounter() *ShardedCounter {
+	c := &ShardedCounter{}
+	for i := range c.shards {
+		c.shards[i] = &shard{counts: make(map[string]int)}
+	}
+	return c
+}
+
+func (c *ShardedCounter) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%numShards]
+}
+
+// Increment locks only the shard that owns key
+func (c *ShardedCounter) Increment(key string) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[key]++
+}
+
+// Snapshot copies every shard's counts, one shard at a time
+func (c *ShardedCounter) Snapshot() map[string]int {
+	out := make(map[string]int)
+	for _, s := range c.shards {
+		// ✅ FIX: the defer lives in snapshotShard, so it runs per iteration
+		snapshotShard(s, out)
+	}
+	return out
+}
+
+// snapshotShard copies one shard - its deferred Unlock runs when THIS
+// function returns, releasing the shard before the next one is locked
+func snapshotShard(s *shard, out map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range s.counts {
+		out[k] = v
+	}
+	// Simulate copying a large shard
+	time.Sleep(5 * time.Millisecond)
+}
+
+// RecordBatches counts n batches under the shared statsMu
+func (c *ShardedCounter) RecordBatches(n int) {
+	for i := 0; i < n; i++ {
+		// ✅ FIX: short critical section with an explicit Unlock
+		c.statsMu.Lock()
+		c.batches++
+		c.statsMu.Unlock()
+	}
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	counter := NewShardedCounter()
+
+	if *deadlock {
+		demonstrateDeadlock(counter)
+		return
+	}
+
+	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Printf("%d request handlers incrementing counters while Snapshot runs every 20ms...\n", numWorkers)
+	fmt.Println()
+
+	runWorkers(counter, numWorkers)
+	go func() {
+		for {
+			counter.Snapshot()
+			atomic.AddInt64(&snapshots, 1)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	duration := 10 * time.Second
+	start := time.Now()
+	var lastIncrements int64
+
+	for time.Since(start) < duration {
+		<-ticker.C
+		done := atomic.LoadInt64(&increments)
+		fmt.Printf("[AFTER %v] Goroutines: %d  |  Increments/s: %d  |  Max wait: %v  |  Blocked in Lock: %d  |  Snapshots: %d\n",
+			time.Since(start).Round(time.Second),
+			runtime.NumGoroutine(),
+			(done-lastIncrements)/2,
+			time.Duration(atomic.SwapInt64(&maxWaitNs, 0)).Round(time.Millisecond),
+			countBlockedInLock(),
+			atomic.LoadInt64(&snapshots))
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		lastIncrements = done
+	}
+
+	fmt.Println("\nMax wait stays near one shard copy: Snapshot holds at most one of the 16 shard locks at a time.")
+	fmt.Println("Compare: curl http://localhost:6061/debug/pprof/goroutine?debug=1 | grep -A5 Mutex")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// runWorkers starts n request handlers that increment counters for 1000
+// users as fast as the shard locks allow
+func runWorkers(c *ShardedCounter, n int) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user_%d", i)
+	}
+
+	for w := 0; w < n; w++ {
+		go func(w int) {
+			for i := w; ; i++ {
+				start := time.Now()
+				c.Increment(keys[i%len(keys)])
+				atomic.AddInt64(&increments, 1)
+				recordWait(time.Since(start))
+			}
+		}(w)
+	}
+}
+
+// recordWait keeps the longest Increment latency seen since the last report
+func recordWait(d time.Duration) {
+	for {
+		cur := atomic.LoadInt64(&maxWaitNs)
+		if int64(d) <= cur || atomic.CompareAndSwapInt64(&maxWaitNs, cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// demonstrateDeadlock runs RecordBatches with the same timeout the leaky
+// version uses to detect its self-deadlock
+func demonstrateDeadlock(c *ShardedCounter) {
+	fmt.Println("Calling RecordBatches(3) with Lock/Unlock on one mutex inside the loop...")
+
+	finished := make(chan struct{})
+	go func() {
+		c.RecordBatches(3)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		fmt.Printf("✓ RecordBatches returned: %d batches recorded, no deadlock\n", c.batches)
+	case <-time.After(2 * time.Second):
+		fmt.Println("\n⚠️  DEADLOCK: RecordBatches is still blocked after 2s")
+		os.Exit(1)
+	}
+}
+
+// countBlockedInLock counts goroutines currently waiting in sync.Mutex.Lock
+func countBlockedInLock() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	blocked := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "sync.(*Mutex).Lock") {
+			blocked++
+		}
+	}
+	return blocked
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example is the locking twin of the defer-in-loop file leak.
+// Snapshot walks every shard doing `mu.Lock(); defer mu.Unlock()` inside the
+// loop body. None of those defers run until Snapshot returns, so every shard
+// stays locked for the whole scan and every request touching any shard queues
+// up behind it. With a single mutex the same mistake self-deadlocks on the
+// second iteration (run with -deadlock).
+
+const (
+	numShards  = 16
+	numWorkers = 32
+)
+
+var (
+	increments int64
+	snapshots  int64
+	maxWaitNs  int64 // longest single Increment since the last report
+
+	deadlock = flag.Bool("deadlock", false, "run the single-mutex variant that self-deadlocks; exits 0 once the deadlock is detected, 1 if RecordBatches returns")
+	hold     = flag.Bool("hold", false, "with -deadlock, stay up after detecting the deadlock so it can be inspected with pprof")
+)
+
+type shard struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// ShardedCounter spreads keys over shards so writers rarely contend
+type ShardedCounter struct {
+	shards [numShards]*shard
+
+	// statsMu guards batches, a single lock shared by all shards
+	statsMu sync.Mutex
+	batches int
+}
+
+func NewShardedCounter() *ShardedCounter {
+	c := &ShardedCounter{}
+	for i := range c.shards {
+		c.shards[i] = &shard{counts: make(map[string]int)}
+	}
+	return c
+}
+
+func (c *ShardedCounter) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%numShards]
+}
+
+// Increment locks only the shard that owns key
+func (c *ShardedCounter) Increment(key string) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[key]++
+}
+
+// Snapshot copies every shard's counts
+// BUG: defer inside the loop - no shard is unlocked until Snapshot returns
+func (c *ShardedCounter) Snapshot() map[string]int {
+	out := make(map[string]int)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		defer s.mu.Unlock() // BUG: runs when Snapshot returns, not per iteration
+
+		for k, v := range s.counts {
+			out[k] = v
+		}
+		// Simulate copying a large shard
+		time.Sleep(5 * time.Millisecond)
+	}
+	return out
+}
+
+// RecordBatches counts n batches under the shared statsMu
+// BUG: the second iteration's Lock waits for the first iteration's Unlock,
+// which is deferred until this function returns - it never returns
+func (c *ShardedCounter) RecordBatches(n int) {
+	for i := 0; i < n; i++ {
+		c.statsMu.Lock()
+		defer c.statsMu.Unlock() // BUG: self-deadlock on iteration 2
+		c.batches++
+	}
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6060")
+		log.Fatal(http.ListenAndServe("localhost:6060", debugMux))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	counter := NewShardedCounter()
+
+	if *deadlock {
+		demonstrateDeadlock(counter)
+		return
+	}
+
+	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Printf("%d request handlers incrementing counters while Snapshot runs every 20ms...\n", numWorkers)
+	fmt.Println()
+
+	runWorkers(counter, numWorkers)
+	go func() {
+		for {
+			counter.Snapshot()
+			atomic.AddInt64(&snapshots, 1)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	duration := 10 * time.Second
+	start := time.Now()
+	var lastIncrements int64
+
+	for time.Since(start) < duration {
+		<-ticker.C
+		done := atomic.LoadInt64(&increments)
+		fmt.Printf("[AFTER %v] Goroutines: %d  |  Increments/s: %d  |  Max wait: %v  |  Blocked in Lock: %d  |  Snapshots: %d\n",
+			time.Since(start).Round(time.Second),
+			runtime.NumGoroutine(),
+			(done-lastIncrements)/2,
+			time.Duration(atomic.SwapInt64(&maxWaitNs, 0)).Round(time.Millisecond),
+			countBlockedInLock(),
+			atomic.LoadInt64(&snapshots))
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		lastIncrements = done
+	}
+
+	fmt.Println("\nRequests stall for the whole scan: every Snapshot holds all 16 shard locks at once.")
+	fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine?debug=1 | grep -A5 Mutex")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// runWorkers starts n request handlers that increment counters for 1000
+// users as fast as the shard locks allow
+func runWorkers(c *ShardedCounter, n int) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user_%d", i)
+	}
+
+	for w := 0; w < n; w++ {
+		go func(w int) {
+			for i := w; ; i++ {
+				start := time.Now()
+				c.Increment(keys[i%len(keys)])
+				atomic.AddInt64(&increments, 1)
+				recordWait(time.Since(start))
+			}
+		}(w)
+	}
+}
+
+// recordWait keeps the longest Increment latency seen since the last report
+func recordWait(d time.Duration) {
+	for {
+		cur := atomic.LoadInt64(&maxWaitNs)
+		if int64(d) <= cur || atomic.CompareAndSwapInt64(&maxWaitNs, cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// demonstrateDeadlock runs RecordBatches and detects the self-deadlock with
+// a timeout. The Go runtime can't report it: the pprof server goroutine is
+// still alive, so not all goroutines are asleep. It exits with status 1 if
+// RecordBatches returns, and with -hold blocks instead of returning once the
+// deadlock is detected.
+func demonstrateDeadlock(c *ShardedCounter) {
+	fmt.Println("Calling RecordBatches(3) with Lock/defer Unlock on one mutex inside the loop...")
+
+	finished := make(chan struct{})
+	go func() {
+		c.RecordBatches(3)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		fmt.Println("✗ RecordBatches returned (unexpected for the leaky version)")
+		os.Exit(1)
+	case <-time.After(2 * time.Second):
+		fmt.Println("\n⚠️  DEADLOCK: RecordBatches is still blocked after 2s")
+		fmt.Println("Iteration 2 waits in Lock for the Unlock deferred by iteration 1,")
+		fmt.Println("which only runs when RecordBatches returns.")
+		fmt.Printf("Goroutines blocked in Lock: %d\n", countBlockedInLock())
+	}
+
+	if !*hold {
+		fmt.Println("Run with -deadlock -hold to keep the process up and inspect it with pprof")
+		return
+	}
+	fmt.Println("Run: curl http://localhost:6060/debug/pprof/goroutine?debug=2 | grep -B2 -A8 RecordBatches")
+	fmt.Println("Press Ctrl+C to stop")
+	select {}
+}
+
+// countBlockedInLock counts goroutines currently waiting in sync.Mutex.Lock
+func countBlockedInLock() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	blocked := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "sync.(*Mutex).Lock") {
+			blocked++
+		}
+	}
+	return blocked
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
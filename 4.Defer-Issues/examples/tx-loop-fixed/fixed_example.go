@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// Fixed version of tx-loop-leak: the loop body moves into migrateOne, so
+// `defer tx.Rollback()` runs at the end of every table. A skipped table's
+// transaction is rolled back right away and its connection goes back to the
+// pool; a committed table's Rollback is a no-op returning sql.ErrTxDone.
+
+// Migration flags, identical in tx-loop-leak and tx-loop-fixed so runs are
+// comparable
+var (
+	numTables = flag.Int("tables", 200, "number of tables to migrate")
+	poolSize  = flag.Int("pool", 10, "db.SetMaxOpenConns")
+	skipEvery = flag.Int("skip-every", 8, "every Nth table is already migrated and gets skipped")
+	delay     = flag.Duration("delay", 10*time.Millisecond, "time each ALTER TABLE takes")
+	timeout   = flag.Duration("timeout", 8*time.Second, "deadline for the whole migration")
+)
+
+// Migrator applies one schema change to every table
+type Migrator struct {
+	db *sql.DB
+
+	tablesDone       int64 // migrated or skipped
+	pendingRollbacks int64 // deferred Rollbacks that haven't run yet
+}
+
+// alreadyMigrated reports whether table i has the new column from an earlier run
+func alreadyMigrated(i int) bool {
+	return *skipEvery > 0 && i%*skipEvery == *skipEvery-1
+}
+
+// migrateAll migrates the tables one at a time
+func (m *Migrator) migrateAll(ctx context.Context, tables []string) error {
+	for i, table := range tables {
+		if err := m.migrateOne(ctx, i, table); err != nil {
+			return err
+		}
+		atomic.AddInt64(&m.tablesDone, 1)
+	}
+	return nil
+}
+
+// migrateOne migrates a single table in its own transaction
+// ✅ FIX: the deferred Rollback runs when this table is done, releasing its
+// connection whether it was committed, skipped or failed
+func (m *Migrator) migrateOne(ctx context.Context, i int, table string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("table %d (%s): begin: %w", i, table, err)
+	}
+	atomic.AddInt64(&m.pendingRollbacks, 1)
+	defer atomic.AddInt64(&m.pendingRollbacks, -1)
+	defer tx.Rollback() // ✅ runs per table; a no-op after Commit
+
+	if alreadyMigrated(i) {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN created_at TIMESTAMP"); err != nil {
+		return fmt.Errorf("table %d (%s): alter: %w", i, table, err)
+	}
+	time.Sleep(*delay)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("table %d (%s): commit: %w", i, table, err)
+	}
+	return nil
+}
+
+// tableNames returns n table names
+func tableNames(n int) []string {
+	tables := make([]string, n)
+	for i := range tables {
+		tables[i] = fmt.Sprintf("table_%03d", i)
+	}
+	return tables
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
+	// Start pprof server
+	go func() {
+		log.Println("pprof server running on http://localhost:6061")
+		log.Fatal(http.ListenAndServe("localhost:6061", debugMux))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	db, err := sql.Open("fakedb", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(*poolSize)
+
+	m := &Migrator{db: db}
+	tables := tableNames(*numTables)
+
+	fmt.Printf("[START] Goroutines: %d  |  Pool size: %d\n", runtime.NumGoroutine(), *poolSize)
+	skipped := "none"
+	if *skipEvery > 0 {
+		skipped = fmt.Sprintf("every %dth", *skipEvery)
+	}
+	fmt.Printf("Migrating %d tables (%s already migrated) with defer tx.Rollback() in migrateOne...\n",
+		len(tables), skipped)
+	fmt.Println()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- m.migrateAll(ctx, tables) }()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Printf("[AFTER %v] Tables done: %d/%d  |  Pending rollbacks: %d  |  Goroutines: %d\n",
+				time.Since(start).Round(time.Second),
+				atomic.LoadInt64(&m.tablesDone), len(tables),
+				atomic.LoadInt64(&m.pendingRollbacks),
+				runtime.NumGoroutine())
+			fmt.Printf("           %s\n", poolStats(db))
+			fmt.Printf("           %s\n", gcpercent.Stats())
+			continue
+		case err = <-result:
+		}
+		break
+	}
+
+	verifyPoolUsage(db, m, len(tables), err)
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// verifyPoolUsage checks that the migration finished without ever holding
+// more transactions than the pool has connections, and released them all.
+// It exits with status 1 otherwise.
+func verifyPoolUsage(db *sql.DB, m *Migrator, tables int, err error) {
+	ok := true
+	check := func(desc string, pass bool) {
+		if pass {
+			fmt.Printf("✓ %s\n", desc)
+		} else {
+			fmt.Printf("✗ %s\n", desc)
+			ok = false
+		}
+	}
+
+	stats := db.Stats()
+	done := atomic.LoadInt64(&m.tablesDone)
+	check(fmt.Sprintf("migrated %d/%d tables (err: %v)", done, tables, err),
+		err == nil && done == int64(tables))
+	check(fmt.Sprintf("peak live transactions %d <= pool size %d", fakeDB.PeakTx(), *poolSize),
+		fakeDB.PeakTx() <= int64(*poolSize))
+	check(fmt.Sprintf("no Begin waited for a connection (waits: %d)", stats.WaitCount),
+		stats.WaitCount == 0)
+	check(fmt.Sprintf("nothing left open: %d live tx, %d pending rollbacks, %d conns in use",
+		fakeDB.LiveTx(), atomic.LoadInt64(&m.pendingRollbacks), stats.InUse),
+		fakeDB.LiveTx() == 0 && atomic.LoadInt64(&m.pendingRollbacks) == 0 && stats.InUse == 0)
+	fmt.Printf("[FINAL] %s\n", poolStats(db))
+
+	if !ok {
+		fmt.Println("\nPool usage check failed")
+		os.Exit(1)
+	}
+}
+
+// fakeDriver is an in-memory database/sql driver that runs no SQL at all. It
+// only counts the connections and transactions it hands out, so the monitor
+// can see what the pool and the pending defers are holding.
+type fakeDriver struct {
+	openConns int64 // connections opened and not yet closed
+	liveTx    int64 // transactions begun and not yet committed or rolled back
+	peakTx    int64
+	commits   int64
+	rollbacks int64
+}
+
+// fakeDB is registered as the "fakedb" driver
+var fakeDB = &fakeDriver{}
+
+func init() {
+	sql.Register("fakedb", fakeDB)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	atomic.AddInt64(&d.openConns, 1)
+	return &fakeConn{d: d}, nil
+}
+
+// LiveTx returns how many transactions are open right now. database/sql pins
+// one pooled connection to each of them.
+func (d *fakeDriver) LiveTx() int64 { return atomic.LoadInt64(&d.liveTx) }
+
+// PeakTx returns the most transactions that were ever open at once
+func (d *fakeDriver) PeakTx() int64 { return atomic.LoadInt64(&d.peakTx) }
+
+// OpenConns returns how many connections the pool holds, idle or in use
+func (d *fakeDriver) OpenConns() int64 { return atomic.LoadInt64(&d.openConns) }
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	atomic.AddInt64(&c.d.openConns, -1)
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	live := atomic.AddInt64(&c.d.liveTx, 1)
+	for {
+		peak := atomic.LoadInt64(&c.d.peakTx)
+		if live <= peak || atomic.CompareAndSwapInt64(&c.d.peakTx, peak, live) {
+			break
+		}
+	}
+	return &fakeTx{d: c.d}, nil
+}
+
+// ExecContext accepts any statement and pretends it changed nothing
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+type fakeTx struct {
+	d    *fakeDriver
+	done int32
+}
+
+func (tx *fakeTx) Commit() error {
+	if atomic.CompareAndSwapInt32(&tx.done, 0, 1) {
+		atomic.AddInt64(&tx.d.liveTx, -1)
+		atomic.AddInt64(&tx.d.commits, 1)
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	if atomic.CompareAndSwapInt32(&tx.done, 0, 1) {
+		atomic.AddInt64(&tx.d.liveTx, -1)
+		atomic.AddInt64(&tx.d.rollbacks, 1)
+	}
+	return nil
+}
+
+// poolStats formats the driver counters and the pool's own view of them
+func poolStats(db *sql.DB) string {
+	s := db.Stats()
+	return fmt.Sprintf("Live tx: %d  |  Pool in use: %d/%d  |  Conn waits: %d  |  Commits: %d  |  Rollbacks: %d",
+		fakeDB.LiveTx(), s.InUse, s.MaxOpenConnections, s.WaitCount,
+		atomic.LoadInt64(&fakeDB.commits), atomic.LoadInt64(&fakeDB.rollbacks))
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// errFlaky is returned by the handlers in TestRetryQueue
+var errFlaky = errors.New("handler failed")
+
+// TestRetryQueue runs two EventProcessors with failing handlers: one that
+// fails each event twice before succeeding, and one that never succeeds for
+// every 5th event. It checks that flaky events are all processed after their
+// retries and that the permanently failing ones are dead-lettered once they
+// exceed the max age.
+func TestRetryQueue(t *testing.T) {
+	const (
+		numEvents = 50
+		backoff   = 10 * time.Millisecond
+		maxAge    = 200 * time.Millisecond
+	)
+
+	// run queues numEvents events into a processor using handler and waits
+	// until each has been processed or dead-lettered
+	run := func(handler func(Event) error) (processed, retried int64, dead []Event) {
+		p := NewEventProcessor(WithHandler(handler), WithRetries(backoff, maxAge, bufferSize))
+		defer p.Close()
+		go p.Process()
+
+		processedBefore := atomic.LoadInt64(&eventsProcessed)
+		retriedBefore := atomic.LoadInt64(&eventsRetried)
+		deadBefore := atomic.LoadInt64(&eventsDeadLettered)
+		for i := 1; i <= numEvents; i++ {
+			p.Queue(context.Background(), newEvent(int64(i), 64))
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			processed = atomic.LoadInt64(&eventsProcessed) - processedBefore
+			if processed+atomic.LoadInt64(&eventsDeadLettered)-deadBefore == numEvents {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return processed, atomic.LoadInt64(&eventsRetried) - retriedBefore, p.DeadLetters()
+	}
+
+	t.Logf("Retry backoff: %v doubling  |  Max age: %v  |  %d events per run", backoff, maxAge, numEvents)
+
+	// Flaky: every event fails its first two attempts
+	processed, retried, dead := run(func(e Event) error {
+		if e.Attempts < 2 {
+			return errFlaky
+		}
+		return nil
+	})
+	t.Logf("Flaky handler:   processed %d, retried %d, dead-lettered %d", processed, retried, len(dead))
+	check(t, "every flaky event was eventually processed", processed == numEvents && len(dead) == 0)
+	check(t, fmt.Sprintf("each needed exactly 2 retries (%d)", retried), retried == 2*numEvents)
+
+	// Poison: every 5th event always fails and must age out
+	processed, retried, dead = run(func(e Event) error {
+		if e.ID%5 == 0 {
+			return errFlaky
+		}
+		return nil
+	})
+	t.Logf("Poison handler:  processed %d, retried %d, dead-lettered %d", processed, retried, len(dead))
+
+	allPoison, allRetried := len(dead) == numEvents/5, true
+	for _, e := range dead {
+		allPoison = allPoison && e.ID%5 == 0
+		allRetried = allRetried && e.Attempts > 1
+	}
+	check(t, "the other events were processed on the first attempt", processed == numEvents-numEvents/5)
+	check(t, fmt.Sprintf("all %d poison events were dead-lettered, and only those", numEvents/5), allPoison)
+	if len(dead) > 0 {
+		check(t, fmt.Sprintf("each was retried before aging out (%d attempts)", dead[0].Attempts), allRetried)
+	}
+}
+
+const (
+	replayEvents     = 100
+	replayCheckpoint = 60 // the child snapshots its state after this many events
+)
+
+// projection is the state rebuilt from the event stream: what a real
+// consumer would keep in memory and lose in a crash
+type projection struct {
+	Events int
+	SumIDs int64
+	LastID int64
+}
+
+func (s *projection) apply(e Event) {
+	s.Events++
+	s.SumIDs += e.ID
+	s.LastID = e.ID
+}
+
+// checkpoint is a snapshot of the projection and the Timestamp of the last
+// event it includes; replay resumes after that time
+type checkpoint struct {
+	State projection
+	At    time.Time
+}
+
+// runReplayChild processes replayEvents events with a persistent log in dir,
+// writes a checkpoint after replayCheckpoint of them, reports progress on
+// stdout and then waits to be killed
+func runReplayChild(dir string) {
+	var state projection
+	handler := func(e Event) error {
+		state.apply(e)
+		if state.Events == replayCheckpoint {
+			b, err := json.Marshal(checkpoint{State: state, At: e.Timestamp})
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, "checkpoint.json"), b, 0o644)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "checkpoint: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if state.Events%20 == 0 {
+			fmt.Printf("processed %d\n", state.Events)
+		}
+		return nil
+	}
+
+	p := NewEventProcessor(WithHandler(handler), WithPersistentLog(filepath.Join(dir, "events.log")))
+	if err := p.LogErr(); err != nil {
+		fmt.Fprintf(os.Stderr, "log: %v\n", err)
+		os.Exit(1)
+	}
+	go p.Process()
+	for i := 1; i <= replayEvents; i++ {
+		p.QueueWithTimeout(newEvent(int64(i), 64), time.Second)
+	}
+
+	// No Close: the parent kills us here. Exit on our own if it never does.
+	time.Sleep(time.Minute)
+}
+
+// TestShutdown checks that an idle processor's Done stays open until Close,
+// and that Close with events still buffered returns, and Done closes, only
+// once every one of them has been handled.
+func TestShutdown(t *testing.T) {
+	const (
+		buffered    = 50
+		handleDelay = 2 * time.Millisecond
+	)
+
+	closed := func(done <-chan struct{}, wait time.Duration) bool {
+		select {
+		case <-done:
+			return true
+		case <-time.After(wait):
+			return false
+		}
+	}
+
+	idle := NewEventProcessor()
+	go idle.Process()
+	check(t, "an idle processor's Done stays open until Close", !closed(idle.Done(), 50*time.Millisecond))
+	idle.Close()
+	check(t, "and closes promptly after it", closed(idle.Done(), time.Second))
+
+	var handled int64
+	p := NewEventProcessor(WithHandler(func(Event) error {
+		time.Sleep(handleDelay)
+		atomic.AddInt64(&handled, 1)
+		return nil
+	}))
+	go p.Process()
+	for i := 1; i <= buffered; i++ {
+		p.Queue(context.Background(), newEvent(int64(i), 64))
+	}
+	start := time.Now()
+	p.Close()
+	atClose := atomic.LoadInt64(&handled)
+	t.Logf("Close returned after %v", time.Since(start).Round(time.Millisecond))
+	check(t, fmt.Sprintf("Close waited for the buffered events (%d of %d handled)", atClose, buffered),
+		atClose == buffered)
+
+	finished := closed(p.Done(), 5*time.Second)
+	atDone := atomic.LoadInt64(&handled)
+	t.Logf("Done closed after %v", time.Since(start).Round(time.Millisecond))
+	check(t, fmt.Sprintf("Done closed only after all %d buffered events were handled (%d)", buffered, atDone),
+		finished && atDone == buffered && p.Backlog() == 0)
+}
+
+// TestDrain queues 100 events behind a 10ms handler and checks that
+// all of them are in the processed count when Drain returns, and that Drain
+// with a shorter deadline gives up with context.DeadlineExceeded
+func TestDrain(t *testing.T) {
+	const (
+		queued      = 100
+		handleDelay = 10 * time.Millisecond
+	)
+
+	slow := WithHandler(func(Event) error {
+		time.Sleep(handleDelay)
+		return nil
+	})
+	queue := func(p *EventProcessor) {
+		for i := 1; i <= queued; i++ {
+			p.Queue(context.Background(), newEvent(int64(i), 64))
+		}
+	}
+
+	before := atomic.LoadInt64(&eventsProcessed)
+	p := NewEventProcessor(slow)
+	go p.Process()
+	queue(p)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	start := time.Now()
+	err := p.Drain(ctx)
+	cancel()
+	processed := atomic.LoadInt64(&eventsProcessed) - before
+	t.Logf("Drain returned after %v", time.Since(start).Round(time.Millisecond))
+	check(t, fmt.Sprintf("Drain returned nil with all %d events processed (%d, err %v)", queued, processed, err),
+		err == nil && processed == queued && p.Backlog() == 0)
+	p.Close()
+
+	short := NewEventProcessor(slow)
+	go short.Process()
+	queue(short)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	before = atomic.LoadInt64(&eventsProcessed)
+	err = short.Drain(ctx)
+	cancel()
+	processed = atomic.LoadInt64(&eventsProcessed) - before
+	check(t, fmt.Sprintf("Drain with a 100ms deadline returned %v with %d of %d processed", err, processed, queued),
+		errors.Is(err, context.DeadlineExceeded) && processed < queued)
+	short.Close()
+	<-short.Done()
+}
+
+// TestReplay re-runs the test binary as a child that processes
+// replayEvents events with a persistent log, kills it with SIGKILL, and
+// rebuilds the child's final state from its last checkpoint plus
+// ReplayFromLog
+func TestReplay(t *testing.T) {
+	if dir := os.Getenv("REPLAY_TEST_DIR"); dir != "" {
+		runReplayChild(dir)
+		os.Exit(0)
+	}
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.log")
+
+	// Start the processor in a child process so it can really be killed
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReplay$")
+	cmd.Env = append(os.Environ(), "REPLAY_TEST_DIR="+dir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		if sc.Text() == fmt.Sprintf("processed %d", replayEvents) {
+			break
+		}
+	}
+
+	// Give the log writer a moment to catch up, as it would between bursts
+	// in a live process, then kill without any chance to clean up
+	time.Sleep(100 * time.Millisecond)
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("kill child: %v", err)
+	}
+	cmd.Wait()
+
+	// Recovery: load the last checkpoint, then replay everything after it
+	b, err := os.ReadFile(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatalf("read checkpoint: %v", err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		t.Fatalf("parse checkpoint: %v", err)
+	}
+
+	var logged int
+	if err := ReplayFromLog(logPath, time.Time{}, func(Event) { logged++ }); err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if logged != replayEvents {
+		t.Errorf("the log holds %d events, want all %d processed", logged, replayEvents)
+	}
+
+	// A crash mid-write leaves a torn last line; replay must skip it
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.WriteString(`{"ID":101,"Timestamp":"20`)
+	f.Close()
+
+	state := cp.State
+	var replayed, firstID int64
+	err = ReplayFromLog(logPath, cp.At, func(e Event) {
+		if replayed == 0 {
+			firstID = e.ID
+		}
+		replayed++
+		state.apply(e)
+	})
+	if err != nil {
+		t.Errorf("replay with a torn final record: %v, want it skipped", err)
+	}
+	if firstID != replayCheckpoint+1 {
+		t.Errorf("replay resumed at event %d, want %d, the first after the checkpoint", firstID, replayCheckpoint+1)
+	}
+	if replayed != replayEvents-replayCheckpoint {
+		t.Errorf("replayed %d events, want %d", replayed, replayEvents-replayCheckpoint)
+	}
+
+	var want projection
+	for i := int64(1); i <= replayEvents; i++ {
+		want.apply(Event{ID: i})
+	}
+	if state != want {
+		t.Errorf("recovered state %+v, want %+v", state, want)
+	}
+}
+
+// TestPayloadScaling fills the bounded EventProcessor with 1KB, then 16KB
+// payloads and checks the retained heap grows with the payload but never
+// beyond twice what a full buffer can hold
+func TestPayloadScaling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("feeds events for 2 seconds per payload size")
+	}
+	const phase = 2 * time.Second
+	sizes := []int{1024, 16 * 1024}
+	retained := make([]int64, len(sizes))
+
+	for i, size := range sizes {
+		p := NewEventProcessor()
+		go p.Process()
+		baseline := heapAlloc()
+
+		ctx, cancel := context.WithTimeout(context.Background(), phase)
+		var peak int64
+		feedEvents(ctx, size, func(e Event) {
+			p.Queue(ctx, e)
+			if e.ID%1000 == 0 {
+				if h := heapAlloc() - baseline; h > peak {
+					peak = h
+				}
+			}
+		})
+		cancel()
+		retained[i] = heapAlloc() - baseline
+
+		bound := int64(bufferSize * size)
+		t.Logf("payload %5d B: retained %6d KB  |  peak %6d KB  |  full buffer %6d KB",
+			size, retained[i]/1024, peak/1024, bound/1024)
+		if retained[i] > 2*bound || peak > 2*bound {
+			t.Errorf("payload %d B: retained %d KB, peak %d KB, want both within 2x a full buffer (%d KB)",
+				size, retained[i]/1024, peak/1024, 2*bound/1024)
+		}
+
+		// Discard what's left so the next size starts from an empty buffer,
+		// and Close has nothing to wait for
+		for len(p.events) > 0 {
+			select {
+			case <-p.events:
+			default:
+			}
+		}
+		p.Close()
+	}
+
+	ratio := float64(retained[1]) / float64(retained[0])
+	want := float64(sizes[1]) / float64(sizes[0])
+	if ratio < want/2 {
+		t.Errorf("%dx the payload retained %.1fx the heap, want at least %.0fx", sizes[1]/sizes[0], ratio, want/2)
+	}
+}
+
+// heapAlloc returns the live heap after a full GC
+func heapAlloc() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"sync/atomic"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This example demonstrates how excessively large channel buffers
@@ -15,25 +21,29 @@ import (
 type Event struct {
 	ID        int64
 	Timestamp time.Time
-	Data      [1024]byte // 1KB payload
+	Data      []byte // -payload bytes, 1KB by default
 }
 
 var (
 	eventsQueued    int64
 	eventsProcessed int64
+
+	payloadSize = flag.Int("payload", 1024, "payload bytes per event")
 )
 
+const bufferSize = 1_000_000
+
 // EventProcessor with dangerously large buffer
 type EventProcessor struct {
-	// BUG: 1 million event buffer = 1GB memory!
+	// BUG: 1 million event buffer = 1GB memory at the default payload!
 	events chan Event
 }
 
 func NewEventProcessor() *EventProcessor {
 	return &EventProcessor{
 		// BUG: Huge buffer hides backpressure
-		// 1M events × 1KB = 1GB of memory
-		events: make(chan Event, 1_000_000),
+		// 1M events × 1KB payload = 1GB of memory
+		events: make(chan Event, bufferSize),
 	}
 }
 
@@ -52,10 +62,13 @@ func (p *EventProcessor) Process() {
 }
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	// Start pprof server
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
@@ -67,9 +80,15 @@ func main() {
 	// Start slow processor (100 events/second)
 	go processor.Process()
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	fmt.Printf("[START] Heap Alloc: %d MB, Events queued: 0\n", m.Alloc/1024/1024)
+	fmt.Printf("Payload: %d bytes/event  |  A full buffer holds %d MB\n",
+		*payloadSize, int64(bufferSize)*int64(*payloadSize)/1024/1024)
 	fmt.Println("Simulating event burst: 10,000 events/second")
 	fmt.Println("Processing rate: 100 events/second")
 	fmt.Println()
@@ -97,6 +116,7 @@ func main() {
 			queued,
 			processed,
 			pending)
+		fmt.Printf("           %s\n", gcpercent.Stats())
 
 		if pending > 10000 {
 			fmt.Println("\nWARNING: Event backlog growing!")
@@ -122,14 +142,36 @@ func simulateEventBurst(p *EventProcessor) {
 	var id int64
 	for range ticker.C {
 		id++
-		event := Event{
-			ID:        id,
-			Timestamp: time.Now(),
-		}
-		// Fill with data
-		for i := range event.Data {
-			event.Data[i] = byte(i % 256)
-		}
-		p.Queue(event)
+		p.Queue(newEvent(id, *payloadSize))
+	}
+}
+
+// newEvent builds event id with a size-byte payload
+func newEvent(id int64, size int) Event {
+	e := Event{
+		ID:        id,
+		Timestamp: time.Now(),
+		Data:      make([]byte, size),
+	}
+	fillPayload(e.Data)
+	return e
+}
+
+// fillPayload writes the same byte pattern into every payload, so runs with
+// the same -payload are comparable
+func fillPayload(data []byte) {
+	for i := range data {
+		data[i] = byte(i % 256)
 	}
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
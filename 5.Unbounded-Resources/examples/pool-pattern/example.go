@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// This example compares three ways to get a temporary buffer on a hot path
+// that JSON-encodes events:
+//
+//   1. no pool      - a fresh bytes.Buffer for every encoding
+//   2. pool, wrong  - buffers come from a sync.Pool but are never Put back,
+//                     so the pool is just an expensive allocator
+//   3. pool, right  - Get, Reset, write the bytes out, defer Put
+//
+// None of these leak in the classic sense - the GC reclaims every buffer - but
+// an unbounded stream of short-lived allocations drives GC frequency and CPU.
+//
+// The buffers come from Pool[T], a typed sync.Pool that counts borrowed
+// objects and can catch a forgotten Put.
+
+// Pool is a typed sync.Pool. Outstanding counts objects handed out by Get and
+// not yet Put back. With WithLeakDetection, each borrowed object also carries
+// a finalizer: if the GC collects it before it comes back, that Get was a
+// pool leak, and the pool counts it and warns. Objects sitting in the pool
+// have no finalizer, so the pool's own discards at GC aren't reported.
+type Pool[T any] struct {
+	pool        sync.Pool
+	detect      bool
+	warn        func(msg string)
+	outstanding int64
+	leaked      int64
+}
+
+// PoolOption configures a Pool
+type PoolOption func(*poolConfig)
+
+type poolConfig struct {
+	detect bool
+	warn   func(msg string)
+}
+
+// WithLeakDetection sets a finalizer on every object Get hands out and
+// clears it in Put. warn receives a message naming where the leaked object
+// was borrowed; nil logs it. Each Get then costs a runtime.Caller and a
+// SetFinalizer, so this is for tests and debugging, not the hot path.
+func WithLeakDetection(warn func(msg string)) PoolOption {
+	return func(c *poolConfig) {
+		c.detect = true
+		c.warn = warn
+	}
+}
+
+// NewPool returns a Pool whose Get calls newFn when the pool is empty
+func NewPool[T any](newFn func() *T, opts ...PoolOption) *Pool[T] {
+	var cfg poolConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.warn == nil {
+		cfg.warn = func(msg string) { log.Print(msg) }
+	}
+	p := &Pool[T]{detect: cfg.detect, warn: cfg.warn}
+	p.pool.New = func() any { return newFn() }
+	return p
+}
+
+// Get borrows an object from the pool. Its contents are whatever the last
+// user left, so reset it before use.
+func (p *Pool[T]) Get() *T {
+	obj := p.pool.Get().(*T)
+	atomic.AddInt64(&p.outstanding, 1)
+	if p.detect {
+		where := "unknown caller"
+		if _, file, line, ok := runtime.Caller(1); ok {
+			where = fmt.Sprintf("%s:%d", file, line)
+		}
+		runtime.SetFinalizer(obj, func(obj *T) {
+			n := atomic.AddInt64(&p.leaked, 1)
+			p.warn(fmt.Sprintf("pool leak: %T borrowed at %s was garbage collected without Put (%d leaked)", obj, where, n))
+		})
+	}
+	return obj
+}
+
+// Put returns obj to the pool. obj must not be used afterwards.
+func (p *Pool[T]) Put(obj *T) {
+	if obj == nil {
+		return
+	}
+	if p.detect {
+		runtime.SetFinalizer(obj, nil)
+	}
+	atomic.AddInt64(&p.outstanding, -1)
+	p.pool.Put(obj)
+}
+
+// Outstanding returns how many objects Get has handed out that were not Put
+// back, including any that have since leaked
+func (p *Pool[T]) Outstanding() int {
+	return int(atomic.LoadInt64(&p.outstanding))
+}
+
+// Leaked returns how many borrowed objects the GC collected without a Put.
+// It stays 0 without WithLeakDetection.
+func (p *Pool[T]) Leaked() int {
+	return int(atomic.LoadInt64(&p.leaked))
+}
+
+// Event is a typical log/telemetry record
+type Event struct {
+	ID        int               `json:"id"`
+	Type      string            `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Tags      map[string]string `json:"tags"`
+	Payload   string            `json:"payload"`
+}
+
+// maxPooledBuffer keeps one huge event from pinning a huge buffer in the pool
+const maxPooledBuffer = 64 * 1024
+
+var (
+	encodings   = flag.Int("n", 200_000, "encodings per mode")
+	detectLeaks = flag.Bool("detect-leaks", false, "enable Pool leak detection on the buffer pool, which reports each never-Put buffer the GC collects")
+
+	// bufPool is set up in main, once -detect-leaks is parsed
+	bufPool *Pool[bytes.Buffer]
+)
+
+func newBuffer() *bytes.Buffer { return new(bytes.Buffer) }
+
+// Each encoder builds the whole record in a buffer and then writes it to w in
+// one call, the way a log shipper or HTTP handler frames a message
+
+// encodeNoPool allocates a new buffer (and grows it) on every call
+func encodeNoPool(w io.Writer, e *Event) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(e); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodePoolNoPut takes a buffer from the pool but never returns it
+// BUG: every Get misses, so New runs each time - same allocations as no pool
+// plus the pool's own bookkeeping
+func encodePoolNoPut(w io.Writer, e *Event) error {
+	buf := bufPool.Get()
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err // BUG: buffer is never Put back
+}
+
+// encodePooled reuses buffers from the pool
+func encodePooled(w io.Writer, e *Event) error {
+	buf := bufPool.Get()
+	buf.Reset()
+	defer func() {
+		// ✅ Don't let one oversized event pin a large buffer in the pool
+		if buf.Cap() <= maxPooledBuffer {
+			bufPool.Put(buf)
+		}
+	}()
+
+	if err := json.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+	// ✅ w must not retain buf.Bytes() - the buffer is reused after Put
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type mode struct {
+	name   string
+	encode func(io.Writer, *Event) error
+}
+
+var modes = []mode{
+	{"no pool", encodeNoPool},
+	{"pool, never Put", encodePoolNoPut},
+	{"pool, defer Put", encodePooled},
+}
+
+func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
+	var opts []PoolOption
+	if *detectLeaks {
+		// One line per leaked buffer would flood the output; the count is
+		// printed with the results
+		opts = append(opts, WithLeakDetection(func(string) {}))
+	}
+	bufPool = NewPool(newBuffer, opts...)
+
+	event := newEvent()
+
+	go func() {
+		fmt.Println("pprof server running on http://localhost:6060")
+		fmt.Println("Collect allocation profile: curl http://localhost:6060/debug/pprof/allocs > allocs.pprof")
+		fmt.Println()
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
+			fmt.Printf("pprof server error: %v\n", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	var sample bytes.Buffer
+	encodePooled(&sample, event)
+	fmt.Printf("Encoding a %d-byte event %d times per mode on %d goroutines...\n\n",
+		sample.Len(), *encodings, runtime.GOMAXPROCS(0))
+
+	fmt.Printf("%-18s %12s %14s %10s %10s %10s\n", "mode", "allocs/op", "total alloc", "GC cycles", "time", "not Put")
+	for _, m := range modes {
+		outstanding := bufPool.Outstanding()
+		allocs, totalAlloc, gcCycles, elapsed := runMode(m, event, *encodings)
+		fmt.Printf("%-18s %12.0f %11d MB %10d %10v %10d\n",
+			m.name, allocs, totalAlloc/1024/1024, gcCycles, elapsed.Round(time.Millisecond),
+			bufPool.Outstanding()-outstanding)
+	}
+	fmt.Printf("\nWhole run: %s\n", gcpercent.Stats())
+	if *detectLeaks {
+		runtime.GC()
+		runtime.GC()
+		time.Sleep(100 * time.Millisecond) // let the finalizer goroutine catch up
+		fmt.Printf("Leak detection: %d buffers collected without Put, %d outstanding\n",
+			bufPool.Leaked(), bufPool.Outstanding())
+	}
+
+	fmt.Println("\nThe never-Put pool allocates like no pool at all: every Get falls through to New.")
+	fmt.Println("With defer Put, buffers are reused and only the encoder itself is allocated.")
+	fmt.Println("Run go test -bench . for ns/op and B/op per mode.")
+	fmt.Println("Press Ctrl+C to stop")
+
+	select {}
+}
+
+// runMode encodes n events across GOMAXPROCS goroutines and reports the
+// allocations per encoding, bytes allocated, GC cycles run and wall time
+func runMode(m mode, e *Event, n int) (allocsPerOp float64, totalAlloc uint64, gcCycles uint32, elapsed time.Duration) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	workers := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(count int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				m.encode(io.Discard, e)
+			}
+		}(n / workers)
+	}
+	wg.Wait()
+
+	elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	allocsPerOp = float64(after.Mallocs-before.Mallocs) / float64(n/workers*workers)
+	return allocsPerOp, after.TotalAlloc - before.TotalAlloc, after.NumGC - before.NumGC, elapsed
+}
+
+func newEvent() *Event {
+	return &Event{
+		ID:        42,
+		Type:      "request.completed",
+		Timestamp: time.Now(),
+		Tags: map[string]string{
+			"service": "checkout",
+			"region":  "eu-west-1",
+			"status":  "200",
+		},
+		Payload: strings.Repeat("x", 2048),
+	}
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
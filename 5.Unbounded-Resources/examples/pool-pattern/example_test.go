@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPooledEncodingAllocatesLess checks the demo's claim: with defer Put
+// only the encoder is allocated, while a pool that is never Put back
+// allocates as much as no pool at all
+func TestPooledEncodingAllocatesLess(t *testing.T) {
+	bufPool = NewPool(newBuffer)
+	e := newEvent()
+
+	allocs := make(map[string]float64)
+	for _, m := range modes {
+		allocs[m.name] = testing.AllocsPerRun(1000, func() { m.encode(io.Discard, e) })
+	}
+	t.Logf("allocs/op: %v", allocs)
+
+	if allocs["pool, defer Put"] >= allocs["no pool"] {
+		t.Errorf("defer Put allocates %.0f per encoding, want fewer than no pool's %.0f",
+			allocs["pool, defer Put"], allocs["no pool"])
+	}
+	if allocs["pool, never Put"] < allocs["no pool"] {
+		t.Errorf("never Put allocates %.0f per encoding, want at least no pool's %.0f: every Get falls through to New",
+			allocs["pool, never Put"], allocs["no pool"])
+	}
+}
+
+// BenchmarkModes encodes the demo event in each mode from GOMAXPROCS
+// goroutines
+func BenchmarkModes(b *testing.B) {
+	bufPool = NewPool(newBuffer)
+	e := newEvent()
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.encode(io.Discard, e)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkPoolGetPut measures a Get and Put pair without and with leak
+// detection, which adds a runtime.Caller and a SetFinalizer to every Get
+func BenchmarkPoolGetPut(b *testing.B) {
+	cost := func(p *Pool[bytes.Buffer]) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				p.Put(p.Get())
+			}
+		}
+	}
+	b.Run("Plain", cost(NewPool(newBuffer)))
+	b.Run("LeakDetection", cost(NewPool(newBuffer, WithLeakDetection(func(string) {}))))
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestPoolLeakDetection borrows objects from leak-detecting pools and drops
+// some without Put. After forced GCs, only the dropped ones may be counted as
+// leaked.
+func TestPoolLeakDetection(t *testing.T) {
+	const borrows = 100
+
+	// collect runs GCs until want objects have leaked or a second passes;
+	// finalizers run on their own goroutine after the GC that finds them
+	collect := func(p *Pool[bytes.Buffer], want int) {
+		for deadline := time.Now().Add(time.Second); p.Leaked() < want && time.Now().Before(deadline); {
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Balanced: every Get is Put back, and the pool itself drops its
+	// contents across GCs without any of them counting as a leak
+	balanced := NewPool(newBuffer, WithLeakDetection(func(string) {}))
+	for i := 0; i < borrows; i++ {
+		buf := balanced.Get()
+		buf.WriteString("balanced")
+		balanced.Put(buf)
+	}
+	collect(balanced, 0)
+	check(t, fmt.Sprintf("%d balanced Get/Put: %d outstanding, %d leaked", borrows, balanced.Outstanding(), balanced.Leaked()),
+		balanced.Outstanding() == 0 && balanced.Leaked() == 0)
+
+	// Leaky: borrowed and dropped
+	var mu sync.Mutex
+	var warnings []string
+	leaky := NewPool(newBuffer, WithLeakDetection(func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, msg)
+	}))
+	for i := 0; i < borrows; i++ {
+		leaky.Get().WriteString("forgotten")
+	}
+	collect(leaky, borrows)
+	check(t, fmt.Sprintf("%d Gets without Put: %d outstanding, %d leaked", borrows, leaky.Outstanding(), leaky.Leaked()),
+		leaky.Outstanding() == borrows && leaky.Leaked() == borrows)
+
+	mu.Lock()
+	first := ""
+	if len(warnings) > 0 {
+		first = warnings[0]
+	}
+	check(t, fmt.Sprintf("one warning per leak (%d)", len(warnings)), len(warnings) == borrows)
+	check(t, "the warning names where the object was borrowed", strings.Contains(first, "example_test.go:"))
+	mu.Unlock()
+	t.Log(first)
+
+	// Mixed: only the dropped half counts
+	mixed := NewPool(newBuffer, WithLeakDetection(func(string) {}))
+	for i := 0; i < borrows; i++ {
+		buf := mixed.Get()
+		if i%2 == 0 {
+			mixed.Put(buf)
+		}
+	}
+	collect(mixed, borrows/2)
+	check(t, fmt.Sprintf("half Put back: %d outstanding, %d leaked (want %d each)", mixed.Outstanding(), mixed.Leaked(), borrows/2),
+		mixed.Outstanding() == borrows/2 && mixed.Leaked() == borrows/2)
+
+	// Without detection nothing is counted as leaked, and Get/Put stays cheap
+	plain := NewPool(newBuffer)
+	plain.Get()
+	collect(plain, 0)
+	check(t, fmt.Sprintf("without WithLeakDetection: %d outstanding, %d leaked", plain.Outstanding(), plain.Leaked()),
+		plain.Outstanding() == 1 && plain.Leaked() == 0)
+}
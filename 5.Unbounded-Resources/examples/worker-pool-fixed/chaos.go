@@ -0,0 +1,11 @@
+//go:build chaos
+
+package main
+
+// Building with the chaos tag lets WithChaos take effect without setting
+// WORKER_POOL_CHAOS=1:
+//
+//	go run -tags chaos fixed_example.go chaos.go
+func init() {
+	chaosBuildTag = true
+}
@@ -1,79 +1,886 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
 	"net/http"
-	_ "net/http/pprof"
+	"os"
+	"reflect"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutinequota"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/histogram"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/sighandler"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This example demonstrates a properly bounded worker pool that
 // limits concurrent goroutines and provides backpressure when overloaded.
 
-var (
-	tasksSubmitted int64
-	tasksCompleted int64
-	tasksRejected  int64
-)
-
 // WorkerPool implements a fixed-size pool of workers
 type WorkerPool struct {
 	tasks    chan func()
-	workers  int
+	affinity []chan func() // one queue per worker, for SubmitAffinized
+	workers  int           // base workers, the floor for Resize
 	shutdown chan struct{}
+
+	resizeMu sync.Mutex
+	elastic  []chan struct{} // stop channel of each worker added by Resize, newest last
+	chaos    *chaosConfig
+
+	onBackpressure       func(queueLen, queueCap int)
+	backpressureInterval time.Duration
+	lastBackpressure     int64 // UnixNano of the last onBackpressure call
+
+	quota      *goroutinequota.Quota
+	quotaLabel string
+	overQuota  int64 // tasks that waited for a slot because quotaLabel was at its limit
+
+	summaryName string // set by WithSummary
+
+	submits submitWindow         // Submit and SubmitAffinized outcomes, for RejectionRate
+	latency *histogram.Histogram // submit-to-finish time of accepted Submit and SubmitAffinized tasks
+
+	// Task counts for Stats
+	started   time.Time
+	submitted int64
+	completed int64
+	rejected  int64
+	panicked  int64
+	inFlight  int64
 }
 
-// NewWorkerPool creates a pool with fixed worker count and queue size
-func NewWorkerPool(workerCount, queueSize int) *WorkerPool {
+// Option configures optional WorkerPool behavior
+type Option func(*WorkerPool)
+
+// NewWorkerPool creates a pool with fixed worker count and queue size. It
+// needs at least one worker and a queue size of at least 0, where 0 means
+// Submit only succeeds when a worker is free to take the task.
+func NewWorkerPool(workerCount, queueSize int, opts ...Option) (*WorkerPool, error) {
+	if workerCount < 1 {
+		return nil, fmt.Errorf("worker pool needs at least 1 worker, got %d", workerCount)
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("worker pool queue size must be at least 0, got %d", queueSize)
+	}
+
 	pool := &WorkerPool{
 		tasks:    make(chan func(), queueSize),
+		affinity: make([]chan func(), workerCount),
 		workers:  workerCount,
 		shutdown: make(chan struct{}),
+		latency:  histogram.New(latencyBuckets),
+		started:  time.Now(),
+	}
+	for _, opt := range opts {
+		opt(pool)
+	}
+
+	// Each worker's affinity queue gets an even share of queueSize
+	perWorker := queueSize / workerCount
+	if perWorker < 1 {
+		perWorker = 1
 	}
 
 	// Start fixed number of workers
 	for i := 0; i < workerCount; i++ {
+		pool.affinity[i] = make(chan func(), perWorker)
 		go pool.worker(i)
 	}
 
-	return pool
+	if pool.summaryName != "" {
+		summary.Register(pool.summaryName, pool)
+	}
+	return pool, nil
+}
+
+// WithSummary registers the pool in /debug/summary under name once it is
+// built, so its caller doesn't have to
+func WithSummary(name string) Option {
+	return func(p *WorkerPool) {
+		p.summaryName = name
+	}
 }
 
-// worker processes tasks from the queue
+// worker processes tasks from the shared queue and from its own affinity
+// queue
 func (p *WorkerPool) worker(id int) {
 	for {
+		var task func()
 		select {
-		case task := <-p.tasks:
-			task()
+		case task = <-p.tasks:
+		case task = <-p.affinity[id]:
 		case <-p.shutdown:
 			return
 		}
+		release, ok := p.acquireQuota()
+		if !ok {
+			return
+		}
+		p.runTask(task)
+		release()
 	}
 }
 
+// runTask runs a single task, recovering from panics so one bad task
+// can't take its worker down with it
+func (p *WorkerPool) runTask(task func()) {
+	atomic.AddInt64(&p.inFlight, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.panicked, 1)
+		}
+		atomic.AddInt64(&p.inFlight, -1)
+	}()
+	task()
+	atomic.AddInt64(&p.completed, 1)
+}
+
 // Submit adds a task to the pool, returns false if queue is full
 func (p *WorkerPool) Submit(task func()) bool {
+	if p.chaos != nil {
+		task = p.chaos.wrap(task)
+	}
+	task = p.timed(task)
+
 	select {
 	case p.tasks <- task:
+		atomic.AddInt64(&p.submitted, 1)
+		p.submits.record(time.Now(), true)
 		return true
 	default:
 		// Queue full - apply backpressure
+		atomic.AddInt64(&p.rejected, 1)
+		p.submits.record(time.Now(), false)
+		p.signalBackpressure()
 		return false
 	}
 }
 
-// Close shuts down the worker pool
+// SubmitAffinized queues task on the worker that key hashes to, returns
+// false if that worker's queue is full. Every task for one key runs on the
+// same worker, so tasks for a key run one at a time in submission order and
+// state owned by that key needs no lock. Tasks for keys on other workers
+// still run in parallel. A slow key holds up every key that shares its
+// worker, and a hot key can fill its worker's queue while the rest are idle.
+func (p *WorkerPool) SubmitAffinized(key string, task func()) bool {
+	if p.chaos != nil {
+		task = p.chaos.wrap(task)
+	}
+	task = p.timed(task)
+
+	select {
+	case p.affinity[p.workerFor(key)] <- task:
+		atomic.AddInt64(&p.submitted, 1)
+		p.submits.record(time.Now(), true)
+		return true
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		p.submits.record(time.Now(), false)
+		p.signalBackpressure()
+		return false
+	}
+}
+
+// timed returns task wrapped to record, when it finishes, the time since it
+// was submitted: its wait in the queue plus its run, panics included
+func (p *WorkerPool) timed(task func()) func() {
+	submitted := time.Now()
+	return func() {
+		defer func() { p.latency.Observe(time.Since(submitted)) }()
+		task()
+	}
+}
+
+// AffinityLen returns how many tasks are queued on key's worker, including
+// tasks for other keys that hash to the same worker
+func (p *WorkerPool) AffinityLen(key string) int {
+	return len(p.affinity[p.workerFor(key)])
+}
+
+// workerFor maps key to a worker index with FNV-1a
+func (p *WorkerPool) workerFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.affinity)))
+}
+
+// OnBackpressure calls fn when Submit rejects a task because the queue is
+// full, at most once per interval however many tasks are rejected. fn runs on
+// the submitting goroutine, so it should only record or forward the signal.
+func OnBackpressure(fn func(queueLen, queueCap int), interval time.Duration) Option {
+	return func(p *WorkerPool) {
+		p.onBackpressure = fn
+		p.backpressureInterval = interval
+	}
+}
+
+// signalBackpressure calls onBackpressure unless it already ran within the
+// last interval. The CAS makes concurrent rejections elect a single caller.
+func (p *WorkerPool) signalBackpressure() {
+	if p.onBackpressure == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastBackpressure)
+	if last != 0 && now-last < int64(p.backpressureInterval) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&p.lastBackpressure, last, now) {
+		p.onBackpressure(len(p.tasks), cap(p.tasks))
+	}
+}
+
+// SubmitLabeled is Submit for callers that tag their work with pprof labels.
+// Labels belong to a goroutine, so a task run by a worker would otherwise
+// lose them; the task runs under ctx's labels plus labels instead, and CPU
+// and goroutine profiles attribute it to the caller.
+func (p *WorkerPool) SubmitLabeled(ctx context.Context, task func(), labels pprof.LabelSet) bool {
+	return p.Submit(func() {
+		// pprof.Do leaves the goroutine with ctx's labels when it returns;
+		// reset them so the idle worker isn't attributed to this caller
+		defer pprof.SetGoroutineLabels(context.Background())
+		pprof.Do(ctx, labels, func(context.Context) {
+			task()
+		})
+	})
+}
+
+// WithGoroutineQuota makes every worker acquire a slot for label from q
+// before starting a task. A worker that finds label at its limit holds on to
+// its task and waits for a slot, so accepted tasks are delayed, never
+// dropped; the wait is counted in OverQuota and signals backpressure, and the
+// queue backs up until Submit rejects. Pools sharing q with different labels
+// don't slow each other.
+func WithGoroutineQuota(q *goroutinequota.Quota, label string) Option {
+	return func(p *WorkerPool) {
+		p.quota = q
+		p.quotaLabel = label
+	}
+}
+
+// acquireQuota takes a quota slot for the next task, waiting for one if the
+// label is at its limit. It returns false only if the pool is closed while
+// waiting; the task is then left unrun like the ones still queued.
+func (p *WorkerPool) acquireQuota() (func(), bool) {
+	if p.quota == nil {
+		return func() {}, true
+	}
+	release, err := p.quota.Acquire(p.quotaLabel)
+	if err == nil {
+		return release, true
+	}
+
+	atomic.AddInt64(&p.overQuota, 1)
+	p.signalBackpressure()
+	release, err = p.quota.Wait(p.quotaLabel, p.shutdown)
+	return release, err == nil
+}
+
+// OverQuota returns how many tasks had to wait for a WithGoroutineQuota slot
+func (p *WorkerPool) OverQuota() int64 {
+	return atomic.LoadInt64(&p.overQuota)
+}
+
+// QueueDepth returns how many submitted tasks are waiting for a worker,
+// counting the affinity queues
+func (p *WorkerPool) QueueDepth() int {
+	depth := len(p.tasks)
+	for _, q := range p.affinity {
+		depth += len(q)
+	}
+	return depth
+}
+
+// QueueOccupancy returns how full the shared queue that Submit uses is, from
+// 0 to 1. A full affinity queue shows up in RejectionRate instead.
+func (p *WorkerPool) QueueOccupancy() float64 {
+	if cap(p.tasks) == 0 {
+		return 0
+	}
+	return float64(len(p.tasks)) / float64(cap(p.tasks))
+}
+
+// RejectionRate returns the share of Submit and SubmitAffinized calls over
+// the last rejectionWindow that were rejected, and how many calls that was
+func (p *WorkerPool) RejectionRate() (rate float64, calls int64) {
+	submitted, rejected := p.submits.totals(time.Now())
+	calls = submitted + rejected
+	if calls == 0 {
+		return 0, 0
+	}
+	return float64(rejected) / float64(calls), calls
+}
+
+// rejectionWindow is how far back RejectionRate looks
+const rejectionWindow = 10 * time.Second
+
+// submitWindow counts accepted and rejected submits in one bucket per second
+// of rejectionWindow. A bucket is reused once its second falls out of the
+// window, so old rejections stop counting without a cleanup goroutine.
+type submitWindow struct {
+	mu      sync.Mutex
+	buckets [rejectionWindow / time.Second]submitBucket
+}
+
+// submitBucket holds one second's submit outcomes
+type submitBucket struct {
+	second              int64 // Unix second the counts belong to
+	submitted, rejected int64
+}
+
+// record counts one submit made at now
+func (w *submitWindow) record(now time.Time, accepted bool) {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if b.second != sec {
+		*b = submitBucket{second: sec}
+	}
+	if accepted {
+		b.submitted++
+	} else {
+		b.rejected++
+	}
+}
+
+// totals sums the buckets still inside the window that ends at now
+func (w *submitWindow) totals(now time.Time) (submitted, rejected int64) {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range w.buckets {
+		if age := sec - b.second; age >= 0 && age < int64(len(w.buckets)) {
+			submitted += b.submitted
+			rejected += b.rejected
+		}
+	}
+	return submitted, rejected
+}
+
+// Workers returns how many workers are running: the base workers plus those
+// added by Resize
+func (p *WorkerPool) Workers() int {
+	p.resizeMu.Lock()
+	defer p.resizeMu.Unlock()
+	return p.workers + len(p.elastic)
+}
+
+// Resize starts or stops workers until n are running and returns the new
+// count. The workers the pool was created with own the affinity queues, so n
+// is never taken below that count. Workers added here only take tasks from
+// the shared queue; a stopped one finishes its current task first.
+func (p *WorkerPool) Resize(n int) int {
+	p.resizeMu.Lock()
+	defer p.resizeMu.Unlock()
+	if n < p.workers {
+		n = p.workers
+	}
+	for p.workers+len(p.elastic) < n {
+		stop := make(chan struct{})
+		p.elastic = append(p.elastic, stop)
+		go p.elasticWorker(stop)
+	}
+	for p.workers+len(p.elastic) > n {
+		last := len(p.elastic) - 1
+		close(p.elastic[last])
+		p.elastic = p.elastic[:last]
+	}
+	return n
+}
+
+// elasticWorker is worker without an affinity queue, until stop is closed
+func (p *WorkerPool) elasticWorker(stop chan struct{}) {
+	for {
+		select {
+		case task := <-p.tasks:
+			// Waits on shutdown only: a task taken off the queue runs even
+			// if Resize stops this worker meanwhile
+			release, ok := p.acquireQuota()
+			if !ok {
+				return
+			}
+			p.runTask(task)
+			release()
+		case <-stop:
+			return
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// LatencyQuantile returns the q-th quantile, from 0 to 1, of the time tasks
+// took from Submit or SubmitAffinized to finishing, as an upper bound (see
+// histogram.Histogram.Quantile). Rejected tasks aren't counted. It is 0
+// before any task has finished.
+func (p *WorkerPool) LatencyQuantile(q float64) time.Duration {
+	return p.latency.Quantile(q)
+}
+
+// MeetsSLA reports whether the p99 task latency is within targetP99. The
+// latency includes the wait in the queue, so a pool that can't keep up fails
+// it even when each task runs quickly. p99 is a bucket bound, so a true p99
+// just under the target can still fail. With nothing recorded yet it returns
+// true. The histogram covers every task since the pool was created or
+// ResetLatency was last called; an autoscaler should reset it after each
+// decision, so an old overload doesn't outweigh the current load.
+func (p *WorkerPool) MeetsSLA(targetP99 time.Duration) bool {
+	return p.latency.Quantile(0.99) <= targetP99
+}
+
+// ResetLatency clears the latency histogram and starts a new interval
+func (p *WorkerPool) ResetLatency() {
+	p.latency.Reset()
+}
+
+// WorkerPoolStats is a snapshot of a WorkerPool's size, queue and task
+// counts. Each field is read atomically, but not all of them at one instant,
+// so under load the counts can disagree by a task or two.
+type WorkerPoolStats struct {
+	Workers        int     // base workers plus those added by Resize
+	QueueLen       int     // tasks waiting in the shared queue; QueueDepth adds the affinity queues
+	QueueCap       int     // capacity of the shared queue
+	TasksSubmitted int64   // accepted by Submit, SubmitAffinized, Reduce or ForEach
+	TasksCompleted int64   // returned without panicking
+	TasksRejected  int64   // refused by Submit or SubmitAffinized because the queue was full
+	TasksPanicked  int64   // recovered by the worker that ran them
+	TasksInFlight  int     // running on a worker now
+	UptimeSeconds  float64 // since NewWorkerPool
+}
+
+// Stats returns a snapshot of the pool for monitoring
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Workers:        p.Workers(),
+		QueueLen:       len(p.tasks),
+		QueueCap:       cap(p.tasks),
+		TasksSubmitted: atomic.LoadInt64(&p.submitted),
+		TasksCompleted: atomic.LoadInt64(&p.completed),
+		TasksRejected:  atomic.LoadInt64(&p.rejected),
+		TasksPanicked:  atomic.LoadInt64(&p.panicked),
+		TasksInFlight:  int(atomic.LoadInt64(&p.inFlight)),
+		UptimeSeconds:  time.Since(p.started).Seconds(),
+	}
+}
+
+// Load returns the part of Stats that health.WorkerPoolCheck reads
+func (p *WorkerPool) Load() health.PoolLoad {
+	s := p.Stats()
+	return health.PoolLoad{QueueLen: s.QueueLen, QueueCap: s.QueueCap, Busy: s.TasksInFlight, Workers: s.Workers}
+}
+
+// Summary reports the pool's size, backlog and task counts for
+// /debug/summary
+func (p *WorkerPool) Summary() map[string]interface{} {
+	s := p.Stats()
+	rate, _ := p.RejectionRate()
+	return map[string]interface{}{
+		"workers":         s.Workers,
+		"queue_depth":     p.QueueDepth(),
+		"queue_capacity":  s.QueueCap,
+		"queue_occupancy": p.QueueOccupancy(),
+		"rejection_rate":  rate,
+		"over_quota":      p.OverQuota(),
+		"latency_p99":     p.LatencyQuantile(0.99).String(),
+		"tasks_submitted": s.TasksSubmitted,
+		"tasks_completed": s.TasksCompleted,
+		"tasks_rejected":  s.TasksRejected,
+		"tasks_panicked":  s.TasksPanicked,
+		"tasks_in_flight": s.TasksInFlight,
+		"uptime_seconds":  s.UptimeSeconds,
+	}
+}
+
+// latencyBuckets are the histogram bucket upper bounds used for task
+// latency, in a 1-2-5 series from 1µs to 10s
+var latencyBuckets = histogram.Series125(time.Microsecond, 10*time.Second)
+
+// Close shuts down the worker pool and removes it from /debug/summary
 func (p *WorkerPool) Close() {
 	close(p.shutdown)
+	if p.summaryName != "" {
+		summary.Unregister(p.summaryName)
+	}
+}
+
+// enqueue blocks until task is queued or ctx is done. Unlike Submit it never
+// rejects and never applies chaos, because Reduce needs every task to run.
+func (p *WorkerPool) enqueue(ctx context.Context, task func()) error {
+	select {
+	case p.tasks <- task:
+		atomic.AddInt64(&p.submitted, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.shutdown:
+		return errors.New("worker pool closed")
+	}
 }
 
+// runAll runs fn(0) ... fn(n-1) on the pool and waits for all of them. It
+// returns ctx's error if ctx ends first, or the first panic raised by fn.
+func (p *WorkerPool) runAll(ctx context.Context, n int, fn func(i int)) error {
+	var (
+		wg       sync.WaitGroup
+		panicMu  sync.Mutex
+		panicErr error
+	)
+	for i := 0; i < n; i++ {
+		i := i // per-iteration copy; loop variables are shared before Go 1.22
+		wg.Add(1)
+		err := p.enqueue(ctx, func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panicMu.Lock()
+					if panicErr == nil {
+						panicErr = fmt.Errorf("task %d panicked: %v", i, r)
+					}
+					panicMu.Unlock()
+				}
+			}()
+			fn(i)
+		})
+		if err != nil {
+			wg.Done()
+			wg.Wait()
+			return err
+		}
+	}
+	wg.Wait()
+
+	if panicErr != nil {
+		return panicErr
+	}
+	return ctx.Err()
+}
+
+// Reduce maps items in parallel on pool and folds the results with reducer.
+// Items are split into a few chunks per worker; each chunk is mapped and
+// folded by one task, then the chunk results are combined pairwise, level by
+// level, with every pair reduced as its own pool task. Adjacent results are
+// always combined left to right, so reducer must be associative but need not
+// be commutative. identity is folded in first, as the left operand of the
+// final reducer call, and is returned for empty input.
+//
+// Go methods can't take type parameters, so this is a function over a pool
+// rather than a WorkerPool method.
+func Reduce[T, R any](ctx context.Context, pool *WorkerPool, items []T, mapper func(T) R, reducer func(R, R) R, identity R) (R, error) {
+	if len(items) == 0 {
+		return identity, ctx.Err()
+	}
+
+	// A task per item would spend more time on channel sends than on work
+	chunks := pool.Workers() * 4
+	if chunks > len(items) {
+		chunks = len(items)
+	}
+	chunkSize := (len(items) + chunks - 1) / chunks
+	chunks = (len(items) + chunkSize - 1) / chunkSize
+
+	// Leaves of the tree: map and fold each chunk
+	partials := make([]R, chunks)
+	err := pool.runAll(ctx, chunks, func(i int) {
+		lo, hi := i*chunkSize, (i+1)*chunkSize
+		if hi > len(items) {
+			hi = len(items)
+		}
+		acc := mapper(items[lo])
+		for _, item := range items[lo+1 : hi] {
+			acc = reducer(acc, mapper(item))
+		}
+		partials[i] = acc
+	})
+	if err != nil {
+		return identity, err
+	}
+
+	// Combine pairs until one result is left: log2(chunks) levels
+	for len(partials) > 1 {
+		next := make([]R, (len(partials)+1)/2)
+		if len(partials)%2 == 1 {
+			next[len(next)-1] = partials[len(partials)-1]
+		}
+		err := pool.runAll(ctx, len(partials)/2, func(i int) {
+			next[i] = reducer(partials[2*i], partials[2*i+1])
+		})
+		if err != nil {
+			return identity, err
+		}
+		partials = next
+	}
+
+	return reducer(identity, partials[0]), nil
+}
+
+// ForEach runs fn on every item on pool and calls each with every result as
+// soon as it is ready, in completion order, not item order. each runs serially
+// on the calling goroutine, so it needs no locking. The first error from fn,
+// or a panic in it, cancels the items not yet started; each is not called
+// again after that, and ForEach returns the error once every started fn has
+// finished.
+//
+// Reduce is the choice when only the combined result matters: nothing is
+// available until every item is done. ForEach suits side effects that should
+// start early, such as writing each response out or updating progress, and
+// it never holds more than one undelivered result per worker.
+func ForEach[In, Out any](ctx context.Context, pool *WorkerPool, items []In, fn func(In) (Out, error), each func(Out)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		out Out
+		err error
+	}
+	results := make(chan result)
+
+	// Feed from a separate goroutine: a full queue would otherwise block this
+	// one while the workers block sending it results
+	var (
+		wg      sync.WaitGroup
+		feedErr error
+	)
+	go func() {
+		for i, item := range items {
+			i, item := i, item // per-iteration copy; loop variables are shared before Go 1.22
+			wg.Add(1)
+			err := pool.enqueue(ctx, func() {
+				defer wg.Done()
+				if ctx.Err() != nil {
+					return // cancelled while queued
+				}
+
+				var r result
+				func() {
+					defer func() {
+						if p := recover(); p != nil {
+							r.err = fmt.Errorf("item %d panicked: %v", i, p)
+						}
+					}()
+					r.out, r.err = fn(item)
+				}()
+
+				select {
+				case results <- r:
+				case <-ctx.Done():
+				}
+			})
+			if err != nil {
+				wg.Done()
+				feedErr = err
+				break
+			}
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	for r := range results {
+		if firstErr != nil {
+			continue // drain so in-flight tasks can finish
+		}
+		if r.err != nil {
+			firstErr = r.err
+			cancel()
+			continue
+		}
+		each(r.out)
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if feedErr != nil {
+		return feedErr
+	}
+	return ctx.Err()
+}
+
+// chaosBuildTag is set by chaos.go when built with -tags chaos
+var chaosBuildTag bool
+
+// chaosConfig injects random failures and delays into submitted tasks
+type chaosConfig struct {
+	failureRate float64
+	maxDelayMs  int
+}
+
+// WithChaos makes each task panic with probability failureRate and, with
+// probability failureRate/2, sleep a random 0-maxDelayMs ms first. A
+// maxDelayMs of 0 or less disables the delays. It only
+// takes effect when built with -tags chaos or run with WORKER_POOL_CHAOS=1,
+// so a WithChaos left in production code stays inert.
+func WithChaos(failureRate float64, maxDelayMs int) Option {
+	return func(p *WorkerPool) {
+		if !chaosBuildTag && os.Getenv("WORKER_POOL_CHAOS") != "1" {
+			return
+		}
+		p.chaos = &chaosConfig{failureRate: failureRate, maxDelayMs: maxDelayMs}
+	}
+}
+
+// ChaosEnabled reports whether tasks are being wrapped with chaos
+func (p *WorkerPool) ChaosEnabled() bool {
+	return p.chaos != nil
+}
+
+func (c *chaosConfig) wrap(task func()) func() {
+	return func() {
+		// A non-positive maxDelayMs injects no delay rather than panicking in Intn
+		if c.maxDelayMs > 0 && rand.Float64() < c.failureRate/2 {
+			time.Sleep(time.Duration(rand.Intn(c.maxDelayMs+1)) * time.Millisecond)
+		}
+		if rand.Float64() < c.failureRate {
+			panic("chaos: injected task failure")
+		}
+		task()
+	}
+}
+
+// Backlog is a source of work waiting to reach the pool, such as the buffer
+// of channel-buffer-fixed's EventProcessor
+type Backlog interface {
+	Backlog() int
+}
+
+// AutoscalerConfig bounds an Autoscaler and sets how eagerly it reacts
+type AutoscalerConfig struct {
+	MinWorkers, MaxWorkers int
+	ScaleUpAt              int // add Step workers while the backlog is above this
+	ScaleDownAt            int // remove Step workers while the backlog is below this
+	Step                   int
+	Interval               time.Duration // how often the backlog is sampled
+}
+
+// Autoscaler resizes a WorkerPool to its saturation: every Interval it adds
+// up the upstream backlog and the pool's own queue, then grows the pool when
+// work is piling up and shrinks it when the backlog has drained, within
+// MinWorkers and MaxWorkers. Between ScaleDownAt and ScaleUpAt it leaves the
+// pool alone, so a backlog hovering near one threshold doesn't flap.
+type Autoscaler struct {
+	pool   *WorkerPool
+	source Backlog
+	cfg    AutoscalerConfig
+
+	scaleUps, scaleDowns int64
+	peakWorkers          int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAutoscaler sizes pool to cfg.MinWorkers and starts watching source
+func NewAutoscaler(pool *WorkerPool, source Backlog, cfg AutoscalerConfig) *Autoscaler {
+	a := &Autoscaler{
+		pool:   pool,
+		source: source,
+		cfg:    cfg,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	a.peakWorkers = int64(pool.Resize(cfg.MinWorkers))
+	go a.run()
+	return a
+}
+
+func (a *Autoscaler) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.adjust()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// adjust makes one scaling decision from the current backlog
+func (a *Autoscaler) adjust() {
+	backlog := a.source.Backlog() + a.pool.QueueDepth()
+	workers := a.pool.Workers()
+
+	switch {
+	case backlog > a.cfg.ScaleUpAt && workers < a.cfg.MaxWorkers:
+		target := workers + a.cfg.Step
+		if target > a.cfg.MaxWorkers {
+			target = a.cfg.MaxWorkers
+		}
+		workers = a.pool.Resize(target)
+		atomic.AddInt64(&a.scaleUps, 1)
+		if int64(workers) > atomic.LoadInt64(&a.peakWorkers) {
+			atomic.StoreInt64(&a.peakWorkers, int64(workers))
+		}
+	case backlog < a.cfg.ScaleDownAt && workers > a.cfg.MinWorkers:
+		target := workers - a.cfg.Step
+		if target < a.cfg.MinWorkers {
+			target = a.cfg.MinWorkers
+		}
+		a.pool.Resize(target)
+		atomic.AddInt64(&a.scaleDowns, 1)
+	}
+}
+
+// Summary reports the autoscaler's decisions for /debug/summary
+func (a *Autoscaler) Summary() map[string]interface{} {
+	return map[string]interface{}{
+		"workers":      a.pool.Workers(),
+		"min_workers":  a.cfg.MinWorkers,
+		"max_workers":  a.cfg.MaxWorkers,
+		"peak_workers": atomic.LoadInt64(&a.peakWorkers),
+		"scale_ups":    atomic.LoadInt64(&a.scaleUps),
+		"scale_downs":  atomic.LoadInt64(&a.scaleDowns),
+	}
+}
+
+// Stop ends the autoscaler and waits for its goroutine. The pool keeps its
+// current size.
+func (a *Autoscaler) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+var (
+	wordCount = flag.Bool("wordcount", false, "run the Reduce word-count demo instead of the traffic spike")
+
+	backpressureSignals int64
+)
+
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+	if *wordCount {
+		demonstrateWordCount()
+		return
+	}
+
+	sighandler.InstallLeakDump("/tmp/leakdump")
+
 	// Start pprof server
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6061")
-		if err := http.ListenAndServe("localhost:6061", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6061", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
@@ -81,12 +888,31 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 
 	// Create bounded worker pool: 100 workers, 500 queue size
-	pool := NewWorkerPool(100, 500)
+	// Chaos stays off unless enabled with -tags chaos or WORKER_POOL_CHAOS=1
+	// Upstream load shedding would hook in at OnBackpressure; here it is counted
+	pool, err := NewWorkerPool(100, 500, WithChaos(0.05, 100), WithSummary("worker_pool"),
+		OnBackpressure(func(queueLen, queueCap int) {
+			atomic.AddInt64(&backpressureSignals, 1)
+		}, time.Second))
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer pool.Close()
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
+	// /readyz fails once the queue is over 80% full or over 10% of submits
+	// are rejected
+	debugMux.HandleFunc("/readyz", health.ReadyHandler(health.WorkerPoolCheck(pool, 0.8, 0.1)))
+
 	initialGoroutines := runtime.NumGoroutine()
 	fmt.Printf("[START] Goroutines: %d (100 workers + overhead)\n", initialGoroutines)
 	fmt.Println("Simulating traffic spike: 1000 tasks/second")
+	if pool.ChaosEnabled() {
+		fmt.Println("Chaos mode ON: 5% of tasks panic, 2.5% are delayed up to 100ms")
+	}
 	fmt.Println()
 
 	// Simulate incoming tasks at high rate
@@ -102,16 +928,19 @@ func main() {
 	for time.Since(start) < duration {
 		<-ticker.C
 		goroutines := runtime.NumGoroutine()
-		submitted := atomic.LoadInt64(&tasksSubmitted)
-		completed := atomic.LoadInt64(&tasksCompleted)
-		rejected := atomic.LoadInt64(&tasksRejected)
+		stats := pool.Stats()
 
-		fmt.Printf("[AFTER %v] Goroutines: %d  |  Submitted: %d  |  Completed: %d  |  Rejected: %d\n",
+		fmt.Printf("[AFTER %v] Goroutines: %d  |  Submitted: %d  |  In flight: %d  |  Completed: %d  |  Rejected: %d\n",
 			time.Since(start).Round(time.Second),
 			goroutines,
-			submitted,
-			completed,
-			rejected)
+			stats.TasksSubmitted,
+			stats.TasksInFlight,
+			stats.TasksCompleted,
+			stats.TasksRejected)
+		fmt.Printf("           %s\n", gcpercent.Stats())
+		fmt.Printf("           Workers running task=spike: %d  |  Backpressure signals: %d\n",
+			countLabeled("task", "spike"), atomic.LoadInt64(&backpressureSignals))
+		fmt.Printf("           /readyz: %s\n", readyzStatus())
 
 		if goroutines <= initialGoroutines+10 {
 			fmt.Println("Goroutines stable! Worker pool bounded at 100.")
@@ -120,37 +949,164 @@ func main() {
 
 	fmt.Println("\nNo leak! Goroutine count remained stable.")
 	fmt.Printf("Final goroutine count: %d\n", runtime.NumGoroutine())
-	fmt.Printf("Total tasks: submitted=%d, completed=%d, rejected=%d\n",
-		atomic.LoadInt64(&tasksSubmitted),
-		atomic.LoadInt64(&tasksCompleted),
-		atomic.LoadInt64(&tasksRejected))
+	stats := pool.Stats()
+	fmt.Printf("Total tasks: submitted=%d, completed=%d, rejected=%d, panicked=%d\n",
+		stats.TasksSubmitted, stats.TasksCompleted, stats.TasksRejected, stats.TasksPanicked)
 	fmt.Println("Press Ctrl+C to stop")
 
 	select {}
 }
 
-// simulateTrafficSpike creates tasks at a high rate
+// simulateTrafficSpike creates tasks at a high rate. It runs under a
+// caller=simulateTrafficSpike pprof label, which SubmitLabeled carries over
+// to the workers together with task=spike.
 func simulateTrafficSpike(pool *WorkerPool) {
 	ticker := time.NewTicker(1 * time.Millisecond) // 1000 tasks/second
 	defer ticker.Stop()
 
-	for range ticker.C {
-		// FIX: Submit to bounded pool
-		// Returns false if pool is full (backpressure)
-		task := func() {
-			processTaskCorrectly()
+	pprof.Do(context.Background(), pprof.Labels("caller", "simulateTrafficSpike"), func(ctx context.Context) {
+		for range ticker.C {
+			// FIX: Submit to bounded pool
+			// Returns false if pool is full (backpressure); Stats counts both
+			task := func() {
+				processTaskCorrectly()
+			}
+
+			pool.SubmitLabeled(ctx, task, pprof.Labels("task", "spike"))
 		}
+	})
+}
 
-		if pool.Submit(task) {
-			atomic.AddInt64(&tasksSubmitted, 1)
-		} else {
-			atomic.AddInt64(&tasksRejected, 1)
+// readyzStatus fetches /readyz from the pprof server and returns its status
+// line and body
+func readyzStatus() string {
+	resp, err := http.Get("http://localhost:6061/readyz")
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// countLabeled counts goroutines carrying the pprof label key=value, read from
+// the same goroutine profile /debug/pprof/goroutine?debug=1 serves
+func countLabeled(key, value string) int {
+	var buf strings.Builder
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+
+	// Each record starts with "<count> @ <pcs>", followed by its labels
+	want := fmt.Sprintf("%q:%q", key, value)
+	total, count := 0, 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if n, _, ok := strings.Cut(line, " @ "); ok {
+			count, _ = strconv.Atoi(n)
+		} else if strings.HasPrefix(line, "# labels: ") && strings.Contains(line, want) {
+			total += count
+		}
+	}
+	return total
+}
+
+// countedWords are the words wordCountLines builds its lines from
+var countedWords = []string{"goroutine", "channel", "leak", "pool", "defer", "context", "mutex", "heap"}
+
+// wordCountLines returns n deterministic lines of 12 countedWords each
+func wordCountLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		var b strings.Builder
+		for j := 0; j < 12; j++ {
+			if j > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(countedWords[(i*7+j*3)%len(countedWords)])
 		}
+		lines[i] = b.String()
+	}
+	return lines
+}
+
+// demonstrateWordCount counts words across 100K lines with Reduce and checks
+// the result against a sequential map-reduce. BenchmarkWordCount compares
+// the two.
+func demonstrateWordCount() {
+	pool, err := NewWorkerPool(runtime.NumCPU(), 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+
+	words := countedWords
+	lines := wordCountLines(100_000)
+
+	ctx := context.Background()
+	counts, err := Reduce(ctx, pool, lines, countWords, sumCounts, map[string]int{})
+	if err != nil {
+		fmt.Printf("Reduce failed: %v\n", err)
+		return
+	}
+	want := sequentialWordCount(lines)
+
+	fmt.Printf("Word counts over %d lines with %d workers:\n", len(lines), pool.Workers())
+	for _, w := range words {
+		fmt.Printf("  %-10s %d\n", w, counts[w])
+	}
+	if reflect.DeepEqual(counts, want) {
+		fmt.Println("✓ Reduce matches the sequential map-reduce")
+	} else {
+		fmt.Println("✗ Reduce differs from the sequential map-reduce")
+	}
+
+	fmt.Println("\nRun go test -bench BenchmarkWordCount for the speedup over the sequential version.")
+}
+
+// countWords maps one line to its word counts
+func countWords(line string) map[string]int {
+	counts := make(map[string]int)
+	for _, w := range strings.Fields(line) {
+		counts[w]++
+	}
+	return counts
+}
+
+// sumCounts merges the smaller map into the larger one and returns it.
+// Reduce never uses a value again after passing it to the reducer, so
+// reusing an argument's storage is safe.
+func sumCounts(a, b map[string]int) map[string]int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	for w, n := range b {
+		a[w] += n
+	}
+	return a
+}
+
+// sequentialWordCount is the single-goroutine baseline for Reduce
+func sequentialWordCount(lines []string) map[string]int {
+	acc := map[string]int{}
+	for _, line := range lines {
+		acc = sumCounts(acc, countWords(line))
 	}
+	return acc
 }
 
 // processTaskCorrectly simulates a slow task that takes 5 seconds
 func processTaskCorrectly() {
 	time.Sleep(5 * time.Second)
-	atomic.AddInt64(&tasksCompleted, 1)
+}
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
 }
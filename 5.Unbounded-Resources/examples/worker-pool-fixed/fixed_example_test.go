@@ -0,0 +1,929 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/future"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutinequota"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+)
+
+func TestNewWorkerPoolRejectsBadSizes(t *testing.T) {
+	for _, tc := range []struct{ workers, queue int }{{0, 10}, {-1, 10}, {4, -1}} {
+		if pool, err := NewWorkerPool(tc.workers, tc.queue); err == nil {
+			pool.Close()
+			t.Errorf("NewWorkerPool(%d, %d) returned no error", tc.workers, tc.queue)
+		}
+	}
+}
+
+func TestUnbufferedQueueOccupancy(t *testing.T) {
+	pool, err := NewWorkerPool(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if got := pool.QueueOccupancy(); got != 0 {
+		t.Errorf("QueueOccupancy with queue size 0 = %v, want 0", got)
+	}
+}
+
+// An unbuffered pool's Summary must still encode: json refuses NaN, which
+// would take down /debug/summary for the whole process
+func TestUnbufferedSummaryEncodes(t *testing.T) {
+	pool, err := NewWorkerPool(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	summary := pool.Summary()
+	if got := summary["queue_occupancy"]; got != 0.0 {
+		t.Errorf("queue_occupancy = %v, want 0", got)
+	}
+	if _, err := json.Marshal(summary); err != nil {
+		t.Errorf("json.Marshal(Summary()): %v", err)
+	}
+}
+
+func TestChaosNonPositiveDelay(t *testing.T) {
+	for _, maxDelayMs := range []int{0, -1, -100} {
+		// failureRate 2 takes the delay branch and then the failure every time
+		task := (&chaosConfig{failureRate: 2, maxDelayMs: maxDelayMs}).wrap(func() {})
+		func() {
+			defer func() {
+				if r := recover(); r != "chaos: injected task failure" {
+					t.Errorf("maxDelayMs %d: panic %v, want only the injected failure", maxDelayMs, r)
+				}
+			}()
+			task()
+		}()
+	}
+}
+
+func TestReduceMatchesSequential(t *testing.T) {
+	pool, err := NewWorkerPool(runtime.NumCPU(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	lines := wordCountLines(10_000)
+	counts, err := Reduce(context.Background(), pool, lines, countWords, sumCounts, map[string]int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sequentialWordCount(lines); !reflect.DeepEqual(counts, want) {
+		t.Errorf("Reduce = %v, want the sequential map-reduce's %v", counts, want)
+	}
+}
+
+// TestGoroutineQuota runs two pools that share one Quota: label A is limited
+// to 2 of its 8 workers, label B may use all 8. It measures B's throughput
+// alone, then next to a saturated A, and checks that A's limit holds without
+// slowing B and that every task either pool accepted still runs.
+func TestGoroutineQuota(t *testing.T) {
+	if testing.Short() {
+		t.Skip("floods two pools for two seconds")
+	}
+	const (
+		workers  = 8
+		limitA   = 2
+		taskTime = 5 * time.Millisecond
+		run      = time.Second
+	)
+
+	q := goroutinequota.New(workers)
+	q.SetLimit("A", limitA)
+
+	// flood keeps pool's queue full of taskTime tasks for run and returns how
+	// many completed. peak records the most tasks label had running at once.
+	flood := func(pool *WorkerPool, label string, peak *int64) int64 {
+		ctx, cancel := context.WithTimeout(context.Background(), run)
+		defer cancel()
+
+		var completed int64
+		for ctx.Err() == nil {
+			pool.enqueue(ctx, func() {
+				n := int64(q.Running(label))
+				for {
+					cur := atomic.LoadInt64(peak)
+					if n <= cur || atomic.CompareAndSwapInt64(peak, cur, n) {
+						break
+					}
+				}
+				time.Sleep(taskTime)
+				atomic.AddInt64(&completed, 1)
+			})
+		}
+		return atomic.LoadInt64(&completed)
+	}
+
+	var peakA, peakB int64
+	poolB, err := NewWorkerPool(workers, workers, WithGoroutineQuota(q, "B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poolB.Close()
+	alone := flood(poolB, "B", &peakB)
+
+	poolA, err := NewWorkerPool(workers, workers, WithGoroutineQuota(q, "A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poolA.Close()
+
+	var completedA int64
+	done := make(chan struct{})
+	go func() {
+		completedA = flood(poolA, "A", &peakA)
+		close(done)
+	}()
+	shared := flood(poolB, "B", &peakB)
+	<-done
+
+	// Tasks still queued or waiting for a slot when flood stopped must run
+	// too; over-quota tasks are delayed, not dropped
+	finished := func(pool *WorkerPool) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if s := pool.Stats(); s.TasksCompleted == s.TasksSubmitted {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	t.Logf("B alone: %d tasks; B next to A: %d tasks; A: %d tasks, %d waited for a slot",
+		alone, shared, completedA, poolA.OverQuota())
+
+	if peak := atomic.LoadInt64(&peakA); peak > limitA {
+		t.Errorf("A ran %d tasks at once, want at most %d", peak, limitA)
+	}
+	if poolA.OverQuota() == 0 {
+		t.Error("A never waited for a slot")
+	}
+	if !finished(poolA) {
+		t.Error("not every task A accepted ran")
+	}
+	if float64(shared) < 0.9*float64(alone) {
+		t.Errorf("B completed %d tasks next to A, %d alone; want at least 90%%", shared, alone)
+	}
+	if got := poolB.OverQuota(); got != 0 {
+		t.Errorf("B waited for a slot %d times, want 0", got)
+	}
+	if !finished(poolB) {
+		t.Error("not every task B accepted ran")
+	}
+}
+
+// TestFutures submits a batch of tasks through future.Submit without waiting
+// on any of them, then collects every result through its Future
+func TestFutures(t *testing.T) {
+	const (
+		workers   = 8
+		taskCount = 100
+		taskTime  = 10 * time.Millisecond
+	)
+	pool, err := NewWorkerPool(workers, taskCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// Fire and forget: every submit returns at once
+	errSeventh := errors.New("multiple of 7")
+	start := time.Now()
+	futures := make([]*future.Future[int], 0, taskCount)
+	for i := range taskCount {
+		f, accepted := future.Submit(pool.Submit, func() (int, error) {
+			time.Sleep(taskTime)
+			if i%7 == 0 {
+				return 0, fmt.Errorf("task %d: %w", i, errSeventh)
+			}
+			return i * i, nil
+		})
+		if !accepted {
+			t.Fatalf("task %d rejected", i)
+		}
+		futures = append(futures, f)
+	}
+	if submitTime := time.Since(start); submitTime >= taskTime {
+		t.Errorf("submitting %d tasks took %v, want under one task's %v", taskCount, submitTime, taskTime)
+	}
+
+	// Then collect, each under its own 5-second deadline
+	var sum, want, failed int
+	for i, f := range futures {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		v, err := f.Get(ctx)
+		cancel()
+		switch {
+		case errors.Is(err, errSeventh):
+			failed++
+		case err != nil:
+			t.Errorf("task %d: %v", i, err)
+		default:
+			sum += v
+		}
+		if i%7 != 0 {
+			want += i * i
+		}
+	}
+	if sum != want {
+		t.Errorf("sum of results = %d, want %d", sum, want)
+	}
+	if want := (taskCount + 6) / 7; failed != want {
+		t.Errorf("%d task errors came back through Get, want %d", failed, want)
+	}
+	if depth := pool.QueueDepth(); depth != 0 {
+		t.Errorf("QueueDepth = %d after every Get, want 0", depth)
+	}
+}
+
+// TestReadyz serves health.WorkerPoolCheck for a two-worker pool and checks
+// that it answers 200 while the pool keeps up, 503 once the pool is flooded,
+// and 503 for the rejection rate alone after the queue drains
+func TestReadyz(t *testing.T) {
+	const (
+		queueSize = 10
+		flood     = 100
+	)
+	pool, err := NewWorkerPool(2, queueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	handler := health.ReadyHandler(health.WorkerPoolCheck(pool, 0.8, 0.1))
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+
+	var done sync.WaitGroup
+	for range 20 {
+		done.Add(1)
+		for !pool.Submit(done.Done) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	done.Wait()
+	if code, body := get(); code != http.StatusOK {
+		t.Errorf("keeping up: %d %s, want 200", code, body)
+	}
+
+	// Park both workers and fill the queue behind them, then keep submitting
+	release := make(chan struct{})
+	for range 2 + queueSize {
+		done.Add(1)
+		for !pool.Submit(func() {
+			defer done.Done()
+			<-release
+		}) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for pool.Stats().TasksInFlight < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	rejected := 0
+	for range flood {
+		if !pool.Submit(func() {}) {
+			rejected++
+		}
+	}
+	code, body := get()
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "queue 100% full") || !strings.Contains(body, "rejected") {
+		t.Errorf("overloaded (%d of %d rejected): %d %s, want 503 for both the queue and rejections", rejected, flood, code, body)
+	}
+
+	close(release)
+	done.Wait()
+	for pool.QueueDepth() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	code, body = get()
+	if code != http.StatusServiceUnavailable || strings.Contains(body, "queue") {
+		t.Errorf("drained: %d %s, want 503 for the rejection rate alone", code, body)
+	}
+}
+
+// A rejection counts toward RejectionRate for rejectionWindow and then ages
+// out
+func TestSubmitWindowAgesOut(t *testing.T) {
+	var w submitWindow
+	t0 := time.Unix(1000, 0)
+	w.record(t0, false)
+	w.record(t0.Add(5*time.Second), true)
+	if _, rejected := w.totals(t0.Add(rejectionWindow - time.Second)); rejected != 1 {
+		t.Errorf("rejected inside the window = %d, want 1", rejected)
+	}
+	if submitted, rejected := w.totals(t0.Add(rejectionWindow)); submitted != 1 || rejected != 0 {
+		t.Errorf("after the window: %d submitted, %d rejected, want 1 and 0", submitted, rejected)
+	}
+}
+
+// BenchmarkWordCount counts words across 100K lines with Reduce on a pool of
+// NumCPU workers and sequentially. The speedup is roughly the number of
+// CPUs; on one CPU the two are equal.
+func BenchmarkWordCount(b *testing.B) {
+	lines := wordCountLines(100_000)
+
+	b.Run("Reduce", func(b *testing.B) {
+		pool, err := NewWorkerPool(runtime.NumCPU(), 64)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pool.Close()
+		ctx := context.Background()
+		b.ReportAllocs()
+		for b.Loop() {
+			Reduce(ctx, pool, lines, countWords, sumCounts, map[string]int{})
+		}
+	})
+	b.Run("Sequential", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			sequentialWordCount(lines)
+		}
+	})
+}
+
+// check reports desc as a failure of t unless pass
+func check(t *testing.T, desc string, pass bool) {
+	t.Helper()
+	if !pass {
+		t.Error(desc)
+	}
+}
+
+// TestBackpressure fills a one-worker pool, floods it with Submits for
+// one second and checks that OnBackpressure fired about once per interval
+// rather than once per rejected task.
+func TestBackpressure(t *testing.T) {
+	const (
+		interval = 100 * time.Millisecond
+		flood    = time.Second
+	)
+
+	var signals int64
+	var lastLen, lastCap int64
+	pool, err := NewWorkerPool(1, 10, OnBackpressure(func(queueLen, queueCap int) {
+		atomic.AddInt64(&signals, 1)
+		atomic.StoreInt64(&lastLen, int64(queueLen))
+		atomic.StoreInt64(&lastCap, int64(queueCap))
+	}, interval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// Park the only worker so the queue fills and stays full
+	release := make(chan struct{})
+	pool.Submit(func() { <-release })
+	defer close(release)
+
+	t.Logf("Flooding a full pool (1 worker, queue 10) for %v, callback interval %v", flood, interval)
+	rejected := 0
+	start := time.Now()
+	for time.Since(start) < flood {
+		if !pool.Submit(func() {}) {
+			rejected++
+		}
+	}
+	elapsed := time.Since(start)
+
+	got := atomic.LoadInt64(&signals)
+	maxSignals := int64(elapsed/interval) + 1
+	t.Logf("Rejected: %d  |  Backpressure signals: %d  |  Last signal: queue %d/%d",
+		rejected, got, atomic.LoadInt64(&lastLen), atomic.LoadInt64(&lastCap))
+	check(t, fmt.Sprintf("OnBackpressure fired while the pool was saturated (%d signals)", got), got >= 1)
+	check(t, fmt.Sprintf("Throttled: at most one signal per %v (%d for %d rejections, limit %d), not one per rejection",
+		interval, got, rejected, maxSignals), got <= maxSignals && int64(rejected) > got)
+}
+
+// TestForEach runs the same slow items through ForEach and Reduce to
+// show when the first result becomes usable, then checks that an error stops
+// ForEach early without leaking its goroutines.
+func TestForEach(t *testing.T) {
+	const (
+		workers   = 4
+		itemCount = 40
+		itemTime  = 10 * time.Millisecond
+	)
+	pool, err := NewWorkerPool(workers, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	baseline := runtime.NumGoroutine()
+
+	items := make([]int, itemCount)
+	for i := range items {
+		items[i] = i
+	}
+	square := func(i int) (int, error) {
+		time.Sleep(itemTime)
+		return i * i, nil
+	}
+
+	// ForEach: each sees results while later items are still running
+	start := time.Now()
+	var (
+		firstResult time.Duration
+		sum, calls  int
+		inEach      int32
+		overlapped  bool
+	)
+	err = ForEach(context.Background(), pool, items, square, func(sq int) {
+		if !atomic.CompareAndSwapInt32(&inEach, 0, 1) {
+			overlapped = true
+		}
+		if calls == 0 {
+			firstResult = time.Since(start)
+		}
+		calls++
+		sum += sq
+		atomic.StoreInt32(&inEach, 0)
+	})
+	forEachTotal := time.Since(start)
+
+	// Reduce: nothing is usable until the whole sum is
+	start = time.Now()
+	reduced, _ := Reduce(context.Background(), pool, items,
+		func(i int) int { sq, _ := square(i); return sq },
+		func(a, b int) int { return a + b }, 0)
+	reduceTotal := time.Since(start)
+
+	t.Logf("%d items, %v each, %d workers", itemCount, itemTime, workers)
+	t.Logf("ForEach: first result after %v, all %d after %v",
+		firstResult.Round(time.Millisecond), calls, forEachTotal.Round(time.Millisecond))
+	t.Logf("Reduce:  sum %d available only after %v", reduced, reduceTotal.Round(time.Millisecond))
+
+	check(t, fmt.Sprintf("each called for all %d results, sum %d matches Reduce", itemCount, sum),
+		err == nil && calls == itemCount && sum == reduced)
+	check(t, "each never ran concurrently with itself", !overlapped)
+	check(t, fmt.Sprintf("first result arrived in %v, before a quarter of the run",
+		firstResult.Round(time.Millisecond)), firstResult < forEachTotal/4)
+
+	// The first error cancels the items that haven't started
+	errBad := errors.New("bad item")
+	var started int64
+	calls = 0
+	err = ForEach(context.Background(), pool, items, func(i int) (int, error) {
+		atomic.AddInt64(&started, 1)
+		time.Sleep(itemTime)
+		if i == 5 {
+			return 0, errBad
+		}
+		return i, nil
+	}, func(int) { calls++ })
+	check(t, fmt.Sprintf("the error is returned: %v", err), errors.Is(err, errBad))
+	check(t, fmt.Sprintf("only %d of %d items started before the error stopped ForEach", atomic.LoadInt64(&started), itemCount),
+		atomic.LoadInt64(&started) < itemCount/2)
+
+	// A panic becomes the error
+	err = ForEach(context.Background(), pool, items[:3], func(i int) (int, error) {
+		if i == 1 {
+			panic("boom")
+		}
+		return i, nil
+	}, func(int) {})
+	check(t, fmt.Sprintf("a panic in fn is returned as an error: %v", err), err != nil && strings.Contains(err.Error(), "boom"))
+
+	time.Sleep(50 * time.Millisecond)
+	leaked := runtime.NumGoroutine() - baseline
+	check(t, fmt.Sprintf("goroutines back to baseline (%+d)", leaked), leaked <= 0)
+}
+
+// session is one user's state in TestAffinity. With affinity only the
+// user's own worker touches it and plain fields would do; the counters are
+// atomic so the Submit run can measure the interleaving without a data race.
+type session struct {
+	applied []int32 // applied[e] is the position event e was applied at, from 1
+	seq     int32   // events applied so far
+	running int32   // tasks for this user in progress
+	overlap int32   // set when a second task for this user started while one was running
+}
+
+// serial reports whether the user's tasks never overlapped
+func (s *session) serial() bool {
+	return atomic.LoadInt32(&s.overlap) == 0
+}
+
+// inOrder reports whether every event was applied, in submission order
+func (s *session) inOrder() bool {
+	for e := range s.applied {
+		if atomic.LoadInt32(&s.applied[e]) != int32(e+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestAffinity feeds every user's events to a session processor twice:
+// through Submit, where any worker may pick up any event, and through
+// SubmitAffinized keyed by user. It checks that with affinity each user's
+// events are applied serially and in order while different users still run
+// in parallel.
+func TestAffinity(t *testing.T) {
+	const (
+		workers       = 8
+		users         = 16
+		eventsPerUser = 50
+		eventTime     = time.Millisecond
+	)
+
+	type result struct {
+		serial, ordered int
+		rejected        int
+		maxParallel     int32
+		elapsed         time.Duration
+		queuedOnUser0   int // AffinityLen("user-00") once everything is submitted
+	}
+
+	run := func(submit func(p *WorkerPool, user string, task func()) bool) result {
+		// Room for every event on one worker, so hashing skew can't reject any
+		pool, err := NewWorkerPool(workers, workers*users*eventsPerUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+
+		sessions := make(map[string]*session, users)
+		for u := 0; u < users; u++ {
+			sessions[fmt.Sprintf("user-%02d", u)] = &session{applied: make([]int32, eventsPerUser)}
+		}
+
+		var (
+			res                  result
+			wg                   sync.WaitGroup
+			running, maxParallel int32
+		)
+		// Each user's events arrive as a burst, as a session's would
+		start := time.Now()
+		for u := 0; u < users; u++ {
+			for e := 0; e < eventsPerUser; e++ {
+				user := fmt.Sprintf("user-%02d", u)
+				s, e := sessions[user], e
+				wg.Add(1)
+				task := func() {
+					defer wg.Done()
+					if atomic.AddInt32(&s.running, 1) > 1 {
+						atomic.StoreInt32(&s.overlap, 1)
+					}
+					if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxParallel) {
+						atomic.StoreInt32(&maxParallel, n)
+					}
+					time.Sleep(eventTime)
+					atomic.StoreInt32(&s.applied[e], atomic.AddInt32(&s.seq, 1))
+					atomic.AddInt32(&running, -1)
+					atomic.AddInt32(&s.running, -1)
+				}
+				if !submit(pool, user, task) {
+					res.rejected++
+					wg.Done()
+				}
+			}
+		}
+		res.queuedOnUser0 = pool.AffinityLen("user-00")
+		wg.Wait()
+
+		res.elapsed = time.Since(start)
+		res.maxParallel = atomic.LoadInt32(&maxParallel)
+		for _, s := range sessions {
+			if s.serial() {
+				res.serial++
+			}
+			if s.inOrder() {
+				res.ordered++
+			}
+		}
+		return res
+	}
+
+	t.Logf("%d users x %d events, %v each, %d workers", users, eventsPerUser, eventTime, workers)
+
+	shared := run(func(p *WorkerPool, _ string, task func()) bool {
+		return p.Submit(task)
+	})
+	affine := run(func(p *WorkerPool, user string, task func()) bool {
+		return p.SubmitAffinized(user, task)
+	})
+	for _, r := range []struct {
+		name string
+		res  result
+	}{{"Submit", shared}, {"SubmitAffinized", affine}} {
+		t.Logf("%-16s %2d/%d users serial  |  %2d/%d in order  |  up to %d events in parallel  |  %v",
+			r.name+":", r.res.serial, users, r.res.ordered, users, r.res.maxParallel, r.res.elapsed.Round(time.Millisecond))
+	}
+	t.Logf("AffinityLen(%q) after submitting: %d (its worker's whole backlog)", "user-00", affine.queuedOnUser0)
+
+	check(t, fmt.Sprintf("no task was rejected (%d, %d)", shared.rejected, affine.rejected), shared.rejected == 0 && affine.rejected == 0)
+	check(t, fmt.Sprintf("without affinity, users' events overlapped (%d/%d users serial)", shared.serial, users), shared.serial < users)
+	check(t, fmt.Sprintf("with affinity every user's events ran one at a time (%d/%d)", affine.serial, users), affine.serial == users)
+	check(t, fmt.Sprintf("with affinity every user's events were applied in order (%d/%d)", affine.ordered, users), affine.ordered == users)
+	check(t, fmt.Sprintf("different users still ran in parallel: up to %d at once", affine.maxParallel), affine.maxParallel > 1)
+}
+
+// eventFeed stands in for channel-buffer-fixed's EventProcessor: a bounded
+// buffer of events, dispatched into the pool by one goroutine
+type eventFeed struct {
+	events chan int
+}
+
+// Backlog returns how many events are buffered and not yet handed to the pool
+func (f *eventFeed) Backlog() int {
+	return len(f.events)
+}
+
+// dispatch moves events into pool as fast as it accepts them. enqueue blocks
+// rather than rejecting, so a slow pool shows up as a growing feed backlog.
+func (f *eventFeed) dispatch(pool *WorkerPool, handle func(int)) {
+	for e := range f.events {
+		e := e
+		if pool.enqueue(context.Background(), func() { handle(e) }) != nil {
+			return
+		}
+	}
+}
+
+// TestAutoscaler queues a burst of events into an eventFeed feeding an
+// autoscaled pool, reports workers and backlog as it drains, then checks that
+// the pool grew for the burst and shrank back to its minimum once idle. It
+func TestAutoscaler(t *testing.T) {
+	const (
+		burst     = 2000
+		eventTime = 5 * time.Millisecond
+	)
+	cfg := AutoscalerConfig{
+		MinWorkers:  2,
+		MaxWorkers:  32,
+		ScaleUpAt:   100,
+		ScaleDownAt: 10,
+		Step:        4,
+		Interval:    50 * time.Millisecond,
+	}
+
+	baseline := runtime.NumGoroutine()
+	pool, err := NewWorkerPool(cfg.MinWorkers, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := &eventFeed{events: make(chan int, burst)}
+	scaler := NewAutoscaler(pool, feed, cfg)
+
+	var handled int64
+	go feed.dispatch(pool, func(int) {
+		time.Sleep(eventTime)
+		atomic.AddInt64(&handled, 1)
+	})
+
+	t.Logf("Burst of %d events, %v each, %d-%d workers", burst, eventTime, cfg.MinWorkers, cfg.MaxWorkers)
+	start := time.Now()
+	for i := 0; i < burst; i++ {
+		feed.events <- i
+	}
+
+	// Report until the burst is handled and the pool is back at its minimum
+	var drained time.Duration
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		n := atomic.LoadInt64(&handled)
+		t.Logf("[%5v] Workers: %2d  |  Backlog: %4d  |  Handled: %d",
+			time.Since(start).Round(10*time.Millisecond), pool.Workers(), feed.Backlog()+pool.QueueDepth(), n)
+		if n == burst && drained == 0 {
+			drained = time.Since(start)
+		}
+		if drained != 0 && pool.Workers() == cfg.MinWorkers {
+			break
+		}
+	}
+	scaler.Stop()
+	close(feed.events)
+
+	peak := atomic.LoadInt64(&scaler.peakWorkers)
+	serial := time.Duration(burst/cfg.MinWorkers) * eventTime
+	t.Logf("Peak workers: %d  |  Scale ups: %d  |  Scale downs: %d",
+		peak, atomic.LoadInt64(&scaler.scaleUps), atomic.LoadInt64(&scaler.scaleDowns))
+	t.Logf("Drained in %v; %d fixed workers would need about %v",
+		drained.Round(10*time.Millisecond), cfg.MinWorkers, serial)
+
+	check(t, fmt.Sprintf("the pool grew for the burst: peak %d workers (max %d)", peak, cfg.MaxWorkers),
+		peak > int64(cfg.MinWorkers))
+	check(t, fmt.Sprintf("all %d events handled in %v, under half the fixed-size time", burst, drained.Round(10*time.Millisecond)),
+		drained != 0 && drained < serial/2)
+	check(t, fmt.Sprintf("the pool shrank back to %d workers once idle (now %d)", cfg.MinWorkers, pool.Workers()),
+		pool.Workers() == cfg.MinWorkers)
+
+	pool.Close()
+	time.Sleep(50 * time.Millisecond)
+	leaked := runtime.NumGoroutine() - baseline
+	check(t, fmt.Sprintf("goroutines back to baseline after Close (%+d)", leaked), leaked <= 0)
+}
+
+// TestStats parks both workers of a pool with a queue of 4, fills the
+// queue, submits 3 more and checks Stats, WorkerPoolCheck and Summary while
+// the pool is full. It then releases the tasks, one of which panics, and
+// checks the final counts.
+func TestStats(t *testing.T) {
+	const (
+		workers   = 2
+		queueSize = 4
+		extra     = 3
+	)
+
+	show := func(label string, s WorkerPoolStats) {
+		t.Logf("%-8s %+v", label+":", s)
+	}
+
+	pool, err := NewWorkerPool(workers, queueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	s := pool.Stats()
+	show("idle", s)
+	check(t, "an idle pool reports its size and nothing else",
+		s.Workers == workers && s.QueueCap == queueSize && s.QueueLen == 0 && s.TasksSubmitted == 0 && s.TasksInFlight == 0)
+
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	for i := 0; i < workers+queueSize; i++ {
+		done.Add(1)
+		panics := i == workers+queueSize-1
+		pool.Submit(func() {
+			defer done.Done()
+			<-release
+			if panics {
+				panic("boom")
+			}
+		})
+		// Let a worker pick each of the first tasks up before queueing more
+		for i < workers && pool.Stats().TasksInFlight <= i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	rejected := 0
+	for i := 0; i < extra; i++ {
+		if !pool.Submit(func() {}) {
+			rejected++
+		}
+	}
+	s = pool.Stats()
+	show("full", s)
+	check(t, fmt.Sprintf("full: %d in flight, %d queued, %d submitted, %d rejected", s.TasksInFlight, s.QueueLen, s.TasksSubmitted, s.TasksRejected),
+		s.TasksInFlight == workers && s.QueueLen == queueSize && s.TasksSubmitted == workers+queueSize &&
+			s.TasksRejected == extra && rejected == extra && s.TasksCompleted == 0)
+
+	err = health.WorkerPoolCheck(pool, 0.8, 1).Run()
+	check(t, fmt.Sprintf("WorkerPoolCheck reads the same snapshot (%v)", err),
+		err != nil && strings.Contains(err.Error(), fmt.Sprintf("%d of %d workers busy", workers, workers)))
+	summary := pool.Summary()
+	check(t, fmt.Sprintf("Summary carries the task counts (submitted %v, rejected %v, in flight %v)",
+		summary["tasks_submitted"], summary["tasks_rejected"], summary["tasks_in_flight"]),
+		summary["tasks_submitted"] == int64(workers+queueSize) && summary["tasks_rejected"] == int64(extra) &&
+			summary["tasks_in_flight"] == workers)
+
+	close(release)
+	done.Wait()
+	for pool.Stats().TasksInFlight > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s = pool.Stats()
+	show("drained", s)
+	check(t, fmt.Sprintf("drained: %d completed, %d panicked, nothing queued or in flight", s.TasksCompleted, s.TasksPanicked),
+		s.TasksCompleted == workers+queueSize-1 && s.TasksPanicked == 1 && s.QueueLen == 0 && s.TasksInFlight == 0)
+	check(t, fmt.Sprintf("uptime counts from NewWorkerPool (%.3fs)", s.UptimeSeconds), s.UptimeSeconds > 0)
+}
+
+// TestChaos pushes 10k tasks through a pool whose chaos is forced on,
+// whatever the build tag and WORKER_POOL_CHAOS say. It checks that every
+// accepted task either completed or panicked, then parks one task per worker
+// to prove none of them died with its panic.
+func TestChaos(t *testing.T) {
+	const (
+		workers     = 16
+		queueSize   = 256
+		tasks       = 10000
+		failureRate = 0.1
+		maxDelayMs  = 5
+	)
+
+	pool, err := NewWorkerPool(workers, queueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.chaos = &chaosConfig{failureRate: failureRate, maxDelayMs: maxDelayMs}
+
+	start := time.Now()
+	var ran int64
+	for i := 0; i < tasks; i++ {
+		for !pool.Submit(func() { atomic.AddInt64(&ran, 1) }) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	s := pool.Stats()
+	for s.TasksCompleted+s.TasksPanicked < s.TasksSubmitted && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		s = pool.Stats()
+	}
+	t.Logf("Chaos: %.0f%% failures, up to %dms stalls; %d workers, %d tasks in %v",
+		100*failureRate, maxDelayMs, workers, tasks, time.Since(start).Round(time.Millisecond))
+	t.Logf("Submitted: %d  |  Completed: %d  |  Panicked: %d  |  Rejected and retried: %d",
+		s.TasksSubmitted, s.TasksCompleted, s.TasksPanicked, s.TasksRejected)
+
+	check(t, fmt.Sprintf("all %d tasks were accepted", tasks), s.TasksSubmitted == tasks)
+	check(t, fmt.Sprintf("completed + panicked == submitted (%d + %d == %d)", s.TasksCompleted, s.TasksPanicked, s.TasksSubmitted),
+		s.TasksCompleted+s.TasksPanicked == s.TasksSubmitted)
+	check(t, fmt.Sprintf("chaos fired (%d panics) and every task that didn't panic ran (%d)", s.TasksPanicked, atomic.LoadInt64(&ran)),
+		s.TasksPanicked > 0 && atomic.LoadInt64(&ran) == s.TasksCompleted)
+
+	// enqueue skips chaos, so these can't panic; each one occupies a worker
+	// until release, so all of them in flight at once means no worker died
+	release := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		pool.enqueue(context.Background(), func() { <-release })
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for pool.Stats().TasksInFlight < workers && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	alive := pool.Stats().TasksInFlight
+	close(release)
+	check(t, fmt.Sprintf("all %d workers are alive (%d parked at once)", workers, alive), alive == workers)
+}
+
+// TestSLA runs 5ms tasks through a 4-worker pool, first one at a time
+// and then 200 at once, and checks MeetsSLA with a 50ms p99 target: true
+// while every task starts at once, false once most of them wait in the queue.
+func TestSLA(t *testing.T) {
+	const (
+		workers  = 4
+		taskTime = 5 * time.Millisecond
+		target   = 50 * time.Millisecond
+		burst    = 200
+	)
+
+	pool, err := NewWorkerPool(workers, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	task := func(wg *sync.WaitGroup) func() {
+		return func() {
+			defer wg.Done()
+			time.Sleep(taskTime)
+		}
+	}
+
+	check(t, fmt.Sprintf("an idle pool with nothing recorded meets a %v p99", target), pool.MeetsSLA(target))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		if !pool.Submit(task(&wg)) {
+			wg.Done()
+		}
+		time.Sleep(2 * taskTime)
+	}
+	wg.Wait()
+	light := pool.LatencyQuantile(0.99)
+	check(t, fmt.Sprintf("light load, one task per %v: p99 ≤%v meets the %v target", 2*taskTime, light, target),
+		pool.MeetsSLA(target))
+
+	pool.ResetLatency()
+	rejected := 0
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		if !pool.Submit(task(&wg)) {
+			wg.Done()
+			rejected++
+		}
+	}
+	wg.Wait()
+	overload := pool.LatencyQuantile(0.99)
+	check(t, fmt.Sprintf("overload, %d tasks at once on %d workers: p99 ≤%v misses it (%d rejected)", burst, workers, overload, rejected),
+		!pool.MeetsSLA(target) && rejected == 0)
+
+	pool.ResetLatency()
+	check(t, "ResetLatency starts a new interval that meets it again", pool.MeetsSLA(target) && pool.LatencyQuantile(0.99) == 0)
+}
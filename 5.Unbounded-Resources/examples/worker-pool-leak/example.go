@@ -1,12 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
 	"sync/atomic"
 	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/gcpercent"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
 )
 
 // This example demonstrates unbounded goroutine creation where
@@ -19,18 +25,25 @@ var (
 )
 
 func main() {
+	flag.Parse()
+	gcpercent.Apply()
+
 	// Start pprof server
 	go func() {
 		fmt.Println("pprof server running on http://localhost:6060")
 		fmt.Println("Collect goroutine profile: curl http://localhost:6060/debug/pprof/goroutine > goroutine.pprof")
 		fmt.Println()
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+		if err := http.ListenAndServe("localhost:6060", debugMux); err != nil {
 			fmt.Printf("pprof server error: %v\n", err)
 		}
 	}()
 
 	time.Sleep(100 * time.Millisecond)
 
+	// Serve leak indicators next to pprof, relative to this baseline
+	debugMux.HandleFunc("/healthz", health.Handler(health.Read()))
+	debugMux.HandleFunc("/debug/summary", summary.Handler())
+
 	fmt.Printf("[START] Goroutines: %d\n", runtime.NumGoroutine())
 	fmt.Println("Simulating traffic spike: 1000 tasks/second")
 	fmt.Println()
@@ -56,6 +69,7 @@ func main() {
 			goroutines,
 			submitted,
 			completed)
+		fmt.Printf("           %s\n", gcpercent.Stats())
 
 		if goroutines > 1000 {
 			fmt.Println("\nWARNING: Unbounded goroutine growth detected!")
@@ -90,3 +104,14 @@ func processTaskBadly() {
 	time.Sleep(5 * time.Second)
 	atomic.AddInt64(&tasksCompleted, 1)
 }
+
+// debugMux serves pprof, /healthz and the other debug endpoints. It is
+// passed to the pprof server explicitly instead of using
+// http.DefaultServeMux, so none of them leak onto another server.
+var debugMux = profiling.NewMux()
+
+// init adds /debug/leakreport, diffed against a baseline taken before main
+// runs
+func init() {
+	debugMux.HandleFunc("/debug/leakreport", leakreport.Handler(leakreport.Snapshot()))
+}
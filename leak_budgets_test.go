@@ -0,0 +1,215 @@
+// Package memoryleaks holds the repository-wide leak budget check. The
+// examples are separate package main programs, so the test builds and runs
+// each one rather than calling into it.
+package memoryleaks
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var checkLeaks = flag.Bool("leaks", false, "also run each leaky example and require it to go over its budget")
+
+// budget is one example's row in TestLeakBudgets. The tolerances apply to
+// the example's /debug/leakreport, whose baseline is taken before its main
+// runs. They sit well between the two versions of each pattern; see the
+// README for the measured values.
+type budget struct {
+	leaky      bool          // must go over budget, checked only with -leaks
+	file       string        // the example's main file, from the repo root
+	run        time.Duration // how long it runs before the report is read
+	goroutines int
+	heapMB     float64
+	fds        int
+	args       []string
+}
+
+// Not listed: mutex-loop, whose cost is lock contention rather than held
+// resources, and http-nodrain, whose cost is reconnects; http-nodrain-fixed's
+// TestDrainReuse covers that one.
+var budgets = []budget{
+	{false, "1.Goroutine-Leaks-Most-Common/examples/conn-read-fixed/fixed_example.go", 5 * time.Second, 30, 64, 50, nil},
+	{true, "1.Goroutine-Leaks-Most-Common/examples/conn-read-leak/example.go", 5 * time.Second, 30, 64, 50, nil},
+	{false, "1.Goroutine-Leaks-Most-Common/examples/goroutine-fixed/fixed_example.go", 4 * time.Second, 50, 64, 50, nil},
+	{true, "1.Goroutine-Leaks-Most-Common/examples/goroutine-leak/example.go", 4 * time.Second, 50, 64, 50, nil},
+	{false, "2.Long-Lived-References/examples/cache-fixed/fixed_cache.go", 6 * time.Second, 50, 16, 50, nil},
+	{true, "2.Long-Lived-References/examples/cache-leak/example_cache.go", 6 * time.Second, 50, 16, 50, nil},
+	{false, "2.Long-Lived-References/examples/context-fixed/fixed_context.go", 4 * time.Second, 50, 64, 50, nil},
+	{true, "2.Long-Lived-References/examples/context-leak/example_context.go", 4 * time.Second, 50, 64, 50, nil},
+	{false, "2.Long-Lived-References/examples/map-fixed/fixed_map.go", 6 * time.Second, 50, 64, 50, nil},
+	{true, "2.Long-Lived-References/examples/map-leak/example_map.go", 6 * time.Second, 50, 64, 50, nil},
+	{false, "2.Long-Lived-References/examples/reslicing-fixed/fixed_reslicing.go", 6 * time.Second, 50, 64, 50, nil},
+	{true, "2.Long-Lived-References/examples/reslicing-leak/example_reslicing.go", 6 * time.Second, 50, 64, 50, nil},
+	{false, "3.Resource-Leaks/examples/bufio-fixed/fixed_example.go", 4 * time.Second, 50, 64, 50, nil},
+	{true, "3.Resource-Leaks/examples/bufio-leak/example.go", 4 * time.Second, 50, 64, 50, nil},
+	{false, "3.Resource-Leaks/examples/download-fixed/fixed_example.go", 6 * time.Second, 40, 64, 20, nil},
+	{true, "3.Resource-Leaks/examples/download-leak/example.go", 6 * time.Second, 40, 64, 20, nil},
+	{false, "3.Resource-Leaks/examples/file-fixed/fixed_example.go", 4 * time.Second, 50, 64, 50, nil},
+	{true, "3.Resource-Leaks/examples/file-leak/example.go", 4 * time.Second, 50, 64, 50, nil},
+	{false, "3.Resource-Leaks/examples/hijack-fixed/fixed_example.go", 4 * time.Second, 50, 64, 50, nil},
+	{true, "3.Resource-Leaks/examples/hijack-leak/example.go", 4 * time.Second, 50, 64, 50, nil},
+	{false, "3.Resource-Leaks/examples/http-fixed/fixed_example.go", 5 * time.Second, 30, 64, 30, []string{"-endpoint", "/api/flaky?rate=0.3"}},
+	{true, "3.Resource-Leaks/examples/http-leak/example.go", 5 * time.Second, 30, 64, 30, []string{"-endpoint", "/api/flaky?rate=0.3"}},
+	{false, "3.Resource-Leaks/examples/http2-fixed/fixed_example.go", 4 * time.Second, 30, 64, 30, nil},
+	{true, "3.Resource-Leaks/examples/http2-leak/example.go", 4 * time.Second, 30, 64, 30, nil},
+	{false, "3.Resource-Leaks/examples/proxy-fixed/fixed_example.go", 8 * time.Second, 120, 64, 55, nil},
+	{true, "3.Resource-Leaks/examples/proxy-leak/example.go", 8 * time.Second, 120, 64, 55, nil},
+	{false, "4.Defer-Issues/examples/loop-fixed/fixed_example.go", 3 * time.Second, 50, 64, 50, nil},
+	{true, "4.Defer-Issues/examples/loop-leak/example.go", 3 * time.Second, 50, 64, 50, nil},
+	{false, "4.Defer-Issues/examples/tx-loop-fixed/fixed_example.go", 4 * time.Second, 8, 64, 50, nil},
+	{true, "4.Defer-Issues/examples/tx-loop-leak/example.go", 4 * time.Second, 8, 64, 50, nil},
+	{false, "5.Unbounded-Resources/examples/channel-buffer-fixed/fixed_example.go", 6 * time.Second, 50, 32, 50, nil},
+	{true, "5.Unbounded-Resources/examples/channel-buffer-leak/example.go", 6 * time.Second, 50, 32, 50, nil},
+	{false, "5.Unbounded-Resources/examples/worker-pool-fixed/fixed_example.go", 4 * time.Second, 500, 64, 50, nil},
+	{true, "5.Unbounded-Resources/examples/worker-pool-leak/example.go", 4 * time.Second, 500, 64, 50, nil},
+}
+
+// readyTimeout is how long runFor waits for an example's debug server
+const readyTimeout = 10 * time.Second
+
+// pprofPort finds the port an example serves its debug endpoints on
+var pprofPort = regexp.MustCompile(`ListenAndServe\("localhost:(606[0-9])"`)
+
+// TestLeakBudgets runs each fixed example and requires its leak report's
+// verdict to be clean; with -leaks it also runs each leaky example and
+// requires it to be "leak suspected", so a demo can't be fixed by accident.
+//
+// It runs only with LEAK_BUDGETS=1, because it takes minutes and binds fixed
+// ports: the examples serve their debug endpoints on localhost:6060 and
+// localhost:6061, and some start mock servers on ports of their own. The
+// examples run one at a time for that reason, and a row fails if something
+// else already answers on its port.
+//
+//	LEAK_BUDGETS=1 go test -run TestLeakBudgets .
+//	LEAK_BUDGETS=1 go test -run TestLeakBudgets . -args -leaks
+func TestLeakBudgets(t *testing.T) {
+	if os.Getenv("LEAK_BUDGETS") != "1" {
+		t.Skip("set LEAK_BUDGETS=1 to run every example for several seconds on ports 6060 and 6061")
+	}
+	if testing.Short() {
+		t.Skip("runs every example for several seconds")
+	}
+	bin := t.TempDir()
+
+	for _, b := range budgets {
+		name := filepath.Base(filepath.Dir(b.file))
+		t.Run(name, func(t *testing.T) {
+			if b.leaky && !*checkLeaks {
+				t.Skip("leaky examples run only with -leaks")
+			}
+			src, err := os.ReadFile(b.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := pprofPort.FindSubmatch(src)
+			if m == nil {
+				t.Fatalf("no pprof server in %s", b.file)
+			}
+
+			// Build only the example's main file: the others in its
+			// directory need build tags or modules this check doesn't assume
+			exe := filepath.Join(bin, name)
+			if out, err := exec.Command("go", "build", "-o", exe, b.file).CombinedOutput(); err != nil {
+				t.Fatalf("build failed: %v\n%s", err, out)
+			}
+
+			url := fmt.Sprintf("http://localhost:%s/debug/leakreport?goroutines=%d&heap_mb=%g&fds=%d", m[1], b.goroutines, b.heapMB, b.fds)
+			probe := &http.Client{Timeout: time.Second}
+			if resp, err := probe.Get(url); err == nil {
+				resp.Body.Close()
+				t.Fatalf("something is already serving localhost:%s", m[1])
+			}
+			report := runFor(t, exe, b.args, b.run, url)
+			first, _, _ := strings.Cut(report, "\n")
+			t.Log(first)
+			want := "clean"
+			if b.leaky {
+				want = "leak suspected"
+			}
+			if got := verdict(report); got != want {
+				t.Errorf("verdict %q, want %q\n%s", got, want, report)
+			}
+		})
+	}
+}
+
+// runFor starts exe, polls url until the example answers, lets it run until
+// d after it started, fetches url again and stops it, returning the response
+// body
+func runFor(t *testing.T, exe string, args []string, d time.Duration, url string) string {
+	t.Helper()
+	log, err := os.Create(exe + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	started := time.Now()
+
+	// Wait for the debug server rather than guessing how long startup takes
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Since(started) > readyTimeout {
+			out, _ := os.ReadFile(log.Name())
+			t.Fatalf("no leak report after %v: %v\n%s", readyTimeout, err, lastLines(string(out), 5))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(time.Until(started.Add(d)))
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// verdict returns the word(s) after "Verdict: " in a leak report
+func verdict(report string) string {
+	s := bufio.NewScanner(strings.NewReader(report))
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "Verdict: "); ok {
+			v, _, _ = strings.Cut(v, " (")
+			return v
+		}
+	}
+	return ""
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
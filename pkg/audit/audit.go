@@ -0,0 +1,95 @@
+// Package audit holds two HTTP middlewares that audit a sample of requests
+// in a goroutine and stop waiting for the result after Timeout.
+// LeakyMiddleware is the classic goroutine leak moved into a server: the
+// audit goroutine blocks forever on an unbuffered send once nobody is
+// waiting. FixedMiddleware does the same work with a 1-slot buffered
+// channel, so the goroutine can always finish. Wrap a real handler with
+// LeakyMiddleware to check that your dashboards and alerts actually catch a
+// slow goroutine leak.
+package audit
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Timeout is how long a request waits for its audit result; the audit
+// itself takes Duration, so every sampled request gives up waiting
+const (
+	Timeout  = 1 * time.Millisecond
+	Duration = 5 * time.Millisecond
+)
+
+var abandoned int64
+
+// Abandoned returns how many audits both middlewares have stopped waiting
+// for, in this process
+func Abandoned() int64 {
+	return atomic.LoadInt64(&abandoned)
+}
+
+// LeakyMiddleware leaks one goroutine on every sampled request
+func LeakyMiddleware(rate float64) func(http.Handler) http.Handler {
+	sample := sampler(rate)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sample() {
+				// BUG: unbuffered - once the select below times out nobody
+				// ever receives, so the goroutine blocks on send forever
+				result := make(chan string)
+				go func() {
+					result <- audit(r.URL.Path)
+				}()
+
+				select {
+				case <-result:
+				case <-time.After(Timeout):
+					atomic.AddInt64(&abandoned, 1)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// FixedMiddleware does the same sampled audit without leaking
+func FixedMiddleware(rate float64) func(http.Handler) http.Handler {
+	sample := sampler(rate)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sample() {
+				// ✅ FIX: one slot of buffer - the send always succeeds,
+				// even after the handler stopped waiting
+				result := make(chan string, 1)
+				go func() {
+					result <- audit(r.URL.Path)
+				}()
+
+				select {
+				case <-result:
+				case <-time.After(Timeout):
+					atomic.AddInt64(&abandoned, 1)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sampler returns a func that reports true for exactly rate of its calls,
+// spread evenly, so the expected number of leaks is known in advance
+func sampler(rate float64) func() bool {
+	var calls int64
+	return func() bool {
+		n := atomic.AddInt64(&calls, 1)
+		return math.Floor(float64(n)*rate) > math.Floor(float64(n-1)*rate)
+	}
+}
+
+// audit simulates a call to an audit-log service
+func audit(path string) string {
+	time.Sleep(Duration)
+	return "audited " + path
+}
@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const (
+	requests = 500
+	rate     = 0.1
+)
+
+// drive serves a trivial handler wrapped in mw, sends it requests requests
+// and returns how many goroutines were left behind once the server is
+// closed and the audits have had time to finish
+func drive(t *testing.T, mw func(http.Handler) http.Handler) int {
+	t.Helper()
+	settle()
+	before := runtime.NumGoroutine()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	server := httptest.NewServer(mw(ok))
+	client := server.Client()
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get(fmt.Sprintf("%s/orders/%d", server.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Close the server and idle connections so only leaked goroutines remain
+	client.CloseIdleConnections()
+	server.Close()
+	settle()
+	return runtime.NumGoroutine() - before
+}
+
+// settle gives finished audits and closed connections time to exit
+func settle() {
+	time.Sleep(10 * Duration)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestFixedMiddlewareStaysFlat(t *testing.T) {
+	abandonedBefore := Abandoned()
+	growth := drive(t, FixedMiddleware(rate))
+
+	if abandoned := Abandoned() - abandonedBefore; abandoned != requests*rate {
+		t.Errorf("%d audits abandoned, want %d: every sampled request gives up", abandoned, int(requests*rate))
+	}
+	if growth > 5 {
+		t.Errorf("goroutines grew by %d, want flat", growth)
+	}
+}
+
+func TestLeakyMiddlewareGrows(t *testing.T) {
+	abandonedBefore := Abandoned()
+	growth := drive(t, LeakyMiddleware(rate))
+
+	if abandoned := Abandoned() - abandonedBefore; abandoned != requests*rate {
+		t.Errorf("%d audits abandoned, want %d", abandoned, int(requests*rate))
+	}
+	if growth < requests*rate {
+		t.Errorf("goroutines grew by %d, want at least %d: one per abandoned audit", growth, int(requests*rate))
+	}
+}
+
+func TestSamplerIsExact(t *testing.T) {
+	for _, r := range []float64{0, 0.1, 0.25, 1} {
+		sample := sampler(r)
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if sample() {
+				n++
+			}
+		}
+		if want := int(1000 * r); n != want {
+			t.Errorf("sampler(%v) chose %d of 1000 calls, want %d", r, n, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package cache holds a bounded LRUCache, with read-through loading that
+// coalesces concurrent misses, and eviction policies that compete with it:
+// ClockCache, which approximates LRU with a reference bit per entry, and
+// ClockProCache, which keeps its hot entries through scans that flush an
+// LRU. All three have the same Set, Get, Delete and Len.
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ClockCache approximates LRU with the CLOCK algorithm: entries sit in a
+// fixed ring of slots with a reference bit that Get sets. To make room, the
+// hand sweeps the ring, clearing set bits, and evicts the first entry whose
+// bit is already clear. A hit costs one bit write instead of a list move.
+type ClockCache[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	slots    []clockSlot[V]
+	index    map[string]int // key to slot
+	hand     int
+}
+
+type clockSlot[V any] struct {
+	key   string
+	value V
+	ref   bool
+	used  bool
+}
+
+// NewClockCache returns an empty ClockCache of capacity slots. It panics if
+// capacity is below 1, since a full ring with no slots has nothing to evict.
+func NewClockCache[V any](capacity int) *ClockCache[V] {
+	if capacity < 1 {
+		panic(fmt.Sprintf("cache: NewClockCache: capacity %d, want at least 1", capacity))
+	}
+	return &ClockCache[V]{
+		capacity: capacity,
+		slots:    make([]clockSlot[V], 0, capacity),
+		index:    make(map[string]int, capacity),
+	}
+}
+
+func (c *ClockCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i, ok := c.index[key]; ok {
+		c.slots[i].value = value
+		c.slots[i].ref = true
+		return
+	}
+	if len(c.slots) < c.capacity {
+		c.index[key] = len(c.slots)
+		c.slots = append(c.slots, clockSlot[V]{key: key, value: value, used: true})
+		return
+	}
+
+	// Second chance: skip free slots left by Delete and referenced entries,
+	// clearing their bit as the hand passes
+	for c.slots[c.hand].used && c.slots[c.hand].ref {
+		c.slots[c.hand].ref = false
+		c.hand = (c.hand + 1) % len(c.slots)
+	}
+	if victim := &c.slots[c.hand]; victim.used {
+		delete(c.index, victim.key)
+	}
+	c.slots[c.hand] = clockSlot[V]{key: key, value: value, used: true}
+	c.index[key] = c.hand
+	c.hand = (c.hand + 1) % len(c.slots)
+}
+
+func (c *ClockCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.index[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.slots[i].ref = true
+	return c.slots[i].value, true
+}
+
+// Delete frees key's slot. The slot is reused by the next Set that finds the
+// ring full, so the ring never grows past capacity.
+func (c *ClockCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.index[key]; ok {
+		delete(c.index, key)
+		c.slots[i] = clockSlot[V]{}
+	}
+}
+
+func (c *ClockCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.index)
+}
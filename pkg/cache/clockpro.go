@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ClockProCache implements CLOCK-Pro (Jiang, Chen and Zhang, USENIX 2005).
+// Resident entries are hot, if they have been reused within a short reuse
+// distance, or cold. Evictions come only from cold entries, so a scan of keys
+// that are used once flows through the cold entries without touching the hot
+// ones, which is where LRU loses its whole working set. An evicted cold entry
+// stays in the ring as a non-resident test entry, keeping its key but not its
+// value: if the key is set again while its test entry exists, it returns hot
+// and the cold allocation grows, and when the test entry expires the cold
+// allocation shrinks. Three hands share one ring:
+//
+//   - handCold evicts unreferenced cold entries and promotes referenced ones
+//   - handHot demotes unreferenced hot entries to cold when hot exceeds its share
+//   - handTest expires test entries, which never outnumber capacity
+//
+// Test entries are what bound the extra memory: at most capacity keys, and
+// no values.
+type ClockProCache[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	coldCap  int // adaptive target for cold entries, 1..capacity
+	index    map[string]*clockProEntry[V]
+
+	handHot, handCold, handTest *clockProEntry[V]
+
+	hot, cold, test int
+}
+
+type clockProStatus uint8
+
+const (
+	clockProCold clockProStatus = iota
+	clockProHot
+	clockProTest // non-resident: value is the zero value
+)
+
+type clockProEntry[V any] struct {
+	key        string
+	value      V
+	status     clockProStatus
+	ref        bool
+	prev, next *clockProEntry[V]
+}
+
+// NewClockProCache returns an empty ClockProCache holding up to capacity
+// values and capacity test keys. It panics if capacity is below 1: insert
+// needs a cold entry to evict.
+func NewClockProCache[V any](capacity int) *ClockProCache[V] {
+	if capacity < 1 {
+		panic(fmt.Sprintf("cache: NewClockProCache: capacity %d, want at least 1", capacity))
+	}
+	return &ClockProCache[V]{
+		capacity: capacity,
+		coldCap:  capacity,
+		index:    make(map[string]*clockProEntry[V], 2*capacity),
+	}
+}
+
+func (c *ClockProCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.index[key]
+	switch {
+	case !ok:
+		c.insert(&clockProEntry[V]{key: key, value: value, status: clockProCold})
+		c.cold++
+	case e.status != clockProTest:
+		e.value = value
+		e.ref = true
+	default:
+		// Reused within its test period: cold entries deserve more room,
+		// and this one comes back hot
+		if c.coldCap < c.capacity {
+			c.coldCap++
+		}
+		c.unlink(e)
+		c.test--
+		c.insert(&clockProEntry[V]{key: key, value: value, status: clockProHot})
+		c.hot++
+	}
+}
+
+func (c *ClockProCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[key]
+	if !ok || e.status == clockProTest {
+		var zero V
+		return zero, false
+	}
+	e.ref = true
+	return e.value, true
+}
+
+func (c *ClockProCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[key]
+	if !ok {
+		return
+	}
+	switch e.status {
+	case clockProHot:
+		c.hot--
+	case clockProCold:
+		c.cold--
+	case clockProTest:
+		c.test--
+	}
+	c.unlink(e)
+}
+
+// Len returns the number of resident entries; test entries hold no value
+func (c *ClockProCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hot + c.cold
+}
+
+// NonResident returns the number of test entries, which is at most capacity
+func (c *ClockProCache[V]) NonResident() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.test
+}
+
+// insert makes room for e if the cache is full, then links it in just
+// behind handHot, the position of the most recently used entry
+func (c *ClockProCache[V]) insert(e *clockProEntry[V]) {
+	for c.hot+c.cold >= c.capacity {
+		c.runHandCold()
+	}
+	c.index[e.key] = e
+	if c.handHot == nil {
+		e.prev, e.next = e, e
+		c.handHot, c.handCold, c.handTest = e, e, e
+		return
+	}
+	e.prev, e.next = c.handHot.prev, c.handHot
+	e.prev.next = e
+	c.handHot.prev = e
+	if c.handCold == c.handHot {
+		c.handCold = e
+	}
+}
+
+// unlink removes e from the ring and the index, stepping back any hand that
+// points at it
+func (c *ClockProCache[V]) unlink(e *clockProEntry[V]) {
+	delete(c.index, e.key)
+	if e.next == e {
+		c.handHot, c.handCold, c.handTest = nil, nil, nil
+		return
+	}
+	if c.handHot == e {
+		c.handHot = e.prev
+	}
+	if c.handCold == e {
+		c.handCold = e.prev
+	}
+	if c.handTest == e {
+		c.handTest = e.prev
+	}
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+// runHandCold advances handCold by one entry. A referenced cold entry is
+// promoted to hot; an unreferenced one loses its value and becomes a test
+// entry. Afterwards handHot runs until hot fits its share again.
+func (c *ClockProCache[V]) runHandCold() {
+	e := c.handCold
+	if e.status == clockProCold {
+		if e.ref {
+			e.status = clockProHot
+			e.ref = false
+			c.cold--
+			c.hot++
+		} else {
+			e.status = clockProTest
+			var zero V
+			e.value = zero
+			c.cold--
+			c.test++
+			for c.test > c.capacity {
+				c.runHandTest()
+			}
+		}
+	}
+	c.handCold = c.handCold.next
+	for c.hot > c.capacity-c.coldCap {
+		c.runHandHot()
+	}
+}
+
+// runHandHot advances handHot by one entry, clearing a hot entry's reference
+// bit or demoting it to cold if the bit was already clear. It first lets
+// handTest pass, so test entries it would skip over get a chance to expire.
+func (c *ClockProCache[V]) runHandHot() {
+	if c.handHot == c.handTest {
+		c.runHandTest()
+	}
+	e := c.handHot
+	if e.status == clockProHot {
+		if e.ref {
+			e.ref = false
+		} else {
+			e.status = clockProCold
+			c.hot--
+			c.cold++
+		}
+	}
+	c.handHot = c.handHot.next
+}
+
+// runHandTest advances handTest by one entry, expiring it if it is a test
+// entry. An expired test entry shrinks the cold allocation, because its key
+// wasn't reused in time to justify the room.
+func (c *ClockProCache[V]) runHandTest() {
+	if c.handTest == c.handCold {
+		c.runHandCold()
+	}
+	e := c.handTest
+	if e.status == clockProTest {
+		c.unlink(e) // steps handTest back to e.prev
+		c.test--
+		if c.coldCap > 1 {
+			c.coldCap--
+		}
+	}
+	c.handTest = c.handTest.next
+}
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// policy is the interface the three caches share
+type policy interface {
+	Set(key string, value int)
+	Get(key string) (int, bool)
+	Delete(key string)
+	Len() int
+}
+
+// policies are the caches the hit rate tests compare
+var policies = []struct {
+	name string
+	new  func(capacity int) policy
+}{
+	{"LRU", func(n int) policy { return NewLRUCache[int](n) }},
+	{"CLOCK", func(n int) policy { return NewClockCache[int](n) }},
+	{"CLOCK-Pro", func(n int) policy { return NewClockProCache[int](n) }},
+}
+
+// The Zipf workload: reads over workingSet keys, optionally interrupted by
+// scans of keys read once
+const (
+	workingSet = 10_000
+	zipfS      = 1.1
+	scanEvery  = 20_000 // accesses between scans
+	scanLen    = 5_000  // one-off keys per scan
+)
+
+// zipfTrace returns n keys drawn from a Zipf distribution over workingSet
+// keys, key_0 being the most popular. With scans, scanLen keys that are
+// never read again follow every scanEvery draws, like a batch job or report
+// that reads every row once.
+func zipfTrace(n int, scans bool) []string {
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, zipfS, 1, workingSet-1)
+	trace := make([]string, 0, n)
+	scanned := 0
+	for len(trace) < n {
+		trace = append(trace, "key_"+strconv.FormatUint(zipf.Uint64(), 10))
+		if scans && len(trace)%scanEvery == 0 {
+			for i := 0; i < scanLen && len(trace) < n; i++ {
+				trace = append(trace, "scan_"+strconv.Itoa(scanned))
+				scanned++
+			}
+		}
+	}
+	return trace
+}
+
+// replay reads every key of trace through c, setting it on a miss the way a
+// read-through cache would, and returns the hit rate in percent. It fails
+// t if c holds more than capacity entries, checked every 1000 accesses.
+func replay(t testing.TB, c policy, capacity int, trace []string) float64 {
+	hits := 0
+	for i, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, i)
+		}
+		if n := c.Len(); i%1000 == 0 && n > capacity {
+			t.Fatalf("%d entries at access %d, capacity %d", n, i, capacity)
+		}
+	}
+	return 100 * float64(hits) / float64(len(trace))
+}
+
+// consistent reports whether the hot, cold and test counts match the entries
+// in the ring and the index
+func (c *ClockProCache[V]) consistent() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hot, cold, test int
+	if e := c.handHot; e != nil {
+		for {
+			switch e.status {
+			case clockProHot:
+				hot++
+			case clockProCold:
+				cold++
+			case clockProTest:
+				test++
+			}
+			if c.index[e.key] != e {
+				return false
+			}
+			if e = e.next; e == c.handHot {
+				break
+			}
+		}
+	}
+	return hot == c.hot && cold == c.cold && test == c.test && len(c.index) == hot+cold+test
+}
+
+func TestClockProCacheBookkeeping(t *testing.T) {
+	const capacity = 100
+	c := NewClockProCache[int](capacity)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100_000; i++ {
+		key := "key_" + strconv.Itoa(rng.Intn(400))
+		switch r := rng.Intn(10); {
+		case r < 6:
+			if _, hit := c.Get(key); !hit {
+				c.Set(key, i)
+			}
+		case r < 9:
+			c.Set(key, i)
+		default:
+			c.Delete(key)
+		}
+		if i%100 != 0 {
+			continue
+		}
+		if !c.consistent() {
+			t.Fatalf("after %d operations the hot, cold and test counts don't match the ring", i)
+		}
+		if c.Len() > capacity || c.NonResident() > capacity {
+			t.Fatalf("after %d operations: %d values and %d test keys, capacity %d", i, c.Len(), c.NonResident(), capacity)
+		}
+	}
+}
+
+func TestCachesStoreValues(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			c := p.new(2)
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Set("a", 3)
+			if v, ok := c.Get("a"); !ok || v != 3 {
+				t.Errorf("Get(a) = %d, %v, want 3, true", v, ok)
+			}
+			c.Delete("a")
+			if _, ok := c.Get("a"); ok || c.Len() != 1 {
+				t.Errorf("after Delete(a): Get hit %v, Len %d, want a miss and 1", ok, c.Len())
+			}
+			c.Set("c", 4)
+			c.Set("d", 5)
+			if c.Len() != 2 {
+				t.Errorf("Len = %d after filling 2 slots past a Delete, want 2", c.Len())
+			}
+		})
+	}
+}
+
+func TestCachesRejectZeroCapacity(t *testing.T) {
+	for _, p := range policies {
+		for _, capacity := range []int{0, -1} {
+			t.Run(fmt.Sprintf("%s/%d", p.name, capacity), func(t *testing.T) {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("capacity %d didn't panic", capacity)
+					}
+				}()
+				p.new(capacity)
+			})
+		}
+	}
+	// The smallest valid cache still evicts
+	for _, p := range policies {
+		c := p.new(1)
+		c.Set("a", 1)
+		c.Set("b", 2)
+		if v, ok := c.Get("b"); !ok || v != 2 || c.Len() != 1 {
+			t.Errorf("%s of capacity 1: Get(b) = %d, %v with %d entries, want 2, true with 1", p.name, v, ok, c.Len())
+		}
+	}
+}
+
+// TestClockProCacheSurvivesScans checks the point of CLOCK-Pro: scans of
+// one-off keys flush an LRU's working set but only pass through CLOCK-Pro's
+// cold entries
+func TestClockProCacheSurvivesScans(t *testing.T) {
+	trace := zipfTrace(200_000, true)
+	for _, pct := range []int{10, 25, 50} {
+		capacity := workingSet * pct / 100
+		lruRate := replay(t, NewLRUCache[int](capacity), capacity, trace)
+		proRate := replay(t, NewClockProCache[int](capacity), capacity, trace)
+		if proRate <= lruRate {
+			t.Errorf("capacity %d%%: CLOCK-Pro hit rate %.1f%%, LRU %.1f%%, want CLOCK-Pro higher", pct, proRate, lruRate)
+		}
+	}
+}
+
+// BenchmarkZipf replays Zipf traces, with and without scans, through each
+// policy at 10%, 25% and 50% of the working set, and reports the hit rate
+// next to the time per access:
+//
+//	go test -bench Zipf ./pkg/cache
+func BenchmarkZipf(b *testing.B) {
+	for _, scans := range []bool{false, true} {
+		trace := zipfTrace(500_000, scans)
+		workload := "zipf"
+		if scans {
+			workload = "zipf+scans"
+		}
+		for _, pct := range []int{10, 25, 50} {
+			capacity := workingSet * pct / 100
+			for _, p := range policies {
+				b.Run(fmt.Sprintf("%s/%d%%/%s", workload, pct, p.name), func(b *testing.B) {
+					var rate float64
+					for b.Loop() {
+						rate = replay(b, p.new(capacity), capacity, trace)
+					}
+					b.ReportMetric(rate, "hit%")
+					b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(trace)), "ns/access")
+				})
+			}
+		}
+	}
+}
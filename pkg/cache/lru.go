@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// LRUCache is a bounded LRU: a map for lookups and a list in recency order,
+// most recent at the front, so Set evicts from the back once the cache holds
+// capacity entries. GetOrLoad adds read-through loading that coalesces
+// concurrent misses for one key.
+type LRUCache[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	index    map[string]*list.Element
+	order    *list.List // of *lruEntry[V]
+	inflight map[string]*call[V]
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// call is one in-flight load; waiters block on done, then read val and err
+type call[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// ErrLoadPanicked is what GetOrLoad's waiters get when the load they were
+// waiting for panicked
+var ErrLoadPanicked = errors.New("cache load panicked")
+
+// NewLRUCache returns an empty LRUCache of capacity entries. It panics if
+// capacity is below 1, since every Set would evict the value it just stored.
+func NewLRUCache[V any](capacity int) *LRUCache[V] {
+	if capacity < 1 {
+		panic(fmt.Sprintf("cache: NewLRUCache: capacity %d, want at least 1", capacity))
+	}
+	return &LRUCache[V]{
+		capacity: capacity,
+		index:    make(map[string]*list.Element, capacity),
+		order:    list.New(),
+		inflight: make(map[string]*call[V]),
+	}
+}
+
+func (c *LRUCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value)
+}
+
+// set adds or updates key and evicts the oldest entry when over capacity.
+// Caller must hold c.mu.
+func (c *LRUCache[V]) set(key string, value V) {
+	if elem, ok := c.index[key]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*lruEntry[V]).value = value
+		return
+	}
+	c.index[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value})
+	if c.order.Len() > c.capacity {
+		delete(c.index, c.order.Remove(c.order.Back()).(*lruEntry[V]).key)
+	}
+}
+
+func (c *LRUCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.index[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[V]).value, true
+}
+
+func (c *LRUCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		c.order.Remove(elem)
+		delete(c.index, key)
+	}
+}
+
+func (c *LRUCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// GetOrLoad returns the cached value for key. On a miss the first caller runs
+// load while later callers for the same key wait for its result instead of
+// running load again. Errors are returned to every waiter but not cached.
+func (c *LRUCache[V]) GetOrLoad(key string, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if elem, ok := c.index[key]; ok {
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*lruEntry[V]).value, nil
+	}
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		return cl.val, cl.err
+	}
+	cl := &call[V]{done: make(chan struct{}), err: ErrLoadPanicked}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	// Release the waiters even if load panics - otherwise every later
+	// request for key blocks on done forever (a goroutine leak)
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if cl.err == nil {
+			c.set(key, cl.val)
+		}
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+
+	cl.val, cl.err = load()
+	return cl.val, cl.err
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecent(t *testing.T) {
+	c := NewLRUCache[int](2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b survived, want it evicted as the least recently used")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.Get(key); !ok || v != want {
+			t.Errorf("Get(%s) = %d, %v, want %d, true", key, v, ok, want)
+		}
+	}
+}
+
+// TestGetOrLoadCoalesces starts 20 GetOrLoad calls for one key while the
+// first load is blocked; only that load may run, and every caller gets its
+// value
+func TestGetOrLoadCoalesces(t *testing.T) {
+	const callers = 20
+	c := NewLRUCache[string](10)
+	var loads int64
+	release := make(chan struct{})
+	load := func() (string, error) {
+		atomic.AddInt64(&loads, 1)
+		<-release
+		return "body", nil
+	}
+
+	var wg sync.WaitGroup
+	got := make([]string, callers)
+	for i := range callers {
+		wg.Go(func() {
+			got[i], _ = c.GetOrLoad("k", load)
+		})
+	}
+	for atomic.LoadInt64(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // let the other callers reach the wait
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&loads); n != 1 {
+		t.Errorf("load ran %d times for %d callers, want 1", n, callers)
+	}
+	for i, v := range got {
+		if v != "body" {
+			t.Errorf("caller %d got %q, want body", i, v)
+		}
+	}
+	if v, ok := c.Get("k"); !ok || v != "body" {
+		t.Errorf("Get after the load = %q, %v, want body, true", v, ok)
+	}
+}
+
+func TestGetOrLoadDoesNotCacheErrors(t *testing.T) {
+	c := NewLRUCache[int](10)
+	errDown := errors.New("down")
+	if _, err := c.GetOrLoad("k", func() (int, error) { return 0, errDown }); !errors.Is(err, errDown) {
+		t.Errorf("GetOrLoad = %v, want the load's error", err)
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len = %d after a failed load, want 0", c.Len())
+	}
+	if v, err := c.GetOrLoad("k", func() (int, error) { return 7, nil }); v != 7 || err != nil {
+		t.Errorf("GetOrLoad after the failure = %d, %v, want a fresh load", v, err)
+	}
+}
+
+// A load that panics must still release its waiters and the key
+func TestGetOrLoadPanicReleasesWaiters(t *testing.T) {
+	c := NewLRUCache[int](10)
+	started, release := make(chan struct{}), make(chan struct{})
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.GetOrLoad("k", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrLoad("k", func() (int, error) { return 1, nil })
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if p := <-panicked; p != "boom" {
+		t.Errorf("loader recovered %v, want boom", p)
+	}
+	select {
+	case err := <-waiter:
+		if err != nil && !errors.Is(err, ErrLoadPanicked) {
+			t.Errorf("waiter got %v, want ErrLoadPanicked or its own load", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the load panicked")
+	}
+	if v, err := c.GetOrLoad("k", func() (int, error) { return 2, nil }); err != nil || (v != 1 && v != 2) {
+		t.Errorf("GetOrLoad after the panic = %d, %v, want a fresh load", v, err)
+	}
+}
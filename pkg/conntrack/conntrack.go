@@ -0,0 +1,111 @@
+// Package conntrack counts a server's connections by state, so a leaked
+// response body shows up on the server side as a connection that stays
+// active or idle instead of closing.
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracker counts a server's connections by state. Listen wraps net.Listen
+// so every accepted connection is counted, and ConnState, set as the
+// server's http.Server.ConnState callback, follows each one through
+// StateNew, StateActive, StateIdle and StateClosed.
+type Tracker struct {
+	accepted int64
+
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+	closed int64
+}
+
+// Stats is a snapshot of a Tracker. New, Active and Idle are live
+// connections; Closed and Accepted are totals since startup.
+type Stats struct {
+	New      int   `json:"new"`
+	Active   int   `json:"active"`
+	Idle     int   `json:"idle"`
+	Hijacked int   `json:"hijacked"`
+	Closed   int64 `json:"closed"`
+	Accepted int64 `json:"accepted"`
+}
+
+// New returns a Tracker with no connections
+func New() *Tracker {
+	return &Tracker{states: make(map[net.Conn]http.ConnState)}
+}
+
+// Listen is net.Listen with every accepted connection counted
+func (t *Tracker) Listen(network, addr string) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &trackingListener{Listener: ln, tracker: t}, nil
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *Tracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.tracker.accepted, 1)
+	}
+	return c, err
+}
+
+// ConnState records c's new state. A closed connection is forgotten and only
+// counted, so the map holds live connections only.
+func (t *Tracker) ConnState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state == http.StateClosed {
+		delete(t.states, c)
+		t.closed++
+		return
+	}
+	t.states[c] = state
+}
+
+// Stats returns the current count per state
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{Closed: t.closed, Accepted: atomic.LoadInt64(&t.accepted)}
+	for _, state := range t.states {
+		switch state {
+		case http.StateNew:
+			s.New++
+		case http.StateActive:
+			s.Active++
+		case http.StateIdle:
+			s.Idle++
+		case http.StateHijacked:
+			s.Hijacked++
+		}
+	}
+	return s
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("new %d  |  active %d  |  idle %d  |  closed %d  |  accepted %d",
+		s.New, s.Active, s.Idle, s.Closed, s.Accepted)
+}
+
+// Handler serves Stats as JSON, registered at /debug/conntrack
+func (t *Tracker) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
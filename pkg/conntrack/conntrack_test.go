@@ -0,0 +1,87 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitStats polls t until ok accepts its Stats or a second has passed, since
+// the server reports state changes from its connection goroutines
+func waitStats(t *Tracker, ok func(Stats) bool) Stats {
+	for deadline := time.Now().Add(time.Second); !ok(t.Stats()) && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return t.Stats()
+}
+
+func TestTrackerFollowsConnections(t *testing.T) {
+	tracker := New()
+	ln, err := tracker.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				<-release
+			}
+		}),
+		ConnState: tracker.ConnState,
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	url := "http://" + ln.Addr().String()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func(path string) {
+		resp, err := client.Get(url + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		get("/block")
+		close(done)
+	}()
+	if s := waitStats(tracker, func(s Stats) bool { return s.Active == 1 }); s.Active != 1 || s.Accepted != 1 {
+		t.Errorf("with a request blocked: %s, want 1 active of 1 accepted", s)
+	}
+	close(release)
+	<-done
+	if s := waitStats(tracker, func(s Stats) bool { return s.Idle == 1 }); s.Idle != 1 || s.Active != 0 {
+		t.Errorf("after the response: %s, want the connection idle", s)
+	}
+
+	get("/")
+	if s := tracker.Stats(); s.Accepted != 1 {
+		t.Errorf("a second request dialled again: %s, want the idle connection reused", s)
+	}
+
+	client.CloseIdleConnections()
+	if s := waitStats(tracker, func(s Stats) bool { return s.Closed == 1 }); s.Closed != 1 || s.Idle != 0 {
+		t.Errorf("after closing idle connections: %s, want 1 closed and none live", s)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tracker := New()
+	rec := httptest.NewRecorder()
+	tracker.Handler()(rec, httptest.NewRequest("GET", "/debug/conntrack", nil))
+	var s Stats
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil || s != (Stats{}) {
+		t.Errorf("Handler served %+v (%v), want zero Stats", s, err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+}
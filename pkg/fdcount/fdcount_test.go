@@ -0,0 +1,59 @@
+package fdcount
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCountFollowsOpenFiles(t *testing.T) {
+	before := Count()
+	if before < 0 {
+		t.Skip("no /proc/self/fd or /dev/fd on this platform")
+	}
+
+	var files []*os.File
+	for i := 0; i < 3; i++ {
+		f, err := os.Create(filepath.Join(t.TempDir(), "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	if got := Count(); got != before+3 {
+		t.Errorf("Count with 3 files open = %d, want %d", got, before+3)
+	}
+
+	for _, f := range files {
+		f.Close()
+	}
+	if got := Count(); got != before {
+		t.Errorf("Count after closing them = %d, want %d", got, before)
+	}
+}
+
+func TestSocketsFollowsListeners(t *testing.T) {
+	before := Sockets()
+	if before < 0 {
+		t.Skip("no /proc/self/fd on this platform")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := Sockets(); got != before+1 {
+		t.Errorf("Sockets with a listener and a file open = %d, want %d", got, before+1)
+	}
+
+	ln.Close()
+	if got := Sockets(); got != before {
+		t.Errorf("Sockets after closing the listener = %d, want %d", got, before)
+	}
+}
@@ -0,0 +1,117 @@
+package fdcount
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Op names a file operation a Tracker can time
+type Op int
+
+const (
+	OpCreate Op = iota
+	OpWrite
+	OpClose
+)
+
+// Tracker counts files opened and closed through File, giving an exact live
+// count where the OS-level descriptor count from Count is only an estimate.
+// The zero value is ready to use.
+type Tracker struct {
+	opened int64
+	closed int64
+	peak   int64
+
+	// OnClose, if set, is called with the file name on each first Close
+	OnClose func(name string)
+
+	// Observe, if set, is called with how long each Create, Write and Close
+	// took
+	Observe func(op Op, d time.Duration)
+}
+
+// File wraps *os.File and reports its Close to the tracker
+type File struct {
+	*os.File
+	tracker *Tracker
+	closed  int32
+}
+
+// Create creates the named file and counts it as open
+func (t *Tracker) Create(name string) (*File, error) {
+	start := time.Now()
+	f, err := os.Create(name)
+	t.observe(OpCreate, start)
+	return t.track(f, err)
+}
+
+// Open opens the named file for reading and counts it as open
+func (t *Tracker) Open(name string) (*File, error) {
+	return t.track(os.Open(name))
+}
+
+func (t *Tracker) track(f *os.File, err error) (*File, error) {
+	if err != nil {
+		return nil, err
+	}
+	live := atomic.AddInt64(&t.opened, 1) - atomic.LoadInt64(&t.closed)
+	for {
+		peak := atomic.LoadInt64(&t.peak)
+		if live <= peak || atomic.CompareAndSwapInt64(&t.peak, peak, live) {
+			break
+		}
+	}
+	return &File{File: f, tracker: t}, nil
+}
+
+func (t *Tracker) observe(op Op, start time.Time) {
+	if t.Observe != nil {
+		t.Observe(op, time.Since(start))
+	}
+}
+
+// Close closes the file. Only the first call is counted, so closing twice
+// can't push the live count below the real number of open files.
+func (f *File) Close() error {
+	if atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		atomic.AddInt64(&f.tracker.closed, 1)
+		if f.tracker.OnClose != nil {
+			f.tracker.OnClose(f.Name())
+		}
+	}
+	start := time.Now()
+	err := f.File.Close()
+	f.tracker.observe(OpClose, start)
+	return err
+}
+
+// Write writes to the file and reports how long it took
+func (f *File) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Write(p)
+	f.tracker.observe(OpWrite, start)
+	return n, err
+}
+
+// Current returns how many tracked files are open right now
+func (t *Tracker) Current() int64 {
+	return atomic.LoadInt64(&t.opened) - atomic.LoadInt64(&t.closed)
+}
+
+// Peak returns the most tracked files that were open at the same time
+func (t *Tracker) Peak() int64 {
+	return atomic.LoadInt64(&t.peak)
+}
+
+// Balance returns the total number of tracked opens and closes
+func (t *Tracker) Balance() (opened, closed int64) {
+	return atomic.LoadInt64(&t.opened), atomic.LoadInt64(&t.closed)
+}
+
+// String formats the balance for the monitoring output
+func (t *Tracker) String() string {
+	opened, closed := t.Balance()
+	return fmt.Sprintf("opened %d / closed %d / live %d", opened, closed, opened-closed)
+}
@@ -0,0 +1,89 @@
+package fdcount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestTrackerScript opens and closes files in a fixed order, closing two of
+// them twice, and checks Current after every step, then Peak and Balance. A
+// second Close must fail with os.ErrClosed and leave the counts alone.
+func TestTrackerScript(t *testing.T) {
+	dir := t.TempDir()
+	// "+x" opens x and "-x" closes it; live is Current after the step
+	script := []struct {
+		step string
+		live int64
+	}{
+		{"+a", 1}, {"+b", 2}, {"-a", 1}, {"-a", 1}, {"+c", 2}, {"+d", 3},
+		{"-b", 2}, {"-d", 1}, {"-c", 0}, {"-c", 0},
+	}
+	var closedOrder []string
+	tr := &Tracker{OnClose: func(name string) {
+		closedOrder = append(closedOrder, filepath.Base(name))
+	}}
+	opened := make(map[string]*File)
+	var closeErrs []error
+	for _, s := range script {
+		name := s.step[1:]
+		if s.step[0] == '+' {
+			f, err := tr.Create(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened[name] = f
+		} else {
+			closeErrs = append(closeErrs, opened[name].Close())
+		}
+		if got := tr.Current(); got != s.live {
+			t.Errorf("after %s: Current = %d, want %d", s.step, got, s.live)
+		}
+	}
+
+	if open, closed := tr.Balance(); open != 4 || closed != 4 {
+		t.Errorf("Balance = %d opened, %d closed, want 4, 4", open, closed)
+	}
+	if got := tr.Peak(); got != 3 {
+		t.Errorf("Peak = %d, want 3", got)
+	}
+	// closeErrs[1] and closeErrs[5] are the second Closes of a and c
+	for _, i := range []int{1, 5} {
+		if !errors.Is(closeErrs[i], os.ErrClosed) {
+			t.Errorf("second Close returned %v, want os.ErrClosed", closeErrs[i])
+		}
+	}
+	if want := []string{"a", "b", "d", "c"}; !slices.Equal(closedOrder, want) {
+		t.Errorf("OnClose saw %v, want %v", closedOrder, want)
+	}
+}
+
+func TestTrackerObserve(t *testing.T) {
+	seen := make(map[Op]int)
+	tr := &Tracker{Observe: func(op Op, d time.Duration) {
+		if d < 0 {
+			t.Errorf("op %d took %v", op, d)
+		}
+		seen[op]++
+	}}
+	f, err := tr.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if seen[OpCreate] != 1 || seen[OpWrite] != 1 || seen[OpClose] != 1 {
+		t.Errorf("observed %v, want one create, write and close", seen)
+	}
+	if _, err := tr.Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Open of a missing file succeeded")
+	}
+	if open, _ := tr.Balance(); open != 1 {
+		t.Errorf("a failed Open was counted: %d opened, want 1", open)
+	}
+}
@@ -0,0 +1,64 @@
+// Package future turns a task handed to a worker pool into a value the
+// caller can wait for later. It works with any pool whose Submit takes a
+// func() and reports whether the task was accepted.
+package future
+
+import (
+	"context"
+	"fmt"
+)
+
+// Future is the pending result of a task passed to Submit
+type Future[T any] struct {
+	result chan result[T] // buffered: the worker never waits for Get
+	done   chan struct{}  // closed once val and err are set
+	val    T
+	err    error
+}
+
+type result[T any] struct {
+	val T
+	err error
+}
+
+// Get blocks until the task has finished or ctx is done. It can be called
+// any number of times, from any goroutine; every call after the first
+// returns the same result. A Future that is never read holds only its
+// buffered result, so dropping one leaks nothing.
+func (f *Future[T]) Get(ctx context.Context) (T, error) {
+	select {
+	case r := <-f.result:
+		f.val, f.err = r.val, r.err
+		close(f.done)
+	case <-f.done:
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+	return f.val, f.err
+}
+
+// Submit hands task to submit, typically a pool's Submit method, and returns
+// a Future for its result, or false if submit rejected it. A panic in task
+// becomes the Future's error. If the pool drops the task without running
+// it, the Future never resolves, which is one reason Get takes a ctx.
+func Submit[T any](submit func(func()) bool, task func() (T, error)) (*Future[T], bool) {
+	f := &Future[T]{
+		result: make(chan result[T], 1),
+		done:   make(chan struct{}),
+	}
+	ok := submit(func() {
+		var r result[T]
+		defer func() {
+			if p := recover(); p != nil {
+				r.err = fmt.Errorf("task panicked: %v", p)
+			}
+			f.result <- r
+		}()
+		r.val, r.err = task()
+	})
+	if !ok {
+		return nil, false
+	}
+	return f, true
+}
@@ -0,0 +1,81 @@
+package future
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spawn runs each task on its own goroutine
+func spawn(task func()) bool {
+	go task()
+	return true
+}
+
+func TestGet(t *testing.T) {
+	f, ok := Submit(spawn, func() (int, error) { return 42, nil })
+	if !ok {
+		t.Fatal("Submit rejected the task")
+	}
+	for i := range 2 {
+		if v, err := f.Get(context.Background()); v != 42 || err != nil {
+			t.Errorf("Get #%d = %d, %v, want 42, nil", i+1, v, err)
+		}
+	}
+
+	errBad := errors.New("bad")
+	f, _ = Submit(spawn, func() (int, error) { return 0, errBad })
+	if _, err := f.Get(context.Background()); !errors.Is(err, errBad) {
+		t.Errorf("Get = %v, want the task's error", err)
+	}
+}
+
+func TestPanicBecomesError(t *testing.T) {
+	f, _ := Submit(spawn, func() (string, error) { panic("boom") })
+	if _, err := f.Get(context.Background()); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Get = %v, want the panic as an error", err)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	f, ok := Submit(func(func()) bool { return false }, func() (int, error) { return 1, nil })
+	if ok || f != nil {
+		t.Errorf("Submit = %v, %v, want nil, false", f, ok)
+	}
+}
+
+// An expired ctx stops the wait, not the task
+func TestGetDeadline(t *testing.T) {
+	release := make(chan struct{})
+	f, _ := Submit(spawn, func() (string, error) { <-release; return "late", nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := f.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get = %v, want DeadlineExceeded", err)
+	}
+	close(release)
+	if s, err := f.Get(context.Background()); s != "late" || err != nil {
+		t.Errorf("later Get = %q, %v, want late, nil", s, err)
+	}
+}
+
+// Futures nobody reads don't keep their task's goroutine: the result sits in
+// the buffer
+func TestUnreadFuturesLeakNothing(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	for i := range 100 {
+		Submit(spawn, func() (int, error) { return i, nil })
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("%d goroutines after 100 unread futures, want %d", n, baseline)
+	}
+}
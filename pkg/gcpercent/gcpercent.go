@@ -0,0 +1,45 @@
+// Package gcpercent adds the -gcpercent flag the examples use to tune the
+// GC, and formats GC activity for their periodic output. Importing it
+// registers the flag on flag.CommandLine.
+package gcpercent
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+var percent = flag.Int("gcpercent", fromEnv(), "GC target percentage for debug.SetGCPercent (-1 disables the GC)")
+
+// Apply hands -gcpercent to the runtime; call it after flag.Parse
+func Apply() {
+	debug.SetGCPercent(*percent)
+}
+
+// fromEnv returns the percentage the runtime started with: GOGC from the
+// environment, or 100
+func fromEnv() int {
+	switch gogc := os.Getenv("GOGC"); gogc {
+	case "":
+		return 100
+	case "off":
+		return -1
+	default:
+		if n, err := strconv.Atoi(gogc); err == nil {
+			return n
+		}
+		return 100
+	}
+}
+
+// Stats formats GC activity for the periodic output
+func Stats() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return fmt.Sprintf("GC cycles: %d  |  GC pause total: %v  |  GOGC: %d",
+		m.NumGC, time.Duration(m.PauseTotalNs).Round(time.Microsecond), *percent)
+}
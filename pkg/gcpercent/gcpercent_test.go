@@ -0,0 +1,78 @@
+package gcpercent
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/health"
+)
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		gogc string
+		want int
+	}{
+		{"", 100},
+		{"off", -1},
+		{"25", 25},
+		{"lots", 100},
+	}
+	for _, tt := range tests {
+		t.Setenv("GOGC", tt.gogc)
+		if got := fromEnv(); got != tt.want {
+			t.Errorf("GOGC=%q: fromEnv() = %d, want %d", tt.gogc, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(100))
+	defer flag.Set("gcpercent", flag.Lookup("gcpercent").Value.String())
+
+	if err := flag.Set("gcpercent", "25"); err != nil {
+		t.Fatal(err)
+	}
+	Apply()
+	if got := health.Read().GCPercent; got != 25 {
+		t.Errorf("after -gcpercent 25, /healthz reports gc_percent %d", got)
+	}
+	if s := Stats(); !strings.HasSuffix(s, "GOGC: 25") {
+		t.Errorf("Stats() = %q, want GOGC: 25", s)
+	}
+}
+
+// TestApplyDoesNotFixALeak holds on to 80 MB at each GC percentage: memory
+// that is still referenced can't be collected, so /healthz calls a leak
+// whatever the setting
+func TestApplyDoesNotFixALeak(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(100))
+	defer flag.Set("gcpercent", flag.Lookup("gcpercent").Value.String())
+
+	for _, p := range []string{"10", "100", "400"} {
+		flag.Set("gcpercent", p)
+		Apply()
+		runtime.GC() // drop the last round's 80 MB from the baseline
+		h := health.Handler(health.Read())
+
+		var held [][]byte
+		for i := 0; i < 80; i++ {
+			held = append(held, make([]byte, 1<<20))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var s health.Status
+		if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Verdict != "leak suspected" {
+			t.Errorf("-gcpercent %s: verdict %q with the heap %d MB over its baseline, want leak suspected", p, s.Verdict, s.HeapDeltaBytes>>20)
+		}
+		runtime.KeepAlive(held)
+	}
+}
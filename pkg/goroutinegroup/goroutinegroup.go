@@ -0,0 +1,66 @@
+// Package goroutinegroup counts the live goroutines by wait state, the
+// at-a-glance breakdown that points a goroutine leak at "chan send" or
+// "select" before anyone reads a profile.
+package goroutinegroup
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ByState parses a full goroutine dump and counts goroutines by wait state,
+// e.g. {"chan send": 500, "select": 2, "IO wait": 1}. Durations such as
+// "chan send, 2 minutes" are folded into their state, and older runtimes
+// that report a blocked Mutex.Lock as "semacquire" are mapped to
+// "sync.Mutex.Lock".
+func ByState() map[string]int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	groups := make(map[string]int)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		// Header line: "goroutine 42 [chan send, 2 minutes]:"
+		header, _, _ := strings.Cut(g, "\n")
+		open := strings.IndexByte(header, '[')
+		end := strings.LastIndexByte(header, ']')
+		if open < 0 || end < open {
+			continue
+		}
+		state, _, _ := strings.Cut(header[open+1:end], ",")
+		if state == "semacquire" && strings.Contains(g, "sync.(*Mutex).Lock") {
+			state = "sync.Mutex.Lock"
+		}
+		groups[state]++
+	}
+	return groups
+}
+
+// Format renders ByState output largest bucket first, e.g.
+// "500 in chan send, 2 in select"
+func Format(groups map[string]int) string {
+	states := make([]string, 0, len(groups))
+	for state := range groups {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if groups[states[i]] != groups[states[j]] {
+			return groups[states[i]] > groups[states[j]]
+		}
+		return states[i] < states[j]
+	})
+
+	parts := make([]string, len(states))
+	for i, state := range states {
+		parts[i] = fmt.Sprintf("%d in %s", groups[state], state)
+	}
+	return strings.Join(parts, ", ")
+}
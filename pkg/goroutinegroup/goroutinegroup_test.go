@@ -0,0 +1,105 @@
+package goroutinegroup
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestByState blocks a known number of goroutines in each wait state and
+// checks that ByState reports exactly that many more
+func TestByState(t *testing.T) {
+	want := map[string]int{
+		"chan send":       20,
+		"chan receive":    10,
+		"select":          5,
+		"sync.Mutex.Lock": 3,
+		"IO wait":         2,
+	}
+	before := ByState()
+
+	// Every goroutine is waited for on the way out, so none of them is
+	// still parked when the next run takes its baseline
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	sendCh := make(chan int)
+	recvCh := make(chan int)
+	for i := 0; i < want["chan send"]; i++ {
+		wg.Go(func() { sendCh <- 1 })
+	}
+	for i := 0; i < want["chan receive"]; i++ {
+		wg.Go(func() { <-recvCh })
+	}
+	for i := 0; i < want["select"]; i++ {
+		wg.Go(func() {
+			select {
+			case <-release:
+			case <-recvCh:
+			}
+		})
+	}
+
+	var mu sync.Mutex
+	mu.Lock()
+	for i := 0; i < want["sync.Mutex.Lock"]; i++ {
+		wg.Go(func() {
+			mu.Lock()
+			mu.Unlock()
+		})
+	}
+
+	var listeners []net.Listener
+	for i := 0; i < want["IO wait"]; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+		wg.Go(func() { ln.Accept() })
+	}
+
+	defer func() {
+		close(release)
+		mu.Unlock()
+		for i := 0; i < want["chan send"]; i++ {
+			<-sendCh
+		}
+		close(recvCh)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		wg.Wait()
+	}()
+
+	// Poll instead of a fixed sleep, so a slow machine has time to park
+	// every goroutine
+	var got map[string]int
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		got = ByState()
+		ok := true
+		for state, n := range want {
+			if got[state]-before[state] != n {
+				ok = false
+			}
+		}
+		if ok || time.Now().After(deadline) {
+			break
+		}
+	}
+	for state, n := range want {
+		if added := got[state] - before[state]; added != n {
+			t.Errorf("%s: %d more goroutines, want %d", state, added, n)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	groups := map[string]int{"select": 2, "chan send": 500, "IO wait": 2}
+	if got, want := Format(groups), "500 in chan send, 2 in IO wait, 2 in select"; got != want {
+		t.Errorf("Format = %q, want %q", got, want)
+	}
+	if got := Format(nil); got != "" {
+		t.Errorf("Format(nil) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Package goroutinequota caps how many goroutines each label may run at
+// once, so one workload in a multi-tenant process can't crowd out the
+// others.
+package goroutinequota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrExceeded is returned by Quota.Acquire when a label is at its limit,
+// and by Quota.Wait when it gives up
+var ErrExceeded = errors.New("goroutine quota exceeded")
+
+// Quota counts the goroutines running under each label against that label's
+// limit. Labels without a limit of their own get the default.
+type Quota struct {
+	mu           sync.Mutex
+	defaultLimit int
+	limits       map[string]int
+	running      map[string]int
+	freed        chan struct{} // closed and replaced whenever a slot is released
+}
+
+func New(defaultLimit int) *Quota {
+	return &Quota{
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]int),
+		running:      make(map[string]int),
+		freed:        make(chan struct{}),
+	}
+}
+
+// SetLimit sets label's limit, overriding the default
+func (q *Quota) SetLimit(label string, limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits[label] = limit
+}
+
+// Acquire counts one more goroutine running under label, or returns
+// ErrExceeded if label is already at its limit. Call the returned func
+// when the goroutine exits; calling it again has no effect.
+func (q *Quota) Acquire(label string) (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.acquireLocked(label)
+}
+
+// Wait is Acquire that blocks until label has a free slot instead of failing.
+// It returns ErrExceeded only if stop is closed first.
+func (q *Quota) Wait(label string, stop <-chan struct{}) (func(), error) {
+	for {
+		q.mu.Lock()
+		release, err := q.acquireLocked(label)
+		freed := q.freed
+		q.mu.Unlock()
+		if err == nil {
+			return release, nil
+		}
+
+		select {
+		case <-freed:
+		case <-stop:
+			return nil, err
+		}
+	}
+}
+
+// acquireLocked is Acquire with q.mu held
+func (q *Quota) acquireLocked(label string) (func(), error) {
+	limit, ok := q.limits[label]
+	if !ok {
+		limit = q.defaultLimit
+	}
+	if q.running[label] >= limit {
+		return nil, fmt.Errorf("%w: %s is running %d of %d", ErrExceeded, label, q.running[label], limit)
+	}
+	q.running[label]++
+
+	var released int32
+	return func() {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			return
+		}
+		q.mu.Lock()
+		q.running[label]--
+		if q.running[label] == 0 {
+			delete(q.running, label)
+		}
+		close(q.freed)
+		q.freed = make(chan struct{})
+		q.mu.Unlock()
+	}, nil
+}
+
+// Running returns how many goroutines are running under label
+func (q *Quota) Running(label string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running[label]
+}
@@ -0,0 +1,81 @@
+package goroutinequota
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLimits(t *testing.T) {
+	q := New(2)
+	q.SetLimit("A", 1)
+
+	releaseA, err := q.Acquire("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Acquire("A"); !errors.Is(err, ErrExceeded) {
+		t.Errorf("second Acquire(A) = %v, want ErrExceeded", err)
+	}
+	for i := range 2 {
+		if _, err := q.Acquire("B"); err != nil {
+			t.Errorf("Acquire(B) #%d = %v, want the default limit of 2", i+1, err)
+		}
+	}
+	if _, err := q.Acquire("B"); !errors.Is(err, ErrExceeded) {
+		t.Errorf("third Acquire(B) = %v, want ErrExceeded", err)
+	}
+
+	releaseA()
+	releaseA()
+	if got := q.Running("A"); got != 0 {
+		t.Errorf("Running(A) after releasing twice = %d, want 0", got)
+	}
+	if got := q.Running("B"); got != 2 {
+		t.Errorf("Running(B) = %d, want 2", got)
+	}
+	if _, err := q.Acquire("A"); err != nil {
+		t.Errorf("Acquire(A) after release = %v", err)
+	}
+}
+
+func TestWaitGetsFreedSlot(t *testing.T) {
+	q := New(1)
+	release, err := q.Acquire("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		release, err := q.Wait("A", nil)
+		if err == nil {
+			release()
+		}
+		got <- err
+	}()
+
+	select {
+	case err := <-got:
+		t.Fatalf("Wait returned %v while A was at its limit", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Errorf("Wait = %v, want a slot", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait still blocked after the slot was released")
+	}
+}
+
+func TestWaitStops(t *testing.T) {
+	q := New(0)
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := q.Wait("A", stop); !errors.Is(err, ErrExceeded) {
+		t.Errorf("Wait with stop closed = %v, want ErrExceeded", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package goroutineresources counts what each request uses, bytes allocated
+// and descriptors opened and closed, through the request's context, so
+// helpers deep in the call chain can record usage without extra parameters.
+// Routes sums the counts per route, to show which kind of request puts the
+// most pressure on resources.
+package goroutineresources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// accounting holds one request's resource counters
+type accounting struct {
+	allocBytes int64
+	fdsOpened  int64
+	fdsClosed  int64
+}
+
+// Usage is what a request used, taken when its handler finishes
+type Usage struct {
+	AllocBytes int64
+	FDsOpened  int64
+	FDsClosed  int64
+}
+
+// FDsLeaked is how many descriptors the request opened but didn't close
+func (u Usage) FDsLeaked() int64 {
+	return u.FDsOpened - u.FDsClosed
+}
+
+type accountingKey struct{}
+
+// WithTracking returns a copy of ctx that carries fresh resource counters
+func WithTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, accountingKey{}, &accounting{})
+}
+
+// accountingFrom returns ctx's counters, or nil when ctx isn't tracked
+func accountingFrom(ctx context.Context) *accounting {
+	a, _ := ctx.Value(accountingKey{}).(*accounting)
+	return a
+}
+
+// RecordAlloc adds bytes to ctx's allocation count. The Record functions are
+// no-ops on an untracked context.
+func RecordAlloc(ctx context.Context, bytes int64) {
+	if a := accountingFrom(ctx); a != nil {
+		atomic.AddInt64(&a.allocBytes, bytes)
+	}
+}
+
+// RecordFDOpen counts a descriptor opened on behalf of ctx's request
+func RecordFDOpen(ctx context.Context) {
+	if a := accountingFrom(ctx); a != nil {
+		atomic.AddInt64(&a.fdsOpened, 1)
+	}
+}
+
+// RecordFDClose counts a descriptor closed on behalf of ctx's request
+func RecordFDClose(ctx context.Context) {
+	if a := accountingFrom(ctx); a != nil {
+		atomic.AddInt64(&a.fdsClosed, 1)
+	}
+}
+
+// Report returns ctx's totals so far
+func Report(ctx context.Context) Usage {
+	a := accountingFrom(ctx)
+	if a == nil {
+		return Usage{}
+	}
+	return Usage{
+		AllocBytes: atomic.LoadInt64(&a.allocBytes),
+		FDsOpened:  atomic.LoadInt64(&a.fdsOpened),
+		FDsClosed:  atomic.LoadInt64(&a.fdsClosed),
+	}
+}
+
+// Routes sums the usage of every finished request per route
+type Routes struct {
+	mu     sync.Mutex
+	routes map[string]*routeTotals
+}
+
+type routeTotals struct {
+	requests int64
+	Usage
+}
+
+func NewRoutes() *Routes {
+	return &Routes{routes: make(map[string]*routeTotals)}
+}
+
+// Track gives each request to h its own counters and adds the request's
+// usage to route's totals when h returns
+func (rs *Routes) Track(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithTracking(r.Context())
+		h(w, r.WithContext(ctx))
+		rs.add(route, Report(ctx))
+	}
+}
+
+func (rs *Routes) add(route string, rep Usage) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	t, ok := rs.routes[route]
+	if !ok {
+		t = &routeTotals{}
+		rs.routes[route] = t
+	}
+	t.requests++
+	t.AllocBytes += rep.AllocBytes
+	t.FDsOpened += rep.FDsOpened
+	t.FDsClosed += rep.FDsClosed
+}
+
+// String formats per-request averages for each route, busiest first
+func (rs *Routes) String() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	names := make([]string, 0, len(rs.routes))
+	for name := range rs.routes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return rs.routes[names[i]].requests > rs.routes[names[j]].requests
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		t := rs.routes[name]
+		parts = append(parts, fmt.Sprintf("%s: %d req, %d B/req, %.1f FDs/req, %d leaked",
+			name, t.requests, t.AllocBytes/t.requests,
+			float64(t.FDsOpened)/float64(t.requests), t.FDsLeaked()))
+	}
+	return strings.Join(parts, "  |  ")
+}
@@ -0,0 +1,73 @@
+package goroutineresources
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	ctx := WithTracking(context.Background())
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			RecordAlloc(ctx, 100)
+			RecordFDOpen(ctx)
+		})
+	}
+	wg.Wait()
+	RecordFDClose(ctx)
+
+	got := Report(ctx)
+	if want := (Usage{AllocBytes: 1000, FDsOpened: 10, FDsClosed: 1}); got != want {
+		t.Errorf("Report = %+v, want %+v", got, want)
+	}
+	if got.FDsLeaked() != 9 {
+		t.Errorf("FDsLeaked = %d, want 9", got.FDsLeaked())
+	}
+
+	// A nested WithTracking starts from zero and leaves the outer counts alone
+	inner := WithTracking(ctx)
+	RecordAlloc(inner, 5)
+	if got := Report(inner).AllocBytes; got != 5 {
+		t.Errorf("inner AllocBytes = %d, want 5", got)
+	}
+	if got := Report(ctx).AllocBytes; got != 1000 {
+		t.Errorf("outer AllocBytes = %d, want 1000", got)
+	}
+}
+
+func TestUntracked(t *testing.T) {
+	ctx := context.Background()
+	RecordAlloc(ctx, 100)
+	RecordFDOpen(ctx)
+	RecordFDClose(ctx)
+	if got := Report(ctx); got != (Usage{}) {
+		t.Errorf("Report of an untracked context = %+v, want zero", got)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	routes := NewRoutes()
+	cheap := routes.Track("/cheap", func(w http.ResponseWriter, r *http.Request) {
+		RecordAlloc(r.Context(), 10)
+	})
+	leaky := routes.Track("/leaky", func(w http.ResponseWriter, r *http.Request) {
+		RecordAlloc(r.Context(), 1000)
+		RecordFDOpen(r.Context())
+	})
+	for range 3 {
+		cheap(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cheap", nil))
+	}
+	leaky(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/leaky", nil))
+
+	want := "/cheap: 3 req, 10 B/req, 0.0 FDs/req, 0 leaked  |  /leaky: 1 req, 1000 B/req, 1.0 FDs/req, 1 leaked"
+	if got := routes.String(); got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	if got := NewRoutes().String(); got != "" {
+		t.Errorf("String with no requests = %q, want empty", got)
+	}
+}
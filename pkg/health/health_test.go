@@ -0,0 +1,76 @@
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+// get serves one /healthz request on h, checks it is a 200 with a JSON body
+// holding every field of Status and nothing else, and decodes it
+func get(t *testing.T, h http.HandlerFunc) Status {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /healthz: status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("body %q: %v", rec.Body.String(), err)
+	}
+	fields := []string{"goroutines", "heap_alloc_bytes", "open_fds", "goroutine_delta", "heap_delta_bytes",
+		"fd_delta", "gc_percent", "num_gc", "gc_pause_total_ns", "verdict"}
+	for _, field := range fields {
+		if _, found := raw[field]; !found {
+			t.Errorf("body %q has no %q", rec.Body.String(), field)
+		}
+	}
+	if len(raw) != len(fields) {
+		t.Errorf("body has %d fields, want %d", len(raw), len(fields))
+	}
+
+	var s Status
+	dec := json.NewDecoder(bytes.NewReader(rec.Body.Bytes()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(Read())
+
+	s := get(t, h)
+	if s.Verdict != "ok" || s.Goroutines < 1 || s.OpenFDs == 0 {
+		t.Errorf("healthy: %+v, want verdict ok", s)
+	}
+
+	// 150 blocked goroutines are past the threshold of 100
+	const leaked = 150
+	block := make(chan struct{})
+	defer close(block)
+	for i := 0; i < leaked; i++ {
+		go func() { <-block }()
+	}
+	s = get(t, h)
+	if s.Verdict != "leak suspected" || s.GoroutineDelta < leaked {
+		t.Errorf("leaking: verdict %q with %d more goroutines, want leak suspected", s.Verdict, s.GoroutineDelta)
+	}
+}
+
+func TestReadGCPercent(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(37))
+	if got := Read().GCPercent; got != 37 {
+		t.Errorf("GCPercent = %d, want 37", got)
+	}
+	debug.SetGCPercent(-1)
+	if got := Read().GCPercent; got != -1 {
+		t.Errorf("GCPercent with the GC off = %d, want -1", got)
+	}
+}
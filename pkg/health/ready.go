@@ -0,0 +1,88 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Check is one named readiness check. Run returns nil when the component is
+// healthy, or the reason it isn't.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// PoolLoad is one snapshot of a worker pool's load
+type PoolLoad struct {
+	QueueLen int // tasks waiting in the shared queue
+	QueueCap int // capacity of the shared queue
+	Busy     int // workers running a task
+	Workers  int
+}
+
+// Pool is what WorkerPoolCheck reads from a worker pool
+type Pool interface {
+	Load() PoolLoad
+	// RejectionRate returns the share of recent submits that were rejected,
+	// and how many submits that was
+	RejectionRate() (rate float64, calls int64)
+}
+
+// WorkerPoolCheck fails while pool's shared queue is more than
+// maxQueueOccupancy full, or while more than maxRejectionRate of its recent
+// submits were rejected. Both are fractions from 0 to 1. The rejection rate
+// keeps the check failing for a while after the queue drains, so a pool
+// that only just recovered isn't sent a new flood at once.
+func WorkerPoolCheck(pool Pool, maxQueueOccupancy, maxRejectionRate float64) Check {
+	return Check{Name: "worker_pool", Run: func() error {
+		var problems []string
+		l := pool.Load()
+		if l.QueueCap > 0 {
+			if occ := float64(l.QueueLen) / float64(l.QueueCap); occ > maxQueueOccupancy {
+				problems = append(problems, fmt.Sprintf("queue %.0f%% full (max %.0f%%) with %d of %d workers busy",
+					occ*100, maxQueueOccupancy*100, l.Busy, l.Workers))
+			}
+		}
+		if rate, calls := pool.RejectionRate(); rate > maxRejectionRate {
+			problems = append(problems, fmt.Sprintf("%.0f%% of %d recent submits rejected (max %.0f%%)",
+				rate*100, calls, maxRejectionRate*100))
+		}
+		if len(problems) > 0 {
+			return errors.New(strings.Join(problems, ", "))
+		}
+		return nil
+	}}
+}
+
+// checkResult is one check's entry in the ReadyHandler response
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadyHandler runs every check on each request and serves the results as
+// JSON, with 200 if all of them pass and 503 if any fails. Unlike Handler,
+// which reports leak indicators for a person to read, the status code is
+// meant for a load balancer deciding whether to send more work.
+func ReadyHandler(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		results := make([]checkResult, 0, len(checks))
+		for _, c := range checks {
+			res := checkResult{Name: c.Name, Status: "ok"}
+			if err := c.Run(); err != nil {
+				res.Status, res.Error = "failing", err.Error()
+				status = http.StatusServiceUnavailable
+			}
+			results = append(results, res)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	}
+}
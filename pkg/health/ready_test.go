@@ -0,0 +1,87 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakePool reports a fixed load and rejection rate
+type fakePool struct {
+	load  PoolLoad
+	rate  float64
+	calls int64
+}
+
+func (p *fakePool) Load() PoolLoad                  { return p.load }
+func (p *fakePool) RejectionRate() (float64, int64) { return p.rate, p.calls }
+
+func TestWorkerPoolCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pool fakePool
+		want []string // substrings of the error, none if the check passes
+	}{
+		{"idle", fakePool{load: PoolLoad{QueueCap: 10, Workers: 2}}, nil},
+		{"at the limit", fakePool{load: PoolLoad{QueueLen: 8, QueueCap: 10, Busy: 2, Workers: 2}, rate: 0.1, calls: 10}, nil},
+		{"queue full", fakePool{load: PoolLoad{QueueLen: 10, QueueCap: 10, Busy: 2, Workers: 2}},
+			[]string{"queue 100% full (max 80%) with 2 of 2 workers busy"}},
+		{"rejecting", fakePool{load: PoolLoad{QueueCap: 10, Workers: 2}, rate: 0.5, calls: 40},
+			[]string{"50% of 40 recent submits rejected (max 10%)"}},
+		{"both", fakePool{load: PoolLoad{QueueLen: 9, QueueCap: 10, Busy: 1, Workers: 2}, rate: 0.2, calls: 5},
+			[]string{"queue 90% full", "1 of 2 workers busy", "20% of 5 recent submits"}},
+		{"unbuffered", fakePool{load: PoolLoad{Busy: 2, Workers: 2}}, nil},
+	} {
+		err := WorkerPoolCheck(&tc.pool, 0.8, 0.1).Run()
+		if tc.want == nil {
+			if err != nil {
+				t.Errorf("%s: %v, want nil", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: nil, want %q", tc.name, tc.want)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: %q, want it to contain %q", tc.name, err, want)
+			}
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	failing := errors.New("down")
+	serve := func(checks ...Check) (int, []checkResult) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ReadyHandler(checks...)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		var results []checkResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("body %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, results
+	}
+	ok := Check{Name: "a", Run: func() error { return nil }}
+	bad := Check{Name: "b", Run: func() error { return failing }}
+
+	code, results := serve(ok)
+	if code != http.StatusOK || len(results) != 1 || results[0] != (checkResult{Name: "a", Status: "ok"}) {
+		t.Errorf("passing: %d %+v, want 200 with a ok", code, results)
+	}
+	code, results = serve(ok, bad)
+	want := []checkResult{{Name: "a", Status: "ok"}, {Name: "b", Status: "failing", Error: "down"}}
+	if code != http.StatusServiceUnavailable || len(results) != 2 || results[0] != want[0] || results[1] != want[1] {
+		t.Errorf("failing: %d %+v, want 503 with %+v", code, results, want)
+	}
+	if code, results = serve(); code != http.StatusOK || len(results) != 0 {
+		t.Errorf("no checks: %d %+v, want 200 and []", code, results)
+	}
+}
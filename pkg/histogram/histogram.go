@@ -0,0 +1,103 @@
+// Package histogram counts durations in fixed buckets, for latency
+// percentiles that cost one atomic add per observation. The loop examples
+// time file operations with it and the worker pool times its tasks.
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram counts durations in fixed buckets. Bucket i holds observations
+// no larger than bounds[i] and above bounds[i-1]; one more bucket holds
+// everything above the last bound. Observe is safe for concurrent use.
+type Histogram struct {
+	bounds []time.Duration
+	counts []int64
+	max    int64 // nanoseconds
+}
+
+// New returns a histogram with the given ascending bucket bounds
+func New(bounds []time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// Series125 returns bucket bounds in a 1-2-5 series, 1, 2, 5, 10, 20 and so
+// on times from, up to and including the last one no larger than to
+func Series125(from, to time.Duration) []time.Duration {
+	var bounds []time.Duration
+	for decade := from; decade <= to; decade *= 10 {
+		for _, step := range []time.Duration{1, 2, 5} {
+			if b := decade * step; b <= to {
+				bounds = append(bounds, b)
+			}
+		}
+	}
+	return bounds
+}
+
+// Observe adds d to its bucket
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	for {
+		cur := atomic.LoadInt64(&h.max)
+		if int64(d) <= cur || atomic.CompareAndSwapInt64(&h.max, cur, int64(d)) {
+			break
+		}
+	}
+}
+
+// Reset zeroes every bucket and the max. Observations made while it runs
+// may survive it.
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() int64 {
+	var n int64
+	for i := range h.counts {
+		n += atomic.LoadInt64(&h.counts[i])
+	}
+	return n
+}
+
+// Max returns the largest observation
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.max))
+}
+
+// Quantile returns the upper bound of the bucket holding the q-th
+// observation, so the true value is at most that. In the overflow bucket it
+// returns Max. It returns 0 for an empty histogram.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, bound := range h.bounds {
+		seen += atomic.LoadInt64(&h.counts[i])
+		if seen >= rank {
+			return bound
+		}
+	}
+	return h.Max()
+}
+
+// String formats p50, p95 and max for a final report
+func (h *Histogram) String() string {
+	return fmt.Sprintf("p50 ≤%-7v p95 ≤%-7v max %-10v (n=%d)",
+		h.Quantile(0.50), h.Quantile(0.95), h.Max().Round(time.Microsecond), h.Count())
+}
@@ -0,0 +1,101 @@
+package histogram
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBounds = []time.Duration{10 * time.Microsecond, 100 * time.Microsecond, time.Millisecond}
+
+func TestBucketBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		d    time.Duration
+		want time.Duration
+	}{
+		{"0 goes in the first bucket", 0, 10 * time.Microsecond},
+		{"a value equal to a bound goes in that bound's bucket", 10 * time.Microsecond, 10 * time.Microsecond},
+		{"1ns above a bound goes in the next bucket", 10*time.Microsecond + 1, 100 * time.Microsecond},
+		{"the last bound is inclusive too", time.Millisecond, time.Millisecond},
+		{"above the last bound, Quantile reports the max", 3 * time.Millisecond, 3 * time.Millisecond},
+	} {
+		h := New(testBounds)
+		h.Observe(tc.d)
+		if got := h.Quantile(1); got != tc.want {
+			t.Errorf("%s: Observe(%v) then Quantile(1) = %v, want %v", tc.desc, tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	h := New(testBounds)
+	if h.Quantile(0.5) != 0 || h.Count() != 0 || h.Max() != 0 {
+		t.Errorf("empty histogram: Quantile %v, Count %d, Max %v, want all 0", h.Quantile(0.5), h.Count(), h.Max())
+	}
+
+	// 90x5µs, 9x50µs, 1x2s
+	for i := 0; i < 90; i++ {
+		h.Observe(5 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(50 * time.Microsecond)
+	}
+	h.Observe(2 * time.Second)
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 10 * time.Microsecond},
+		{0.5, 10 * time.Microsecond},
+		{0.9, 10 * time.Microsecond},
+		{0.95, 100 * time.Microsecond},
+		{0.99, 100 * time.Microsecond},
+		{1, 2 * time.Second},
+	} {
+		if got := h.Quantile(tc.q); got != tc.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tc.q, got, tc.want)
+		}
+	}
+	if h.Max() != 2*time.Second || h.Count() != 100 {
+		t.Errorf("Max %v, Count %d, want 2s and 100", h.Max(), h.Count())
+	}
+
+	h.Reset()
+	if h.Count() != 0 || h.Max() != 0 || h.Quantile(1) != 0 {
+		t.Errorf("after Reset: Count %d, Max %v, Quantile(1) %v, want all 0", h.Count(), h.Max(), h.Quantile(1))
+	}
+}
+
+func TestConcurrentObserve(t *testing.T) {
+	h := New(testBounds)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Go(func() {
+			for i := 0; i < 1000; i++ {
+				h.Observe(time.Duration(g*1000+i) * time.Microsecond)
+			}
+		})
+	}
+	wg.Wait()
+	if h.Count() != 8000 || h.Max() != 7999*time.Microsecond {
+		t.Errorf("Count %d, Max %v, want 8000 and 7.999ms", h.Count(), h.Max())
+	}
+}
+
+func TestSeries125(t *testing.T) {
+	got := Series125(time.Microsecond, time.Millisecond)
+	want := []time.Duration{
+		1 * time.Microsecond, 2 * time.Microsecond, 5 * time.Microsecond,
+		10 * time.Microsecond, 20 * time.Microsecond, 50 * time.Microsecond,
+		100 * time.Microsecond, 200 * time.Microsecond, 500 * time.Microsecond,
+		1 * time.Millisecond,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Series125(1µs, 1ms) = %v, want %v", got, want)
+	}
+	if got := Series125(time.Microsecond, 10*time.Second); len(got) != 22 || got[len(got)-1] != 10*time.Second {
+		t.Errorf("Series125(1µs, 10s) = %v, want 22 bounds ending at 10s", got)
+	}
+}
@@ -0,0 +1,191 @@
+// Package leakreport snapshots a process's leak indicators, goroutines
+// grouped by stack, heap and open file descriptors, and diffs two snapshots
+// into a LeakReport that names the stacks that grew.
+package leakreport
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// ResourceSnapshot is every leak indicator at one moment: the goroutines,
+// grouped by stack, the heap and the open FDs
+type ResourceSnapshot struct {
+	Taken          time.Time
+	Goroutines     int
+	Stacks         map[string]int // goroutines by stack, see goroutineStacks
+	HeapAllocBytes uint64
+	OpenFDs        int // -1 when the platform doesn't expose them
+}
+
+// Snapshot captures a ResourceSnapshot. Its parts are read one after the
+// other, so a busy process can move a little between them.
+func Snapshot() ResourceSnapshot {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return ResourceSnapshot{
+		Taken:          time.Now(),
+		Goroutines:     runtime.NumGoroutine(),
+		Stacks:         goroutineStacks(),
+		HeapAllocBytes: m.HeapAlloc,
+		OpenFDs:        fdcount.Count(),
+	}
+}
+
+// maxStackFrames is how many frames of a stack goroutineStacks keeps
+const maxStackFrames = 8
+
+// goroutineStacks counts the live goroutines by stack, read from the debug=1
+// goroutine profile, which already groups identical stacks and leaves out
+// the runtime's own frames. A key is the stack's frames, innermost first, one
+// "function (file:line)" per line, at most maxStackFrames of them.
+func goroutineStacks() map[string]int {
+	var profile strings.Builder
+	pprof.Lookup("goroutine").WriteTo(&profile, 1)
+
+	stacks := make(map[string]int)
+	count := 0
+	var frames []string
+	flush := func() {
+		if len(frames) == 0 {
+			frames = []string{"(runtime frames only)"}
+		}
+		if len(frames) > maxStackFrames {
+			frames = append(frames[:maxStackFrames], "...")
+		}
+		if count > 0 {
+			stacks[strings.Join(frames, "\n")] += count
+		}
+		count, frames = 0, nil
+	}
+	for _, line := range strings.Split(profile.String(), "\n") {
+		// "3 @ 0x43e1ee 0x44f2c5 ..." starts a stack shared by 3 goroutines
+		if n, rest, found := strings.Cut(line, " @ "); found && !strings.HasPrefix(rest, " ") {
+			flush()
+			count, _ = strconv.Atoi(n)
+			continue
+		}
+		// "#  0x44f2c4  main.worker+0x44  /path/to/example.go:42" is a frame
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "#" {
+			continue
+		}
+		fn, _, _ := strings.Cut(fields[2], "+0x")
+		file := fields[3][strings.LastIndex(fields[3], "/")+1:]
+		frames = append(frames, fmt.Sprintf("%s (%s)", fn, file))
+	}
+	flush()
+	return stacks
+}
+
+// LeakReport is what changed between two snapshots
+type LeakReport struct {
+	Elapsed        time.Duration
+	GoroutineDelta int
+	HeapDeltaMB    float64
+	FDDelta        int // 0 when either snapshot has no FD count
+
+	// NewGoroutineStacks lists the stacks with more goroutines than before,
+	// most added first, each as "+N" and its frames
+	NewGoroutineStacks []string
+}
+
+// Diff compares two snapshots of the same process
+func Diff(before, after ResourceSnapshot) LeakReport {
+	r := LeakReport{
+		Elapsed:        after.Taken.Sub(before.Taken),
+		GoroutineDelta: after.Goroutines - before.Goroutines,
+		HeapDeltaMB:    (float64(after.HeapAllocBytes) - float64(before.HeapAllocBytes)) / (1 << 20),
+	}
+	if before.OpenFDs >= 0 && after.OpenFDs >= 0 {
+		r.FDDelta = after.OpenFDs - before.OpenFDs
+	}
+
+	type grown struct {
+		stack string
+		added int
+	}
+	var stacks []grown
+	for stack, n := range after.Stacks {
+		if added := n - before.Stacks[stack]; added > 0 {
+			stacks = append(stacks, grown{stack, added})
+		}
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].added != stacks[j].added {
+			return stacks[i].added > stacks[j].added
+		}
+		return stacks[i].stack < stacks[j].stack
+	})
+	for _, g := range stacks {
+		r.NewGoroutineStacks = append(r.NewGoroutineStacks, fmt.Sprintf("+%d %s", g.added, g.stack))
+	}
+	return r
+}
+
+// IsClean reports whether every delta is within its tolerance
+func (r LeakReport) IsClean(goroutineTolerance int, heapMBTolerance float64, fdTolerance int) bool {
+	return r.GoroutineDelta <= goroutineTolerance && r.HeapDeltaMB <= heapMBTolerance && r.FDDelta <= fdTolerance
+}
+
+// Verdict is IsClean as the word Handler prints: "clean", or "leak suspected"
+func (r LeakReport) Verdict(goroutineTolerance int, heapMBTolerance float64, fdTolerance int) string {
+	if r.IsClean(goroutineTolerance, heapMBTolerance, fdTolerance) {
+		return "clean"
+	}
+	return "leak suspected"
+}
+
+// String formats the report as a diff: the deltas on one line, then each new
+// stack with its frames indented under its count
+func (r LeakReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Over %v: goroutines %+d  |  heap %+.1f MB  |  FDs %+d\n",
+		r.Elapsed.Round(time.Millisecond), r.GoroutineDelta, r.HeapDeltaMB, r.FDDelta)
+	if len(r.NewGoroutineStacks) == 0 {
+		b.WriteString("No new goroutine stacks\n")
+	}
+	for _, stack := range r.NewGoroutineStacks {
+		b.WriteString(strings.ReplaceAll(stack, "\n", "\n      ") + "\n")
+	}
+	return b.String()
+}
+
+// Handler serves a LeakReport from baseline to now, as text, leaving out the
+// goroutine serving the request. Given all three of ?goroutines=, ?heap_mb=
+// and ?fds=, it adds a "Verdict:" line for those tolerances. The examples
+// mount it at /debug/leakreport.
+func Handler(baseline ResourceSnapshot) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := Snapshot()
+		for stack := range now.Stacks {
+			if strings.Contains(stack, "leakreport.Handler") {
+				now.Goroutines--
+				if now.Stacks[stack]--; now.Stacks[stack] == 0 {
+					delete(now.Stacks, stack)
+				}
+				break
+			}
+		}
+		report := Diff(baseline, now)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, report)
+
+		q := r.URL.Query()
+		goroutines, err1 := strconv.Atoi(q.Get("goroutines"))
+		heapMB, err2 := strconv.ParseFloat(q.Get("heap_mb"), 64)
+		fds, err3 := strconv.Atoi(q.Get("fds"))
+		if err1 == nil && err2 == nil && err3 == nil {
+			fmt.Fprintf(w, "Verdict: %s (tolerance: goroutines %d, heap %.1f MB, FDs %d)\n",
+				report.Verdict(goroutines, heapMB, fds), goroutines, heapMB, fds)
+		}
+	}
+}
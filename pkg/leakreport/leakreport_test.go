@@ -0,0 +1,164 @@
+package leakreport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockOn parks a goroutine until ch is closed, under a name the tests can
+// find in its stack
+func blockOn(ch chan struct{}) {
+	<-ch
+}
+
+// inBlockOn returns how many goroutines a snapshot shows in blockOn
+func inBlockOn(s ResourceSnapshot) int {
+	for stack, n := range s.Stacks {
+		if strings.Contains(stack, "leakreport.blockOn") {
+			return n
+		}
+	}
+	return 0
+}
+
+// startBlocked starts n goroutines in blockOn and waits until Snapshot shows
+// all of them there, not just created. They are released when the test ends,
+// which waits for them to exit so the next test starts without them.
+func startBlocked(t *testing.T, n int) {
+	t.Helper()
+	release := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go blockOn(release)
+	}
+	waitInBlockOn(t, n)
+	t.Cleanup(func() {
+		close(release)
+		waitInBlockOn(t, 0)
+	})
+}
+
+// waitInBlockOn waits up to 5 seconds for exactly n goroutines in blockOn
+func waitInBlockOn(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for inBlockOn(Snapshot()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines in blockOn, want %d", inBlockOn(Snapshot()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// grownStack returns the entry of r.NewGoroutineStacks for blockOn
+func grownStack(r LeakReport) string {
+	for _, stack := range r.NewGoroutineStacks {
+		if strings.Contains(stack, "leakreport.blockOn") {
+			return stack
+		}
+	}
+	return ""
+}
+
+func TestDiff(t *testing.T) {
+	start := time.Now()
+	before := ResourceSnapshot{
+		Taken:          start,
+		Goroutines:     4,
+		Stacks:         map[string]int{"main.a": 2, "main.b": 2},
+		HeapAllocBytes: 1 << 20,
+		OpenFDs:        10,
+	}
+	after := ResourceSnapshot{
+		Taken:          start.Add(time.Second),
+		Goroutines:     9,
+		Stacks:         map[string]int{"main.a": 3, "main.b": 1, "main.c": 5},
+		HeapAllocBytes: 4 << 20,
+		OpenFDs:        12,
+	}
+
+	r := Diff(before, after)
+	if r.Elapsed != time.Second || r.GoroutineDelta != 5 || r.HeapDeltaMB != 3 || r.FDDelta != 2 {
+		t.Errorf("Diff = %+v, want 1s, +5 goroutines, +3 MB, +2 FDs", r)
+	}
+	want := []string{"+5 main.c", "+1 main.a"}
+	if strings.Join(r.NewGoroutineStacks, "|") != strings.Join(want, "|") {
+		t.Errorf("NewGoroutineStacks = %q, want %q", r.NewGoroutineStacks, want)
+	}
+
+	after.OpenFDs = -1
+	if r := Diff(before, after); r.FDDelta != 0 {
+		t.Errorf("FDDelta without an FD count = %d, want 0", r.FDDelta)
+	}
+}
+
+func TestIsClean(t *testing.T) {
+	r := LeakReport{GoroutineDelta: 10, HeapDeltaMB: 2.5, FDDelta: 3}
+	tests := []struct {
+		goroutines int
+		heapMB     float64
+		fds        int
+		want       bool
+	}{
+		{10, 2.5, 3, true},
+		{9, 2.5, 3, false},
+		{10, 2, 3, false},
+		{10, 2.5, 2, false},
+		{100, 64, 50, true},
+	}
+	for _, tt := range tests {
+		if got := r.IsClean(tt.goroutines, tt.heapMB, tt.fds); got != tt.want {
+			t.Errorf("IsClean(%d, %v, %d) = %v, want %v", tt.goroutines, tt.heapMB, tt.fds, got, tt.want)
+		}
+		want := "leak suspected"
+		if tt.want {
+			want = "clean"
+		}
+		if got := r.Verdict(tt.goroutines, tt.heapMB, tt.fds); got != want {
+			t.Errorf("Verdict(%d, %v, %d) = %q, want %q", tt.goroutines, tt.heapMB, tt.fds, got, want)
+		}
+	}
+}
+
+func TestSnapshotGroupsBlockedGoroutines(t *testing.T) {
+	before := Snapshot()
+	startBlocked(t, 5)
+
+	r := Diff(before, Snapshot())
+	if r.GoroutineDelta != 5 {
+		t.Errorf("GoroutineDelta = %d, want 5", r.GoroutineDelta)
+	}
+	if stack := grownStack(r); !strings.HasPrefix(stack, "+5 ") || !strings.Contains(stack, "leakreport.blockOn (leakreport_test.go:") {
+		t.Errorf("new stacks = %q, want +5 in blockOn", r.NewGoroutineStacks)
+	}
+	if s := r.String(); !strings.Contains(s, "goroutines +5") || !strings.Contains(s, "\n      ") {
+		t.Errorf("String() = %q, want the delta and indented frames", s)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(Snapshot())
+	startBlocked(t, 3)
+
+	get := func(query string) string {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/debug/leakreport"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", query, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	body := get("")
+	if !strings.Contains(body, "+3 github.com/Danialsamadi/Memmory-leaks-go/pkg/leakreport.blockOn") || strings.Contains(body, "Verdict:") {
+		t.Errorf("report without tolerances = %q, want the blockOn stack and no verdict", body)
+	}
+	if body := get("?goroutines=0&heap_mb=64&fds=50"); !strings.Contains(body, "Verdict: leak suspected") {
+		t.Errorf("report with no goroutine tolerance = %q, want leak suspected", body)
+	}
+	if body := get("?goroutines=100&heap_mb=64&fds=50"); !strings.Contains(body, "Verdict: clean") {
+		t.Errorf("report within tolerance = %q, want clean", body)
+	}
+}
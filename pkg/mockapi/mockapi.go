@@ -0,0 +1,235 @@
+// Package mockapi is the upstream HTTP service the 3.Resource-Leaks examples
+// call, with failure modes to leak against and a RequestTracker that shows
+// the leak from the server's side.
+package mockapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+)
+
+// Server is the upstream service the HTTP examples call. Besides the routes
+// an example adds with HandleFunc, it serves failure modes, so timeout and
+// error-path bugs can be shown against it:
+//
+//	/api/slow?delay=2s   answers after delay (default 1s)
+//	/api/hang            never answers, until the client gives up or the server shuts down
+//	/api/flaky?rate=0.3  answers 500 with probability rate (default 0.5)
+//	/api/big?bytes=N     streams an N-byte body in 32 KB chunks (default 1 MB)
+type Server struct {
+	mux     *http.ServeMux
+	server  *http.Server
+	addr    net.Addr
+	done    chan struct{} // closed when Serve returns
+	quit    chan struct{} // closed on Stop; releases /api/hang
+	hanging int64         // /api/hang requests waiting
+	tracker *RequestTracker
+	conns   *conntrack.Tracker
+}
+
+// StopReport says what became of the requests in flight when Stop was called
+type StopReport struct {
+	InFlight int           // requests being served when Stop began
+	Drained  int           // of those, finished before the deadline
+	Forced   int           // still running at the deadline; their connections were closed
+	Took     time.Duration // until Serve had returned and the port was free
+}
+
+func (r StopReport) String() string {
+	return fmt.Sprintf("%d in flight: %d drained, %d forcibly closed, in %v",
+		r.InFlight, r.Drained, r.Forced, r.Took.Round(time.Millisecond))
+}
+
+// Limits on the failure-mode parameters, so a typo can't tie the mock up
+const (
+	maxDelay = time.Minute
+	maxBytes = 1 << 30
+)
+
+// New returns a Server with the failure-mode routes registered. Its
+// handlers still running after slowAfter are logged (0 = never), and its
+// connections are counted by conns. Add the example's own routes with
+// HandleFunc, then call Start.
+func New(slowAfter time.Duration, conns *conntrack.Tracker) *Server {
+	m := &Server{
+		mux:   http.NewServeMux(),
+		done:  make(chan struct{}),
+		quit:  make(chan struct{}),
+		conns: conns,
+	}
+	m.mux.HandleFunc("/api/slow", m.serveSlow)
+	m.mux.HandleFunc("/api/hang", m.serveHang)
+	m.mux.HandleFunc("/api/flaky", m.serveFlaky)
+	m.mux.HandleFunc("/api/big", m.serveBig)
+	m.tracker = NewRequestTracker(m.mux, m.route, slowAfter)
+	return m
+}
+
+// route names r by the pattern it matched, so the per-path counts can't
+// grow with every distinct URL a client sends
+func (m *Server) route(r *http.Request) string {
+	if _, pattern := m.mux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "(unmatched)"
+}
+
+// HandleFunc registers an example's own route
+func (m *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.mux.HandleFunc(pattern, handler)
+}
+
+// Start listens on addr, counted by the Server's conns, and serves in the
+// background
+func (m *Server) Start(addr string) error {
+	ln, err := m.conns.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.addr = ln.Addr()
+	// /status is served outside the tracker, so polling it doesn't count
+	// as a request in flight
+	root := http.NewServeMux()
+	root.Handle("/", m.tracker)
+	root.Handle("/status", m.tracker.StatusHandler())
+	m.server = &http.Server{
+		Handler:   root,
+		ConnState: m.conns.ConnState,
+	}
+	// Shutdown doesn't cancel the contexts of requests in progress, so a
+	// hanging request is released here or Stop would wait out its deadline
+	m.server.RegisterOnShutdown(func() { close(m.quit) })
+
+	go func() {
+		defer close(m.done)
+		if err := m.server.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("Mock server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// URL returns the base URL of the running server, such as http://127.0.0.1:8080
+func (m *Server) URL() string {
+	return "http://" + m.addr.String()
+}
+
+// Stop shuts the server down gracefully: it stops accepting, releases hanging
+// requests, closes idle connections and lets active requests finish until ctx
+// ends, then closes the connections of any still running. It returns once
+// Serve has returned and the port is free, with ctx's error if requests had
+// to be cut off.
+func (m *Server) Stop(ctx context.Context) (StopReport, error) {
+	start := time.Now()
+	r := StopReport{InFlight: int(m.InFlight())}
+	err := m.server.Shutdown(ctx)
+	if err != nil {
+		r.Forced = int(m.InFlight())
+		m.server.Close()
+	}
+	<-m.done
+	// Requests that arrived on a busy connection just as Stop began can be
+	// forced without having been counted in InFlight
+	if r.Forced > r.InFlight {
+		r.InFlight = r.Forced
+	}
+	r.Drained = r.InFlight - r.Forced
+	r.Took = time.Since(start)
+	return r, err
+}
+
+// Hanging returns how many /api/hang requests are waiting
+func (m *Server) Hanging() int64 {
+	return atomic.LoadInt64(&m.hanging)
+}
+
+// InFlight returns how many requests the server is handling
+func (m *Server) InFlight() int64 {
+	return m.tracker.InFlight()
+}
+
+// Tracker returns the middleware counting the server's requests
+func (m *Server) Tracker() *RequestTracker {
+	return m.tracker
+}
+
+func (m *Server) serveSlow(w http.ResponseWriter, r *http.Request) {
+	delay, err := param(r, "delay", time.Second, time.ParseDuration)
+	if err != nil || delay < 0 || delay > maxDelay {
+		http.Error(w, fmt.Sprintf("delay must be a duration up to %v", maxDelay), http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	fmt.Fprintf(w, `{"status":"ok","delay":%q}`, delay)
+}
+
+func (m *Server) serveHang(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&m.hanging, 1)
+	defer atomic.AddInt64(&m.hanging, -1)
+	select {
+	case <-r.Context().Done():
+	case <-m.quit:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+func (m *Server) serveFlaky(w http.ResponseWriter, r *http.Request) {
+	rate, err := param(r, "rate", 0.5, func(s string) (float64, error) { return strconv.ParseFloat(s, 64) })
+	if err != nil || rate < 0 || rate > 1 {
+		http.Error(w, "rate must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	if rand.Float64() < rate {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, `{"status":"ok"}`)
+}
+
+func (m *Server) serveBig(w http.ResponseWriter, r *http.Request) {
+	size, err := param(r, "bytes", int64(1<<20), func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) })
+	if err != nil || size < 0 || size > maxBytes {
+		http.Error(w, fmt.Sprintf("bytes must be between 0 and %d", maxBytes), http.StatusBadRequest)
+		return
+	}
+	chunk := bytes.Repeat([]byte("b"), 32<<10)
+	flusher, _ := w.(http.Flusher)
+	for left := size; left > 0; {
+		n := int64(len(chunk))
+		if left < n {
+			n = left
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return // the client went away
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		left -= n
+	}
+}
+
+// param parses query parameter name with parse, or returns def when the
+// parameter is absent
+func param[T any](r *http.Request, name string, def T, parse func(string) (T, error)) (T, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	return parse(s)
+}
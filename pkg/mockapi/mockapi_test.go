@@ -0,0 +1,198 @@
+package mockapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+)
+
+// startServer starts a Server on a free port and stops it when the test ends
+func startServer(t *testing.T) *Server {
+	t.Helper()
+	m := New(0, conntrack.New())
+	if err := m.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m.Stop(ctx)
+	})
+	return m
+}
+
+// get fetches path from m and reads the whole body
+func get(client *http.Client, m *Server, path string) (status int, size int64, took time.Duration, err error) {
+	start := time.Now()
+	resp, err := client.Get(m.URL() + path)
+	if err != nil {
+		return 0, 0, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	size, err = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, size, time.Since(start), err
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); !cond() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestFailureModes(t *testing.T) {
+	m := startServer(t)
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	status, _, took, err := get(client, m, "/api/slow?delay=200ms")
+	if err != nil || status != http.StatusOK || took < 200*time.Millisecond {
+		t.Errorf("/api/slow?delay=200ms answered %d after %v (%v), want 200 after 200ms", status, took, err)
+	}
+
+	failures := 0
+	for i := 0; i < 200; i++ {
+		if status, _, _, _ := get(client, m, "/api/flaky?rate=0.3"); status == http.StatusInternalServerError {
+			failures++
+		}
+	}
+	if failures < 30 || failures > 90 {
+		t.Errorf("/api/flaky?rate=0.3 failed %d of 200, want 30-90", failures)
+	}
+	if status, _, _, _ := get(client, m, "/api/flaky?rate=1"); status != http.StatusInternalServerError {
+		t.Errorf("/api/flaky?rate=1 answered %d, want 500", status)
+	}
+	if status, _, _, _ := get(client, m, "/api/flaky?rate=0"); status != http.StatusOK {
+		t.Errorf("/api/flaky?rate=0 answered %d, want 200", status)
+	}
+
+	status, size, _, err := get(client, m, "/api/big?bytes=5000000")
+	if err != nil || status != http.StatusOK || size != 5000000 {
+		t.Errorf("/api/big?bytes=5000000 streamed %d bytes with %d (%v)", size, status, err)
+	}
+}
+
+func TestBadParameters(t *testing.T) {
+	m := startServer(t)
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/api/slow?delay=soon", "/api/slow?delay=2h", "/api/flaky?rate=2", "/api/big?bytes=-1"} {
+		if status, _, _, _ := get(client, m, path); status != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want 400", path, status)
+		}
+	}
+}
+
+// TestHang checks that /api/hang holds a request until the client gives up
+// or Stop releases it, and that the Server leaves no goroutine behind
+func TestHang(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	conns := conntrack.New()
+	m := New(0, conns)
+	if err := m.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	impatient := &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := impatient.Get(m.URL() + "/api/hang"); err == nil {
+		t.Error("/api/hang answered within a 100ms client timeout")
+	}
+	if !waitFor(func() bool { return m.Hanging() == 0 }) {
+		t.Errorf("%d handlers still hanging after the client gave up", m.Hanging())
+	}
+
+	// A client with no timeout waits until Stop releases it
+	client := &http.Client{}
+	released := make(chan int, 1)
+	go func() {
+		status, _, _, _ := get(client, m, "/api/hang")
+		released <- status
+	}()
+	if !waitFor(func() bool { return m.Hanging() == 1 }) {
+		t.Fatalf("/api/hang is holding %d clients, want 1", m.Hanging())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	start := time.Now()
+	_, err := m.Stop(ctx)
+	cancel()
+	if took := time.Since(start); err != nil || took > time.Second {
+		t.Errorf("Stop took %v (%v), want the hanging request released at once", took, err)
+	}
+	select {
+	case status := <-released:
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("the hanging request got %d, want 503", status)
+		}
+	case <-time.After(time.Second):
+		t.Error("the hanging request got no answer")
+	}
+
+	client.CloseIdleConnections()
+	impatient.CloseIdleConnections()
+	waitFor(func() bool { s := conns.Stats(); return s.New+s.Active+s.Idle == 0 })
+	if !waitFor(func() bool { return runtime.NumGoroutine() <= baseline }) {
+		t.Errorf("goroutines %+d after Stop, want back to baseline", runtime.NumGoroutine()-baseline)
+	}
+}
+
+// startRequest fetches path from m in the background and returns once the
+// server is handling it
+func startRequest(t *testing.T, m *Server, path string) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	before := m.InFlight()
+	go func() {
+		_, _, _, err := get(http.DefaultClient, m, path)
+		done <- err
+	}()
+	if !waitFor(func() bool { return m.InFlight() > before }) {
+		t.Fatalf("%s never reached the server", path)
+	}
+	return done
+}
+
+func TestStopDrains(t *testing.T) {
+	m := New(0, conntrack.New())
+	if err := m.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	slow := startRequest(t, m, "/api/slow?delay=300ms")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	report, err := m.Stop(ctx)
+	cancel()
+	if err != nil || report.InFlight != 1 || report.Drained != 1 || report.Forced != 0 {
+		t.Errorf("Stop = %s (%v), want the slow request drained", report, err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("the drained request failed: %v", err)
+	}
+}
+
+func TestStopForcesPastDeadline(t *testing.T) {
+	const deadline = 200 * time.Millisecond
+	m := New(0, conntrack.New())
+	if err := m.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	slow := startRequest(t, m, "/api/slow?delay=10s")
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	report, err := m.Stop(ctx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) || report.Took > deadline+300*time.Millisecond {
+		t.Errorf("Stop = %s (%v), want it to give up at its %v deadline", report, err, deadline)
+	}
+	if report.InFlight != 1 || report.Forced != 1 || report.Drained != 0 {
+		t.Errorf("Stop = %s, want the 10s request forcibly closed", report)
+	}
+	if err := <-slow; err == nil {
+		t.Error("the forced request's client saw no error")
+	}
+}
@@ -0,0 +1,101 @@
+package mockapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestTracker is middleware for the server side of a demo. It keeps a
+// gauge of requests in flight and a count of requests per route, and logs
+// every handler still running after slowAfter, with its route and how long
+// it took once it returns. Against a hanging endpoint the gauge climbs in
+// step with the client's leaked requests, which shows the leak from the
+// server's side.
+type RequestTracker struct {
+	next      http.Handler
+	route     func(*http.Request) string
+	slowAfter time.Duration // 0 turns the watchdog off
+
+	inFlight int64
+	slow     int64 // handlers that ran past slowAfter
+
+	mu       sync.Mutex
+	requests map[string]int64
+}
+
+// NewRequestTracker wraps next. route names each request for the per-route
+// counts and the watchdog's log lines; it should map to a fixed set of
+// names, such as mux patterns, or the counts grow with every URL.
+func NewRequestTracker(next http.Handler, route func(*http.Request) string, slowAfter time.Duration) *RequestTracker {
+	return &RequestTracker{
+		next:      next,
+		route:     route,
+		slowAfter: slowAfter,
+		requests:  make(map[string]int64),
+	}
+}
+
+func (t *RequestTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := t.route(r)
+	t.mu.Lock()
+	t.requests[route]++
+	t.mu.Unlock()
+
+	atomic.AddInt64(&t.inFlight, 1)
+	defer atomic.AddInt64(&t.inFlight, -1)
+
+	// The watchdog fires while the handler is still running, so a handler
+	// that never returns is reported too
+	if t.slowAfter > 0 {
+		start := time.Now()
+		watchdog := time.AfterFunc(t.slowAfter, func() {
+			atomic.AddInt64(&t.slow, 1)
+			log.Printf("slow handler: %s still running after %v", route, t.slowAfter)
+		})
+		defer func() {
+			if !watchdog.Stop() {
+				log.Printf("slow handler: %s returned after %v", route, time.Since(start).Round(time.Millisecond))
+			}
+		}()
+	}
+	t.next.ServeHTTP(w, r)
+}
+
+// InFlight returns how many requests are being handled
+func (t *RequestTracker) InFlight() int64 {
+	return atomic.LoadInt64(&t.inFlight)
+}
+
+// Slow returns how many handlers have run past the watchdog threshold
+func (t *RequestTracker) Slow() int64 {
+	return atomic.LoadInt64(&t.slow)
+}
+
+// Requests returns a copy of the request count per route
+func (t *RequestTracker) Requests() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	requests := make(map[string]int64, len(t.requests))
+	for route, n := range t.requests {
+		requests[route] = n
+	}
+	return requests
+}
+
+// StatusHandler serves the gauge, the slow count and the per-route counts
+// as JSON
+func (t *RequestTracker) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"in_flight":  t.InFlight(),
+			"slow":       t.Slow(),
+			"slow_after": t.slowAfter.String(),
+			"requests":   t.Requests(),
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package mockapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/conntrack"
+)
+
+// safeBuffer is a bytes.Buffer that log and the test can share
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *safeBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// TestRequestTracker runs concurrent requests through a RequestTracker and
+// checks the gauge rises and falls with them, that each route is counted,
+// and that the watchdog logs handlers past its threshold and only those
+func TestRequestTracker(t *testing.T) {
+	var logged safeBuffer
+	log.SetOutput(&logged)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	const (
+		concurrent = 20
+		slowAfter  = 50 * time.Millisecond
+	)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block":
+			<-release
+		case "/slow":
+			time.Sleep(2 * slowAfter)
+		case "/fast":
+			time.Sleep(slowAfter / 5)
+		}
+	})
+	tracker := NewRequestTracker(handler, func(r *http.Request) string { return r.URL.Path }, slowAfter)
+	serve := func(path string) {
+		tracker.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Go(func() { serve("/block") })
+	}
+	if !waitFor(func() bool { return tracker.InFlight() == concurrent }) {
+		t.Errorf("%d in flight, want %d", tracker.InFlight(), concurrent)
+	}
+	close(release)
+	wg.Wait()
+	if got := tracker.InFlight(); got != 0 {
+		t.Errorf("%d in flight once they returned, want 0", got)
+	}
+	// The blocked requests crossed the threshold too
+	blockedSlow := tracker.Slow()
+	logged.Reset()
+
+	for i := 0; i < 5; i++ {
+		serve("/fast")
+	}
+	if tracker.Slow() != blockedSlow || logged.String() != "" {
+		t.Errorf("5 handlers under %v were reported slow: %q", slowAfter, logged.String())
+	}
+
+	serve("/slow")
+	lines := logged.String()
+	if tracker.Slow() != blockedSlow+1 ||
+		!strings.Contains(lines, "/slow still running after 50ms") || !strings.Contains(lines, "/slow returned after") {
+		t.Errorf("a %v handler logged %q, want its route in both watchdog lines", 2*slowAfter, lines)
+	}
+	requests := tracker.Requests()
+	if requests["/block"] != concurrent || requests["/fast"] != 5 || requests["/slow"] != 1 {
+		t.Errorf("per-route counts %v, want %d /block, 5 /fast and 1 /slow", requests, concurrent)
+	}
+}
+
+// TestStatusCountsHanging holds /api/hang requests against a Server and
+// reads them back from /status, counted by route rather than by URL
+func TestStatusCountsHanging(t *testing.T) {
+	m := New(0, conntrack.New())
+	if err := m.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	const hanging = 5
+	client := &http.Client{}
+	var hangers sync.WaitGroup
+	defer func() {
+		// Stop releases the hanging requests
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m.Stop(ctx)
+		hangers.Wait()
+		client.CloseIdleConnections()
+	}()
+	for i := 0; i < hanging; i++ {
+		hangers.Go(func() { get(client, m, "/api/hang") })
+	}
+	if !waitFor(func() bool { return m.Hanging() == hanging }) {
+		t.Fatalf("%d requests hanging, want %d", m.Hanging(), hanging)
+	}
+	for _, path := range []string{"/nowhere?id=1", "/nowhere?id=2"} {
+		get(client, m, path)
+	}
+
+	var status struct {
+		InFlight int64            `json:"in_flight"`
+		Requests map[string]int64 `json:"requests"`
+	}
+	resp, err := client.Get(m.URL() + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || status.InFlight != hanging {
+		t.Errorf("/status in_flight = %d (%v), want the %d hanging requests", status.InFlight, err, hanging)
+	}
+	if status.Requests["/api/hang"] != hanging || status.Requests["(unmatched)"] != 2 || len(status.Requests) != 2 {
+		t.Errorf("/status requests = %v, want %d /api/hang and 2 (unmatched)", status.Requests, hanging)
+	}
+}
@@ -0,0 +1,293 @@
+// Package mux carries many logical streams over one net.Conn, so a program
+// that needs thousands of connections to one peer holds one socket and one
+// reader goroutine per side instead of one per stream.
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Multiplexer carries many logical streams over one net.Conn, so opening
+// another stream costs a map entry and a buffer instead of a socket and a
+// reader goroutine. Each frame on the wire is a 4-byte stream ID, a 4-byte
+// payload length and the payload. A frame with no payload closes the
+// sender's side of its stream. Both ends open a stream by agreeing on its ID.
+//
+// There is no flow control: a stream whose reader falls more than
+// maxStreamBuffer behind closes the whole connection. Protocols built for
+// this, such as HTTP/2, give each stream a window the sender must wait for.
+type Multiplexer struct {
+	conn    net.Conn
+	writeMu sync.Mutex // one frame at a time on conn
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	err     error // set once the connection is closed
+}
+
+// Frame limits: Write splits larger payloads, and Serve rejects a frame that
+// claims more
+const (
+	maxFramePayload = 32 << 10
+	maxStreamBuffer = 1 << 20
+)
+
+var (
+	// ErrClosed is returned by reads and writes after Close
+	ErrClosed = errors.New("mux: closed")
+	// ErrStreamClosed is returned by a stream's Read and Write after its
+	// own Close
+	ErrStreamClosed = errors.New("mux: stream closed")
+
+	errPeerGone = fmt.Errorf("mux: peer closed the connection: %w", io.ErrUnexpectedEOF)
+)
+
+// New returns a Multiplexer over conn. Run Serve on one goroutine to
+// receive frames.
+func New(conn net.Conn) *Multiplexer {
+	return &Multiplexer{conn: conn, streams: make(map[uint32]*Stream)}
+}
+
+// Open returns the stream with this ID, creating it if neither side has
+// used it yet. Data the peer sent before Open is already buffered.
+func (m *Multiplexer) Open(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streamLocked(id)
+}
+
+// streamLocked returns the stream with this ID, creating it. The caller
+// holds m.mu.
+func (m *Multiplexer) streamLocked(id uint32) *Stream {
+	s, ok := m.streams[id]
+	if !ok {
+		s = &Stream{id: id, m: m, err: m.err}
+		s.cond = sync.NewCond(&s.mu)
+		if m.err == nil {
+			m.streams[id] = s
+		}
+	}
+	return s
+}
+
+// Streams returns how many streams are open on either side
+func (m *Multiplexer) Streams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// Serve reads frames and appends each payload to its stream's buffer until
+// the connection fails or Close is called. It is the only goroutine reading
+// conn, however many streams there are. It returns nil after Close, or when
+// the peer closes the connection between frames; streams the peer hadn't
+// closed then fail with an error wrapping io.ErrUnexpectedEOF.
+func (m *Multiplexer) Serve() error {
+	var hdr [8]byte
+	payload := make([]byte, maxFramePayload)
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			if err == io.EOF {
+				m.shutdown(errPeerGone)
+				return nil
+			}
+			return m.shutdown(err)
+		}
+		id := binary.BigEndian.Uint32(hdr[:4])
+		n := binary.BigEndian.Uint32(hdr[4:])
+		if n > maxFramePayload {
+			return m.shutdown(fmt.Errorf("mux: stream %d: frame of %d bytes exceeds %d", id, n, maxFramePayload))
+		}
+		if _, err := io.ReadFull(m.conn, payload[:n]); err != nil {
+			return m.shutdown(err)
+		}
+
+		m.mu.Lock()
+		s := m.streamLocked(id)
+		m.mu.Unlock()
+		if !s.deliver(payload[:n]) {
+			return m.shutdown(fmt.Errorf("mux: stream %d: reader is more than %d bytes behind", id, maxStreamBuffer))
+		}
+	}
+}
+
+// Close closes every stream and the connection. Data already buffered can
+// still be read; after that, reads return ErrClosed.
+func (m *Multiplexer) Close() error {
+	m.shutdown(ErrClosed)
+	return nil
+}
+
+// shutdown records err as the reason the connection ended, fails every
+// stream with it, closes conn and returns what Serve should return. Only the
+// first call has an effect.
+func (m *Multiplexer) shutdown(err error) error {
+	m.mu.Lock()
+	if m.err != nil {
+		closedByUs := m.err == ErrClosed
+		m.mu.Unlock()
+		if closedByUs {
+			return nil
+		}
+		return err
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+
+	m.conn.Close()
+	for _, s := range streams {
+		s.fail(err)
+	}
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// writeFrame sends one frame. A nil payload closes the stream on the peer.
+func (m *Multiplexer) writeFrame(id uint32, payload []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], id)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(payload)))
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if _, err := m.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := m.conn.Write(payload)
+	return err
+}
+
+// forget removes a stream both sides have closed
+func (m *Multiplexer) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Stream is one logical connection on a Multiplexer. It is an
+// io.ReadWriteCloser: Read returns io.EOF once the peer has closed its side
+// and everything it sent has been read.
+type Stream struct {
+	id uint32
+	m  *Multiplexer
+
+	mu           sync.Mutex
+	cond         *sync.Cond // signalled when data, a close or an error arrives
+	buf          bytes.Buffer
+	remoteClosed bool
+	localClosed  bool
+	err          error // the connection's error, once it has ended
+}
+
+// Read blocks until the stream has data, the peer closes it, or the
+// connection ends
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.buf.Len() > 0:
+			return s.buf.Read(p)
+		case s.remoteClosed:
+			return 0, io.EOF
+		case s.localClosed:
+			return 0, ErrStreamClosed
+		case s.err != nil:
+			return 0, s.err
+		}
+		s.cond.Wait()
+	}
+}
+
+// Write sends p in frames of up to maxFramePayload bytes
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	err := s.err
+	if s.localClosed {
+		err = ErrStreamClosed
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFramePayload {
+			chunk = chunk[:maxFramePayload]
+		}
+		if err := s.m.writeFrame(s.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close sends the peer an empty frame, which it reads as io.EOF. The stream
+// is forgotten once both sides have closed it.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	err := s.err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.m.forget(s.id)
+	}
+	if err != nil {
+		return nil // the connection is gone, so the peer's streams are too
+	}
+	return s.m.writeFrame(s.id, nil)
+}
+
+// deliver appends a frame's payload to the buffer, or records the peer's
+// close for an empty one. It reports false if the buffer would pass
+// maxStreamBuffer.
+func (s *Stream) deliver(payload []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	if len(payload) == 0 {
+		s.remoteClosed = true
+		if s.localClosed {
+			s.m.forget(s.id)
+		}
+		return true
+	}
+	if s.localClosed {
+		return true // nobody will read it
+	}
+	if s.buf.Len()+len(payload) > maxStreamBuffer {
+		return false
+	}
+	s.buf.Write(payload)
+	return true
+}
+
+// fail ends the stream with the connection's error
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
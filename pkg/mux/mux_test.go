@@ -0,0 +1,158 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns two connected Multiplexers over a net.Pipe, each with Serve
+// running, and channels carrying what each Serve returned
+func pair() (*Multiplexer, *Multiplexer, chan error, chan error) {
+	a, b := net.Pipe()
+	ma, mb := New(a), New(b)
+	errA, errB := make(chan error, 1), make(chan error, 1)
+	go func() { errA <- ma.Serve() }()
+	go func() { errB <- mb.Serve() }()
+	return ma, mb, errA, errB
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); !cond() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+// TestConcurrentStreams runs concurrent writers on 100 streams, with
+// payloads spanning several frames, and checks each arrives intact and
+// closed streams are forgotten on both sides
+func TestConcurrentStreams(t *testing.T) {
+	const streams, writers = 100, 8
+	client, server, _, _ := pair()
+	defer client.Close()
+	defer server.Close()
+	payload := func(id int) []byte {
+		b := make([]byte, maxFramePayload*2+id)
+		for i := range b {
+			b[i] = byte(id + i)
+		}
+		return b
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Go(func() {
+			for id := w; id < streams; id += writers {
+				s := client.Open(uint32(id))
+				s.Write(payload(id))
+				s.Close()
+			}
+		})
+	}
+	for id := 0; id < streams; id++ {
+		s := server.Open(uint32(id))
+		b, err := io.ReadAll(s)
+		if err != nil || !bytes.Equal(b, payload(id)) {
+			t.Errorf("stream %d: read %d bytes (%v), want %d intact", id, len(b), err, len(payload(id)))
+		}
+		s.Close()
+	}
+	wg.Wait()
+
+	if !waitFor(func() bool { return client.Streams() == 0 && server.Streams() == 0 }) {
+		t.Errorf("%d and %d streams left, want closed streams forgotten on both sides", client.Streams(), server.Streams())
+	}
+}
+
+// TestClose checks that Close wakes a blocked Read, ends both Serves, and
+// fails the peer's open stream instead of giving it a clean EOF
+func TestClose(t *testing.T) {
+	client, server, errC, errS := pair()
+	defer client.Close()
+
+	waiting := server.Open(1000)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := waiting.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	peer := client.Open(1000)
+	time.Sleep(10 * time.Millisecond)
+	server.Close()
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("blocked Read returned %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Close didn't wake a blocked Read")
+	}
+	if err := <-errS; err != nil {
+		t.Errorf("Serve returned %v after Close, want nil", err)
+	}
+	if err := <-errC; err != nil {
+		t.Errorf("the peer's Serve returned %v when the connection closed, want nil", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("the peer's open stream read %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := server.Open(1001).Write([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server, _, _ := pair()
+	defer client.Close()
+	defer server.Close()
+
+	s := client.Open(1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Write after the stream's Close returned %v, want ErrStreamClosed", err)
+	}
+	if _, err := io.ReadAll(server.Open(1)); err != nil {
+		t.Errorf("the peer read %v after the close, want a clean EOF", err)
+	}
+}
+
+// TestOverflow checks that a stream nobody reads can't buffer without bound
+func TestOverflow(t *testing.T) {
+	client, _, errC, errS := pair()
+	defer client.Close()
+	go client.Open(7).Write(make([]byte, maxStreamBuffer+maxFramePayload))
+	select {
+	case err := <-errS:
+		if err == nil {
+			t.Errorf("an unread stream past %d KB closed the connection without an error", maxStreamBuffer>>10)
+		}
+	case <-time.After(time.Second):
+		t.Error("an unread stream past the buffer limit didn't close the connection")
+	}
+	<-errC
+}
+
+func TestNoGoroutinesLeft(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	client, server, errC, errS := pair()
+	s := client.Open(1)
+	s.Write([]byte("hello"))
+	s.Close()
+	io.ReadAll(server.Open(1))
+	client.Close()
+	<-errC
+	<-errS
+	if !waitFor(func() bool { return runtime.NumGoroutine() <= baseline }) {
+		t.Errorf("goroutines %d -> %d, want back to baseline", baseline, runtime.NumGoroutine())
+	}
+}
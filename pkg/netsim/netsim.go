@@ -0,0 +1,166 @@
+// Package netsim simulates a network in memory, for reproducing connection
+// leaks without sockets: NewPipePair makes a connection, SlowWriter and
+// DropAfter make it a bad one, and a Network serves pipes through an accept
+// loop while counting how many the server closed.
+package netsim
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewPipePair returns the two ends of an in-memory connection, from
+// net.Pipe. There is no socket, so nothing shows in the FD count, and each
+// Write blocks until the other end has read all of it.
+func NewPipePair() (client, server net.Conn) {
+	return net.Pipe()
+}
+
+// SlowWriter returns conn with its writes throttled to bytesPerSecond, as
+// over a slow link. Each Write sends a tenth of a second's worth at a time.
+func SlowWriter(conn net.Conn, bytesPerSecond int) net.Conn {
+	return &slowConn{Conn: conn, rate: bytesPerSecond}
+}
+
+type slowConn struct {
+	net.Conn
+	rate int
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	piece := max(c.rate/10, 1)
+	written := 0
+	for len(p) > 0 {
+		n := min(piece, len(p))
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(c.rate))
+		m, err := c.Conn.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// DropAfter returns conn cut off after n bytes have been read from it, as if
+// the link failed mid-message: reads return the first n bytes, then
+// io.ErrUnexpectedEOF. conn is closed at that point, so the peer's writes
+// fail too.
+func DropAfter(conn net.Conn, n int) net.Conn {
+	return &dropConn{Conn: conn, left: n}
+}
+
+type dropConn struct {
+	net.Conn
+	mu   sync.Mutex
+	left int
+}
+
+func (c *dropConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.left <= 0 {
+		c.Conn.Close()
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.Conn.Read(p)
+	c.left -= n
+	return n, err
+}
+
+// Network is an in-memory network in front of one server. Dial, which has a
+// Transport's DialContext signature, creates a NewPipePair and hands its
+// server end to Accept, so an http.Server or any accept loop serves it as a
+// net.Listener. ServerWrap and ClientWrap, if set, wrap each end, e.g. with
+// SlowWriter or DropAfter. It counts the server ends accepted and the ones
+// the server closed.
+type Network struct {
+	ServerWrap func(net.Conn) net.Conn
+	ClientWrap func(net.Conn) net.Conn
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	accepted  int64
+	closed    int64
+}
+
+// NewNetwork returns a Network with no connections
+func NewNetwork() *Network {
+	return &Network{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Dial connects to the server behind n. It blocks until Accept takes the
+// server end, n is closed or ctx is done.
+func (n *Network) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := NewPipePair()
+	var end net.Conn = &pipeEnd{Conn: server, network: n}
+	if n.ServerWrap != nil {
+		end = n.ServerWrap(end)
+	}
+	select {
+	case n.conns <- end:
+	case <-n.done:
+		client.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		client.Close()
+		return nil, ctx.Err()
+	}
+	if n.ClientWrap != nil {
+		return n.ClientWrap(client), nil
+	}
+	return client, nil
+}
+
+// Accept returns the server end of the next Dial
+func (n *Network) Accept() (net.Conn, error) {
+	select {
+	case c := <-n.conns:
+		atomic.AddInt64(&n.accepted, 1)
+		return c, nil
+	case <-n.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops Accept and fails later Dials. Connections already made stay
+// open.
+func (n *Network) Close() error {
+	n.closeOnce.Do(func() { close(n.done) })
+	return nil
+}
+
+func (n *Network) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Counts returns the server ends accepted and closed so far
+func (n *Network) Counts() (accepted, closed int64) {
+	return atomic.LoadInt64(&n.accepted), atomic.LoadInt64(&n.closed)
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeEnd is a server end that counts its first Close
+type pipeEnd struct {
+	net.Conn
+	network *Network
+	once    sync.Once
+}
+
+func (c *pipeEnd) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.network.closed, 1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,125 @@
+package netsim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+func TestSlowWriter(t *testing.T) {
+	client, server := NewPipePair()
+	defer client.Close()
+	slow := SlowWriter(server, 40000)
+	go func() {
+		slow.Write(bytes.Repeat([]byte("x"), 4000))
+		slow.Close()
+	}()
+
+	start := time.Now()
+	got, err := io.ReadAll(client)
+	took := time.Since(start)
+	if err != nil || len(got) != 4000 {
+		t.Fatalf("read %d bytes, %v; want 4000, nil", len(got), err)
+	}
+	if took < 80*time.Millisecond || took > time.Second {
+		t.Errorf("4000 bytes at 40000 B/s took %v, want about 100ms", took)
+	}
+}
+
+func TestDropAfter(t *testing.T) {
+	client, server := NewPipePair()
+	dropped := DropAfter(client, 5)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte("hello, world"))
+		writeErr <- err
+	}()
+
+	got, err := io.ReadAll(dropped)
+	if string(got) != "hello" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadAll = %q, %v; want %q, io.ErrUnexpectedEOF", got, err, "hello")
+	}
+	if err := <-writeErr; err == nil {
+		t.Error("the peer's write succeeded after the drop, want an error")
+	}
+}
+
+func TestNetworkCountsServerCloses(t *testing.T) {
+	socketsBefore := fdcount.Sockets()
+
+	network := NewNetwork()
+	defer network.Close()
+	go http.Serve(network, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+
+	fetch := func(client *http.Client) {
+		t.Helper()
+		resp, err := client.Get("http://netsim/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("body = %q, %v; want %q", body, err, "ok")
+		}
+	}
+
+	// Drained bodies return their connection, so one pipe serves them all
+	keepAlive := &http.Client{Transport: &http.Transport{DialContext: network.Dial}}
+	for i := 0; i < 5; i++ {
+		fetch(keepAlive)
+	}
+	if accepted, closed := network.Counts(); accepted != 1 || closed != 0 {
+		t.Errorf("after 5 kept-alive fetches, Counts = %d accepted, %d closed; want 1, 0", accepted, closed)
+	}
+
+	// Without keep-alive the server closes each pipe after its response
+	oneShot := &http.Client{Transport: &http.Transport{DialContext: network.Dial, DisableKeepAlives: true}}
+	for i := 0; i < 5; i++ {
+		fetch(oneShot)
+	}
+	var accepted, closed int64
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if accepted, closed = network.Counts(); closed == 5 {
+			break
+		}
+	}
+	if accepted != 6 || closed != 5 {
+		t.Errorf("after 5 more fetches without keep-alive, Counts = %d accepted, %d closed; want 6, 5", accepted, closed)
+	}
+
+	if socketsBefore >= 0 {
+		if after := fdcount.Sockets(); after != socketsBefore {
+			t.Errorf("sockets went from %d to %d, want no change", socketsBefore, after)
+		}
+	}
+}
+
+func TestNetworkClose(t *testing.T) {
+	network := NewNetwork()
+	network.Close()
+	network.Close()
+
+	if _, err := network.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+	if _, err := network.Dial(context.Background(), "pipe", "server"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Dial after Close = %v, want net.ErrClosed", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewNetwork().Dial(ctx, "pipe", "server"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Dial with nothing accepting = %v, want context.DeadlineExceeded", err)
+	}
+}
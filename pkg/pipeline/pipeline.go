@@ -0,0 +1,109 @@
+// Package pipeline builds multi-stage channel pipelines, generator -> filter
+// -> mapper -> sink, that don't leak their stages' goroutines when the sink
+// stops reading.
+package pipeline
+
+import "context"
+
+// Stage is one step of a channel pipeline. Start runs it on one goroutine
+// that reads from its input and writes to the channel it returns. Every
+// receive and send also selects on ctx.Done(), so a cancelled pipeline's
+// stages return instead of blocking on a channel nobody reads any more.
+type Stage[In, Out any] struct {
+	run func(ctx context.Context, in <-chan In, out chan<- Out)
+}
+
+// Start runs the stage on in and returns its output, which is closed when
+// in is closed and drained or ctx is cancelled
+func (s Stage[In, Out]) Start(ctx context.Context, in <-chan In) <-chan Out {
+	out := make(chan Out)
+	go func() {
+		defer close(out)
+		s.run(ctx, in, out)
+	}()
+	return out
+}
+
+// Map is a Stage that sends fn(v) for every v it receives
+func Map[In, Out any](fn func(In) Out) Stage[In, Out] {
+	return Stage[In, Out]{run: func(ctx context.Context, in <-chan In, out chan<- Out) {
+		for {
+			v, ok := receive(ctx, in)
+			if !ok || !send(ctx, out, fn(v)) {
+				return
+			}
+		}
+	}}
+}
+
+// Filter is a Stage that sends on only the values keep accepts
+func Filter[T any](keep func(T) bool) Stage[T, T] {
+	return Stage[T, T]{run: func(ctx context.Context, in <-chan T, out chan<- T) {
+		for {
+			v, ok := receive(ctx, in)
+			if !ok {
+				return
+			}
+			if keep(v) && !send(ctx, out, v) {
+				return
+			}
+		}
+	}}
+}
+
+// Connect joins s1's output to s2's input as one Stage. The joined stage
+// stops when ctx or the context it is started with ends, whichever is first,
+// and it doesn't return until s1's goroutine has returned too.
+func Connect[A, B, C any](ctx context.Context, s1 Stage[A, B], s2 Stage[B, C]) Stage[A, C] {
+	return Stage[A, C]{run: func(runCtx context.Context, in <-chan A, out chan<- C) {
+		both, cancel := context.WithCancel(runCtx)
+		defer cancel()
+		defer context.AfterFunc(ctx, cancel)()
+
+		mid := make(chan B)
+		s1Done := make(chan struct{})
+		go func() {
+			defer close(s1Done)
+			defer close(mid)
+			s1.run(both, in, mid)
+		}()
+		s2.run(both, mid, out)
+
+		// s2 returned, so nothing reads mid; cancel so s1 can't block on it
+		cancel()
+		<-s1Done
+	}}
+}
+
+// Generate is a pipeline source: it sends next(0), next(1), ... until ctx is
+// cancelled
+func Generate[T any](ctx context.Context, next func(i int) T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for i := 0; send(ctx, out, next(i)); i++ {
+		}
+	}()
+	return out
+}
+
+// receive returns the next value from in, or false if in is closed or ctx ends
+func receive[T any](ctx context.Context, in <-chan T) (T, bool) {
+	select {
+	case v, ok := <-in:
+		return v, ok
+	case <-ctx.Done():
+		var zero T
+		return zero, false
+	}
+}
+
+// send sends v on out and reports whether it was sent before ctx ended
+func send[T any](ctx context.Context, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
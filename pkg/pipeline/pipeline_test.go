@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	even   = Filter(func(n int) bool { return n%2 == 0 })
+	square = Map(func(n int) string { return strconv.Itoa(n * n) })
+)
+
+func count(i int) int { return i }
+
+// waitForCount waits up to a second for the goroutine count to reach want
+// and returns the last count
+func waitForCount(want int) int {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+// TestCancel stops reading partway through, so every stage is blocked on a
+// send when the pipeline's context is cancelled
+func TestCancel(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	out := Connect(ctx, even, square).Start(context.Background(), Generate(ctx, count))
+	var got []string
+	for len(got) < 5 {
+		got = append(got, <-out)
+	}
+	if strings.Join(got, ",") != "0,4,16,36,64" {
+		t.Errorf("first 5 results = %v, want 0 4 16 36 64", got)
+	}
+	if n := runtime.NumGoroutine(); n != baseline+3 {
+		t.Errorf("%d goroutines mid-stream, want %d", n, baseline+3)
+	}
+
+	cancel()
+	if n := waitForCount(baseline); n != baseline {
+		t.Errorf("%d goroutines after cancel, want %d", n, baseline)
+	}
+	if _, open := <-out; open {
+		t.Error("output still open after cancel")
+	}
+}
+
+// Cancelling the context given to Start stops the pipeline the same way
+func TestCancelStart(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	runCtx, stop := context.WithCancel(context.Background())
+	out := Connect(context.Background(), even, square).Start(runCtx, Generate(runCtx, count))
+	<-out
+	stop()
+	if n := waitForCount(baseline); n != baseline {
+		t.Errorf("%d goroutines after cancelling Start's context, want %d", n, baseline)
+	}
+}
+
+// A finite input drains through and closes the output
+func TestClosedInput(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for i := 1; i <= 10; i++ {
+			in <- i
+		}
+	}()
+	var got []string
+	for v := range Connect(context.Background(), even, square).Start(context.Background(), in) {
+		got = append(got, v)
+	}
+	if strings.Join(got, ",") != "4,16,36,64,100" {
+		t.Errorf("results of 1..10 = %v, want 4 16 36 64 100", got)
+	}
+	if n := waitForCount(baseline); n != baseline {
+		t.Errorf("%d goroutines after a normal finish, want %d", n, baseline)
+	}
+}
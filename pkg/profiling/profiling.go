@@ -0,0 +1,142 @@
+// Package profiling serves the runtime profiles on a ServeMux of their own,
+// so they are only reachable through the server that is handed that mux.
+package profiling
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewMux returns a ServeMux serving the endpoints net/http/pprof serves,
+// under /debug/pprof/: each runtime/pprof profile by name, an index at
+// /debug/pprof/, a CPU profile at /debug/pprof/profile?seconds=N, an
+// execution trace at /debug/pprof/trace?seconds=N, and the symbol and
+// cmdline endpoints. The handlers are written here against runtime/pprof
+// and runtime/trace: importing net/http/pprof, even just for its handlers,
+// runs its init, which registers them on http.DefaultServeMux.
+func NewMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", serveProfile)
+	mux.HandleFunc("/debug/pprof/profile", serveCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", serveTrace)
+	mux.HandleFunc("/debug/pprof/symbol", serveSymbol)
+	mux.HandleFunc("/debug/pprof/cmdline", serveCmdline)
+	return mux
+}
+
+// serveProfile writes the named profile, such as /debug/pprof/heap, in the
+// format ?debug= selects: 0, the default, is the gzipped protobuf that go
+// tool pprof reads, and 1 or 2 are text. /debug/pprof/ lists the profiles.
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+		}
+		fmt.Fprintln(w, "-\tprofile (CPU, ?seconds=30)")
+		fmt.Fprintln(w, "-\ttrace (?seconds=1)")
+		fmt.Fprintln(w, "-\tsymbol")
+		fmt.Fprintln(w, "-\tcmdline")
+		return
+	}
+
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "unknown profile: "+name, http.StatusNotFound)
+		return
+	}
+	level, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if level == 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	p.WriteTo(w, level)
+}
+
+// serveCPUProfile records a CPU profile for ?seconds= (default 30), or until
+// the client goes away
+func serveCPUProfile(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
+
+// serveTrace records an execution trace for ?seconds= (default 1, fractions
+// allowed), or until the client goes away, for go tool trace
+func serveTrace(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseFloat(r.URL.Query().Get("seconds"), 64)
+	if err != nil || seconds <= 0 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+	case <-r.Context().Done():
+	}
+	trace.Stop()
+}
+
+// serveSymbol maps program counters to function names for go tool pprof.
+// The counters come '+'-separated in the query of a GET or the body of a
+// POST, in hex; each known one gets a "0x<pc> <function>" line after a
+// "num_symbols: 1" header, which tells pprof that symbols are available.
+func serveSymbol(w http.ResponseWriter, r *http.Request) {
+	input := r.URL.RawQuery
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "reading request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		input = string(body)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "num_symbols: 1")
+	for _, word := range strings.Split(input, "+") {
+		pc, _ := strconv.ParseUint(word, 0, 64)
+		if pc == 0 {
+			continue
+		}
+		if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+			fmt.Fprintf(w, "%#x %s\n", pc, f.Name())
+		}
+	}
+}
+
+// serveCmdline writes the program's command line, its arguments separated
+// by NUL bytes
+func serveCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
@@ -0,0 +1,99 @@
+package profiling
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// get serves one GET request for path on h
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestNewMuxServesHeap(t *testing.T) {
+	rec := get(NewMux(), "/debug/pprof/heap")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /debug/pprof/heap: status %d", rec.Code)
+	}
+	// go tool pprof reads gzipped protobuf
+	if body := rec.Body.Bytes(); !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		t.Errorf("heap profile is not gzipped: % x", body[:min(len(body), 8)])
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="heap"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestNewMuxServesText(t *testing.T) {
+	mux := NewMux()
+
+	rec := get(mux, "/debug/pprof/goroutine?debug=1")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "goroutine profile:") {
+		t.Errorf("GET /debug/pprof/goroutine?debug=1: status %d, body %.40q", rec.Code, rec.Body.String())
+	}
+
+	rec = get(mux, "/debug/pprof/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "\theap\n") {
+		t.Errorf("GET /debug/pprof/: status %d, body %q, want the profile list", rec.Code, rec.Body.String())
+	}
+
+	if rec := get(mux, "/debug/pprof/nope"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/nope: status %d, want 404", rec.Code)
+	}
+}
+
+func TestNewMuxServesCPUProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("records a 1s CPU profile")
+	}
+	rec := get(NewMux(), "/debug/pprof/profile?seconds=1")
+	if body := rec.Body.Bytes(); rec.Code != http.StatusOK || !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		t.Errorf("GET /debug/pprof/profile?seconds=1: status %d, %d bytes, want a gzipped profile", rec.Code, len(body))
+	}
+}
+
+func TestNewMuxServesTrace(t *testing.T) {
+	rec := get(NewMux(), "/debug/pprof/trace?seconds=0.1")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "go 1.") {
+		t.Errorf("GET /debug/pprof/trace?seconds=0.1: status %d, body %.20q, want a trace", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNewMuxServesSymbol(t *testing.T) {
+	pc := reflect.ValueOf(NewMux).Pointer()
+	want := fmt.Sprintf("num_symbols: 1\n%#x github.com/Danialsamadi/Memmory-leaks-go/pkg/profiling.NewMux\n", pc)
+
+	if rec := get(NewMux(), fmt.Sprintf("/debug/pprof/symbol?%#x+0x0", pc)); rec.Body.String() != want {
+		t.Errorf("GET /debug/pprof/symbol: %q, want %q", rec.Body.String(), want)
+	}
+
+	rec := httptest.NewRecorder()
+	NewMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/pprof/symbol", strings.NewReader(fmt.Sprintf("%#x", pc))))
+	if rec.Body.String() != want {
+		t.Errorf("POST /debug/pprof/symbol: %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestNewMuxServesCmdline(t *testing.T) {
+	rec := get(NewMux(), "/debug/pprof/cmdline")
+	if want := strings.Join(os.Args, "\x00"); rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("GET /debug/pprof/cmdline: status %d, body %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+}
+
+func TestNewMuxLeavesDefaultServeMuxClean(t *testing.T) {
+	NewMux()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/profile", "/debug/pprof/trace"} {
+		if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != "" {
+			t.Errorf("http.DefaultServeMux serves %s with pattern %q", path, pattern)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package ratelimit holds two limiters with the same Allow method: a
+// SlidingWindowLimiter, which never admits more than its limit in any
+// window, and the classic TokenBucket it is compared with, which admits the
+// same average rate but lets bursts through.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingWindowLimiter admits at most limit events in any window-long span of
+// time. Admission times are kept in a ring buffer with one slot per allowed
+// event, so memory is fixed and the oldest admission is always at head.
+type SlidingWindowLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	times  []time.Time // ring buffer of admission times
+	head   int         // index of the oldest admission
+	count  int
+}
+
+func NewSlidingWindowLimiter(limit int, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		window: window,
+		times:  make([]time.Time, limit),
+	}
+}
+
+func (l *SlidingWindowLimiter) Allow() bool {
+	return l.AllowAt(time.Now())
+}
+
+// AllowAt drops admissions older than the window, then admits the event at
+// now if fewer than limit remain. Calls must not go back in time; it exists
+// so a burst can be replayed on a simulated clock.
+func (l *SlidingWindowLimiter) AllowAt(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.count > 0 && now.Sub(l.times[l.head]) >= l.window {
+		l.head = (l.head + 1) % len(l.times)
+		l.count--
+	}
+	if l.count == len(l.times) {
+		return false
+	}
+	l.times[(l.head+l.count)%len(l.times)] = now
+	l.count++
+	return true
+}
+
+// TokenBucket refills at a constant rate up to capacity tokens, the classic
+// limiter from 5.Unbounded-Resources/resources/04-rate-limiting.md. After an
+// idle period it admits a full bucket at once and keeps refilling during
+// the burst.
+type TokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64 // tokens per second
+	lastRefill time.Time
+}
+
+func NewTokenBucket(capacity, refillRate float64) *TokenBucket {
+	return &TokenBucket{
+		tokens:     capacity,
+		capacity:   capacity,
+		refillRate: refillRate,
+	}
+}
+
+func (tb *TokenBucket) Allow() bool {
+	return tb.AllowAt(time.Now())
+}
+
+// AllowAt refills the bucket for the time since the last call, then takes a
+// token if there is one. Like SlidingWindowLimiter.AllowAt, it is for
+// replaying a burst on a simulated clock.
+func (tb *TokenBucket) AllowAt(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if !tb.lastRefill.IsZero() {
+		tb.tokens += now.Sub(tb.lastRefill).Seconds() * tb.refillRate
+		if tb.tokens > tb.capacity {
+			tb.tokens = tb.capacity
+		}
+	}
+	tb.lastRefill = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true
+	}
+	return false
+}
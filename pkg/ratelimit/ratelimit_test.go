@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// The burst both limiters get: 10,000 events per second for a second after
+// an idle period, against 100 events per 100ms
+const (
+	limit  = 100
+	window = 100 * time.Millisecond
+	burst  = time.Second
+	gap    = 100 * time.Microsecond
+)
+
+// replay runs the burst through allowAt on a simulated clock and returns the
+// admission times
+func replay(allowAt func(time.Time) bool) []time.Time {
+	var admitted []time.Time
+	start := time.Unix(0, 0)
+	for t := time.Duration(0); t < burst; t += gap {
+		if now := start.Add(t); allowAt(now) {
+			admitted = append(admitted, now)
+		}
+	}
+	return admitted
+}
+
+// maxInWindow returns the most timestamps (in ascending order) that fall in
+// any window-long span
+func maxInWindow(times []time.Time) int {
+	best, lo := 0, 0
+	for hi := range times {
+		for times[hi].Sub(times[lo]) >= window {
+			lo++
+		}
+		best = max(best, hi-lo+1)
+	}
+	return best
+}
+
+func TestSlidingWindowLimiterBurst(t *testing.T) {
+	admitted := replay(NewSlidingWindowLimiter(limit, window).AllowAt)
+	if len(admitted) != 1000 {
+		t.Errorf("admitted %d of the burst, want 1000", len(admitted))
+	}
+	if n := maxInWindow(admitted); n != limit {
+		t.Errorf("at most %d in any %v, want %d", n, window, limit)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	// The same average rate: a full bucket of 100, refilled at 1000/s
+	admitted := replay(NewTokenBucket(limit, limit/window.Seconds()).AllowAt)
+	if len(admitted) < 1090 || len(admitted) > 1100 {
+		t.Errorf("admitted %d of the burst, want a full bucket on top of the refill, about 1099", len(admitted))
+	}
+	if n := maxInWindow(admitted); n < 2*limit-10 {
+		t.Errorf("at most %d in any %v, want close to %d: the bucket and its refill", n, window, 2*limit)
+	}
+}
+
+func TestSlidingWindowLimiterExpires(t *testing.T) {
+	l := NewSlidingWindowLimiter(2, window)
+	start := time.Unix(0, 0)
+	for i, tt := range []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{10 * time.Millisecond, true},
+		{20 * time.Millisecond, false},
+		{window, true}, // the first admission has just expired
+		{window + 5*time.Millisecond, false},
+		{window + 10*time.Millisecond, true},
+	} {
+		if got := l.AllowAt(start.Add(tt.at)); got != tt.want {
+			t.Errorf("call %d at %v: Allow = %v, want %v", i, tt.at, got, tt.want)
+		}
+	}
+}
+
+// The benchmarks call Allow on the real clock under a burst: far more calls
+// than the limit, so most are rejected, which is the path a limiter spends
+// its time on when it matters
+
+func BenchmarkSlidingWindowLimiterBurst(b *testing.B) {
+	l := NewSlidingWindowLimiter(limit, window)
+	for b.Loop() {
+		l.Allow()
+	}
+}
+
+func BenchmarkTokenBucketBurst(b *testing.B) {
+	tb := NewTokenBucket(limit, limit/window.Seconds())
+	for b.Loop() {
+		tb.Allow()
+	}
+}
+
+func BenchmarkSlidingWindowLimiterBurstParallel(b *testing.B) {
+	l := NewSlidingWindowLimiter(limit, window)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Allow()
+		}
+	})
+}
+
+func BenchmarkTokenBucketBurstParallel(b *testing.B) {
+	tb := NewTokenBucket(limit, limit/window.Seconds())
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Allow()
+		}
+	})
+}
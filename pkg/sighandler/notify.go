@@ -0,0 +1,48 @@
+package sighandler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SignalError is the cause of a context cancelled by NotifyContext. It
+// compares equal to another SignalError for the same signal, and matches
+// context.Canceled, so errors.Is works with either.
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e SignalError) Error() string { return e.Signal.String() + " signal received" }
+
+func (e SignalError) Is(target error) bool { return target == context.Canceled }
+
+// NotifyContext is signal.NotifyContext, except that the returned context's
+// cause is a SignalError naming the signal that arrived. signal.NotifyContext
+// only describes the signal in an unexported error, which callers can't tell
+// apart without matching its text.
+func NotifyContext(parent context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		select {
+		case sig := <-ch:
+			cancel(SignalError{Signal: sig})
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel(nil)
+	}
+}
+
+// Terminated reports whether ctx, or a context it derives from, was
+// cancelled by NotifyContext because of SIGTERM
+func Terminated(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), SignalError{Signal: syscall.SIGTERM})
+}
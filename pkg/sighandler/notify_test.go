@@ -0,0 +1,59 @@
+package sighandler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyContextSIGTERM(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A derived context, like the examples' -duration timeout, keeps the cause
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM didn't cancel the context")
+	}
+	if !Terminated(ctx) {
+		t.Errorf("Terminated = false, cause %v", context.Cause(ctx))
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) || !errors.Is(context.Cause(ctx), context.Canceled) {
+		t.Errorf("Err = %v, cause %v, want both to match context.Canceled", ctx.Err(), context.Cause(ctx))
+	}
+}
+
+func TestTerminatedOtherCauses(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR1)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	<-ctx.Done()
+	stop()
+	if Terminated(ctx) {
+		t.Errorf("Terminated = true after SIGUSR1")
+	}
+	if cause := context.Cause(ctx); cause != (SignalError{Signal: syscall.SIGUSR1}) {
+		t.Errorf("cause = %v, want SIGUSR1", cause)
+	}
+
+	ctx, stop = NotifyContext(context.Background(), syscall.SIGTERM)
+	stop()
+	if Terminated(ctx) || !errors.Is(context.Cause(ctx), context.Canceled) {
+		t.Errorf("after stop: Terminated = %v, cause %v, want false and context.Canceled", Terminated(ctx), context.Cause(ctx))
+	}
+
+	ctx, stop = NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	if Terminated(ctx) {
+		t.Errorf("Terminated = true after a timeout")
+	}
+}
@@ -0,0 +1,95 @@
+// Package sighandler writes a leak dump when the process gets SIGTERM. An
+// orchestrator sends SIGTERM some seconds before SIGKILL, and the process's
+// state in that window is usually what got it restarted.
+package sighandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/goroutinegroup"
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/summary"
+)
+
+// InstallLeakDump makes the first SIGTERM write a leak dump to dir, then
+// re-raises SIGTERM with its default action, so the process still exits the
+// way its supervisor expects. Programs that shut down gracefully on SIGTERM
+// call LogLeakDump from that path instead, because re-raising would cut
+// their shutdown short.
+func InstallLeakDump(dir string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		LogLeakDump(dir)
+		// With no channel left for SIGTERM, its default action is restored
+		signal.Stop(sigs)
+		if self, err := os.FindProcess(os.Getpid()); err == nil {
+			self.Signal(syscall.SIGTERM)
+		}
+	}()
+}
+
+// LogLeakDump writes a leak dump to dir and logs where it went
+func LogLeakDump(dir string) {
+	path, err := WriteLeakDump(dir)
+	if err != nil {
+		log.Printf("Leak dump failed: %v", err)
+		return
+	}
+	log.Printf("Leak dump written to %s", path)
+}
+
+// WriteLeakDump writes goroutine.txt (the goroutine profile as text, one
+// entry per distinct stack with its count), heap.pprof (for go tool pprof,
+// after a GC so it is current) and summary.json (what /debug/summary
+// serves, plus goroutinegroup.ByState under "goroutine_groups") to a new
+// directory under dir, named after the program, its PID and the time, and
+// returns that directory
+func WriteLeakDump(dir string) (string, error) {
+	name := fmt.Sprintf("%s-%d-%s", filepath.Base(os.Args[0]), os.Getpid(), time.Now().Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", err
+	}
+
+	write := func(file string, fn func(io.Writer) error) error {
+		f, err := os.Create(filepath.Join(path, file))
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		return f.Close()
+	}
+	runtime.GC()
+	err := write("goroutine.txt", func(w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 1)
+	})
+	if err == nil {
+		err = write("heap.pprof", func(w io.Writer) error {
+			return pprof.Lookup("heap").WriteTo(w, 0)
+		})
+	}
+	if err == nil {
+		err = write("summary.json", func(w io.Writer) error {
+			dump := summary.Read()
+			dump["goroutine_groups"] = goroutinegroup.ByState()
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(dump)
+		})
+	}
+	return path, err
+}
@@ -0,0 +1,98 @@
+package sighandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// checkDump checks that path holds the three files of a leak dump and
+// returns the decoded summary.json
+func checkDump(t *testing.T, path string) map[string]json.RawMessage {
+	t.Helper()
+	goroutines, err := os.ReadFile(filepath.Join(path, "goroutine.txt"))
+	if err != nil || !strings.HasPrefix(string(goroutines), "goroutine profile:") {
+		t.Errorf("goroutine.txt: %v, starts %.30q", err, goroutines)
+	}
+	heap, err := os.ReadFile(filepath.Join(path, "heap.pprof"))
+	if err != nil || !bytes.HasPrefix(heap, []byte{0x1f, 0x8b}) {
+		t.Errorf("heap.pprof: %v, want a gzipped profile", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(path, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &dump); err != nil {
+		t.Fatalf("summary.json: %v", err)
+	}
+	for _, field := range []string{"goroutines", "memstats", "open_fds", "goroutine_groups"} {
+		if _, found := dump[field]; !found {
+			t.Errorf("summary.json has no %q: %s", field, raw)
+		}
+	}
+	return dump
+}
+
+func TestWriteLeakDump(t *testing.T) {
+	dir := t.TempDir()
+	path, err := WriteLeakDump(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != dir || !strings.Contains(filepath.Base(path), "-") {
+		t.Errorf("dump in %s, want a program-PID-time directory under %s", path, dir)
+	}
+
+	var groups map[string]int
+	if err := json.Unmarshal(checkDump(t, path)["goroutine_groups"], &groups); err != nil || groups["running"] < 1 {
+		t.Errorf("goroutine_groups = %v (%v), want at least the running goroutine", groups, err)
+	}
+}
+
+// TestInstallLeakDump re-runs the test binary as a child that installs the
+// handler and waits; SIGTERM must leave one dump behind and still kill the
+// child with SIGTERM
+func TestInstallLeakDump(t *testing.T) {
+	if dir := os.Getenv("SIGHANDLER_TEST_DIR"); dir != "" {
+		InstallLeakDump(dir)
+		os.Stdout.WriteString("ready\n")
+		time.Sleep(10 * time.Second)
+		os.Exit(0)
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstallLeakDump$")
+	cmd.Env = append(os.Environ(), "SIGHANDLER_TEST_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("ready\n"))
+	if _, err := stdout.Read(buf); err != nil || string(buf) != "ready\n" {
+		cmd.Process.Kill()
+		t.Fatalf("child never got ready: %q, %v", buf, err)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	var exit *exec.ExitError
+	err = cmd.Wait()
+	if !errors.As(err, &exit) || exit.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Errorf("child exited with %v, want killed by SIGTERM", err)
+	}
+	dumps, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(dumps) != 1 {
+		t.Fatalf("%d dumps in %s, want 1", len(dumps), dir)
+	}
+	checkDump(t, dumps[0])
+}
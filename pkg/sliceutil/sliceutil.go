@@ -0,0 +1,28 @@
+// Package sliceutil copies slices into backing arrays of their own, the fix
+// for keeping a small part of a large slice: a reslice such as src[:n]
+// keeps all of src's array reachable.
+package sliceutil
+
+// Clone returns a copy of src in a new backing array of exactly len(src), so
+// keeping the copy doesn't keep src's array alive. A nil src returns nil.
+func Clone[T any](src []T) []T {
+	return CloneN(src, len(src))
+}
+
+// CloneN returns a copy of the first n elements of src, or all of them if src
+// is shorter, in a new backing array with len == cap. A negative n is
+// treated as 0, and a nil src returns nil.
+func CloneN[T any](src []T, n int) []T {
+	if src == nil {
+		return nil
+	}
+	if n > len(src) {
+		n = len(src)
+	}
+	if n < 0 {
+		n = 0
+	}
+	dst := make([]T, n)
+	copy(dst, src)
+	return dst
+}
@@ -0,0 +1,83 @@
+package sliceutil
+
+import (
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// check runs a testing/quick property over 1000 random inputs
+func check(t *testing.T, f any) {
+	t.Helper()
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// independent reports whether writing to every element of dst leaves src
+// unchanged
+func independent(src, dst []int) bool {
+	before := append([]int(nil), src...)
+	for i := range dst {
+		dst[i] = ^dst[i]
+	}
+	return reflect.DeepEqual(src, before) || len(dst) == 0
+}
+
+// clamp is n limited to [0, hi]
+func clamp(n, hi int) int {
+	return min(max(n, 0), hi)
+}
+
+func TestClone(t *testing.T) {
+	t.Run("len == cap == len(src)", func(t *testing.T) {
+		check(t, func(src []int) bool {
+			c := Clone(src)
+			return len(c) == cap(c) && len(c) == len(src)
+		})
+	})
+	t.Run("same elements", func(t *testing.T) {
+		check(t, func(src []int) bool {
+			if len(src) == 0 {
+				return true
+			}
+			return reflect.DeepEqual(Clone(src), src)
+		})
+	})
+	t.Run("independent of src", func(t *testing.T) {
+		check(t, func(src []int) bool {
+			return independent(src, Clone(src))
+		})
+	})
+	if Clone([]int(nil)) != nil {
+		t.Error("Clone(nil) != nil")
+	}
+	if c := Clone([]int{}); c == nil {
+		t.Error("Clone of an empty slice is nil")
+	}
+}
+
+func TestCloneN(t *testing.T) {
+	t.Run("len == cap == n clamped to [0, len(src)]", func(t *testing.T) {
+		check(t, func(src []int, n int8) bool {
+			c := CloneN(src, int(n))
+			return len(c) == cap(c) && len(c) == clamp(int(n), len(src))
+		})
+	})
+	t.Run("src's first elements, independent of src", func(t *testing.T) {
+		check(t, func(src []int, n uint8) bool {
+			c := CloneN(src, int(n))
+			if len(c) == 0 {
+				return true
+			}
+			return reflect.DeepEqual(c, src[:len(c)]) && independent(src, c)
+		})
+	})
+	t.Run("doesn't keep a large array", func(t *testing.T) {
+		src := make([]byte, 64*1024)
+		check(t, func(n uint16) bool {
+			c := CloneN(src, int(n))
+			return cap(c) == len(c) && cap(c) <= int(n)
+		})
+	})
+}
@@ -0,0 +1,79 @@
+// Package summary serves /debug/summary: goroutines, the key MemStats fields,
+// open FDs and the state of every registered component in one JSON object,
+// so a single request shows the process's state without reading profiles.
+package summary
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/Danialsamadi/Memmory-leaks-go/pkg/fdcount"
+)
+
+// Summarizer is implemented by components that report their own state in
+// /debug/summary
+type Summarizer interface {
+	Summary() map[string]interface{}
+}
+
+// summarizers holds the components added with Register
+var summarizers = struct {
+	sync.Mutex
+	byName map[string]Summarizer
+}{byName: make(map[string]Summarizer)}
+
+// Register adds s to the summary under name, replacing any component already
+// registered with that name
+func Register(name string, s Summarizer) {
+	summarizers.Lock()
+	defer summarizers.Unlock()
+	summarizers.byName[name] = s
+}
+
+// Unregister removes the component registered under name, if any, so a
+// component that has shut down stops reporting
+func Unregister(name string) {
+	summarizers.Lock()
+	defer summarizers.Unlock()
+	delete(summarizers.byName, name)
+}
+
+// Handler serves Read as JSON
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Read()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Read collects what Handler serves. Each component's Summary is called
+// with the registry locked, so it must not call Register or Unregister.
+func Read() map[string]interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	summarizers.Lock()
+	components := make(map[string]interface{}, len(summarizers.byName))
+	for name, s := range summarizers.byName {
+		components[name] = s.Summary()
+	}
+	summarizers.Unlock()
+
+	return map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"open_fds":   fdcount.Count(),
+		"memstats": map[string]interface{}{
+			"heap_alloc_bytes":  m.HeapAlloc,
+			"heap_inuse_bytes":  m.HeapInuse,
+			"heap_objects":      m.HeapObjects,
+			"sys_bytes":         m.Sys,
+			"num_gc":            m.NumGC,
+			"gc_pause_total_ns": m.PauseTotalNs,
+		},
+		"components": components,
+	}
+}
@@ -0,0 +1,65 @@
+package summary
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fixed is a Summarizer reporting a constant state
+type fixed map[string]interface{}
+
+func (f fixed) Summary() map[string]interface{} { return f }
+
+func TestHandler(t *testing.T) {
+	Register("queue", fixed{"depth": 3})
+	Register("cache", fixed{"entries": 1})
+	Register("cache", fixed{"entries": 2})
+	t.Cleanup(func() {
+		Unregister("queue")
+		Unregister("cache")
+	})
+
+	rec := httptest.NewRecorder()
+	Handler()(rec, httptest.NewRequest(http.MethodGet, "/debug/summary", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /debug/summary: status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var got struct {
+		Goroutines int                               `json:"goroutines"`
+		OpenFDs    int                               `json:"open_fds"`
+		MemStats   map[string]uint64                 `json:"memstats"`
+		Components map[string]map[string]interface{} `json:"components"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Goroutines < 1 || got.OpenFDs == 0 || got.MemStats["heap_alloc_bytes"] == 0 {
+		t.Errorf("process state = %d goroutines, %d FDs, memstats %v", got.Goroutines, got.OpenFDs, got.MemStats)
+	}
+	if len(got.Components) != 2 || got.Components["queue"]["depth"] != 3.0 {
+		t.Errorf("components = %v, want queue and cache", got.Components)
+	}
+	if got.Components["cache"]["entries"] != 2.0 {
+		t.Errorf("cache = %v, want the second registration to replace the first", got.Components["cache"])
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	Register("pool", fixed{"workers": 4})
+	Register("other", fixed{"workers": 1})
+	t.Cleanup(func() { Unregister("other") })
+
+	Unregister("pool")
+	Unregister("never-registered")
+
+	components := Read()["components"].(map[string]interface{})
+	if _, ok := components["pool"]; ok {
+		t.Errorf("components = %v, want pool gone after Unregister", components)
+	}
+	if _, ok := components["other"]; !ok {
+		t.Errorf("components = %v, want other to stay registered", components)
+	}
+}
@@ -0,0 +1,51 @@
+// Package workload drives the examples' load: it calls a function at a rate
+// that follows a ramp-up, steady and ramp-down profile, so leaks show up as
+// they would under real traffic rather than all at once.
+package workload
+
+import (
+	"context"
+	"time"
+)
+
+// Ramp calls fn at a rate that rises linearly from zero to peak calls per
+// second over warmup, holds at peak for steady, then falls back to zero over
+// cooldown. It returns when the profile completes or ctx is cancelled.
+func Ramp(ctx context.Context, peak float64, warmup, steady, cooldown time.Duration, fn func()) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	last := start
+	owed := 0.0 // calls due but not yet made
+
+	for {
+		select {
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			if elapsed >= warmup+steady+cooldown {
+				return
+			}
+			owed += Rate(elapsed, peak, warmup, steady, cooldown) * now.Sub(last).Seconds()
+			last = now
+			for ; owed >= 1; owed-- {
+				fn()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Rate returns the target calls per second at elapsed into the profile
+func Rate(elapsed time.Duration, peak float64, warmup, steady, cooldown time.Duration) float64 {
+	switch {
+	case elapsed < warmup:
+		return peak * float64(elapsed) / float64(warmup)
+	case elapsed < warmup+steady:
+		return peak
+	case elapsed < warmup+steady+cooldown:
+		return peak * float64(warmup+steady+cooldown-elapsed) / float64(cooldown)
+	}
+	return 0
+}
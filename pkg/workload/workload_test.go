@@ -0,0 +1,80 @@
+package workload
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	const peak = 100.0
+	up, hold, down := time.Second, 2*time.Second, time.Second
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{500 * time.Millisecond, 50},
+		{time.Second, 100},
+		{2 * time.Second, 100},
+		{3500 * time.Millisecond, 50},
+		{4 * time.Second, 0},
+		{5 * time.Second, 0},
+	} {
+		if got := Rate(tc.elapsed, peak, up, hold, down); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("Rate(%v) = %v, want %v", tc.elapsed, got, tc.want)
+		}
+	}
+}
+
+// TestRampFollowsProfile runs a short profile (peak 200/s, 500ms up, 1s
+// steady, 500ms down) and compares the calls made in each 250ms step with
+// the integral of Rate over that step. A step passes within 15% or 3 calls
+// of the target, whichever is looser.
+func TestRampFollowsProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a 2s profile")
+	}
+	const (
+		peak     = 200.0
+		up       = 500 * time.Millisecond
+		hold     = time.Second
+		down     = 500 * time.Millisecond
+		step     = 250 * time.Millisecond
+		numSteps = int((up + hold + down) / step)
+	)
+
+	counts := make([]int, numSteps)
+	start := time.Now()
+	Ramp(context.Background(), peak, up, hold, down, func() {
+		if i := int(time.Since(start) / step); i < numSteps {
+			counts[i]++
+		}
+	})
+
+	for i, got := range counts {
+		// Integrate the target rate over the step in 1ms slices
+		want := 0.0
+		for e := time.Duration(i) * step; e < time.Duration(i+1)*step; e += time.Millisecond {
+			want += Rate(e, peak, up, hold, down) * time.Millisecond.Seconds()
+		}
+		if tolerance := math.Max(0.15*want, 3); math.Abs(float64(got)-want) > tolerance {
+			t.Errorf("%v-%v: %d calls, want %.1f (±%.1f)", time.Duration(i)*step, time.Duration(i+1)*step, got, want, tolerance)
+		}
+	}
+}
+
+func TestRampStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	start := time.Now()
+	Ramp(ctx, 1000, 0, time.Hour, 0, func() { calls++ })
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Ramp returned %v after a cancelled ctx, want at once", elapsed)
+	}
+	if calls > 10 {
+		t.Errorf("%d calls after a cancelled ctx, want about none", calls)
+	}
+}
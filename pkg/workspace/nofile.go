@@ -0,0 +1,43 @@
+package workspace
+
+import (
+	"flag"
+	"log"
+	"syscall"
+)
+
+var nofile = flag.Uint64("nofile", 0, "lower the soft RLIMIT_NOFILE to this many descriptors (0 = leave it)")
+
+// Nofile returns -nofile, or 0 if the limit is left alone
+func Nofile() uint64 {
+	return *nofile
+}
+
+// ApplyNofile lowers the soft open-file limit for -nofile so descriptor
+// exhaustion is reached in seconds; call it after flag.Parse
+func ApplyNofile() {
+	if *nofile == 0 {
+		return
+	}
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		log.Printf("Error reading RLIMIT_NOFILE: %v", err)
+		return
+	}
+	rl.Cur = *nofile
+	if rl.Cur > rl.Max {
+		rl.Cur = rl.Max
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		log.Printf("Error setting RLIMIT_NOFILE: %v", err)
+	}
+}
+
+// FileLimit returns the soft RLIMIT_NOFILE, or 0 if it can't be read
+func FileLimit() uint64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	return rl.Cur
+}
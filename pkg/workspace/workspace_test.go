@@ -0,0 +1,145 @@
+package workspace
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRecordRotatesOldestFirst(t *testing.T) {
+	ws, err := New(t.TempDir(), "rotate", WithMaxBytes(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 20 files of 100 bytes against a 1000-byte cap
+	data := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		path := ws.Path(fmt.Sprintf("logfile_%d.txt", i))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ws.Record(path, int64(len(data)))
+	}
+
+	entries, _ := os.ReadDir(ws.Dir)
+	if len(entries) != 10 {
+		t.Errorf("%d files on disk, want 10: %s", len(entries), ws)
+	}
+	if _, err := os.Stat(ws.Path("logfile_9.txt")); !os.IsNotExist(err) {
+		t.Errorf("logfile_9.txt: %v, want it rotated out", err)
+	}
+	if _, err := os.Stat(ws.Path("logfile_10.txt")); err != nil {
+		t.Errorf("logfile_10.txt: %v, want it kept", err)
+	}
+	if got, want := ws.String(), "10 files, 1.0 KB (cap 1.0 KB, 10 rotated out)"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+
+	var none *Workspace
+	none.Record(ws.Path("logfile_0.txt"), 100)
+}
+
+func TestCloseRemovesEverything(t *testing.T) {
+	ws, err := New(t.TempDir(), "close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ws.Path("data.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ws.Dir); !os.IsNotExist(err) {
+		t.Errorf("%s after Close: %v, want it gone", ws.Dir, err)
+	}
+	if err := ws.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+}
+
+// TestSIGTERMRemovesWorkspace re-runs the test binary as a child that
+// creates a workspace with the default handler and waits. SIGTERM must
+// remove the directory and exit with 128+SIGTERM, as a shell reports it.
+func TestSIGTERMRemovesWorkspace(t *testing.T) {
+	if parent := os.Getenv("WORKSPACE_TEST_PARENT"); parent != "" {
+		ws, err := New(parent, "sigterm")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		os.WriteFile(ws.Path("data.txt"), []byte("x"), 0o644)
+		fmt.Println(ws.Dir)
+		time.Sleep(10 * time.Second)
+		os.Exit(0)
+	}
+
+	parent := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSIGTERMRemovesWorkspace$")
+	cmd.Env = append(os.Environ(), "WORKSPACE_TEST_PARENT="+parent)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	out := bufio.NewReader(stdout)
+	dir, err := out.ReadString('\n')
+	dir = strings.TrimSpace(dir)
+	if err != nil || !strings.HasPrefix(dir, parent) {
+		cmd.Process.Kill()
+		t.Fatalf("child never created its workspace: %q, %v", dir, err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	rest, _ := io.ReadAll(out)
+	var exit *exec.ExitError
+	err = cmd.Wait()
+	if !errors.As(err, &exit) || exit.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("child exited with %v, want status %d", err, 128+int(syscall.SIGTERM))
+	}
+	if !strings.Contains(string(rest), "workspace removed") {
+		t.Errorf("child printed %q, want the removal reported", rest)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s after SIGTERM: %v, want it gone", dir, err)
+	}
+}
+
+func TestApplyNofile(t *testing.T) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl)
+		flag.Set("nofile", "0")
+	})
+
+	ApplyNofile()
+	if got := FileLimit(); got != rl.Cur {
+		t.Errorf("FileLimit with -nofile 0 = %d, want it left at %d", got, rl.Cur)
+	}
+
+	flag.Set("nofile", "64")
+	ApplyNofile()
+	if Nofile() != 64 || FileLimit() != 64 {
+		t.Errorf("with -nofile 64: Nofile = %d, FileLimit = %d; want 64, 64", Nofile(), FileLimit())
+	}
+}
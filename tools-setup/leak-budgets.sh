@@ -0,0 +1,31 @@
+#!/usr/bin/env bash
+#
+# leak-budgets.sh runs TestLeakBudgets, in leak_budgets_test.go at the repo
+# root: each fixed example runs for a few seconds, and the check fails if its
+# /debug/leakreport is over that pattern's budget. With --leaks it also runs
+# each leaky example and fails if it stays under budget, so a demo can't be
+# "fixed" by accident. The budget table is at the top of the test.
+#
+# Usage (from anywhere in the repo):
+#
+#   tools-setup/leak-budgets.sh            # fixed examples only
+#   tools-setup/leak-budgets.sh --leaks    # fixed and leaky examples
+#
+# Needs go, and nothing else listening on localhost:6060 or localhost:6061:
+# the examples bind those fixed pprof ports and their own mock server ports,
+# so they run one at a time. The test skips itself unless LEAK_BUDGETS=1,
+# which this script sets. When an example misses its budget,
+# the test prints its leak report: the deltas since the process started and
+# the goroutine stacks that grew, which usually name the leak.
+
+set -u
+
+cd "$(dirname "$0")/.." || exit 1
+
+export LEAK_BUDGETS=1
+
+case "${1:-}" in
+	--leaks) exec go test -count=1 -run '^TestLeakBudgets$' -v . -args -leaks ;;
+	"") exec go test -count=1 -run '^TestLeakBudgets$' -v . ;;
+	*) echo "usage: $0 [--leaks]" >&2; exit 2 ;;
+esac